@@ -20,9 +20,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
 )
 
 // SetOptions sets batch options.
@@ -48,6 +50,24 @@ type Batch struct {
 	commitW        sync.WaitGroup
 	// commitComplete is used to signal if batch commit is complete and batch is fully written to DB.
 	commitComplete chan struct{}
+
+	// progress is called after each tiny batch of the batch is committed.
+	progress   func(written, total int)
+	progressMu sync.Mutex
+	written    int64
+	total      int64
+	// size is the memdb size of entries put into the batch. Entries are not freed from memdb
+	// until the batch is committed, so the batch size is limited to the memdb size.
+	size int64
+	// seqs are sequences of the entries put into the batch and not yet written to memdb.
+	seqs []uint64
+}
+
+// OnProgress sets a callback called after each partial write of the batch is committed to the WAL.
+// It receives number of entries written so far and number of entries put into the batch so far.
+// Calls are serialized and complete before Commit returns.
+func (b *Batch) OnProgress(fn func(written, total int)) {
+	b.progress = fn
 }
 
 // Put adds entry to batch for given topic->key/value.
@@ -61,19 +81,43 @@ func (b *Batch) Put(topic, payload []byte) error {
 // PutEntry appends entries to a bacth for given topic->key/value pair.
 // It is safe to modify the contents of the argument after Put returns but not
 // before.
-func (b *Batch) PutEntry(e *Entry) error {
-	switch {
-	case len(e.Topic) == 0:
-		return errTopicEmpty
-	case len(e.Topic) > maxTopicLength:
-		return errTopicTooLarge
-	case len(e.Payload) == 0:
-		return errValueEmpty
-	case len(e.Payload) > maxValueLength:
-		return errValueTooLarge
+func (b *Batch) PutEntry(e *Entry) (err error) {
+	if err := b.db.runWriteHooks(e); err != nil {
+		return err
+	}
+	if err := e.validate(b.db.opts.maxTopicSize, b.db.opts.maxValueSize); err != nil {
+		return err
 	}
+	if err := b.db.waitMem(); err != nil {
+		return err
+	}
+	if err := b.db.checkExternalID(e); err != nil {
+		return err
+	}
+	var dedupKey string
+	if len(e.DedupKey) != 0 {
+		dedupKey = dedupKeyOf(e)
+		if b.db.dedup.seen(dedupKey) {
+			return nil
+		}
+		defer func() {
+			if err != nil {
+				b.db.dedup.forget(dedupKey)
+			}
+		}()
+	}
+	size := int64(entrySize + idSize + len(e.Topic) + len(e.Payload) + 4)
+	if atomic.AddInt64(&b.size, size) > b.db.opts.memdbSize {
+		atomic.AddInt64(&b.size, -size)
+		return fmt.Errorf("batch.PutEntry: batch size exceeds memdb size %d, commit the entries in smaller batches: %w", b.db.opts.memdbSize, ErrFull)
+	}
+	defer func() {
+		if err != nil {
+			atomic.AddInt64(&b.size, -size)
+		}
+	}()
 	e.Encryption = e.Encryption || b.opts.batchOptions.encryption
-	if err := b.db.setEntry(b.tinyBatch.timeID(), e); err != nil {
+	if err := b.setEntry(e); err != nil {
 		return err
 	}
 
@@ -81,6 +125,10 @@ func (b *Batch) PutEntry(e *Entry) error {
 	defer func() {
 		<-b.tinyBatchLockC
 	}()
+	b.seqs = append(b.seqs, e.seq)
+	if err := b.db.setExternalID(b.tinyBatch, e); err != nil {
+		return err
+	}
 
 	var scratch [4]byte
 	binary.LittleEndian.PutUint32(scratch[0:4], uint32(len(e.cache)+4))
@@ -93,8 +141,12 @@ func (b *Batch) PutEntry(e *Entry) error {
 
 	b.tinyBatch.index = append(b.tinyBatch.index, batchIndex{delFlag: false, offset: b.tinyBatch.size})
 	b.tinyBatch.size += int64(len(e.cache) + 4)
+	if dedupKey != "" {
+		b.tinyBatch.dedupKeys = append(b.tinyBatch.dedupKeys, dedupKey)
+	}
 
 	b.tinyBatch.incount()
+	atomic.AddInt64(&b.total, 1)
 
 	// reset message entry
 	e.reset()
@@ -102,6 +154,20 @@ func (b *Batch) PutEntry(e *Entry) error {
 	return nil
 }
 
+// setEntry sets the sequence of the entry and adds it to the pending batch sequences. The tiny batch
+// lock of the DB is held, so PutEntryAtSeq sees the sequence either in memdb or as pending.
+func (b *Batch) setEntry(e *Entry) error {
+	b.db.lockTinyBatch()
+	defer func() {
+		<-b.db.tinyBatchLockC
+	}()
+	if err := b.db.setEntry(b.tinyBatch.timeID(), e); err != nil {
+		return err
+	}
+	b.db.batchSeqs.add(e.seq)
+	return nil
+}
+
 // Delete appends delete entry to batch for given key.
 // It is safe to modify the contents of the argument after Delete returns but
 // not before.
@@ -120,8 +186,8 @@ func (b *Batch) DeleteEntry(e *Entry) error {
 		return errMsgIDEmpty
 	case len(e.Topic) == 0:
 		return errTopicEmpty
-	case len(e.Topic) > maxTopicLength:
-		return errTopicTooLarge
+	case len(e.Topic) > b.db.opts.maxTopicSize:
+		return ErrTopicTooLarge
 	}
 
 	if err := b.db.setEntry(b.tinyBatch.timeID(), e); err != nil {
@@ -146,6 +212,7 @@ func (b *Batch) DeleteEntry(e *Entry) error {
 	b.tinyBatch.size += int64(len(e.cache) + 4)
 
 	b.tinyBatch.incount()
+	atomic.AddInt64(&b.total, 1)
 
 	// reset message entry
 	e.reset()
@@ -153,6 +220,63 @@ func (b *Batch) DeleteEntry(e *Entry) error {
 	return nil
 }
 
+// Len returns number of entries in the batch pending write.
+func (b *Batch) Len() int {
+	return int(b.tinyBatch.len())
+}
+
+// Size returns size of the entries in the batch pending write.
+func (b *Batch) Size() int64 {
+	b.tinyBatchLockC <- struct{}{}
+	defer func() {
+		<-b.tinyBatchLockC
+	}()
+	return b.tinyBatch.size
+}
+
+// Reset discards entries in the batch pending write without committing them.
+// Sequences allocated to the discarded entries are returned to the free slots.
+// Entries already written by the batch are not affected.
+func (b *Batch) Reset() error {
+	if err := b.db.ok(); err != nil {
+		return err
+	}
+	b.tinyBatchLockC <- struct{}{}
+	defer func() {
+		<-b.tinyBatchLockC
+	}()
+
+	var e entry
+	for _, index := range b.tinyBatch.index {
+		if index.delFlag {
+			continue
+		}
+		entryData, err := b.tinyBatch.buffer.Slice(index.offset+4, index.offset+entrySize+4)
+		if err != nil {
+			return err
+		}
+		if err := e.UnmarshalBinary(entryData); err != nil {
+			return err
+		}
+		// Sequence of an existing entry is not freed.
+		if !b.db.filter.Test(e.seq) {
+			b.db.freeList.freeSlot(e.seq)
+			if err := b.db.externalIDs.remove(e.seq); err != nil {
+				return err
+			}
+		}
+	}
+	b.db.batchSeqs.remove(b.seqs)
+	b.seqs = nil
+	atomic.AddInt64(&b.total, -int64(b.tinyBatch.len()))
+	b.db.dedup.forgetAll(b.tinyBatch.dedupKeys)
+	b.tinyBatch.dedupKeys = nil
+	b.tinyBatch.reset()
+	b.tinyBatch.buffer.Reset()
+
+	return nil
+}
+
 func (b *Batch) writeInternal(fn func(i int, e entry, data []byte) error) error {
 	if err := b.db.ok(); err != nil {
 		return err
@@ -219,14 +343,16 @@ func (b *Batch) Write() error {
 				t.Unmarshal(rawTopic)
 				topics[e.topicHash] = t
 			}
-			b.db.trie.add(newTopic(e.topicHash, 0), t.Parts, t.Depth)
+			b.db.trie.add(newTopic(e.topicHash, 0, t.Topic), t.Parts, t.Depth)
 		}
 		blockID := startBlockIndex(e.seq)
 		memseq := b.db.cacheID ^ e.seq
 		if err := b.db.mem.Set(uint64(blockID), memseq, data); err != nil {
 			return err
 		}
-		if ok := b.db.timeWindow.add(b.tinyBatch.timeID(), e.topicHash, newWinEntry(e.seq, e.expiresAt)); !ok {
+		we := newWinEntry(e.seq, e.expiresAt)
+		we.timestamp = uid.Time(data[entrySize : entrySize+4])
+		if ok := b.db.timeWindow.add(b.tinyBatch.timeID(), e.topicHash, we); !ok {
 			return errForbidden
 		}
 		b.tinyBatch.entries = append(b.tinyBatch.entries, e.seq)
@@ -234,13 +360,35 @@ func (b *Batch) Write() error {
 	})
 
 	b.tinyBatchLockC <- struct{}{}
-	b.db.batchPool.write(b.tinyBatch)
+	// entries are in memdb or are not written.
+	b.db.batchSeqs.remove(b.seqs)
+	b.seqs = nil
+	tinyBatch := b.tinyBatch
+	n := int64(tinyBatch.len())
+	b.db.batchPool.write(tinyBatch)
 	b.tinyBatch = b.db.newTinyBatch()
 	<-b.tinyBatchLockC
 
+	if b.progress != nil {
+		b.commitW.Add(1)
+		go b.notifyProgress(tinyBatch, n)
+	}
+
 	return nil
 }
 
+// notifyProgress calls the progress callback once the tiny batch is committed.
+func (b *Batch) notifyProgress(tinyBatch *tinyBatch, n int64) {
+	defer b.commitW.Done()
+	<-tinyBatch.doneChan
+	if tinyBatch.err != nil {
+		return
+	}
+	b.progressMu.Lock()
+	defer b.progressMu.Unlock()
+	b.progress(int(atomic.AddInt64(&b.written, n)), int(atomic.LoadInt64(&b.total)))
+}
+
 // batchWriteLoop handles batch partial writes using tiny batches.
 func (b *Batch) writeLoop(interval time.Duration) {
 	b.db.closeW.Add(1)
@@ -281,6 +429,8 @@ func (b *Batch) Commit() error {
 		<-tinyBatch.doneChan
 		b.db.releaseTimeID(timeID)
 	}
+	// wait for progress callbacks of the committed tiny batches.
+	b.commitW.Wait()
 
 	b.tinyBatchGroup = make(map[int64]*tinyBatch)
 	return nil
@@ -292,6 +442,13 @@ func (b *Batch) Abort() {
 	for _, tinyBatch := range b.tinyBatchGroup {
 		b.db.rollback(tinyBatch)
 	}
+	// entries of the tiny batch not yet written are not committed.
+	if _, ok := b.tinyBatchGroup[b.tinyBatch.timeID()]; !ok {
+		b.db.dedup.forgetAll(b.tinyBatch.dedupKeys)
+		b.tinyBatch.dedupKeys = nil
+	}
+	b.db.batchSeqs.remove(b.seqs)
+	b.seqs = nil
 	// abort time window entries
 	b.db.abort()
 	b.db = nil
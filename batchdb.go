@@ -39,8 +39,12 @@ type (
 		size       int64
 		entries    []uint64
 		index      []batchIndex
+		records    [][]byte       // delete and external ID log records written with the entries.
+		dedupKeys  []string       // dedup keys of the entries, forgotten if the batch is rolled back.
+		watched    []watchedEntry // entries fanned out to watchers once the batch is committed.
 
 		doneChan chan struct{}
+		err      error // err is commit error, it is set before doneChan is closed.
 	}
 )
 
@@ -70,6 +74,7 @@ func (b *tinyBatch) reset() {
 	b.size = 0
 	b.entries = b.entries[:0]
 	b.index = b.index[:0]
+	b.records = nil
 }
 
 func (b *tinyBatch) abort() {
@@ -98,6 +103,13 @@ type batchPool struct {
 	stopped      int32
 	waiting      int32
 	wait         bool
+
+	// inFlight counts batches enqueued but not yet committed, inFlightErr is the first commit
+	// error of the batches since the last wait. Both are guarded by inFlightMu.
+	inFlightMu   sync.Mutex
+	inFlightCond *sync.Cond
+	inFlight     int
+	inFlightErr  error
 }
 
 // batchdb manages the batch execution.
@@ -108,6 +120,26 @@ type batchdb struct {
 	//tiny Batch
 	tinyBatchLockC chan struct{}
 	tinyBatch      *tinyBatch
+
+	// tiny batch lock statistics.
+	lockAcquisitions uint64
+	lockWaitNs       uint64
+	lockMaxWaitNs    int64
+}
+
+// lockTinyBatch acquires the tiny batch lock and records the time waited for the lock.
+func (db *batchdb) lockTinyBatch() {
+	start := time.Now()
+	db.tinyBatchLockC <- struct{}{}
+	wait := int64(time.Since(start))
+	atomic.AddUint64(&db.lockAcquisitions, 1)
+	atomic.AddUint64(&db.lockWaitNs, uint64(wait))
+	for {
+		max := atomic.LoadInt64(&db.lockMaxWaitNs)
+		if wait <= max || atomic.CompareAndSwapInt64(&db.lockMaxWaitNs, max, wait) {
+			return
+		}
+	}
 }
 
 func (db *DB) newBatchPool(maxBatches int) *batchPool {
@@ -123,6 +155,7 @@ func (db *DB) newBatchPool(maxBatches int) *batchPool {
 		batchQueue:  make(chan *tinyBatch),
 		stoppedChan: make(chan struct{}),
 	}
+	pool.inFlightCond = sync.NewCond(&pool.inFlightMu)
 
 	// start the batch dispatcher
 	go pool.dispatch()
@@ -152,11 +185,17 @@ func (p *batchPool) size() int {
 // stop tells dispatcher to exit, and wether or not complete queued batches.
 func (p *batchPool) stop(wait bool) {
 	// Acquire tinyBatch write lock
-	p.db.tinyBatchLockC <- struct{}{}
+	p.db.lockTinyBatch()
 	defer func() {
 		<-p.db.tinyBatchLockC
 	}()
 	p.stopOnce.Do(func() {
+		// Write pending entries of the tiny batch not yet written by the tiny batch loop.
+		if wait && p.db.tinyBatch.len() != 0 {
+			p.enqueue()
+			p.writeQueue <- p.db.tinyBatch
+			p.db.tinyBatch = p.db.newTinyBatch()
+		}
 		atomic.StoreInt32(&p.stopped, 1)
 		p.wait = wait
 		// Close write queue and wait for currently running batches to finish
@@ -183,6 +222,7 @@ func (p *batchPool) waitQueueSize() int {
 // write enqueues a batch to write.
 func (p *batchPool) write(tinyBatch *tinyBatch) {
 	if tinyBatch != nil {
+		p.enqueue()
 		p.writeQueue <- tinyBatch
 	}
 }
@@ -192,15 +232,48 @@ func (p *batchPool) writeWait(tinyBatch *tinyBatch) {
 	if tinyBatch == nil {
 		return
 	}
+	p.enqueue()
 	p.writeQueue <- tinyBatch
 	<-tinyBatch.doneChan
 }
 
+// enqueue adds a batch to the batches in flight.
+func (p *batchPool) enqueue() {
+	p.inFlightMu.Lock()
+	defer p.inFlightMu.Unlock()
+	p.inFlight++
+}
+
+// done removes a batch from the batches in flight and records its commit error.
+func (p *batchPool) done(err error) {
+	p.inFlightMu.Lock()
+	defer p.inFlightMu.Unlock()
+	p.inFlight--
+	if err != nil && p.inFlightErr == nil {
+		p.inFlightErr = err
+	}
+	if p.inFlight == 0 {
+		p.inFlightCond.Broadcast()
+	}
+}
+
+// waitInFlight waits for the batches in flight to commit and returns the first commit error since the last wait.
+func (p *batchPool) waitInFlight() error {
+	p.inFlightMu.Lock()
+	defer p.inFlightMu.Unlock()
+	for p.inFlight > 0 {
+		p.inFlightCond.Wait()
+	}
+	err := p.inFlightErr
+	p.inFlightErr = nil
+	return err
+}
+
 // batch starts a new batch.
 func (db *DB) batch() *Batch {
 	opts := &options{}
 	WithDefaultBatchOptions().set(opts)
-	opts.batchOptions.encryption = db.encryption == 1
+	opts.batchOptions.encryption = db.encryption == 1 || db.opts.batchOptions.encryption
 	b := &Batch{opts: opts, db: db, tinyBatchLockC: make(chan struct{}, 1), tinyBatchGroup: make(map[int64]*tinyBatch)}
 	b.tinyBatch = db.newTinyBatch()
 	return b
@@ -224,6 +297,7 @@ func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
 	// fmt.Println("Batch: batch started... ", b.tinyBatch.timeID())
 	// If an error is returned from the function then rollback and return error.
 	if err := fn(b, b.commitComplete); err != nil {
+		b.unsetManaged()
 		b.Abort()
 		close(b.commitComplete)
 		return err
@@ -232,6 +306,36 @@ func (db *DB) Batch(fn func(*Batch, <-chan struct{}) error) error {
 	return b.Commit()
 }
 
+// FlushBatch writes pending entries of the tiny batch without waiting for the tiny batch write interval.
+// It blocks until the tiny batch is committed and returns the commit error if any.
+func (db *DB) FlushBatch() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.lockTinyBatch()
+	if db.tinyBatch.len() == 0 {
+		<-db.tinyBatchLockC
+		return nil
+	}
+	tinyBatch := db.tinyBatch
+	db.batchPool.write(tinyBatch)
+	db.tinyBatch = db.newTinyBatch()
+	<-db.tinyBatchLockC
+
+	<-tinyBatch.doneChan
+	return tinyBatch.err
+}
+
+// Flush writes pending entries of the tiny batch to the WAL and waits for the tiny batches in flight to commit.
+// Each tiny batch is synced to the WAL on commit, so entries survive a crash without running Sync that writes
+// the index and data files. It returns the commit error of a tiny batch in flight if any.
+func (db *DB) Flush() error {
+	if err := db.FlushBatch(); err != nil {
+		return err
+	}
+	return db.batchPool.waitInFlight()
+}
+
 // tinyBatchLoop handles tiny batches.
 func (db *DB) tinyBatchLoop(interval time.Duration) {
 	db.closeW.Add(1)
@@ -243,12 +347,19 @@ func (db *DB) tinyBatchLoop(interval time.Duration) {
 			tinyBatchTicker.Stop()
 			return
 		case <-tinyBatchTicker.C:
+			// the tiny batch is replaced under the lock, so it is read under the lock.
+			db.lockTinyBatch()
+			// batch pool is stopped while waiting for the lock.
+			if db.batchPool.isStopped() {
+				<-db.tinyBatchLockC
+				tinyBatchTicker.Stop()
+				return
+			}
 			if db.tinyBatch.len() != 0 {
-				db.tinyBatchLockC <- struct{}{}
 				db.batchPool.write(db.tinyBatch)
 				db.tinyBatch = db.newTinyBatch()
-				<-db.tinyBatchLockC
 			}
+			<-db.tinyBatchLockC
 		}
 	}
 }
@@ -303,6 +414,11 @@ Loop:
 	if p.wait {
 		p.runQueuedBatches()
 	}
+	// batches left in the waiting queue are not committed.
+	for p.waitingQueue.len() != 0 {
+		p.waitingQueue.pop()
+		p.done(ErrClosed)
+	}
 
 	// Stop all remaining tinyBatch as it become ready.
 	for batchCount > 0 {
@@ -315,10 +431,12 @@ Loop:
 
 // commit run initial tinyBatch commit, then start tinyBatch waiting for more.
 func (p *batchPool) commit(tinyBatch *tinyBatch, batchQueue chan *tinyBatch) {
-	if err := p.db.tinyCommit(tinyBatch); err != nil {
+	err := p.db.tinyCommit(tinyBatch)
+	if err != nil {
 		logger.Error().Err(err).Str("context", "tinyCommit").Msgf("Error committing tinyBatch")
 		p.db.rollback(tinyBatch)
 	}
+	p.done(err)
 
 	go p.tinyCommit(batchQueue)
 }
@@ -333,10 +451,12 @@ func (p *batchPool) tinyCommit(batchQueue chan *tinyBatch) {
 			return
 		}
 
-		if err := p.db.tinyCommit(tinyBatch); err != nil {
+		err := p.db.tinyCommit(tinyBatch)
+		if err != nil {
 			logger.Error().Err(err).Str("context", "tinyCommit").Msgf("Error committing tinyBatch")
 			p.db.rollback(tinyBatch)
 		}
+		p.done(err)
 	}
 }
 
@@ -36,6 +36,7 @@ type (
 		msgOffset int64
 
 		cacheBlock []byte // block from memdb if it exist
+		expiresAt  uint32 // expiresAt is only set for the slot read from memdb.
 	}
 
 	block struct {
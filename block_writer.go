@@ -64,6 +64,14 @@ func (bw *blockWriter) del(seq uint64) (slot, error) {
 	}
 	b.entries[i] = slot{}
 
+	if _, err := bw.WriteAt(b.MarshalBinary(), off); err != nil {
+		return delEntry, err
+	}
+	if wb, ok := bw.blocks[blockIdx]; ok {
+		wb.entries = b.entries
+		wb.entryIdx = b.entryIdx
+		bw.blocks[blockIdx] = wb
+	}
 	return delEntry, nil
 }
 
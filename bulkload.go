@@ -0,0 +1,219 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// bulkLoadChunkSize is the number of entries written to the DB files at a time by BulkLoad.
+const bulkLoadChunkSize = entriesPerIndexBlock * 256
+
+// EntryIterator is an iterator over entries to load into the DB using BulkLoad.
+type EntryIterator interface {
+	// Next advances the iterator to the next entry, it returns false when iteration is done or on error.
+	Next() bool
+	// Entry returns the current entry.
+	Entry() *Entry
+	// Error returns the error that stopped the iteration if any.
+	Error() error
+}
+
+// BulkLoadOptions is used to set options for the BulkLoad.
+type BulkLoadOptions struct {
+	// PreAllocateBlocks is number of index blocks to allocate before loading entries.
+	PreAllocateBlocks int
+	// SkipFilter skips adding entries to the filter, deletes are then ignored for the loaded entries.
+	SkipFilter bool
+}
+
+// BulkLoad loads entries from the iterator into an empty DB. Entries are written directly into the index,
+// data and window files bypassing memdb and write ahead log, and DB files are synced once at the end.
+// It returns an error if DB has entries, as bulk loaded entries cannot be recovered from the log.
+func (db *DB) BulkLoad(iter EntryIterator, opts *BulkLoadOptions) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &BulkLoadOptions{}
+	}
+
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	// sequence is checked as well so entries not yet synced are not mixed with bulk loaded entries.
+	if db.Count() > 0 || db.seq() > 0 {
+		return fmt.Errorf("db.BulkLoad: DB is not empty: %w", ErrBadRequest)
+	}
+	if opts.PreAllocateBlocks > 0 {
+		if err := db.extendBlocks(int32(opts.PreAllocateBlocks)); err != nil {
+			return err
+		}
+	}
+
+	l := db.newBulkLoader(opts)
+	for iter.Next() {
+		if err := l.append(iter.Entry()); err != nil {
+			l.finish()
+			return err
+		}
+		if l.count == bulkLoadChunkSize {
+			if err := l.write(); err != nil {
+				return err
+			}
+			l = db.newBulkLoader(opts)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		l.finish()
+		return err
+	}
+	if err := l.write(); err != nil {
+		return err
+	}
+	return db.sync()
+}
+
+// bulkLoader writes a chunk of bulk loaded entries into the DB files.
+type bulkLoader struct {
+	*DB
+	loadOpts *BulkLoadOptions
+
+	startBlockIdx int32
+	upperSeq      uint64
+	count         int64
+	inBytes       int64
+	winEntries    map[uint64]windowEntries
+
+	windowWriter *windowWriter
+	blockWriter  *blockWriter
+	dataWriter   *dataWriter
+}
+
+func (db *DB) newBulkLoader(opts *BulkLoadOptions) *bulkLoader {
+	return &bulkLoader{
+		DB:            db,
+		loadOpts:      opts,
+		startBlockIdx: db.blocks(),
+		winEntries:    make(map[uint64]windowEntries),
+		windowWriter:  newWindowWriter(db.timeWindow, db.bufPool.Get()),
+		blockWriter:   newBlockWriter(&db.index, db.bufPool.Get()),
+		dataWriter:    newDataWriter(&db.data, db.bufPool.Get()),
+	}
+}
+
+// append appends the entry to the writers.
+func (l *bulkLoader) append(e *Entry) error {
+	if err := e.validate(l.opts.maxTopicSize, l.opts.maxValueSize); err != nil {
+		return err
+	}
+	if err := l.checkExternalID(e); err != nil {
+		return err
+	}
+	if err := l.setEntry(0, e); err != nil {
+		return err
+	}
+	// entries are synced to the DB files with the external ID file, so the mapping is not logged.
+	if _, err := l.externalIDs.add(e.ExternalID, e.seq); err != nil {
+		return err
+	}
+	if e.topicSize != 0 {
+		t := new(message.Topic)
+		rawTopic := e.cache[entrySize+idSize : entrySize+idSize+e.topicSize]
+		t.Unmarshal(rawTopic)
+		l.trie.add(newTopic(e.topicHash, 0, t.Topic), t.Parts, t.Depth)
+	}
+
+	var err error
+	s := slot{seq: e.seq, topicSize: e.topicSize, valueSize: e.valueSize}
+	if s.msgOffset, err = l.dataWriter.append(e.cache[entrySize:]); err != nil {
+		return err
+	}
+	if _, err := l.blockWriter.append(s, l.startBlockIdx); err != nil {
+		return err
+	}
+	l.winEntries[e.topicHash] = append(l.winEntries[e.topicHash], newWinEntry(e.seq, e.expiresAt))
+	if !l.loadOpts.SkipFilter {
+		l.filter.Append(e.seq)
+	}
+	if e.seq > l.upperSeq {
+		l.upperSeq = e.seq
+	}
+	l.count++
+	l.inBytes += int64(e.valueSize)
+
+	// reset message entry
+	e.reset()
+	return nil
+}
+
+// write writes the appended entries into the DB files.
+func (l *bulkLoader) write() error {
+	defer l.finish()
+	if l.count == 0 {
+		return nil
+	}
+	if _, err := l.dataWriter.write(); err != nil {
+		return err
+	}
+	nBlocks := int32((l.upperSeq - 1) / entriesPerIndexBlock)
+	if nBlocks > l.blocks() {
+		if err := l.extendBlocks(nBlocks - l.blocks()); err != nil {
+			return err
+		}
+	}
+	for h, wEntries := range l.winEntries {
+		topicOff, ok := l.trie.getOffset(h)
+		if !ok {
+			return errors.New("db.BulkLoad: unable to get topic offset from trie")
+		}
+		wOff, err := l.windowWriter.append(h, topicOff, wEntries)
+		if err != nil {
+			return err
+		}
+		if ok := l.trie.setOffset(topic{hash: h, offset: wOff}); !ok {
+			return errors.New("db.BulkLoad: unable to set topic offset in trie")
+		}
+	}
+	if err := l.windowWriter.write(); err != nil {
+		return err
+	}
+	if err := l.blockWriter.write(); err != nil {
+		return err
+	}
+	l.incount(uint64(l.count))
+	l.meter.InMsgs.Inc(l.count)
+	l.meter.InBytes.Inc(l.inBytes)
+	l.opts.metricsSink.InBytes(l.inBytes)
+	return nil
+}
+
+// finish returns buffers of the writers to the pool.
+func (l *bulkLoader) finish() {
+	l.bufPool.Put(l.windowWriter.buffer)
+	l.bufPool.Put(l.blockWriter.buffer)
+	l.bufPool.Put(l.dataWriter.buffer)
+}
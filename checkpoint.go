@@ -0,0 +1,343 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+const checkpointSize = 64
+
+// checkpoint is a named recovery point of the DB.
+type checkpoint struct {
+	sequence  uint64
+	count     uint64
+	blockIdx  int32
+	windowIdx int32
+	dataOff   int64
+	checksum  [sha256.Size]byte // SHA256 of the index header at the checkpoint.
+}
+
+// MarshalBinary serializes checkpoint into binary data.
+func (c checkpoint) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, checkpointSize)
+	binary.LittleEndian.PutUint64(buf[0:8], c.sequence)
+	binary.LittleEndian.PutUint64(buf[8:16], c.count)
+	binary.LittleEndian.PutUint32(buf[16:20], uint32(c.blockIdx))
+	binary.LittleEndian.PutUint32(buf[20:24], uint32(c.windowIdx))
+	binary.LittleEndian.PutUint64(buf[24:32], uint64(c.dataOff))
+	copy(buf[32:], c.checksum[:])
+	return buf, nil
+}
+
+// UnmarshalBinary de-serializes checkpoint from binary data.
+func (c *checkpoint) UnmarshalBinary(data []byte) error {
+	c.sequence = binary.LittleEndian.Uint64(data[0:8])
+	c.count = binary.LittleEndian.Uint64(data[8:16])
+	c.blockIdx = int32(binary.LittleEndian.Uint32(data[16:20]))
+	c.windowIdx = int32(binary.LittleEndian.Uint32(data[20:24]))
+	c.dataOff = int64(binary.LittleEndian.Uint64(data[24:32]))
+	copy(c.checksum[:], data[32:checkpointSize])
+	return nil
+}
+
+// header returns the index header of the DB at the checkpoint.
+func (c checkpoint) header(db *DB) header {
+	h := db.newHeader()
+	h.sequence = c.sequence
+	h.count = c.count
+	h.blockIdx = c.blockIdx
+	h.windowIdx = c.windowIdx
+	return h
+}
+
+// headerChecksum returns SHA256 of the index header.
+func headerChecksum(h header) [sha256.Size]byte {
+	buf, _ := h.MarshalBinary()
+	return sha256.Sum256(buf)
+}
+
+// checkpointPath returns path of the checkpoint file in the DB directory.
+func (db *DB) checkpointPath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("db.checkpoint: invalid checkpoint name %q: %w", name, ErrBadRequest)
+	}
+	return filepath.Join(filepath.Dir(db.path), name+checkpointPostfix), nil
+}
+
+// Checkpoint syncs the DB and writes a named recovery point to the DB directory.
+// An existing checkpoint with the same name is replaced.
+func (db *DB) Checkpoint(name string) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	path, err := db.checkpointPath(name)
+	if err != nil {
+		return err
+	}
+	if err := db.FlushBatch(); err != nil {
+		return err
+	}
+	if err := db.Sync(); err != nil {
+		return err
+	}
+
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	// Writes are blocked so that free slots and entries not yet synced match the header at the checkpoint.
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	if err := db.sync(); err != nil {
+		return err
+	}
+	h := db.newHeader()
+	c := checkpoint{
+		sequence:  h.sequence,
+		count:     h.count,
+		blockIdx:  h.blockIdx,
+		windowIdx: h.windowIdx,
+		dataOff:   db.data.offset,
+		checksum:  headerChecksum(h),
+	}
+	// Sequences of entries not yet synced are saved as free slots, so they are removed on restore.
+	slots, blocks := db.freeList.snapshot()
+	slots.fs = append(slots.fs, db.timeWindow.pendingSeqs()...)
+	f, err := newFile(db.opts.fileSystem, path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.truncate(0); err != nil {
+		return err
+	}
+	if err := f.writeMarshalableAt(c, 0); err != nil {
+		return err
+	}
+	// external IDs of the entries at the checkpoint follow the free blocks.
+	data := append(slots.MarshalBinary(), blocks.MarshalBinary()...)
+	data = append(data, db.externalIDs.snapshot(nil)...)
+	if _, err := f.WriteAt(data, checkpointSize); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// RestoreCheckpoint rolls back the DB to the named checkpoint. Writes are blocked during the restore. Entries written
+// after the checkpoint, or not yet synced at the checkpoint, are removed. Entries deleted after the checkpoint are not
+// restored, and entries updated after the checkpoint are kept with the update or removed if their data was moved
+// beyond the data file at the checkpoint. External IDs are restored to the external IDs of the entries kept.
+func (db *DB) RestoreCheckpoint(name string) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	path, err := db.checkpointPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := db.opts.fileSystem.Stat(path); err != nil {
+		return fmt.Errorf("db.RestoreCheckpoint: checkpoint %q: %w", name, err)
+	}
+	f, err := newFile(db.opts.fileSystem, path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if f.size < checkpointSize {
+		return fmt.Errorf("db.RestoreCheckpoint: invalid checkpoint size %d: %w", f.size, ErrCorrupted)
+	}
+	var c checkpoint
+	if err := f.readUnmarshalableAt(&c, checkpointSize, 0); err != nil {
+		return err
+	}
+	// free slots and free blocks at the checkpoint follow the checkpoint record.
+	data := make([]byte, f.size-checkpointSize)
+	if _, err := f.ReadAt(data, checkpointSize); err != nil && err != io.EOF {
+		return err
+	}
+	slots, blocks, xids, err := parseSnapshot(data)
+	if err != nil {
+		return fmt.Errorf("db.RestoreCheckpoint: checkpoint %q: %w", name, err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		return err
+	}
+	if err := db.Sync(); err != nil {
+		return err
+	}
+
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	h := c.header(db)
+	if headerChecksum(h) != c.checksum {
+		return fmt.Errorf("db.RestoreCheckpoint: checkpoint %q checksum mismatch: %w", name, ErrCorrupted)
+	}
+	if c.sequence > db.seq() || c.blockIdx > db.blocks() || c.windowIdx > db.timeWindow.windowIndex() || c.dataOff > db.data.offset {
+		return fmt.Errorf("db.RestoreCheckpoint: checkpoint %q is ahead of the DB: %w", name, ErrBadRequest)
+	}
+
+	// removed holds sequences of the entries to remove that are free at the checkpoint. Sequences free at the
+	// checkpoint are reused by entries written after the checkpoint.
+	removed := make(map[uint64]bool)
+	for seq := range slots.cache {
+		removed[seq] = true
+	}
+	// discard entries written after the last sync, so they are not written to the index after the restore.
+	db.tinyBatch.reset()
+	for timeID, wEntries := range db.timeWindow.discard() {
+		for _, we := range wEntries {
+			removed[we.seq()] = true
+		}
+		if err := db.wal.SignalLogApplied(timeID); err != nil {
+			return err
+		}
+	}
+
+	if err := db.index.truncate(blockOffset(c.blockIdx + 1)); err != nil {
+		return err
+	}
+	// remove entries written after the checkpoint from the index blocks, and collect data blocks of the entries.
+	var count uint64
+	var used, freed []freeblock
+	for blockIdx := int32(0); blockIdx <= c.blockIdx; blockIdx++ {
+		off := blockOffset(blockIdx)
+		b := blockHandle{file: db.index, offset: off}
+		if err := b.read(); err != nil {
+			return err
+		}
+		dirty := false
+		for i := 0; i < entriesPerIndexBlock; i++ {
+			s := b.entries[i]
+			if s.seq == 0 {
+				continue
+			}
+			dataBlock := freeblock{offset: s.msgOffset, size: s.mSize()}
+			inData := s.msgOffset+int64(s.mSize()) <= c.dataOff
+			if s.seq > c.sequence || removed[s.seq] || !inData {
+				if inData {
+					freed = append(freed, dataBlock)
+				}
+				if s.seq <= c.sequence {
+					removed[s.seq] = true
+				}
+				b.entries[i] = slot{}
+				dirty = true
+				continue
+			}
+			used = append(used, dataBlock)
+			count++
+		}
+		if !dirty {
+			continue
+		}
+		if _, err := db.index.WriteAt(b.MarshalBinary(), off); err != nil {
+			return err
+		}
+	}
+
+	// remove entries written after the checkpoint from memdb.
+	if seq := db.seq(); seq > c.sequence {
+		for blockIdx := startBlockIndex(c.sequence + 1); blockIdx <= startBlockIndex(seq); blockIdx++ {
+			for _, key := range db.mem.Keys(uint64(blockIdx)) {
+				if key^db.cacheID <= c.sequence {
+					continue
+				}
+				if err := db.mem.Delete(uint64(blockIdx), key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for seq := range removed {
+		if err := db.unwarm(seq); err != nil {
+			return err
+		}
+		if err := db.mem.Delete(uint64(startBlockIndex(seq)), db.cacheID^seq); err != nil {
+			return err
+		}
+	}
+	if err := db.data.truncate(c.dataOff); err != nil {
+		return err
+	}
+	if err := db.timeWindow.rollback(c.windowIdx, c.sequence, removed); err != nil {
+		return err
+	}
+
+	// free slots are the sequences removed and the sequences free at the checkpoint or freed since, free blocks
+	// are the data blocks free at the checkpoint, freed since or of the removed entries, except data blocks in use.
+	db.freeList.trim(c.sequence, c.dataOff)
+	freeSlots, freeBlocks := db.freeList.snapshot()
+	var seqs []uint64
+	for seq := range removed {
+		if seq <= c.sequence {
+			seqs = append(seqs, seq)
+		}
+	}
+	for _, seq := range freeSlots.fs {
+		if !removed[seq] {
+			seqs = append(seqs, seq)
+		}
+	}
+	freed = append(freed, freeBlocks.fb...)
+	freed = append(freed, blocks.fb...)
+	db.freeList.reset(seqs, subtractBlocks(freed, used))
+	// external IDs are reset to the external IDs at the checkpoint of the entries kept.
+	free := make(map[uint64]bool, len(seqs))
+	for _, seq := range seqs {
+		free[seq] = true
+	}
+	if len(xids) == 0 {
+		xids = db.externalIDs.snapshot(nil)
+	}
+	if err := db.externalIDs.reset(xids, func(seq uint64) bool {
+		return seq <= c.sequence && !removed[seq] && !free[seq]
+	}); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&db.syncHandle.lastSyncSeq, c.sequence)
+
+	// reload the header and topics.
+	h.count = count
+	if err := db.index.writeMarshalableAt(h, 0); err != nil {
+		return err
+	}
+	if err := db.readHeader(); err != nil {
+		return err
+	}
+	db.trie.reset()
+	if err := db.loadTrie(); err != nil {
+		return err
+	}
+	return db.sync()
+}
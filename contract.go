@@ -0,0 +1,89 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// contractLabels holds human readable labels of contracts. Labels are persisted to the meta file as JSON.
+type contractLabels struct {
+	mu     sync.RWMutex
+	file   file
+	labels map[string]uint32
+}
+
+func newContractLabels(f file) *contractLabels {
+	return &contractLabels{file: f, labels: make(map[string]uint32)}
+}
+
+// read loads label to contract mapping from the meta file.
+func (c *contractLabels) read() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size := c.file.currSize()
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if _, err := c.file.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, &c.labels)
+}
+
+// add adds label to contract mapping and writes it to the meta file.
+func (c *contractLabels) add(label string, contract uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.labels[label]; ok {
+		return ErrDuplicateLabel
+	}
+	c.labels[label] = contract
+	if err := c.write(); err != nil {
+		delete(c.labels, label)
+		return err
+	}
+	return nil
+}
+
+// lookup returns contract for the label.
+func (c *contractLabels) lookup(label string) (uint32, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	contract, ok := c.labels[label]
+	return contract, ok
+}
+
+func (c *contractLabels) write() error {
+	data, err := json.Marshal(c.labels)
+	if err != nil {
+		return err
+	}
+	if err := c.file.truncate(0); err != nil {
+		return err
+	}
+	if _, err := c.file.write(data); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+func (c *contractLabels) close() error {
+	return c.file.Close()
+}
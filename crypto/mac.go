@@ -100,11 +100,11 @@ func (m *MAC) Decrypt(dst, src []byte) ([]byte, error) {
 	}
 
 	nonce := append(m.salt, src[:MessageOffset]...)
-	dst, err := m.parent.Open(dst, nonce, src[MessageOffset:], nil)
+	msg, err := m.parent.Open(nil, nonce, src[MessageOffset:], nil)
 	if err != nil {
 		return dst, errors.New("Authentication failed.")
 	}
-	// Append epoch to dst at the beginning
-	dst = append(src[:EpochSize], dst...)
-	return dst, nil
+	// Append epoch to dst at the beginning, src is not modified as it may be shared with the caller.
+	dst = append(dst, src[:EpochSize]...)
+	return append(dst, msg...), nil
 }
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+var csvHeader = []string{"id", "topic", "payload_hex", "expires_at_unix", "seq"}
+
+// ExportCSV writes all entries of the contract to w in CSV format. The first row is a header
+// row "id,topic,payload_hex,expires_at_unix,seq". Payloads are hex encoded.
+// Entries of topics written without a topic name are skipped.
+func (db *DB) ExportCSV(w io.Writer, contract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if w == nil {
+		return fmt.Errorf("db.ExportCSV: writer is nil: %w", ErrBadRequest)
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, t := range db.contractTopics(contract) {
+		if len(t.name) == 0 {
+			continue
+		}
+		if err := db.exportTopic(cw, contract, t); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportTopic writes entries of the topic to cw in order of sequence.
+func (db *DB) exportTopic(cw *csv.Writer, contract uint32, t topic) error {
+	return db.scanTopic(t, func(we winEntry, _ slot, id, val []byte) error {
+		if !message.ID(id).EvalPrefix(contract, 0) {
+			return nil
+		}
+		val, err := db.decodeValue(id, val)
+		if err != nil {
+			return err
+		}
+		row := []string{
+			hex.EncodeToString(id),
+			string(t.name),
+			hex.EncodeToString(val),
+			strconv.FormatUint(uint64(we.expiryTime()), 10),
+			strconv.FormatUint(we.seq(), 10),
+		}
+		return cw.Write(row)
+	})
+}
+
+// ImportCSV reads entries from r in the format written by ExportCSV and puts them into the DB
+// under the contract. Entries are written in batches of size set by WithImportBatchSize.
+// The id and seq columns are ignored and new IDs are assigned to the imported entries.
+// It returns number of entries imported and any parse error along with its line number.
+func (db *DB) ImportCSV(r io.Reader, contract uint32) (int, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	if r == nil {
+		return 0, fmt.Errorf("db.ImportCSV: reader is nil: %w", ErrBadRequest)
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+
+	var imported int
+	var line int
+	entries := make([]*Entry, 0, db.opts.importBatchSize)
+	write := func() error {
+		if len(entries) == 0 {
+			return nil
+		}
+		err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+			for _, e := range entries {
+				if err := b.PutEntry(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		imported += len(entries)
+		entries = entries[:0]
+		return nil
+	}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return imported, fmt.Errorf("db.ImportCSV: line %d: %v", line, err)
+		}
+		if line == 1 && record[0] == csvHeader[0] {
+			continue
+		}
+		payload, err := hex.DecodeString(record[2])
+		if err != nil {
+			return imported, fmt.Errorf("db.ImportCSV: line %d: %v", line, err)
+		}
+		expiresAt, err := strconv.ParseUint(record[3], 10, 32)
+		if err != nil {
+			return imported, fmt.Errorf("db.ImportCSV: line %d: %v", line, err)
+		}
+		e := NewEntry([]byte(record[1]), payload).WithContract(contract)
+		e.ExpiresAt = uint32(expiresAt)
+		entries = append(entries, e)
+		if len(entries) >= db.opts.importBatchSize {
+			if err := write(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if err := write(); err != nil {
+		return imported, err
+	}
+	return imported, nil
+}
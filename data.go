@@ -20,7 +20,9 @@ type dataTable struct {
 	file
 	lease *lease
 
-	offset int64
+	// offset is the logical size of the data table, the file may be preallocated beyond offset.
+	offset       int64
+	preallocSize int64
 }
 
 func (dt *dataTable) readMessage(s slot) ([]byte, []byte, error) {
@@ -34,6 +36,26 @@ func (dt *dataTable) readMessage(s slot) ([]byte, []byte, error) {
 	return message[:idSize], message[s.topicSize+idSize:], nil
 }
 
+// readID returns the message ID of the entry with its flags, the topic and the value are not read.
+func (dt *dataTable) readID(s slot) ([]byte, error) {
+	if s.cacheBlock != nil {
+		return s.cacheBlock[:idSize], nil
+	}
+	return dt.Slice(s.msgOffset, s.msgOffset+int64(idSize))
+}
+
+// flags returns the flags stored in the message ID of the entry.
+func (dt *dataTable) flags(s slot) (uint8, error) {
+	if s.cacheBlock != nil {
+		return s.cacheBlock[idSize-1], nil
+	}
+	flags, err := dt.Slice(s.msgOffset+int64(idSize)-1, s.msgOffset+int64(idSize))
+	if err != nil {
+		return 0, err
+	}
+	return flags[0], nil
+}
+
 func (dt *dataTable) readTopic(s slot) ([]byte, error) {
 	if s.cacheBlock != nil {
 		return s.cacheBlock[idSize : s.topicSize+idSize], nil
@@ -43,10 +65,56 @@ func (dt *dataTable) readTopic(s slot) ([]byte, error) {
 
 func (dt *dataTable) extend(size uint32) (int64, error) {
 	off := dt.offset
-	if _, err := dt.file.extend(size); err != nil {
+	if err := dt.grow(off + int64(size)); err != nil {
 		return 0, err
 	}
 	dt.offset += int64(size)
 
 	return off, nil
 }
+
+// grow grows the data file to fit size bytes. If preallocation is set the file grows in multiples of preallocSize.
+func (dt *dataTable) grow(size int64) error {
+	if size <= dt.size {
+		return nil
+	}
+	if dt.preallocSize > 0 {
+		size = ((size + dt.preallocSize - 1) / dt.preallocSize) * dt.preallocSize
+	}
+	return dt.file.truncate(size)
+}
+
+// writeAt writes data at the offset off of the data file.
+func (dt *dataTable) writeAt(data []byte, off int64) (int, error) {
+	end := off + int64(len(data))
+	if dt.preallocSize > 0 {
+		if err := dt.grow(end); err != nil {
+			return 0, err
+		}
+	}
+	n, err := dt.WriteAt(data, off)
+	if err != nil {
+		return 0, err
+	}
+	if end > dt.size {
+		dt.size = end
+	}
+	return n, nil
+}
+
+// truncate truncates the data file and resets the logical size of the data table.
+func (dt *dataTable) truncate(size int64) error {
+	if err := dt.file.truncate(size); err != nil {
+		return err
+	}
+	dt.offset = size
+	return nil
+}
+
+// trim truncates the data file to the logical size releasing the preallocated space.
+func (dt *dataTable) trim() error {
+	if dt.size == dt.offset {
+		return nil
+	}
+	return dt.truncate(dt.offset)
+}
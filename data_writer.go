@@ -59,7 +59,9 @@ func (dw *dataWriter) append(data []byte) (off int64, err error) {
 }
 
 func (dw *dataWriter) write() (int, error) {
-	n, err := dw.file.write(dw.buffer.Bytes())
+	// buffered data is appended at the end of the data table, and offset is already moved past it.
+	data := dw.buffer.Bytes()
+	n, err := dw.writeAt(data, dw.offset-int64(len(data)))
 	if err != nil {
 		return 0, err
 	}
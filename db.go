@@ -17,22 +17,26 @@
 package unitdb
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
+	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/unit-io/unitdb/crypto"
 	fltr "github.com/unit-io/unitdb/filter"
 	"github.com/unit-io/unitdb/fs"
 	"github.com/unit-io/unitdb/memdb"
 	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
 	"github.com/unit-io/unitdb/wal"
 )
 
@@ -42,6 +46,7 @@ type DB struct {
 	// Need 64-bit alignment.
 	mutex
 	mac        *crypto.MAC
+	oldMacs    []*crypto.MAC
 	syncLockC  chan struct{}
 	filter     Filter
 	lock       fs.LockFile
@@ -54,6 +59,12 @@ type DB struct {
 	timeWindow *timeWindowBucket
 	opts       *options
 	mem        *memdb.DB
+	// contract labels
+	contracts *contractLabels
+	// externalIDs maps external IDs of entries to their sequence.
+	externalIDs *externalIDs
+	// watchers of topics.
+	watchers *watchers
 
 	//batchdb
 	*batchdb
@@ -61,6 +72,21 @@ type DB struct {
 	trie *trie
 	// sync handler
 	syncHandle syncHandle
+	// syncStopC stops the background syncer, it is closed when sync is paused.
+	syncMu     sync.Mutex
+	syncStopC  chan struct{}
+	syncPaused uint32
+	// expiryMu is held by a background expiry run, expiryPaused is set while background expiry is paused.
+	expiryMu     sync.Mutex
+	expiryPaused uint32
+	// snapshots is number of open snapshots.
+	snapshots int32
+	// snapshotChanges holds entries deleted or written while snapshots are open.
+	snapshotChanges *snapshotChanges
+	// subscribers is number of open subscribers.
+	subscribers int32
+	// shards is the consistent hash ring to route contracts to shards.
+	shards *shardRing
 	// The db start time.
 	start time.Time
 	// The metrics to measure timeseries on message events.
@@ -70,6 +96,36 @@ type DB struct {
 	closeC chan struct{}
 	closed uint32
 	closer io.Closer
+	// The slow query log.
+	slowQueryLog slowQueryLog
+	// The DB path used to locate checkpoint files.
+	path string
+	// walReader is set while a WAL reader is open.
+	walReader uint32
+	// recoverySkipped holds sequences of entries skipped by best effort log recovery.
+	recoverySkipped []uint64
+	// expiryNotifier calls the expiry callback, it is nil if no callback is set.
+	expiryNotifier *expiryNotifier
+	// dedup holds dedup keys of the entries written within the dedup window.
+	dedup *dedupCache
+	// warmed holds sequences of the entries loaded into memdb by WarmCache.
+	warmed *warmedEntries
+	// batchSeqs holds sequences of batch entries not yet written to memdb.
+	batchSeqs *batchSeqs
+	// writeHooks are called in order on each entry before it is written.
+	writeHooksMu sync.RWMutex
+	writeHooks   []func(*Entry) error
+	// readHooks are called in order on each entry after it is read.
+	readHooksMu sync.RWMutex
+	readHooks   []func(*Entry) error
+	// syncHooks are called in order with the sequences of each log applied by sync.
+	syncHooksMu sync.RWMutex
+	syncHooks   []func(seqs []uint64)
+	// commitHooks are called in order with the sequences of each tiny batch committed to the WAL.
+	commitHooksMu sync.RWMutex
+	commitHooks   []func(seqs []uint64) error
+	// subscriberStateMu guards the subscriber state file on commit.
+	subscriberStateMu sync.Mutex
 }
 
 // Open opens or creates a new DB.
@@ -82,12 +138,15 @@ func Open(path string, opts ...Options) (*DB, error) {
 			opt.set(options)
 		}
 	}
+	if options.err != nil {
+		return nil, options.err
+	}
 
 	fs := options.fileSystem
-	lock, err := fs.CreateLockFile(path + lockPostfix)
+	lock, err := createLockFile(fs, path+lockPostfix, options.openTimeout)
 	if err != nil {
 		if err == os.ErrExist {
-			err = errLocked
+			err = fmt.Errorf("db.Open: %w", ErrLocked)
 		}
 		return nil, err
 	}
@@ -106,13 +165,16 @@ func Open(path string, opts ...Options) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	lease := newLease(leaseFile, options.minimumFreeBlocksSize)
+	lease := newLease(leaseFile, options.minimumFreeBlocksSize, options.concurrency)
 
 	timeOptions := &timeOptions{
 		maxDuration:         options.syncDurationType * time.Duration(options.maxSyncDurations),
-		expDurationType:     time.Minute,
+		expDurationType:     options.expiryGranularity,
 		maxExpDurations:     maxExpDur,
 		backgroundKeyExpiry: options.backgroundKeyExpiry,
+		clock:               options.clock,
+		nShards:             options.concurrency,
+		winBlockEntries:     winBlockEntries(options.loadFactor),
 	}
 	timewindow, err := newFile(fs, path+windowPostfix)
 	if err != nil {
@@ -124,24 +186,50 @@ func Open(path string, opts ...Options) (*DB, error) {
 		return nil, err
 	}
 
+	meta, err := newFile(fs, path+metaPostfix)
+	if err != nil {
+		return nil, err
+	}
+
+	xid, err := newFile(fs, path+externalIDPostfix)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := newShardRing(fs, path+shardPostfix, options.shards, options.maxShards)
+	if err != nil {
+		return nil, err
+	}
+
 	db := &DB{
-		mutex:      newMutex(),
-		lock:       lock,
-		index:      index,
-		data:       dataTable{file: data, lease: lease, offset: data.Size()},
-		timeWindow: newTimeWindowBucket(timewindow, timeOptions),
-		freeList:   lease,
-		filter:     Filter{file: filter, filterBlock: fltr.NewFilterGenerator()},
-		syncLockC:  make(chan struct{}, 1),
+		mutex:       newMutex(),
+		lock:        lock,
+		index:       index,
+		data:        dataTable{file: data, lease: lease, offset: data.Size(), preallocSize: options.dataPreallocSize},
+		timeWindow:  newTimeWindowBucket(timewindow, timeOptions),
+		freeList:    lease,
+		filter:      Filter{file: filter},
+		contracts:   newContractLabels(meta),
+		externalIDs: newExternalIDs(fs, path+externalIDPostfix, xid),
+		watchers:    newWatchers(),
+		shards:      shards,
+		syncLockC:   make(chan struct{}, 1),
 		dbInfo: dbInfo{
 			blockIdx: -1,
 		},
 		opts: options,
+		path: path,
+
+		batchdb:   &batchdb{},
+		trie:      newTrie(),
+		dedup:     newDedupCache(options.dedupWindow, options.clock),
+		warmed:    newWarmedEntries(),
+		batchSeqs: newBatchSeqs(),
 
-		batchdb: &batchdb{},
-		trie:    newTrie(),
-		start:   time.Now(),
-		meter:   NewMeter(),
+		snapshotChanges: newSnapshotChanges(),
+
+		start: time.Now(),
+		meter: NewMeter(),
 		// Close
 		closeC: make(chan struct{}),
 	}
@@ -158,7 +246,7 @@ func Open(path string, opts ...Options) (*DB, error) {
 				logger.Error().Err(err).Str("context", "db.Open")
 			}
 			// Data file exists, but index is missing.
-			return nil, errCorrupted
+			return nil, fmt.Errorf("db.Open: index file is missing: %w", ErrCorrupted)
 		}
 		// memdb blockcache id.
 		db.cacheID = uint64(rand.Uint32())<<32 + uint64(rand.Uint32())
@@ -171,6 +259,14 @@ func Open(path string, opts ...Options) (*DB, error) {
 		if _, err = db.data.extend(headerSize); err != nil {
 			return nil, err
 		}
+		if options.flags.withoutFilter {
+			db.noFilter = 1
+		}
+		if options.topicNormalizer != nil {
+			db.normalized = 1
+		}
+		// window block 0 is not used as window offset 0 ends the chain of window blocks of a topic.
+		db.timeWindow.setWindowIndex(0)
 		if err := db.writeHeader(); err != nil {
 			return nil, err
 		}
@@ -187,12 +283,47 @@ func Open(path string, opts ...Options) (*DB, error) {
 			}
 			return nil, err
 		}
+		// truncate the preallocated tail of the data file left by a crash.
+		if db.dbInfo.dataSize > 0 && db.dbInfo.dataSize < db.data.size {
+			if err := db.data.truncate(db.dbInfo.dataSize); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := db.contracts.read(); err != nil {
+		logger.Error().Err(err).Str("context", "db.Open")
+		return nil, err
+	}
+
+	if err := db.externalIDs.read(); err != nil {
+		logger.Error().Err(err).Str("context", "db.Open")
+		return nil, err
 	}
 
 	// Create a new MAC from the key.
 	if db.mac, err = crypto.New(options.encryptionKey); err != nil {
 		return nil, err
 	}
+	for _, key := range options.oldEncryptionKeys {
+		mac, err := crypto.New(key)
+		if err != nil {
+			return nil, err
+		}
+		db.oldMacs = append(db.oldMacs, mac)
+	}
+	if err := db.checkReEncryptState(); err != nil {
+		if err := index.Close(); err != nil {
+			logger.Error().Err(err).Str("context", "db.Open")
+		}
+		if err := data.Close(); err != nil {
+			logger.Error().Err(err).Str("context", "db.Open")
+		}
+		if err := lock.Unlock(); err != nil {
+			logger.Error().Err(err).Str("context", "db.Open")
+		}
+		return nil, err
+	}
 
 	// set encryption flag to encrypt messages.
 	if db.opts.flags.encryption {
@@ -200,7 +331,7 @@ func Open(path string, opts ...Options) (*DB, error) {
 	}
 
 	// Create a memdb.
-	mem, err := memdb.Open(options.memdbSize, &memdb.Options{MaxElapsedTime: 2 * time.Second})
+	mem, err := memdb.Open(options.memdbSize, &memdb.Options{MaxElapsedTime: 2 * time.Second, Storage: options.memStorage, Path: path + memPostfix})
 	if err != nil {
 		return nil, err
 	}
@@ -211,8 +342,16 @@ func Open(path string, opts ...Options) (*DB, error) {
 		return nil, err
 	}
 
-	db.filter.cache = db.mem
+	// filter flag is persisted in the header on DB create, so reopen uses the same choice.
+	if db.noFilter == 0 {
+		db.filter.filterBlock = fltr.NewFilterGenerator()
+	}
+	db.filter.cache = fltr.NewCache(options.filterCacheSize)
 	db.filter.cacheID = db.cacheID
+	if err := db.filter.load(); err != nil {
+		logger.Error().Err(err).Str("context", "db.Open")
+		return nil, err
+	}
 
 	if err := db.loadTrie(); err != nil {
 		logger.Error().Err(err).Str("context", "db.loadTrie")
@@ -224,7 +363,7 @@ func Open(path string, opts ...Options) (*DB, error) {
 		return nil, err
 	}
 
-	logOpts := wal.Options{Path: path + logPostfix, TargetSize: options.logSize, BufferSize: options.bufferSize}
+	logOpts := wal.Options{Path: path + logPostfix, TargetSize: options.logSize, BufferSize: options.bufferSize, Compression: options.logCompression}
 	wal, needLogRecovery, err := wal.New(logOpts)
 	if err != nil {
 		wal.Close()
@@ -240,11 +379,25 @@ func Open(path string, opts ...Options) (*DB, error) {
 		}
 	}
 
+	if count, err := db.countEntries(); err != nil {
+		logger.Error().Err(err).Str("context", "db.countEntries")
+	} else if count != db.Count() {
+		logger.Warn().Str("context", "db.Open").Uint64("count", db.Count()).Uint64("entries", count).Msg("DB count does not match entries in index blocks")
+	}
+
 	db.syncHandle = syncHandle{internal: internal{DB: db}}
 	db.startSyncer(options.syncDurationType * time.Duration(options.maxSyncDurations))
 
 	if db.opts.backgroundKeyExpiry {
-		db.startExpirer(time.Minute, maxExpDur)
+		if options.expiryCallback != nil {
+			db.expiryNotifier = newExpiryNotifier(options.expiryCallback)
+			db.expiryNotifier.run(db.closeC)
+		}
+		db.startExpirer(options.expiryGranularity, maxExpDur)
+	}
+
+	if db.opts.defragInterval > 0 {
+		db.startDefragger(db.opts.defragInterval)
 	}
 
 	return db, nil
@@ -252,6 +405,12 @@ func Open(path string, opts ...Options) (*DB, error) {
 
 // Close closes the DB.
 func (db *DB) Close() error {
+	// entries deleted while snapshots are open are deleted before the DB is closed.
+	if db.ok() == nil && atomic.SwapInt32(&db.snapshots, 0) > 0 {
+		if err := db.releaseSnapshotChanges(); err != nil {
+			return err
+		}
+	}
 	if err := db.close(); err != nil {
 		return err
 	}
@@ -271,6 +430,9 @@ func (db *DB) Close() error {
 	if err := db.timeWindow.Close(); err != nil {
 		return err
 	}
+	if err := db.data.trim(); err != nil {
+		return err
+	}
 	if err := db.data.Close(); err != nil {
 		return err
 	}
@@ -280,6 +442,12 @@ func (db *DB) Close() error {
 	if err := db.filter.close(); err != nil {
 		return err
 	}
+	if err := db.contracts.close(); err != nil {
+		return err
+	}
+	if err := db.externalIDs.close(); err != nil {
+		return err
+	}
 	if err := db.lock.Unlock(); err != nil {
 		return err
 	}
@@ -299,21 +467,45 @@ func (db *DB) Close() error {
 
 // Get return items matching the query paramater.
 func (db *DB) Get(q *Query) (items [][]byte, err error) {
+	err = db.get(q, func(_ query, _, _, val []byte) {
+		items = append(items, val)
+	})
+	return items, err
+}
+
+// GetItems returns items matching the query parameter. Each item carries the topic, payload,
+// message ID and expiry of the entry, the topic is the topic the entry was put to, such as a
+// wildcard topic matching the query. Items are returned in the same order as Get.
+func (db *DB) GetItems(q *Query) (items []Item, err error) {
+	err = db.get(q, func(we query, topic, id, val []byte) {
+		items = append(items, Item{topic: topic, value: val, id: messageID(id, we.seq), expiresAt: we.expiresAt})
+	})
+	return items, err
+}
+
+// get reads entries matching the query and calls f on each entry until the query limit is reached.
+// The topic passed to f is the topic of the entry, it differs from the query topic for wildcard queries.
+func (db *DB) get(q *Query, f func(we query, topic, id, val []byte)) (err error) {
+	nItems := 0
 	if err := db.ok(); err != nil {
-		return nil, err
+		return err
 	}
 	switch {
 	case len(q.Topic) == 0:
-		return nil, errTopicEmpty
-	case len(q.Topic) > maxTopicLength:
-		return nil, errTopicTooLarge
+		return errTopicEmpty
+	case len(q.Topic) > db.opts.maxTopicSize:
+		return ErrTopicTooLarge
 	}
 	// // CPU profiling by default
 	// defer profile.Start().Stop()
-	q.opts = &queryOptions{defaultQueryLimit: db.opts.defaultQueryLimit, maxQueryLimit: db.opts.maxQueryLimit}
+	queryStart := time.Now()
+	q.opts = db.newQueryOptions()
 	if err := q.parse(); err != nil {
-		return nil, err
+		return err
 	}
+	defer func() {
+		db.logSlowQuery(q, queryStart, nItems)
+	}()
 	mu := db.getMutex(q.prefix)
 	mu.RLock()
 	defer mu.RUnlock()
@@ -321,9 +513,11 @@ func (db *DB) Get(q *Query) (items [][]byte, err error) {
 	if len(q.winEntries) == 0 {
 		return
 	}
-	sort.Slice(q.winEntries[:], func(i, j int) bool {
-		return q.winEntries[i].seq > q.winEntries[j].seq
-	})
+	if !q.seek {
+		sort.Slice(q.winEntries[:], func(i, j int) bool {
+			return q.winEntries[i].seq > q.winEntries[j].seq
+		})
+	}
 	invalidCount := 0
 	start := 0
 	limit := q.Limit
@@ -332,13 +526,16 @@ func (db *DB) Get(q *Query) (items [][]byte, err error) {
 	}
 	for {
 		for _, we := range q.winEntries[start:limit] {
+			if nItems == int(q.Limit) {
+				break
+			}
 			err = func() error {
 				if we.seq == 0 {
 					return nil
 				}
-				s, err := db.readEntry(we.topicHash, we.seq)
+				s, err := db.readQueryEntry(q, we.topicHash, we.seq)
 				if err != nil {
-					if err == errMsgIDDeleted {
+					if errors.Is(err, errMsgIDDeleted) || errors.Is(err, ErrMsgIDDoesNotExist) {
 						invalidCount++
 						return nil
 					}
@@ -356,30 +553,42 @@ func (db *DB) Get(q *Query) (items [][]byte, err error) {
 					return nil
 				}
 
-				// last bit of ID is an encryption flag.
-				if uint8(id[idSize-1]) == 1 {
-					val, err = db.mac.Decrypt(nil, val)
-					if err != nil {
-						logger.Error().Err(err).Str("context", "mac.decrypt")
-						return err
-					}
+				val, err = db.decodeValue(id, val)
+				if err != nil {
+					logger.Error().Err(err).Str("context", "db.decodeValue")
+					return err
+				}
+				topic := q.Topic
+				if name, ok := db.trie.getName(we.topicHash); ok {
+					topic = name
+				}
+				val, err = db.runReadHooks(we.seq, id, topic, val)
+				if errors.Is(err, ErrSkipEntry) {
+					invalidCount++
+					return nil
 				}
-				var buffer []byte
-				val, err = snappy.Decode(buffer, val)
 				if err != nil {
-					logger.Error().Err(err).Str("context", "snappy.Decode")
 					return err
 				}
-				items = append(items, val)
+				if q.filter != nil && !q.filter(val) {
+					invalidCount++
+					return nil
+				}
+				f(we, topic, id, val)
+				nItems++
+				if q.seek {
+					q.cursor = we.seq
+				}
 				db.meter.OutBytes.Inc(int64(s.valueSize))
+				db.opts.metricsSink.OutBytes(int64(s.valueSize))
 				return nil
 			}()
 			if err != nil {
-				return items, err
+				return err
 			}
 		}
 
-		if invalidCount == 0 || len(items) == int(q.Limit) || len(q.winEntries) == limit {
+		if invalidCount == 0 || nItems == int(q.Limit) || len(q.winEntries) == limit {
 			break
 		}
 
@@ -391,145 +600,1490 @@ func (db *DB) Get(q *Query) (items [][]byte, err error) {
 			limit = limit + invalidCount
 		}
 	}
-	db.meter.Gets.Inc(int64(len(items)))
-	db.meter.OutMsgs.Inc(int64(len(items)))
-	return items, nil
+	db.meter.Gets.Inc(int64(nItems))
+	db.meter.OutMsgs.Inc(int64(nItems))
+	db.opts.metricsSink.Get(int64(nItems))
+	return nil
 }
 
-// Items returns a new ItemIterator.
-func (db *DB) Items(q *Query) (*ItemIterator, error) {
+// GetBySeq returns the entry for the sequence. The topic of the entry is only set if the
+// entry is the first entry written to its topic, as topic is not stored with other entries.
+// The expiry of the entry is only set if the entry is not yet synced to the DB files.
+func (db *DB) GetBySeq(seq uint64) (*Entry, error) {
 	if err := db.ok(); err != nil {
 		return nil, err
 	}
-	switch {
-	case len(q.Topic) == 0:
-		return nil, errTopicEmpty
-	case len(q.Topic) > maxTopicLength:
-		return nil, errTopicTooLarge
+	if seq == 0 {
+		return nil, ErrSeqNotFound
 	}
+	// The topic of the sequence is not known, so the entry is read under the tiny batch lock
+	// to prevent a delete from freeing the slot and its data block during the read.
+	db.tinyBatchLockC <- struct{}{}
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
 
-	q.opts = &queryOptions{defaultQueryLimit: db.opts.defaultQueryLimit, maxQueryLimit: db.opts.maxQueryLimit}
-	if err := q.parse(); err != nil {
+	return db.getBySeq(seq)
+}
+
+// getBySeq returns the entry for the sequence. The caller must hold the tiny batch lock.
+func (db *DB) getBySeq(seq uint64) (*Entry, error) {
+	// topic hash is not used to read the index slot.
+	s, err := db.readEntry(0, seq)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, errMsgIDDeleted) || errors.Is(err, ErrMsgIDDoesNotExist) {
+			return nil, ErrSeqNotFound
+		}
 		return nil, err
 	}
-
-	return &ItemIterator{db: db, query: q}, nil
+	if s.seq != seq {
+		return nil, ErrSeqNotFound
+	}
+	id, val, err := db.data.readMessage(s)
+	if err != nil {
+		logger.Error().Err(err).Str("context", "data.readMessage")
+		return nil, err
+	}
+	e := &Entry{Contract: binary.LittleEndian.Uint32(id[4:8]), ExpiresAt: s.expiresAt}
+	e.ID = make([]byte, 16)
+	copy(e.ID, id[:8])
+	binary.LittleEndian.PutUint64(e.ID[8:16], seq)
+	if s.topicSize != 0 {
+		rawTopic, err := db.data.readTopic(s)
+		if err != nil {
+			return nil, err
+		}
+		t := new(message.Topic)
+		if err := t.Unmarshal(rawTopic); err != nil {
+			return nil, err
+		}
+		e.Topic = t.Topic
+	}
+	e.Encryption = id[idSize-1]&flagEncrypted != 0
+	e.Payload, err = db.decodeValue(id, val)
+	if err != nil {
+		logger.Error().Err(err).Str("context", "db.decodeValue")
+		return nil, err
+	}
+	db.meter.Gets.Inc(1)
+	db.meter.OutMsgs.Inc(1)
+	db.meter.OutBytes.Inc(int64(s.valueSize))
+	db.opts.metricsSink.Get(1)
+	db.opts.metricsSink.OutBytes(int64(s.valueSize))
+	return e, nil
 }
 
-// NewContract generates a new Contract.
-func (db *DB) NewContract() (uint32, error) {
-	raw := make([]byte, 4)
-	rand.Read(raw)
-
-	contract := uint32(binary.LittleEndian.Uint32(raw[:4]))
-	return contract, nil
+// GetByID returns the entry for the external ID set on the entry using Entry.WithExternalID.
+// See GetBySeq for the fields set on the entry.
+func (db *DB) GetByID(externalID []byte) (*Entry, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if len(externalID) != externalIDSize {
+		return nil, errExternalIDInvalid
+	}
+	seq, ok := db.externalIDs.lookup(externalID)
+	if !ok {
+		return nil, ErrMsgIDDoesNotExist
+	}
+	e, err := db.GetBySeq(seq)
+	if err != nil {
+		if errors.Is(err, ErrSeqNotFound) || errors.Is(err, errMsgIDDeleted) {
+			return nil, ErrMsgIDDoesNotExist
+		}
+		return nil, err
+	}
+	e.ExternalID = append([]byte(nil), externalID...)
+	return e, nil
 }
 
-// NewID generates new ID that is later used to put entry or delete entry.
-func (db *DB) NewID() []byte {
-	db.meter.Leases.Inc(1)
-	return message.NewID(db.nextSeq())
+// ExternalID returns the external ID of the entry for the message ID, or nil if the entry has no external ID.
+func (db *DB) ExternalID(id []byte) ([]byte, error) {
+	ok, err := db.HasEntry(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrMsgIDDoesNotExist
+	}
+	xid, _ := db.externalIDs.lookupSeq(message.ID(id).Sequence())
+	return xid, nil
 }
 
-// Put puts entry into DB. It uses default Contract to put entry into DB.
-// It is safe to modify the contents of the argument after Put returns but not
-// before.
-func (db *DB) Put(topic, payload []byte) error {
-	return db.PutEntry(NewEntry(topic, payload))
+// EntriesAfterSeq returns up to limit entries of the topic with sequence greater than seq in ascending
+// order of sequence. It is used by consumers to poll for entries after the last processed sequence.
+func (db *DB) EntriesAfterSeq(topic []byte, seq uint64, limit int) ([]*Entry, error) {
+	return db.entriesAfterSeq(topic, 0, seq, limit)
 }
 
-// PutEntry puts entry into the DB, if Contract is not specified then it uses master Contract.
-// It is safe to modify the contents of the argument after PutEntry returns but not
-// before.
-func (db *DB) PutEntry(e *Entry) error {
+// entriesAfterSeq returns up to limit entries of the topic for the contract with sequence greater than seq.
+func (db *DB) entriesAfterSeq(topic []byte, contract uint32, seq uint64, limit int) ([]*Entry, error) {
 	if err := db.ok(); err != nil {
-		return err
+		return nil, err
 	}
-
 	switch {
-	case len(e.Topic) == 0:
-		return errTopicEmpty
-	case len(e.Topic) > maxTopicLength:
-		return errTopicTooLarge
-	case len(e.Payload) == 0:
-		return errValueEmpty
-	case len(e.Payload) > maxValueLength:
-		return errValueTooLarge
+	case len(topic) == 0:
+		return nil, errTopicEmpty
+	case len(topic) > db.opts.maxTopicSize:
+		return nil, ErrTopicTooLarge
 	}
-
-	db.tinyBatchLockC <- struct{}{}
-	defer func() {
-		<-db.tinyBatchLockC
-	}()
-
-	if err := db.setEntry(db.tinyBatch.timeID(), e); err != nil {
-		return err
+	q := NewQuery(topic).WithContract(contract)
+	q.opts = db.newQueryOptions()
+	if err := q.parse(); err != nil {
+		return nil, err
 	}
-
-	if e.topicSize != 0 {
-		t := new(message.Topic)
-		rawTopic := e.cache[entrySize+idSize : entrySize+idSize+e.topicSize]
-		t.Unmarshal(rawTopic)
-		db.trie.add(newTopic(e.topicHash, 0), t.Parts, t.Depth)
+	switch {
+	case limit <= 0:
+		limit = db.opts.defaultQueryLimit
+	case limit > db.opts.maxQueryLimit:
+		limit = db.opts.maxQueryLimit
+	}
+	names := make(map[uint64][]byte)
+	var wEntries []query
+	// the prefix lock is released before entries are read as GetBySeq takes the tiny batch lock.
+	mu := db.getMutex(q.prefix)
+	mu.RLock()
+	for _, t := range db.trie.lookup(q.parts, q.depth, q.topicType) {
+		names[t.hash] = t.name
+		entries, _ := db.timeWindow.lookup(t.hash, t.offset, 0, math.MaxInt32)
+		for _, we := range entries {
+			if we.seq() > seq {
+				wEntries = append(wEntries, query{topicHash: t.hash, seq: we.seq(), expiresAt: we.expiryTime()})
+			}
+		}
+	}
+	mu.RUnlock()
+	sort.Slice(wEntries, func(i, j int) bool {
+		return wEntries[i].seq < wEntries[j].seq
+	})
+	now := uint32(db.opts.clock.Now().Unix())
+	var items []*Entry
+	for _, we := range wEntries {
+		if len(items) == limit {
+			break
+		}
+		if we.expiresAt != 0 && we.expiresAt <= now {
+			continue
+		}
+		e, err := db.GetBySeq(we.seq)
+		if err != nil {
+			if errors.Is(err, ErrSeqNotFound) || errors.Is(err, errMsgIDDeleted) {
+				continue
+			}
+			return nil, err
+		}
+		if !message.ID(e.ID).EvalPrefix(q.Contract, 0) {
+			continue
+		}
+		e.Topic = names[we.topicHash]
+		e.ExpiresAt = we.expiresAt
+		items = append(items, e)
 	}
+	return items, nil
+}
 
-	blockID := startBlockIndex(e.seq)
-	memseq := db.cacheID ^ e.seq
-	if err := db.mem.Set(uint64(blockID), memseq, e.cache); err != nil {
+// WarmCache loads entries of the topics into memory so that first reads after restart are not read from the DB files.
+// Entries are loaded concurrently bounded by GOMAXPROCS and it returns on first error.
+func (db *DB) WarmCache(topics [][]byte, contract uint32) error {
+	if err := db.ok(); err != nil {
 		return err
 	}
-
-	if ok := db.timeWindow.add(db.tinyBatch.timeID(), e.topicHash, newWinEntry(e.seq, e.expiresAt)); !ok {
-		return errForbidden
+	var winEntries []query
+	for _, topic := range topics {
+		switch {
+		case len(topic) == 0:
+			return errTopicEmpty
+		case len(topic) > db.opts.maxTopicSize:
+			return ErrTopicTooLarge
+		}
+		q := NewQuery(topic).WithContract(contract)
+		q.opts = db.newQueryOptions()
+		if err := q.parse(); err != nil {
+			return err
+		}
+		mu := db.getMutex(q.prefix)
+		mu.RLock()
+		db.lookup(q)
+		mu.RUnlock()
+		winEntries = append(winEntries, q.winEntries...)
 	}
 
-	db.tinyBatch.entries = append(db.tinyBatch.entries, e.seq)
-	db.tinyBatch.incount()
-	// reset message entry.
-	e.reset()
-	return nil
+	var wg sync.WaitGroup
+	limitC := make(chan struct{}, runtime.GOMAXPROCS(0))
+	errC := make(chan error, 1)
+	for _, we := range winEntries {
+		select {
+		case err := <-errC:
+			wg.Wait()
+			return err
+		case limitC <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(we query) {
+			defer func() {
+				<-limitC
+				wg.Done()
+			}()
+			if err := db.warmEntry(we); err != nil {
+				select {
+				case errC <- err:
+				default:
+				}
+			}
+		}(we)
+	}
+	wg.Wait()
+	select {
+	case err := <-errC:
+		return err
+	default:
+		return nil
+	}
 }
 
-// Delete sets entry for deletion.
-// It is safe to modify the contents of the argument after Delete returns but not
-// before.
-func (db *DB) Delete(id, topic []byte) error {
-	return db.DeleteEntry(NewEntry(topic, nil).WithID(id))
+// SeqRange returns the lowest and highest sequence of entries available for the topic.
+// Sequences are read from the time window, no entry data is read from the DB.
+func (db *DB) SeqRange(topic []byte, contract uint32) (minSeq, maxSeq uint64, err error) {
+	if err := db.ok(); err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case len(topic) == 0:
+		return 0, 0, errTopicEmpty
+	case len(topic) > db.opts.maxTopicSize:
+		return 0, 0, ErrTopicTooLarge
+	}
+	q := NewQuery(topic).WithContract(contract)
+	q.opts = db.newQueryOptions()
+	if err := q.parse(); err != nil {
+		return 0, 0, err
+	}
+	for _, t := range db.trie.lookup(q.parts, q.depth, q.topicType) {
+		wEntries, _ := db.timeWindow.lookup(t.hash, t.offset, 0, math.MaxInt32)
+		for _, we := range wEntries {
+			seq := we.seq()
+			if seq == 0 {
+				continue
+			}
+			if minSeq == 0 || seq < minSeq {
+				minSeq = seq
+			}
+			if seq > maxSeq {
+				maxSeq = seq
+			}
+		}
+	}
+	if maxSeq == 0 {
+		return 0, 0, ErrNoEntries
+	}
+	return minSeq, maxSeq, nil
 }
 
-// DeleteEntry deletes an entry from DB. you must provide an ID to delete an entry.
-// It is safe to modify the contents of the argument after Delete returns but
-// not before.
-func (db *DB) DeleteEntry(e *Entry) error {
+// GetTopicWindow returns time of the entries with the lowest and highest sequence available for the topic.
+// Time is read from the message ID of the entries, so entries written with PutWithTimestamp report their given time.
+func (db *DB) GetTopicWindow(topic []byte, contract uint32) (earliest, latest time.Time, err error) {
+	if err := db.ok(); err != nil {
+		return earliest, latest, err
+	}
 	switch {
-	case db.opts.immutable:
-		return errImmutable
-	case len(e.ID) == 0:
-		return errMsgIDEmpty
-	case len(e.Topic) == 0:
-		return errTopicEmpty
-	case len(e.Topic) > maxTopicLength:
-		return errTopicTooLarge
+	case len(topic) == 0:
+		return earliest, latest, errTopicEmpty
+	case len(topic) > db.opts.maxTopicSize:
+		return earliest, latest, ErrTopicTooLarge
 	}
-	id := message.ID(e.ID)
-	topic, _, err := db.parseTopic(e.Contract, e.Topic)
-	if err != nil {
-		return err
+	q := NewQuery(topic).WithContract(contract)
+	q.opts = db.newQueryOptions()
+	if err := q.parse(); err != nil {
+		return earliest, latest, err
 	}
-	if e.Contract == 0 {
-		e.Contract = message.MasterContract
+	var seqs []uint64
+	for _, t := range db.trie.lookup(q.parts, q.depth, q.topicType) {
+		wEntries, _ := db.timeWindow.lookup(t.hash, t.offset, 0, math.MaxInt32)
+		for _, we := range wEntries {
+			if we.seq() != 0 {
+				seqs = append(seqs, we.seq())
+			}
+		}
 	}
-	topic.AddContract(e.Contract)
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
 
-	if err := db.delete(topic.GetHash(e.Contract), message.ID(id).Sequence()); err != nil {
-		return err
+	// skip entries deleted but not yet removed from the time window.
+	first := -1
+	for i := 0; i < len(seqs) && first == -1; i++ {
+		if earliest, err = db.entryTime(seqs[i]); err == nil {
+			first = i
+		} else if !errors.Is(err, errMsgIDDeleted) && !errors.Is(err, ErrMsgIDDoesNotExist) {
+			return earliest, latest, err
+		}
 	}
-
-	return nil
+	if first == -1 {
+		return earliest, latest, ErrNoEntries
+	}
+	for i := len(seqs) - 1; i >= first; i-- {
+		if latest, err = db.entryTime(seqs[i]); err == nil {
+			break
+		} else if !errors.Is(err, errMsgIDDeleted) && !errors.Is(err, ErrMsgIDDoesNotExist) {
+			return earliest, latest, err
+		}
+	}
+	return earliest, latest, nil
 }
 
-// Sync syncs entries into DB. Sync happens synchronously.
-// Sync write window entries into summary file and write index, and data to respective index and data files.
+// HasEntry reports whether entry for the ID exists in the DB. It does not read the entry value.
+// It returns false if the sequence of the ID is reused by another entry.
+func (db *DB) HasEntry(id []byte) (bool, error) {
+	if err := db.ok(); err != nil {
+		return false, err
+	}
+	switch {
+	case len(id) == 0:
+		return false, errMsgIDEmpty
+	case len(id) < message.ID(id).Size():
+		return false, ErrBadRequest
+	}
+	seq := message.ID(id).Sequence()
+	if seq == 0 || db.snapshotChanges.deleted(seq) {
+		return false, nil
+	}
+	blockIdx := startBlockIndex(seq)
+	memseq := db.cacheID ^ seq
+	data, err := db.mem.Get(uint64(blockIdx), memseq)
+	if err != nil {
+		// entry is deleted.
+		return false, nil
+	}
+	if data != nil {
+		return bytes.Equal(data[entrySize:entrySize+idSize-1], id[:idSize-1]), nil
+	}
+
+	// Test filter block for the message id presence.
+	if !db.filter.Test(seq) || blockIdx > db.blocks() {
+		return false, nil
+	}
+	bh := blockHandle{file: db.index, offset: blockOffset(blockIdx)}
+	if err := bh.read(); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	for i := 0; i < entriesPerIndexBlock; i++ {
+		s := bh.entries[i]
+		if s.seq != seq {
+			continue
+		}
+		msgID, err := db.data.readID(s)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(msgID[:idSize-1], id[:idSize-1]) && msgID[idSize-1]&flagDeleted == 0, nil
+	}
+	return false, nil
+}
+
+// GetEntryMetadata returns metadata of the entry for the ID. It reads the index slot of the entry and the message ID
+// stored with the entry, and does not read the topic and the value. Expiry of synced entries is read from the time window.
+// It returns ErrMsgIDDoesNotExist if the sequence of the ID is reused by another entry.
+func (db *DB) GetEntryMetadata(id []byte) (*EntryMetadata, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(id) == 0:
+		return nil, errMsgIDEmpty
+	case len(id) < message.ID(id).Size():
+		return nil, ErrBadRequest
+	}
+	seq := message.ID(id).Sequence()
+	if seq == 0 {
+		return nil, ErrMsgIDDoesNotExist
+	}
+	blockIdx := startBlockIndex(seq)
+	memseq := db.cacheID ^ seq
+	data, err := db.mem.Get(uint64(blockIdx), memseq)
+	if err != nil {
+		return nil, errMsgIDDeleted
+	}
+	if data != nil {
+		if !bytes.Equal(data[entrySize:entrySize+idSize-1], id[:idSize-1]) {
+			return nil, ErrMsgIDDoesNotExist
+		}
+		var e entry
+		if err := e.UnmarshalBinary(data[:entrySize]); err != nil {
+			return nil, err
+		}
+		return &EntryMetadata{Seq: e.seq, TopicSize: e.topicSize, ValueSize: e.valueSize, ExpiresAt: e.expiresAt}, nil
+	}
+
+	s, ok, err := db.indexSlot(seq)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrMsgIDDoesNotExist
+	}
+	msgID, err := db.data.readID(s)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(msgID[:idSize-1], id[:idSize-1]) {
+		return nil, ErrMsgIDDoesNotExist
+	}
+	// expiry of entries synced to the DB files is only kept in the time window.
+	we, _, err := db.timeWindow.entryOf(seq)
+	if err != nil {
+		return nil, err
+	}
+	return &EntryMetadata{Seq: s.seq, TopicSize: s.topicSize, ValueSize: s.valueSize, ExpiresAt: we.expiryTime(), MsgOffset: s.msgOffset}, nil
+}
+
+// EntryCreatedAt returns the time the entry for the ID was written to the DB. The time is derived from the message ID.
+func (db *DB) EntryCreatedAt(id []byte) (time.Time, error) {
+	ok, err := db.HasEntry(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		return time.Time{}, ErrMsgIDDoesNotExist
+	}
+	return time.Unix(uid.Time(id), 0), nil
+}
+
+// Topics returns topics under the given prefix for the contract. The prefix supports '*' wildcard
+// to match any part of the topic and '...' to match all topics under the prefix. Topics are
+// reconstructed from the topic names stored in the DB, topics written without a name are skipped.
+func (db *DB) Topics(prefix []byte, contract uint32) ([][]byte, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if len(prefix) > db.opts.maxTopicSize {
+		return nil, ErrTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	tops := db.trie.subtree(parsePrefix(contract, db.normalizeTopic(prefix)))
+	names := make([][]byte, 0, len(tops))
+	for _, t := range tops {
+		if len(t.name) == 0 {
+			continue
+		}
+		names = append(names, append([]byte(nil), t.name...))
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return bytes.Compare(names[i], names[j]) < 0
+	})
+	return names, nil
+}
+
+// TopicSize is the storage size of a topic.
+type TopicSize struct {
+	Topic string
+	Bytes int64
+}
+
+// TopicsBySize returns topics of the contract sorted by storage size in descending order, limited to limit topics.
+// Size of a topic is the sum of message sizes of its entries read from the index blocks.
+func (db *DB) TopicsBySize(contract uint32, limit int) ([]TopicSize, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	var sizes []TopicSize
+	for _, t := range db.contractTopics(contract) {
+		ts := TopicSize{Topic: string(t.name)}
+		if err := db.scanTopic(t, func(_ winEntry, s slot, _, _ []byte) error {
+			ts.Bytes += int64(s.mSize())
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, ts)
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		return sizes[i].Bytes > sizes[j].Bytes
+	})
+	if limit > 0 && len(sizes) > limit {
+		sizes = sizes[:limit]
+	}
+	return sizes, nil
+}
+
+// TopicEntryCounts returns number of entries of each topic of the contract. Topics written without a name are skipped.
+// At most maxQueryLimit topics are counted in topic order, the counts are returned with ErrResultsTruncated if there are more topics.
+func (db *DB) TopicEntryCounts(contract uint32) (map[string]uint64, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	counts := make(map[string]uint64)
+	for _, t := range db.contractTopics(contract) {
+		if len(t.name) == 0 {
+			continue
+		}
+		if len(counts) == db.opts.maxQueryLimit {
+			return counts, ErrResultsTruncated
+		}
+		var count uint64
+		if err := db.scanTopic(t, func(winEntry, slot, []byte, []byte) error {
+			count++
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		counts[string(t.name)] = count
+	}
+	return counts, nil
+}
+
+// ScanContract calls fn on each entry of all topics of the contract. Topics are scanned in topic order
+// and entries of a topic in order of sequence, reading one window block of the topic at a time. The topic is nil for topics
+// written without a name. The scan stops and returns the error if fn returns an error or reading an entry fails.
+func (db *DB) ScanContract(contract uint32, fn func(topic, payload []byte) error) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	for _, t := range db.contractTopics(contract) {
+		err := db.scanTopic(t, func(_ winEntry, _ slot, id, val []byte) error {
+			if !message.ID(id).EvalPrefix(contract, 0) {
+				return nil
+			}
+			val, err := db.decodeValue(id, val)
+			if err != nil {
+				return err
+			}
+			return fn(t.name, val)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Items returns a new ItemIterator.
+func (db *DB) Items(q *Query) (*ItemIterator, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(q.Topic) == 0:
+		return nil, errTopicEmpty
+	case len(q.Topic) > db.opts.maxTopicSize:
+		return nil, ErrTopicTooLarge
+	}
+
+	q.opts = db.newQueryOptions()
+	if err := q.parse(); err != nil {
+		return nil, err
+	}
+
+	return &ItemIterator{db: db, query: q}, nil
+}
+
+// NewTopicIterator returns a new TopicIterator over all topics in the DB.
+func (db *DB) NewTopicIterator() (*TopicIterator, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	return &TopicIterator{db: db, topics: db.trie.all(), next: -1}, nil
+}
+
+// SeekIterator returns a new ItemIterator for the topic that iterates items with sequence
+// greater than or equal to seq in ascending order. It is used by consumers to resume
+// reading from the last processed sequence.
+func (db *DB) SeekIterator(topic []byte, seq uint64) (*ItemIterator, error) {
+	q := NewQuery(topic)
+	q.seek = true
+	q.fromSeq = seq
+	return db.Items(q)
+}
+
+// NewPrefixIterator returns a new ItemIterator over entries of all topics under the prefix for the contract.
+// The prefix supports '*' wildcard to match any part of the topic. Items are returned in ascending order of sequence.
+func (db *DB) NewPrefixIterator(prefix []byte, contract uint32) (*ItemIterator, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if len(prefix) > db.opts.maxTopicSize {
+		return nil, ErrTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	q := &Query{Topic: prefix, Contract: contract}
+	q.parts = parsePrefix(contract, db.normalizeTopic(prefix))
+	q.prefix = message.Prefix(q.parts)
+	it := &ItemIterator{db: db, query: q, topics: make(map[uint64][]byte)}
+
+	mu := db.getMutex(q.prefix)
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, t := range db.trie.subtree(q.parts) {
+		it.topics[t.hash] = t.name
+		wEntries, _ := db.timeWindow.lookup(t.hash, t.offset, 0, math.MaxInt32)
+		for _, we := range wEntries {
+			q.winEntries = append(q.winEntries, query{topicHash: t.hash, seq: we.seq(), expiresAt: we.expiryTime()})
+		}
+	}
+	sort.Slice(q.winEntries[:], func(i, j int) bool {
+		return q.winEntries[i].seq < q.winEntries[j].seq
+	})
+	q.Limit = len(q.winEntries)
+	return it, nil
+}
+
+// NewContract generates a new Contract.
+func (db *DB) NewContract() (uint32, error) {
+	raw := make([]byte, 4)
+	rand.Read(raw)
+
+	contract := uint32(binary.LittleEndian.Uint32(raw[:4]))
+	return contract, nil
+}
+
+// NewContractWithLabel generates a new Contract and persists the label to contract mapping.
+// It returns an error if the label already exists.
+func (db *DB) NewContractWithLabel(label string) (uint32, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	if label == "" {
+		return 0, ErrBadRequest
+	}
+	contract, err := db.NewContract()
+	if err != nil {
+		return 0, err
+	}
+	if err := db.contracts.add(label, contract); err != nil {
+		return 0, err
+	}
+	return contract, nil
+}
+
+// LookupContract returns the Contract for the label.
+func (db *DB) LookupContract(label string) (uint32, bool) {
+	return db.contracts.lookup(label)
+}
+
+// NewID generates new ID that is later used to put entry or delete entry.
+func (db *DB) NewID() []byte {
+	db.meter.Leases.Inc(1)
+	return message.NewID(db.nextSeq())
+}
+
+// Put puts entry into DB. It uses default Contract to put entry into DB.
+// It is safe to modify the contents of the argument after Put returns but not
+// before.
+func (db *DB) Put(topic, payload []byte) error {
+	return db.PutEntry(NewEntry(topic, payload))
+}
+
+// ValidateEntry validates the entry for the contract without writing it, as a put does. It checks sizes of the topic
+// and payload against the maximum sizes of the DB, and validates the entry with the normalized topic using Entry.Validate.
+// If contract is zero the contract of the entry is used.
+func (db *DB) ValidateEntry(e *Entry, contract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if err := e.validate(db.opts.maxTopicSize, db.opts.maxValueSize); err != nil {
+		return err
+	}
+	return NewEntry(db.normalizeTopic(e.Topic), e.Payload).WithContract(e.Contract).Validate(contract)
+}
+
+// PutEntry puts entry into the DB, if Contract is not specified then it uses master Contract.
+// It is safe to modify the contents of the argument after PutEntry returns but not
+// before.
+func (db *DB) PutEntry(e *Entry) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	// write hooks run before the tiny batch lock, so a slow hook does not block other writers.
+	if err := db.runWriteHooks(e); err != nil {
+		return err
+	}
+	if err := db.waitMem(); err != nil {
+		return err
+	}
+
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	return db.putEntry(e)
+}
+
+// RegisterWriteHook registers a hook that is called on each entry before it is written.
+// Hooks are called in the order they are registered and can modify the entry.
+// If a hook returns an error the entry is not written and the put returns the error.
+// Hooks are called before the write lock is taken, so a hook can write to the DB. Entries
+// copied by DuplicateEntry, MoveEntry and MoveTopic are not passed to the hooks again.
+func (db *DB) RegisterWriteHook(hook func(*Entry) error) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if hook == nil {
+		return fmt.Errorf("db.RegisterWriteHook: hook is nil: %w", ErrBadRequest)
+	}
+	db.writeHooksMu.Lock()
+	defer db.writeHooksMu.Unlock()
+	db.writeHooks = append(db.writeHooks, hook)
+	return nil
+}
+
+// RegisterReadHook registers a hook that is called on each entry after it is read by Get or an ItemIterator.
+// Hooks are called in the order they are registered on the decoded payload and can modify it.
+// If a hook returns ErrSkipEntry the entry is excluded from the result, other errors are returned to the caller.
+func (db *DB) RegisterReadHook(hook func(*Entry) error) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if hook == nil {
+		return fmt.Errorf("db.RegisterReadHook: hook is nil: %w", ErrBadRequest)
+	}
+	db.readHooksMu.Lock()
+	defer db.readHooksMu.Unlock()
+	db.readHooks = append(db.readHooks, hook)
+	return nil
+}
+
+// HookAfterSync registers a hook that is called with the sequences of the entries committed to the DB
+// each time a write ahead log is applied by sync. Hooks are called synchronously during sync so they
+// should be kept short, expensive work should be done in a goroutine started by the hook.
+func (db *DB) HookAfterSync(hook func(seqs []uint64)) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if hook == nil {
+		return fmt.Errorf("db.HookAfterSync: hook is nil: %w", ErrBadRequest)
+	}
+	db.syncHooksMu.Lock()
+	defer db.syncHooksMu.Unlock()
+	db.syncHooks = append(db.syncHooks, hook)
+	return nil
+}
+
+// CommitHook registers a hook that is called with the sequences of the entries committed to the write ahead log,
+// before they are synced to the DB. Hooks are advisory, if a hook returns an error it is logged and the commit
+// does not fail.
+func (db *DB) CommitHook(hook func(seqs []uint64) error) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if hook == nil {
+		return fmt.Errorf("db.CommitHook: hook is nil: %w", ErrBadRequest)
+	}
+	db.commitHooksMu.Lock()
+	defer db.commitHooksMu.Unlock()
+	db.commitHooks = append(db.commitHooks, hook)
+	return nil
+}
+
+// TopicSubscribeOnce returns a channel that receives the next entry put to the topic of the contract
+// using Put or PutEntry, for example to wait for a reply. The entry is received once it is committed.
+// The subscription is released and the channel is closed after it receives an entry or when the DB is closed.
+// Only static topics can be subscribed.
+func (db *DB) TopicSubscribeOnce(topic []byte, contract uint32) (<-chan *Entry, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(topic) == 0:
+		return nil, errTopicEmpty
+	case len(topic) > db.opts.maxTopicSize:
+		return nil, ErrTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	t, _, err := db.parseTopic(contract, topic)
+	if err != nil {
+		return nil, err
+	}
+	if t.TopicType != message.TopicStatic {
+		return nil, fmt.Errorf("db.TopicSubscribeOnce: topic is not static: %w", ErrBadRequest)
+	}
+	t.AddContract(contract)
+	w := db.watchers.add(t.GetHash(contract), true)
+	return w.ch, nil
+}
+
+// AcquireEntry returns an empty entry from the entry pool. The entry can be reused
+// for consecutive puts of the same topic, it must not be modified until PutEntry returns.
+// Call ReleaseEntry to return the entry to the pool.
+func (db *DB) AcquireEntry() *Entry {
+	if v := entryPool.Get(); v != nil {
+		return v.(*Entry)
+	}
+	return new(Entry)
+}
+
+// ReleaseEntry returns the entry to the entry pool. The entry must not be used after it is released.
+func (db *DB) ReleaseEntry(e *Entry) {
+	if e == nil {
+		return
+	}
+	*e = Entry{}
+	entryPool.Put(e)
+}
+
+// PutWithTimestamp puts entry into the DB with message ID time set to the given timestamp.
+// It is used to ingest historical entries so time based queries return them for their original time.
+func (db *DB) PutWithTimestamp(e *Entry, ts time.Time) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if ts.Unix() < uid.Offset {
+		return fmt.Errorf("db.PutWithTimestamp: timestamp before %v: %w", time.Unix(uid.Offset, 0), ErrBadRequest)
+	}
+	// the entry is copied so the caller's entry keeps its ID.
+	te := *e
+	if err := db.runWriteHooks(&te); err != nil {
+		return err
+	}
+	if err := db.waitMem(); err != nil {
+		return err
+	}
+
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	te.ID = message.NewIDAt(db.nextSeq(), ts)
+	return db.putEntry(&te)
+}
+
+// PutEntryAtSeq puts entry into the DB with the given sequence instead of a DB assigned one,
+// for example to replay entries of an upstream DB so that message IDs and cursors match the source.
+// If the entry has an ID its sequence must be seq. The DB sequence is moved past seq so new entries
+// do not reuse it. An error is returned if an entry with the sequence exists.
+// Sequences below the DB sequence are not reused while a snapshot or a subscriber is open.
+func (db *DB) PutEntryAtSeq(seq uint64, e *Entry) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if seq == 0 || (e.ID != nil && (len(e.ID) != message.ID(e.ID).Size() || message.ID(e.ID).Sequence() != seq)) {
+		return fmt.Errorf("db.PutEntryAtSeq: seq %d: %w", seq, ErrBadRequest)
+	}
+	if err := db.runWriteHooks(e); err != nil {
+		return err
+	}
+	if err := db.waitMem(); err != nil {
+		return err
+	}
+
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	// free sequences are not reused while a snapshot or a subscriber is open.
+	if seq <= db.seq() && !db.reuseSeqs() {
+		return errWriteConflict
+	}
+	ok, err := db.hasSeq(seq)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return errSeqExists
+	}
+	// Move the sequence past the entry so new entries do not reuse it.
+	for {
+		cur := db.seq()
+		if seq <= cur || atomic.CompareAndSwapUint64(&db.sequence, cur, seq) {
+			break
+		}
+	}
+	db.freeList.takeSlot(seq)
+	if e.ID == nil {
+		e.ID = message.NewID(seq)
+	}
+	return db.putEntry(e)
+}
+
+// AtomicSwapEntry replaces entry of the old ID with the new entry and returns ID of the new entry.
+// The new entry and the delete of the old entry are committed to the write ahead log together, so after
+// a crash recovery applies both or neither. It returns once the swap is committed to the log.
+func (db *DB) AtomicSwapEntry(oldID []byte, e *Entry) ([]byte, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case db.opts.immutable:
+		return nil, errImmutable
+	case len(oldID) == 0:
+		return nil, errMsgIDEmpty
+	case len(oldID) < message.ID(oldID).Size():
+		return nil, ErrBadRequest
+	}
+	oldSeq := message.ID(oldID).Sequence()
+	if err := db.runWriteHooks(e); err != nil {
+		return nil, err
+	}
+
+	// Sync writes index and window blocks of the deleted entry, so it is blocked during the swap.
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	rec, err := db.deleteRecord(oldID)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Contract == 0 {
+		e.Contract = message.MasterContract
+	}
+	if len(e.ID) == 0 {
+		e.ID = message.NewID(db.nextSeq())
+	}
+	newID := message.ID(e.ID)
+	newID.SetContract(e.Contract)
+	if err := db.putEntry(e); err != nil {
+		return nil, err
+	}
+
+	// The new entry and the delete record of the old entry are committed to the log in one tiny batch,
+	// so recovery after a crash applies both or neither.
+	if err := db.commitDeletes([]uint64{oldSeq}, [][]byte{rec}); err != nil {
+		return nil, err
+	}
+
+	return newID, nil
+}
+
+// UpdateEntry updates payload of the entry keeping its sequence and position in the time window.
+// You must provide an ID to update an entry. The entry keeps its encryption and expiry. It returns
+// ErrMsgIDDoesNotExist if the sequence of the ID is reused by another entry.
+func (db *DB) UpdateEntry(e *Entry) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case len(e.ID) == 0:
+		return errMsgIDEmpty
+	case len(e.ID) < message.ID(e.ID).Size():
+		return ErrBadRequest
+	case len(e.Payload) == 0:
+		return errValueEmpty
+	case len(e.Payload) > db.opts.maxValueSize:
+		return ErrValueTooLarge
+	}
+
+	// Sync moves entries from memdb to DB files so it is blocked during the update.
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	return db.update(e.ID, e.Payload)
+}
+
+// ExtendExpiry extends expiry of the entry for the ID by the duration.
+// It returns an error if the entry has no expiry or the entry has expired.
+func (db *DB) ExtendExpiry(id []byte, d time.Duration) error {
+	return db.setExpiry(id, func(expiresAt uint32) (uint32, error) {
+		if expiresAt == 0 {
+			return 0, ErrEntryHasNoExpiry
+		}
+		return uint32(time.Unix(int64(expiresAt), 0).Add(d).Unix()), nil
+	})
+}
+
+// SetExpiry sets expiry of the entry for the ID to the time.
+// It returns an error if the entry has no expiry or the entry has expired.
+func (db *DB) SetExpiry(id []byte, t time.Time) error {
+	return db.setExpiry(id, func(expiresAt uint32) (uint32, error) {
+		if expiresAt == 0 {
+			return 0, ErrEntryHasNoExpiry
+		}
+		return uint32(t.Unix()), nil
+	})
+}
+
+// ClearExpiry clears expiry of the entry for the ID so the entry does not expire.
+// It returns an error if the entry is already permanent or the entry has expired.
+func (db *DB) ClearExpiry(id []byte) error {
+	return db.setExpiry(id, func(expiresAt uint32) (uint32, error) {
+		if expiresAt == 0 {
+			return 0, ErrEntryAlreadyPermanent
+		}
+		return 0, nil
+	})
+}
+
+// DuplicateEntry copies the entry of the source ID to the new topic and contract and returns ID of the new entry.
+// The stored payload is copied as is with its encryption and compression, and the expiry of the source entry is kept.
+func (db *DB) DuplicateEntry(srcID, newTopic []byte, newContract uint32) ([]byte, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(srcID) == 0:
+		return nil, errMsgIDEmpty
+	case len(srcID) < message.ID(srcID).Size():
+		return nil, ErrBadRequest
+	}
+
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	return db.duplicateEntry(srcID, newTopic, newContract)
+}
+
+// MoveEntry moves the entry of the source ID to the new topic and contract.
+// The new entry and the delete of the source entry are committed to the log in one tiny batch,
+// so after a crash either the source entry or the new entry exists.
+func (db *DB) MoveEntry(srcID, newTopic []byte, newContract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case db.opts.immutable:
+		return errImmutable
+	case len(srcID) == 0:
+		return errMsgIDEmpty
+	case len(srcID) < message.ID(srcID).Size():
+		return ErrBadRequest
+	}
+
+	// Sync writes index and window blocks of the deleted entry, so it is blocked during the move.
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	return db.moveEntry(srcID, newTopic, newContract)
+}
+
+// MoveTopic moves all entries of the old topic of the contract to the new topic. The window blocks of the old topic
+// are linked to the new topic and the topic stored with the entries is rewritten, so entries keep their IDs, sequences
+// and expiry, and payloads are not read. If the new topic already has entries the entries of both topics are merged.
+// Entries are synced before the move. It returns errWriteConflict if entries of the old topic are written during the move.
+func (db *DB) MoveTopic(oldTopic, newTopic []byte, contract uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case db.opts.immutable:
+		return errImmutable
+	case len(oldTopic) == 0 || len(newTopic) == 0:
+		return errTopicEmpty
+	case len(oldTopic) > db.opts.maxTopicSize || len(newTopic) > db.opts.maxTopicSize:
+		return ErrTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	oldT, _, err := db.parseTopic(contract, oldTopic)
+	if err != nil {
+		return err
+	}
+	newT, _, err := db.parseTopic(contract, newTopic)
+	if err != nil {
+		return err
+	}
+	if oldT.TopicType != message.TopicStatic || newT.TopicType != message.TopicStatic {
+		return ErrBadRequest
+	}
+	oldT.AddContract(contract)
+	newT.AddContract(contract)
+	oldHash, newHash := oldT.GetHash(contract), newT.GetHash(contract)
+	if oldHash == newHash {
+		return nil
+	}
+	if _, ok := db.trie.getOffset(oldHash); !ok {
+		return nil
+	}
+
+	if err := db.FlushBatch(); err != nil {
+		return err
+	}
+	// Sync writes index and window blocks of the topic, so it is blocked during the move.
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	if err := db.syncLocked(); err != nil {
+		return err
+	}
+	if db.timeWindow.hasPending(oldHash) {
+		return fmt.Errorf("db.MoveTopic: entries of the topic are not synced: %w", errWriteConflict)
+	}
+	return db.moveTopic(oldT, newT, contract)
+}
+
+// duplicateEntry copies the entry of the source ID to the new topic and contract. The stored value is copied
+// with its flags and expiry, and write hooks are not run on the copy. The caller must hold the tiny batch lock.
+func (db *DB) duplicateEntry(srcID, newTopic []byte, newContract uint32) ([]byte, error) {
+	switch {
+	case len(newTopic) == 0:
+		return nil, errTopicEmpty
+	case len(newTopic) > db.opts.maxTopicSize:
+		return nil, ErrTopicTooLarge
+	}
+	srcSeq := message.ID(srcID).Sequence()
+	// topic hash is not used to read the index slot.
+	s, err := db.readEntry(0, srcSeq)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, errMsgIDDeleted) {
+			return nil, ErrMsgIDDoesNotExist
+		}
+		return nil, err
+	}
+	if s.seq != srcSeq {
+		return nil, ErrMsgIDDoesNotExist
+	}
+	id, val, err := db.data.readMessage(s)
+	if err != nil {
+		return nil, err
+	}
+	// the message ID keeps the contract, so an entry of another contract reusing the sequence does not match.
+	if !bytes.Equal(id[:idSize-1], srcID[:idSize-1]) {
+		return nil, ErrMsgIDDoesNotExist
+	}
+	// expiry of entries synced to the DB files is only kept in the time window.
+	we, ok, err := db.timeWindow.entryOf(srcSeq)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrMsgIDDoesNotExist
+	}
+	if newContract == 0 {
+		newContract = message.MasterContract
+	}
+	e := NewEntry(newTopic, nil).WithContract(newContract)
+	e.ExpiresAt = we.expiryTime()
+	e.value = append([]byte(nil), val...)
+	e.flags = id[idSize-1] &^ flagDeleted
+	e.ID = message.NewID(db.nextSeq())
+	newID := message.ID(e.ID)
+	newID.SetContract(newContract)
+	if err := db.setEntry(db.tinyBatch.timeID(), e); err != nil {
+		return nil, err
+	}
+	if err := db.writeEntry(e); err != nil {
+		return nil, err
+	}
+	e.reset()
+
+	return newID, nil
+}
+
+// moveEntry copies the entry of the source ID to the new topic and contract and commits the copy with a delete
+// record of the source entry in one tiny batch, so recovery applies both or neither. The caller must hold the sync lock
+// and the tiny batch lock.
+func (db *DB) moveEntry(srcID, newTopic []byte, newContract uint32) error {
+	srcSeq := message.ID(srcID).Sequence()
+	rec, err := db.deleteRecord(srcID)
+	if err != nil {
+		return err
+	}
+	if _, err := db.duplicateEntry(srcID, newTopic, newContract); err != nil {
+		return err
+	}
+	return db.commitDeletes([]uint64{srcSeq}, [][]byte{rec})
+}
+
+// putEntry puts entry into the DB. The caller must hold the tiny batch lock and run the write hooks
+// before taking the lock.
+func (db *DB) putEntry(e *Entry) (err error) {
+	if err := e.validate(db.opts.maxTopicSize, db.opts.maxValueSize); err != nil {
+		return err
+	}
+	if err := db.checkExternalID(e); err != nil {
+		return err
+	}
+
+	var dedupKey string
+	if len(e.DedupKey) != 0 {
+		dedupKey = dedupKeyOf(e)
+		if db.dedup.seen(dedupKey) {
+			return nil
+		}
+		defer func() {
+			if err != nil {
+				db.dedup.forget(dedupKey)
+			}
+		}()
+	}
+
+	if err := db.setEntry(db.tinyBatch.timeID(), e); err != nil {
+		return err
+	}
+	if err := db.setExternalID(db.tinyBatch, e); err != nil {
+		return err
+	}
+	if err := db.writeEntry(e); err != nil {
+		return err
+	}
+	if dedupKey != "" {
+		db.tinyBatch.dedupKeys = append(db.tinyBatch.dedupKeys, dedupKey)
+	}
+	db.fanout(e)
+	// reset message entry.
+	e.reset()
+	return nil
+}
+
+// writeEntry adds the packed entry to memdb, time window and the tiny batch. The caller must hold the tiny batch lock.
+func (db *DB) writeEntry(e *Entry) error {
+	if e.topicSize != 0 {
+		t := new(message.Topic)
+		rawTopic := e.cache[entrySize+idSize : entrySize+idSize+e.topicSize]
+		t.Unmarshal(rawTopic)
+		db.trie.add(newTopic(e.topicHash, 0, t.Topic), t.Parts, t.Depth)
+	}
+
+	blockID := startBlockIndex(e.seq)
+	memseq := db.cacheID ^ e.seq
+	if err := db.mem.Set(uint64(blockID), memseq, e.cache); err != nil {
+		return err
+	}
+
+	we := newWinEntry(e.seq, e.expiresAt)
+	we.timestamp = uid.Time(e.cache[entrySize : entrySize+4])
+	if ok := db.timeWindow.add(db.tinyBatch.timeID(), e.topicHash, we); !ok {
+		return errForbidden
+	}
+
+	db.tinyBatch.entries = append(db.tinyBatch.entries, e.seq)
+	db.tinyBatch.incount()
+	return nil
+}
+
+// Delete sets entry for deletion.
+// It is safe to modify the contents of the argument after Delete returns but not
+// before.
+func (db *DB) Delete(id, topic []byte) error {
+	return db.DeleteEntry(NewEntry(topic, nil).WithID(id))
+}
+
+// DeleteEntry deletes an entry from DB. you must provide an ID to delete an entry.
+// It is safe to modify the contents of the argument after Delete returns but
+// not before.
+func (db *DB) DeleteEntry(e *Entry) error {
+	switch {
+	case db.opts.immutable:
+		return errImmutable
+	case len(e.ID) == 0:
+		return errMsgIDEmpty
+	case len(e.Topic) == 0:
+		return errTopicEmpty
+	case len(e.Topic) > db.opts.maxTopicSize:
+		return ErrTopicTooLarge
+	}
+	id := message.ID(e.ID)
+	if e.Contract == 0 {
+		e.Contract = message.MasterContract
+	}
+	topic, _, err := db.parseTopic(e.Contract, e.Topic)
+	if err != nil {
+		return err
+	}
+	topic.AddContract(e.Contract)
+
+	if err := db.delete(topic.GetHash(e.Contract), message.ID(id).Sequence()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteBySeq deletes an entry from DB using its sequence. It is used to delete an entry
+// without knowing its topic. It returns an error if the sequence does not exist in the DB.
+func (db *DB) DeleteBySeq(seq uint64) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case db.opts.immutable:
+		return errImmutable
+	case seq == 0:
+		return errMsgIDEmpty
+	}
+	// topic hash is not used to read the index slot.
+	s, err := db.readEntry(0, seq)
+	if err != nil {
+		if err == io.EOF {
+			return ErrMsgIDDoesNotExist
+		}
+		return err
+	}
+	if s.seq != seq {
+		return ErrMsgIDDoesNotExist
+	}
+
+	return db.delete(0, seq)
+}
+
+// GrowIndex pre-allocates index blocks in a single file extend. Syncs use the pre-allocated
+// blocks before extending the index file again, it is used before bulk writes.
+func (db *DB) GrowIndex(extraBlocks uint32) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if extraBlocks == 0 {
+		return nil
+	}
+	if extraBlocks > math.MaxUint32/blockSize {
+		return fmt.Errorf("db.GrowIndex: too many blocks %d: %w", extraBlocks, ErrBadRequest)
+	}
+
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+
+	if err := db.extendBlocks(int32(extraBlocks)); err != nil {
+		return err
+	}
+	return db.writeHeader()
+}
+
+// ShrinkIndex truncates trailing index blocks that have no entries, such as
+// blocks left empty after heavy deletions.
+func (db *DB) ShrinkIndex() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+
+	nBlocks := db.blocks()
+	lastUsed := nBlocks
+	for ; lastUsed >= 0; lastUsed-- {
+		b := blockHandle{file: db.index, offset: blockOffset(lastUsed)}
+		if err := b.read(); err != nil {
+			if err == io.EOF {
+				continue
+			}
+			return err
+		}
+		if b.entryIdx > 0 {
+			break
+		}
+	}
+	if lastUsed == nBlocks {
+		return nil
+	}
+	size := db.index.currSize()
+	if err := db.index.truncate(blockOffset(lastUsed + 1)); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&db.blockIdx, lastUsed)
+	if err := db.writeHeader(); err != nil {
+		return err
+	}
+	logger.Info().Str("context", "db.ShrinkIndex").Int32("blocks", nBlocks-lastUsed).Int64("reclaimed", size-db.index.currSize()).Msg("index shrunk")
+	return nil
+}
+
+// ScanOrphanedData returns offsets of data file regions that are neither used by an
+// index entry nor free, such as records left behind by a crash.
+func (db *DB) ScanOrphanedData() ([]int64, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+
+	orphans, err := db.orphanedData()
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]int64, 0, len(orphans))
+	for off := range orphans {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets, nil
+}
+
+// FreeOrphanedData adds orphaned data regions returned by ScanOrphanedData to the free blocks
+// so the space is reused. It fails if any offset is no longer orphaned.
+func (db *DB) FreeOrphanedData(offsets []int64) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if db.opts.immutable {
+		return errImmutable
+	}
+
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+
+	orphans, err := db.orphanedData()
+	if err != nil {
+		return err
+	}
+	for _, off := range offsets {
+		if _, ok := orphans[off]; !ok {
+			return fmt.Errorf("db.FreeOrphanedData: offset %d is not orphaned: %w", off, ErrBadRequest)
+		}
+	}
+	var freed int64
+	for _, off := range offsets {
+		db.data.lease.freeBlock(off, orphans[off])
+		freed += int64(orphans[off])
+	}
+	logger.Info().Str("context", "db.FreeOrphanedData").Int("regions", len(offsets)).Int64("freed", freed).Msg("orphaned data freed")
+	return nil
+}
+
+// RecoverySkipped returns sequences of the entries skipped by log recovery in RecoveryBestEffort mode.
+func (db *DB) RecoverySkipped() []uint64 {
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	skipped := make([]uint64, len(db.recoverySkipped))
+	copy(skipped, db.recoverySkipped)
+	return skipped
+}
+
+// Sync syncs entries into DB. Sync happens synchronously.
+// Sync write window entries into summary file and write index, and data to respective index and data files.
 // In case of any error during sync operation recovery is performed on log file (write ahead log).
 func (db *DB) Sync() error {
 	// start := time.Now()
@@ -546,6 +2100,11 @@ func (db *DB) Sync() error {
 		<-db.syncLockC
 	}()
 
+	return db.syncLocked()
+}
+
+// syncLocked syncs entries into DB. The caller must hold the sync lock.
+func (db *DB) syncLocked() error {
 	if ok := db.syncHandle.startSync(); !ok {
 		return nil
 	}
@@ -555,6 +2114,145 @@ func (db *DB) Sync() error {
 	return db.syncHandle.Sync()
 }
 
+// PauseSync stops background syncing, for example during a bulk load.
+// Entries are kept in the write ahead log until sync is resumed or Sync is called.
+// Puts do not wait for memdb space while sync is paused, so memdb grows beyond its size.
+func (db *DB) PauseSync() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.syncMu.Lock()
+	defer db.syncMu.Unlock()
+	if !atomic.CompareAndSwapUint32(&db.syncPaused, 0, 1) {
+		return nil
+	}
+	close(db.syncStopC)
+	return nil
+}
+
+// ResumeSync restarts background syncing paused by PauseSync. If interval is zero
+// the sync interval the DB was opened with is used.
+func (db *DB) ResumeSync(interval time.Duration) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.syncMu.Lock()
+	defer db.syncMu.Unlock()
+	if !atomic.CompareAndSwapUint32(&db.syncPaused, 1, 0) {
+		return nil
+	}
+	if interval <= 0 {
+		interval = db.opts.syncDurationType * time.Duration(db.opts.maxSyncDurations)
+	}
+	db.startSyncer(interval)
+	return nil
+}
+
+// IsSyncPaused returns true if background syncing is paused.
+func (db *DB) IsSyncPaused() bool {
+	return atomic.LoadUint32(&db.syncPaused) == 1
+}
+
+// PauseBackgroundExpiry skips background expiry of entries until ResumeBackgroundExpiry is called,
+// for example so that entries are not deleted during a backup. It waits for a background expiry
+// run in progress to finish, so no entries are expired in background after it returns.
+func (db *DB) PauseBackgroundExpiry() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.expiryMu.Lock()
+	defer db.expiryMu.Unlock()
+	atomic.StoreUint32(&db.expiryPaused, 1)
+	return nil
+}
+
+// ResumeBackgroundExpiry resumes background expiry paused by PauseBackgroundExpiry.
+func (db *DB) ResumeBackgroundExpiry() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	atomic.StoreUint32(&db.expiryPaused, 0)
+	return nil
+}
+
+// CompactTimeWindow writes a new window file dropping window blocks that have all entries expired,
+// replaces the window file with it and updates offsets of the topics in the trie. Syncs and queries
+// of the topics are blocked during the compaction.
+func (db *DB) CompactTimeWindow() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+
+	topics := db.trie.all()
+	prefixes := make([]uint64, 0, len(topics))
+	for _, t := range topics {
+		if prefix, ok := db.trie.prefix(t.hash); ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	unlock := db.mutex.lockAll(prefixes)
+	defer unlock()
+
+	offsets, err := db.timeWindow.compact(db.opts.fileSystem, db.path+windowPostfix)
+	if err != nil {
+		return err
+	}
+	for _, t := range topics {
+		db.trie.setOffset(topic{hash: t.hash, offset: offsets[t.hash]})
+	}
+	if err := db.writeHeader(); err != nil {
+		return err
+	}
+	return db.index.Sync()
+}
+
+// ReEncrypt re-encrypts the encrypted entries in the DB with the new key. New entries are encrypted with
+// the new key once ReEncrypt is called, and the current key is kept to read entries not yet re-encrypted.
+// Entries are re-encrypted per topic in chunks under the sync lock and the topic mutex so the DB stays responsive.
+// Each entry is written to new space before its index entry is updated, so an entry is readable with either key
+// after a crash. Until ReEncrypt completes, Open fails unless all keys in use are given using WithEncryptionKeys.
+// Entries already encrypted with the new key are skipped, so an interrupted ReEncrypt is resumed by opening
+// the DB with the new key as primary key and calling ReEncrypt again.
+func (db *DB) ReEncrypt(newKey []byte) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	mac, err := crypto.New(newKey)
+	if err != nil {
+		return err
+	}
+	// Fingerprints of the keys in use are written before the encryption key is switched so Open can verify
+	// that all keys are given if the re-encryption is interrupted.
+	db.lockTinyBatch()
+	keys := append([][]byte{newKey, db.opts.encryptionKey}, db.opts.oldEncryptionKeys...)
+	if err := db.writeReEncryptState(keyFingerprints(keys...)); err != nil {
+		<-db.tinyBatchLockC
+		return err
+	}
+	db.oldMacs = append([]*crypto.MAC{db.mac}, db.oldMacs...)
+	db.mac = mac
+	db.opts.encryptionKey, db.opts.oldEncryptionKeys = newKey, keys[1:]
+	<-db.tinyBatchLockC
+
+	// Write pending entries into the DB files so all entries encrypted with old keys are re-encrypted.
+	if err := db.FlushBatch(); err != nil {
+		return err
+	}
+	if err := db.Sync(); err != nil {
+		return err
+	}
+	for _, t := range db.trie.all() {
+		if err := db.reEncryptTopic(t); err != nil {
+			return err
+		}
+	}
+	return db.opts.fileSystem.Remove(db.path + reEncryptPostfix)
+}
+
 // FileSize returns the total size of the disk storage used by the DB.
 func (db *DB) FileSize() (int64, error) {
 	var err error
@@ -573,3 +2271,63 @@ func (db *DB) FileSize() (int64, error) {
 func (db *DB) Count() uint64 {
 	return atomic.LoadUint64(&db.count)
 }
+
+// SnapshotTimeWindow returns snapshot of time window entries not yet synced to the window file,
+// and of the external IDs of the entries. It runs under sync lock so the snapshot is consistent
+// with the window file.
+func (db *DB) SnapshotTimeWindow() ([]byte, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	window, err := db.timeWindow.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	xids := db.externalIDs.snapshot(db.timeWindow.pendingSeqs())
+	data := make([]byte, 4, 4+len(window)+len(xids))
+	binary.LittleEndian.PutUint32(data, uint32(len(window)))
+	data = append(data, window...)
+	return append(data, xids...), nil
+}
+
+// RestoreTimeWindow restores time window entries and external IDs of the entries from the snapshot
+// returned by SnapshotTimeWindow.
+func (db *DB) RestoreTimeWindow(data []byte) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if len(data) < 4 || uint64(len(data)-4) < uint64(binary.LittleEndian.Uint32(data)) {
+		return fmt.Errorf("db.RestoreTimeWindow: invalid snapshot size %d: %w", len(data), ErrBadRequest)
+	}
+	size := 4 + int(binary.LittleEndian.Uint32(data))
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	if err := db.timeWindow.Restore(data[4:size]); err != nil {
+		return err
+	}
+	return db.externalIDs.restore(data[size:])
+}
+
+// FreeBlockHistogram returns distribution of free blocks by size using power of 2 bins.
+// It is used to tune minimum free blocks size.
+func (db *DB) FreeBlockHistogram() ([]FreeBin, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	return db.freeList.histogram(32), nil
+}
+
+// CountEntries returns authoritative count of entries in the DB. It reads
+// every index block and sums the entries, so it is expensive on large DB.
+func (db *DB) CountEntries() (uint64, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+	return db.countEntries()
+}
@@ -18,15 +18,25 @@ package unitdb
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math"
+	"os"
 	"sort"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/golang/snappy"
+	"github.com/unit-io/unitdb/crypto"
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/hash"
 	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
 )
 
 const (
@@ -40,10 +50,18 @@ const (
 	windowPostfix        = ".win"
 	logPostfix           = ".log"
 	leasePostfix         = ".lease"
+	checkpointPostfix    = ".checkpoint"
 	lockPostfix          = ".lock"
-	idSize               = 9 // message ID prefix with additional encryption bit.
+	idSize               = 9 // message ID prefix with additional flags byte.
 	filterPostfix        = ".filter"
-	version              = 1 // file format version.
+	metaPostfix          = ".meta"
+	externalIDPostfix    = ".xid"
+	memPostfix           = ".mem"
+	subscriberPostfix    = ".subscriber_state"
+	reEncryptPostfix     = ".reencrypt"
+	compactPostfix       = ".compact"
+	shardPostfix         = ".shards"
+	version              = 2 // file format version, version 2 adds header flags and value flags to the message ID.
 
 	// maxExpDur expired keys are deleted from DB after durType*maxExpDur.
 	// For example if durType is Minute and maxExpDur then
@@ -63,6 +81,18 @@ const (
 	maxSeq = math.MaxUint64
 )
 
+// flags stored in the last byte of the message ID prefix.
+const (
+	flagEncrypted    uint8 = 1 << iota // value is encrypted.
+	flagUncompressed                   // value is stored without snappy compression.
+	flagDeleted                        // entry is deleted, a log record with the flag deletes the entry of its sequence.
+	flagUpdated                        // a log record with the flag replaces the payload of the entry of its sequence.
+	flagExternalID                     // a log record with the flag maps the external ID in its value to the entry of its sequence.
+
+	// logRecordFlags are flags of the log records applied after the entries of the log.
+	logRecordFlags = flagDeleted | flagUpdated | flagExternalID
+)
+
 type dbInfo struct {
 	encryption int8
 	sequence   uint64
@@ -70,10 +100,14 @@ type dbInfo struct {
 	blockIdx   int32
 	windowIdx  int32
 	cacheID    uint64
+	noFilter   int8
+	normalized int8  // normalized is set if the DB is created with a topic normalizer.
+	dataSize   int64 // dataSize is the logical size of the data file if the data file is preallocated.
 }
 
-func (db *DB) writeHeader() error {
-	h := header{
+// newHeader returns the header with the current DB info.
+func (db *DB) newHeader() header {
+	return header{
 		signature: signature,
 		version:   version,
 		dbInfo: dbInfo{
@@ -83,19 +117,87 @@ func (db *DB) writeHeader() error {
 			blockIdx:   db.blocks(),
 			windowIdx:  db.timeWindow.windowIndex(),
 			cacheID:    db.cacheID,
+			noFilter:   db.noFilter,
+			normalized: db.normalized,
+			dataSize:   db.dataSize(),
 		},
 	}
-	return db.index.writeMarshalableAt(h, 0)
+}
+
+// dataSize returns the logical size of the data file to write to the header if the data file is preallocated.
+func (db *DB) dataSize() int64 {
+	if db.data.preallocSize == 0 {
+		return 0
+	}
+	return db.data.offset
+}
+
+// writeDataSize writes the logical size of the data file to the header before index blocks refer to the data
+// appended past the previous size. Open truncates the data file to the size, so the preallocated tail left by a
+// crash is not kept as data.
+func (db *DB) writeDataSize() error {
+	if db.data.preallocSize == 0 {
+		return nil
+	}
+	if err := db.writeHeader(); err != nil {
+		return err
+	}
+	return db.index.Sync()
+}
+
+func (db *DB) writeHeader() error {
+	return db.index.writeMarshalableAt(db.newHeader(), 0)
+}
+
+// createLockFile creates lock file. If the lock file is held by another process it retries
+// with backoff until the lock is released or the timeout elapses. The file lock is released by
+// the OS when the owning process exits, so a lock file left by a crashed process is reclaimed
+// and its owner is logged. A lock file that is locked is never removed, as the owner may be
+// alive in another PID namespace.
+func createLockFile(fsys fs.FileSystem, name string, timeout time.Duration) (fs.LockFile, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := 10 * time.Millisecond
+	for {
+		// owner of a lock file left by a crashed process, the content is replaced once the lock is taken.
+		owner, ownerErr := fs.ReadLockOwner(fsys, name)
+		lock, err := fsys.CreateLockFile(name)
+		if err != os.ErrExist {
+			if err == nil && ownerErr == nil && owner.PID != os.Getpid() {
+				logger.Warn().Str("context", "db.createLockFile").Msgf("reclaimed lock of process %d started at %s, DB will be recovered", owner.PID, owner.Start)
+			}
+			return lock, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		time.Sleep(backoff)
+		if backoff < time.Second {
+			backoff *= 2
+		}
+	}
 }
 
 func (db *DB) readHeader() error {
 	h := &header{}
 	if err := db.index.readUnmarshalableAt(h, headerSize, 0); err != nil {
 		logger.Error().Err(err).Str("context", "db.readHeader")
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("db.readHeader: header is truncated: %w", ErrCorrupted)
+		}
 		return err
 	}
 	if !bytes.Equal(h.signature[:], signature[:]) {
-		return errCorrupted
+		return fmt.Errorf("db.readHeader: invalid signature %q, expected %q: %w", h.signature[:], signature[:], ErrCorrupted)
+	}
+	if h.version != version {
+		return fmt.Errorf("db.readHeader: version %d, expected %d: %w", h.version, version, ErrVersionMismatch)
+	}
+	if h.normalized == 1 && db.opts.topicNormalizer == nil {
+		return fmt.Errorf("db.readHeader: DB is created with a topic normalizer, open it using WithTopicNormalizer: %w", ErrBadRequest)
 	}
 	db.dbInfo = h.dbInfo
 	db.timeWindow.setWindowIndex(db.dbInfo.windowIdx)
@@ -140,7 +242,7 @@ func (db *DB) loadTrie() error {
 		if err != nil {
 			return true, err
 		}
-		if ok := db.trie.add(newTopic(topicHash, off), t.Parts, t.Depth); !ok {
+		if ok := db.trie.add(newTopic(topicHash, off, t.Topic), t.Parts, t.Depth); !ok {
 			logger.Info().Str("context", "db.loadTrie: topic exist in the trie")
 			return false, nil
 		}
@@ -152,7 +254,7 @@ func (db *DB) loadTrie() error {
 // Close closes the DB.
 func (db *DB) close() error {
 	if !db.setClosed() {
-		return errClosed
+		return ErrClosed
 	}
 
 	// Signal all goroutines.
@@ -165,10 +267,28 @@ func (db *DB) close() error {
 
 	// Wait for all goroutines to exit.
 	db.closeW.Wait()
+	db.watchers.close()
 	return nil
 }
 
 func (db *DB) readEntry(topicHash uint64, seq uint64) (slot, error) {
+	// entries deleted while snapshots are open are kept for the snapshots until the last snapshot is closed.
+	if db.snapshotChanges.deleted(seq) {
+		return slot{}, errMsgIDDeleted
+	}
+	return db.readSlot(topicHash, seq)
+}
+
+// readQueryEntry reads the entry of the query. A snapshot query reads entries deleted after the snapshot is taken.
+func (db *DB) readQueryEntry(q *Query, topicHash uint64, seq uint64) (slot, error) {
+	if q.snapshot != nil && db.snapshotChanges.deletedAfter(seq, q.snapshot.gen) {
+		return db.readSlot(topicHash, seq)
+	}
+	return db.readEntry(topicHash, seq)
+}
+
+// readSlot reads the entry of the sequence from memdb or the index block.
+func (db *DB) readSlot(topicHash uint64, seq uint64) (slot, error) {
 	blockID := startBlockIndex(seq)
 	memseq := db.cacheID ^ seq
 	data, err := db.mem.Get(uint64(blockID), memseq)
@@ -184,11 +304,19 @@ func (db *DB) readEntry(topicHash uint64, seq uint64) (slot, error) {
 			valueSize: e.valueSize,
 
 			cacheBlock: data[entrySize:],
+			expiresAt:  e.expiresAt,
+		}
+		if s.topicSize != 0 && data[entrySize+idSize-1]&flagDeleted != 0 {
+			return slot{}, errMsgIDDeleted
 		}
 		return s, nil
 	}
 
-	off := blockOffset(startBlockIndex(seq))
+	// Test filter block for the message id presence.
+	if !db.filter.Test(seq) || blockID > db.blocks() {
+		return slot{}, ErrMsgIDDoesNotExist
+	}
+	off := blockOffset(blockID)
 	bh := blockHandle{file: db.index, offset: off}
 	if err := bh.read(); err != nil {
 		return slot{}, err
@@ -196,265 +324,1487 @@ func (db *DB) readEntry(topicHash uint64, seq uint64) (slot, error) {
 
 	for i := 0; i < entriesPerIndexBlock; i++ {
 		s := bh.entries[i]
-		if s.seq == seq {
-			return s, nil
+		if s.seq != seq {
+			continue
+		}
+		if s.topicSize != 0 {
+			flags, err := db.data.flags(s)
+			if err != nil {
+				return slot{}, err
+			}
+			if flags&flagDeleted != 0 {
+				return slot{}, errMsgIDDeleted
+			}
 		}
+		return s, nil
 	}
 	return slot{}, nil
 }
 
-// lookups are performed in following order
-// ilookup lookups in memory entries from timeWindow
-// lookup lookups persisted entries from timeWindow file.
-func (db *DB) lookup(q *Query) error {
-	topics := db.trie.lookup(q.parts, q.depth, q.topicType)
-	sort.Slice(topics[:], func(i, j int) bool {
-		return topics[i].offset > topics[j].offset
-	})
-	for _, topic := range topics {
-		if len(q.winEntries) > q.Limit {
-			break
-		}
-		limit := q.Limit - len(q.winEntries)
-		wEntries := db.timeWindow.lookup(topic.hash, topic.offset, q.cutoff, limit)
-		for _, we := range wEntries {
-			q.winEntries = append(q.winEntries, query{topicHash: topic.hash, seq: we.seq()})
+// decrypt decrypts the value using the encryption key, and old encryption keys if the value
+// was encrypted before the encryption key was rotated.
+func (db *DB) decrypt(val []byte) ([]byte, error) {
+	dst, err := db.mac.Decrypt(nil, val)
+	if err == nil {
+		return dst, nil
+	}
+	for _, mac := range db.oldMacs {
+		if dst, err := mac.Decrypt(nil, val); err == nil {
+			return dst, nil
 		}
 	}
-	// sort.Slice(q.winEntries[:], func(i, j int) bool {
-	// 	return q.winEntries[i].seq > q.winEntries[j].seq
-	// })
-	return nil
+	return nil, err
 }
 
-// newBlock adds new block to DB and it returns block offset.
-func (db *DB) newBlock() (int64, error) {
-	off, err := db.index.extend(blockSize)
-	db.addBlocks(1)
-	return off, err
+// encodeValue compresses the payload if it is not smaller than the compression threshold, and encrypts it if encrypt is set.
+// It returns the value and the flags to store in the message ID.
+func (db *DB) encodeValue(payload []byte, encrypt bool) ([]byte, uint8) {
+	var flags uint8
+	val := payload
+	// encryption needs the value to have at least the epoch size.
+	if len(payload) < db.opts.compressionThreshold && (!encrypt || len(payload) >= crypto.EpochSize) {
+		flags |= flagUncompressed
+	} else {
+		val = snappy.Encode(nil, payload)
+	}
+	if encrypt {
+		flags |= flagEncrypted
+		val = db.mac.Encrypt(nil, val)
+	}
+	return val, flags
 }
 
-// extendBlocks adds blocks to DB.
-func (db *DB) extendBlocks(nBlocks int32) error {
-	if _, err := db.index.extend(uint32(nBlocks) * blockSize); err != nil {
-		return err
+// decodeValue decrypts and decompresses the value using the flags stored in the message ID.
+func (db *DB) decodeValue(id, val []byte) ([]byte, error) {
+	flags := id[idSize-1]
+	if flags&flagEncrypted != 0 {
+		var err error
+		if val, err = db.decrypt(val); err != nil {
+			return nil, err
+		}
+	} else if flags&flagUncompressed != 0 {
+		// value is copied as it is read from memdb or the data file.
+		return append([]byte(nil), val...), nil
 	}
-	db.addBlocks(nBlocks)
-	return nil
+	if flags&flagUncompressed != 0 {
+		return val, nil
+	}
+	return snappy.Decode(nil, val)
 }
 
-func (db *DB) parseTopic(contract uint32, topic []byte) (*message.Topic, uint32, error) {
-	t := new(message.Topic)
-
-	//Parse the Key.
-	t.ParseKey(topic)
-	// Parse the topic.
-	t.Parse(contract, true)
-	if t.TopicType == message.TopicInvalid {
-		return nil, 0, errBadRequest
+// reEncryptTopic re-encrypts entries of the topic that are not encrypted with the encryption key.
+// Entries are re-encrypted in chunks under the sync lock and the prefix mutex of the topic.
+func (db *DB) reEncryptTopic(t topicNode) error {
+	prefix, ok := db.trie.prefix(t.hash)
+	if !ok {
+		return nil
 	}
-	// In case of ttl, add ttl to the msg and store to the db.
-	if ttl, ok := t.TTL(); ok {
-		return t, ttl, nil
+	seqs, err := db.timeWindow.seqs(t.hash, t.offset, math.MaxInt32)
+	if err != nil {
+		return err
 	}
-	return t, 0, nil
+	mu := db.getMutex(prefix)
+	for len(seqs) > 0 {
+		n := len(seqs)
+		if n > entriesPerIndexBlock {
+			n = entriesPerIndexBlock
+		}
+		if err := db.reEncryptSeqs(mu, seqs[:n]); err != nil {
+			return err
+		}
+		seqs = seqs[n:]
+	}
+	return nil
 }
 
-func (db *DB) setEntry(timeID int64, e *Entry) error {
-	var id message.ID
-	var eBit uint8
-	var seq uint64
-	var rawTopic []byte
-	if !e.parsed {
-		if e.Contract == 0 {
-			e.Contract = message.MasterContract
+// reEncryptSeqs re-encrypts entries of the sequences synced to the DB files. Each entry is rewritten using rewriteMessage
+// so it is either encrypted with the previous key or the encryption key after a crash.
+func (db *DB) reEncryptSeqs(mu *sync.RWMutex, seqs []uint64) error {
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	mu.Lock()
+	defer mu.Unlock()
+	for _, seq := range seqs {
+		bh, entryIdx, ok, err := db.indexEntry(seq)
+		if err != nil {
+			return err
 		}
-		t, ttl, err := db.parseTopic(e.Contract, e.Topic)
+		if !ok {
+			continue
+		}
+		s := bh.entries[entryIdx]
+		msg, err := db.data.Slice(s.msgOffset, s.msgOffset+int64(s.mSize()))
 		if err != nil {
 			return err
 		}
-		if e.ExpiresAt == 0 && ttl > 0 {
-			e.ExpiresAt = ttl
+		if msg[idSize-1]&flagEncrypted == 0 {
+			continue
 		}
-		t.AddContract(e.Contract)
-		e.topicHash = t.GetHash(e.Contract)
-		// topic is packed if it is new topic entry
-		if _, ok := db.trie.getOffset(e.topicHash); !ok {
-			rawTopic = t.Marshal()
-			e.topicSize = uint16(len(rawTopic))
+		hdr, val := msg[:idSize+int(s.topicSize)], msg[idSize+int(s.topicSize):]
+		// Decrypt appends to the value so it is copied before decrypt.
+		if _, err := db.mac.Decrypt(nil, append([]byte(nil), val...)); err == nil {
+			continue
 		}
-		e.parsed = true
-	}
-	if e.ID != nil {
-		id = message.ID(e.ID)
-		seq = id.Sequence()
-		db.freeList.addLease(timeID, seq)
-	} else {
-		if ok, s := db.freeList.getSlot(); ok {
-			db.meter.Leases.Inc(1)
-			seq = s
-		} else {
-			seq = db.nextSeq()
+		val, err = db.decrypt(append([]byte(nil), val...))
+		if err != nil {
+			return err
+		}
+		newMsg := append(append([]byte(nil), hdr...), db.mac.Encrypt(nil, val)...)
+		if err := db.rewriteMessage(&bh, entryIdx, newMsg); err != nil {
+			return err
 		}
-		id = message.NewID(seq)
 	}
-	if seq == 0 {
-		panic("db.setEntry: seq is zero")
+	return nil
+}
+
+// keyFingerprints returns fingerprints of the encryption keys.
+func keyFingerprints(keys ...[]byte) [][sha256.Size]byte {
+	fps := make([][sha256.Size]byte, 0, len(keys))
+	for _, key := range keys {
+		fps = append(fps, sha256.Sum256(key))
 	}
+	return fps
+}
 
-	id.SetContract(e.Contract)
-	e.seq = seq
-	e.expiresAt = e.ExpiresAt
-	val := snappy.Encode(nil, e.Payload)
-	if db.encryption == 1 || e.Encryption {
-		eBit = 1
-		val = db.mac.Encrypt(nil, val)
+// writeReEncryptState writes fingerprints of the encryption keys in use while the entries are re-encrypted.
+// The state file is removed once ReEncrypt completes.
+func (db *DB) writeReEncryptState(fps [][sha256.Size]byte) error {
+	f, err := newFile(db.opts.fileSystem, db.path+reEncryptPostfix)
+	if err != nil {
+		return err
 	}
-	e.valueSize = uint32(len(val))
-	mLen := entrySize + idSize + uint32(e.topicSize) + uint32(e.valueSize)
-	e.cache = make([]byte, mLen)
-	entryData, err := e.MarshalBinary()
+	defer f.Close()
+	var buf []byte
+	for _, fp := range fps {
+		buf = append(buf, fp[:]...)
+	}
+	if err := f.truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.write(buf); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// checkReEncryptState returns an error if ReEncrypt did not complete and a key in use when it was interrupted
+// is not one of the encryption keys, as entries not yet re-encrypted or already re-encrypted cannot be read without it.
+func (db *DB) checkReEncryptState() error {
+	path := db.path + reEncryptPostfix
+	if _, err := db.opts.fileSystem.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	f, err := newFile(db.opts.fileSystem, path)
 	if err != nil {
 		return err
 	}
-	copy(e.cache, entryData)
-	copy(e.cache[entrySize:], id.Prefix())
-	e.cache[entrySize+idSize-1] = byte(eBit)
-	// topic data is added on first entry for the topic.
-	if e.topicSize != 0 {
-		copy(e.cache[entrySize+idSize:], rawTopic)
+	defer f.Close()
+	buf := make([]byte, f.currSize())
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	keys := make(map[[sha256.Size]byte]bool)
+	for _, fp := range keyFingerprints(append([][]byte{db.opts.encryptionKey}, db.opts.oldEncryptionKeys...)...) {
+		keys[fp] = true
+	}
+	for ; len(buf) >= sha256.Size; buf = buf[sha256.Size:] {
+		var fp [sha256.Size]byte
+		copy(fp[:], buf)
+		if !keys[fp] {
+			return fmt.Errorf("db.Open: re-encryption is not complete, open the DB with the new key and the old keys: %w", ErrBadRequest)
+		}
 	}
-	copy(e.cache[entrySize+idSize+uint32(e.topicSize):], val)
 	return nil
 }
 
-// tinyWrite writes tiny batch to DB WAL.
-func (db *DB) tinyWrite(tinyBatch *tinyBatch) error {
-	// Backoff to limit excess memroy usage
-	db.mem.Backoff()
-
-	logWriter, err := db.wal.NewWriter()
+// update updates payload of the entry for the message ID. The caller must hold the sync lock and the tiny batch lock.
+// An entry not yet synced is updated in memdb and an update log record is written to the log of its timeID, so recovery
+// of the log does not undo the update. An entry synced to the DB files is rewritten using rewriteMessage.
+func (db *DB) update(msgID, payload []byte) error {
+	seq := message.ID(msgID).Sequence()
+	// topic hash is not used to read the index slot.
+	s, err := db.readEntry(0, seq)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, errMsgIDDeleted) {
+			return ErrMsgIDDoesNotExist
+		}
+		return err
+	}
+	if s.seq != seq {
+		return ErrMsgIDDoesNotExist
+	}
+	id, _, err := db.data.readMessage(s)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(id[:idSize-1], msgID[:idSize-1]) {
+		return ErrMsgIDDoesNotExist // sequence is reused by another entry.
+	}
+	topic, err := db.data.readTopic(s)
+	if err != nil {
+		return err
+	}
+	val, flags := db.encodeValue(payload, id[idSize-1]&flagEncrypted != 0)
+	e := entry{seq: seq, topicSize: s.topicSize, valueSize: uint32(len(val)), expiresAt: s.expiresAt}
+	rec, err := updateRecord(e, id, topic, val, flags)
 	if err != nil {
 		return err
 	}
 
-	for _, seq := range tinyBatch.entries {
-		blockID := startBlockIndex(seq)
-		memseq := db.cacheID ^ seq
-		data, err := db.mem.Get(uint64(blockID), memseq)
+	if s.cacheBlock != nil {
+		_, timeID, ok, err := db.pendingEntry(seq)
 		if err != nil {
-			// Record is deleted
-			continue
-		}
-		if err := <-logWriter.Append(data); err != nil {
 			return err
 		}
-		data = nil
+		if ok {
+			return db.logUpdate(timeID, rec)
+		}
 	}
-
-	if err := <-logWriter.SignalInitWrite(tinyBatch.timeID()); err != nil {
+	if err := db.applyUpdateRecord(rec); err != nil {
 		return err
 	}
-
+	if db.syncWrites {
+		return db.sync()
+	}
 	return nil
 }
 
-// tinyCommit commits tiny batch to DB.
-func (db *DB) tinyCommit(tinyBatch *tinyBatch) error {
-	db.closeW.Add(1)
-	defer func() {
-		tinyBatch.abort()
-		db.closeW.Done()
-	}()
-
-	// Acquire time lock on timeID
-	timeLock := db.mutex.getMutex(uint64(tinyBatch.timeID()))
-	timeLock.RLock()
-	defer timeLock.RUnlock()
+// updateRecord returns the update log record of the entry with the message ID, topic and value.
+func updateRecord(e entry, id, topic, val []byte, flags uint8) ([]byte, error) {
+	entryData, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	rec := make([]byte, 0, entrySize+idSize+uint32(len(topic))+e.valueSize)
+	rec = append(append(append(append(rec, entryData...), id...), topic...), val...)
+	rec[entrySize+idSize-1] = flags | flagUpdated
+	return rec, nil
+}
 
-	if tinyBatch.len() == 0 {
-		return nil
+// pendingEntry returns the memdb entry of the sequence and its timeID if the entry is not yet synced.
+func (db *DB) pendingEntry(seq uint64) (entry, int64, bool, error) {
+	memdata, err := db.mem.Get(uint64(startBlockIndex(seq)), db.cacheID^seq)
+	if err != nil || memdata == nil {
+		return entry{}, 0, false, nil
 	}
+	var me entry
+	if err := me.UnmarshalBinary(memdata[:entrySize]); err != nil {
+		return entry{}, 0, false, err
+	}
+	timeID, ok := db.timeWindow.timeIDOf(me.topicHash, seq)
+	return me, timeID, ok, nil
+}
 
-	if err := db.tinyWrite(tinyBatch); err != nil {
+// logUpdate writes the update log record of the entry not yet synced to the log of its timeID and applies it.
+// The caller must hold the sync lock and the tiny batch lock.
+func (db *DB) logUpdate(timeID int64, rec []byte) error {
+	logWriter, err := db.wal.NewWriter()
+	if err != nil {
 		return err
 	}
-
-	if !tinyBatch.managed {
-		db.releaseTimeID(tinyBatch.timeID())
+	if err := <-logWriter.Append(rec); err != nil {
+		return err
+	}
+	if err := <-logWriter.SignalInitWrite(timeID); err != nil {
+		return err
+	}
+	if err := db.applyUpdateRecord(rec); err != nil {
+		return err
+	}
+	if db.syncWrites {
+		return db.sync()
 	}
-	db.meter.Puts.Inc(int64(tinyBatch.len()))
-
 	return nil
 }
 
-func (db *DB) rollback(tinyBatch *tinyBatch) error {
-	// Acquire time lock on timeID
-	timeLock := db.mutex.getMutex(uint64(tinyBatch.timeID()))
-	timeLock.Lock()
-	defer timeLock.Unlock()
-
-	entryCount := tinyBatch.len()
-	tinyBatch.reset()
-
-	// Abort signals WAL to release log.
-	if err := db.wal.SignalLogApplied(tinyBatch.timeID()); err != nil {
-		logger.Error().Err(err).Str("context", "db.abort")
+// applyUpdateRecord replaces the payload of the entry of the update log record if the entry still has the ID of the record.
+// The entry is updated in memdb if it is not yet synced or it is cached, and in the DB files if it is synced. The expiry
+// of the record is set in memdb, and in the time window if the record has the topic hash of the entry.
+// The caller must hold the sync lock and the tiny batch lock.
+func (db *DB) applyUpdateRecord(rec []byte) error {
+	var e entry
+	if err := e.UnmarshalBinary(rec[:entrySize]); err != nil {
 		return err
 	}
-	db.timeWindow.abortTimeID(tinyBatch.timeID())
-	db.meter.Aborts.Inc(int64(entryCount))
-	return nil
-}
+	msg := append([]byte(nil), rec[entrySize:]...)
+	msg[idSize-1] &^= flagUpdated
 
-func (db *DB) abort() {
-	err := db.timeWindow.abort(func(wEntries windowEntries) (bool, error) {
+	blockID := startBlockIndex(e.seq)
+	memseq := db.cacheID ^ e.seq
+	memdata, err := db.mem.Get(uint64(blockID), memseq)
+	found := err == nil && memdata != nil
+	if found {
+		if !bytes.Equal(memdata[entrySize:entrySize+idSize-1], msg[:idSize-1]) {
+			return nil // sequence is reused by another entry.
+		}
+		var me entry
+		if err := me.UnmarshalBinary(memdata[:entrySize]); err != nil {
+			return err
+		}
+		me.valueSize = e.valueSize
+		me.expiresAt = e.expiresAt
+		entryData, err := me.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := db.mem.Set(uint64(blockID), memseq, append(entryData, msg...)); err != nil {
+			return err
+		}
+	}
+
+	bh, entryIdx, ok, err := db.indexEntry(e.seq)
+	if err != nil {
+		return err
+	}
+	if ok {
+		found = true
+		id, val, err := db.data.readMessage(bh.entries[entryIdx])
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(id[:idSize-1], msg[:idSize-1]) {
+			return nil // sequence is reused by another entry.
+		}
+		if id[idSize-1] != msg[idSize-1] || !bytes.Equal(val, msg[idSize+uint32(e.topicSize):]) {
+			if err := db.rewriteMessage(&bh, entryIdx, msg); err != nil {
+				return err
+			}
+		}
+	}
+	// The topic hash is only set in the update log records that set expiry of the entry.
+	if !found || e.topicHash == 0 {
+		return nil
+	}
+	_, err = db.setWindowExpiry(e.topicHash, e.seq, func(uint32) (uint32, error) {
+		return e.expiresAt, nil
+	})
+	return err
+}
+
+// applyLogRecord applies the delete, update or external ID log record.
+func (db *DB) applyLogRecord(rec []byte) error {
+	switch flags := rec[entrySize+idSize-1]; {
+	case flags&flagDeleted != 0:
+		return db.applyDeleteRecord(rec)
+	case flags&flagExternalID != 0:
+		return db.applyExternalIDRecord(rec)
+	}
+	return db.applyUpdateRecord(rec)
+}
+
+// warmedEntries holds sequences of the entries loaded into memdb by WarmCache.
+// Warmed entries are already written to the DB files, so these are evicted from memdb when memdb is full.
+type warmedEntries struct {
+	sync.Mutex
+	seqs map[uint64]struct{}
+}
+
+func newWarmedEntries() *warmedEntries {
+	return &warmedEntries{seqs: make(map[uint64]struct{})}
+}
+
+// batchSeqs holds sequences assigned to entries of batches that are not yet written to memdb.
+type batchSeqs struct {
+	sync.Mutex
+	seqs map[uint64]struct{}
+}
+
+func newBatchSeqs() *batchSeqs {
+	return &batchSeqs{seqs: make(map[uint64]struct{})}
+}
+
+func (bs *batchSeqs) add(seq uint64) {
+	bs.Lock()
+	defer bs.Unlock()
+	bs.seqs[seq] = struct{}{}
+}
+
+func (bs *batchSeqs) remove(seqs []uint64) {
+	bs.Lock()
+	defer bs.Unlock()
+	for _, seq := range seqs {
+		delete(bs.seqs, seq)
+	}
+}
+
+// below returns a copy of the sequences not higher than the sequence.
+func (bs *batchSeqs) below(seq uint64) map[uint64]struct{} {
+	bs.Lock()
+	defer bs.Unlock()
+	seqs := make(map[uint64]struct{})
+	for s := range bs.seqs {
+		if s <= seq {
+			seqs[s] = struct{}{}
+		}
+	}
+	return seqs
+}
+
+func (bs *batchSeqs) has(seq uint64) bool {
+	bs.Lock()
+	defer bs.Unlock()
+	_, ok := bs.seqs[seq]
+	return ok
+}
+
+// unwarm removes the warmed entry of the sequence from memdb, it is called before the sequence is freed for reuse.
+func (db *DB) unwarm(seq uint64) error {
+	db.warmed.Lock()
+	defer db.warmed.Unlock()
+	if _, ok := db.warmed.seqs[seq]; !ok {
+		return nil
+	}
+	delete(db.warmed.seqs, seq)
+	return db.mem.Delete(uint64(startBlockIndex(seq)), db.cacheID^seq)
+}
+
+// evictWarmed removes entries loaded by WarmCache from memdb.
+// The lock is held during eviction so a sequence cannot be freed and reused before its warmed entry is removed.
+func (db *DB) evictWarmed() error {
+	db.warmed.Lock()
+	defer db.warmed.Unlock()
+	for seq := range db.warmed.seqs {
+		if err := db.mem.Delete(uint64(startBlockIndex(seq)), db.cacheID^seq); err != nil {
+			return err
+		}
+		delete(db.warmed.seqs, seq)
+	}
+	return nil
+}
+
+// warmEntry reads the entry from the index block and data file and sets it into memdb.
+// Entries already in memdb or deleted are skipped.
+func (db *DB) warmEntry(we query) error {
+	blockID := startBlockIndex(we.seq)
+	memseq := db.cacheID ^ we.seq
+	if data, err := db.mem.Get(uint64(blockID), memseq); err != nil || data != nil {
+		return nil
+	}
+	s, err := db.readEntry(we.topicHash, we.seq)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, errMsgIDDeleted) || errors.Is(err, ErrMsgIDDoesNotExist) {
+			return nil
+		}
+		return err
+	}
+	if s.seq != we.seq || s.cacheBlock != nil {
+		return nil
+	}
+	msg, err := db.data.Slice(s.msgOffset, s.msgOffset+int64(s.mSize()))
+	if err != nil {
+		return err
+	}
+	e := entry{seq: s.seq, topicSize: s.topicSize, valueSize: s.valueSize, expiresAt: we.expiresAt, topicHash: we.topicHash}
+	entryData, err := e.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, entrySize+len(msg))
+	copy(data, entryData)
+	copy(data[entrySize:], msg)
+	db.warmed.Lock()
+	defer db.warmed.Unlock()
+	// The sequence may be freed and reused by a put since it was read.
+	if cur, err := db.mem.Get(uint64(blockID), memseq); err != nil || cur != nil {
+		return err
+	}
+	if err := db.mem.Set(uint64(blockID), memseq, data); err != nil {
+		return err
+	}
+	db.warmed.seqs[we.seq] = struct{}{}
+	return nil
+}
+
+// lookups are performed in following order
+// ilookup lookups in memory entries from timeWindow
+// lookup lookups persisted entries from timeWindow file.
+func (db *DB) lookup(q *Query) error {
+	topics := db.trie.lookup(q.parts, q.depth, q.topicType)
+	sort.Slice(topics[:], func(i, j int) bool {
+		return topics[i].offset > topics[j].offset
+	})
+	// filtered query looks up all entries as entries not matching the filter do not count toward the limit.
+	// seek query looks up all entries as the latest entries of a topic may not include entries from the sequence.
+	// snapshot query looks up all entries as entries written after the snapshot do not count toward the limit.
+	// entries skipped by read hooks do not count toward the limit.
+	qLimit := q.Limit
+	if q.filter != nil || q.seek || q.snapshot != nil || db.hasReadHooks() {
+		qLimit = math.MaxInt32
+	}
+	for _, topic := range topics {
+		if len(q.winEntries) > qLimit {
+			break
+		}
+		limit := qLimit - len(q.winEntries)
+		wEntries, nExpired := db.timeWindow.lookup(topic.hash, topic.offset, q.cutoff, limit)
+		q.expired += nExpired
+		for _, we := range wEntries {
+			if q.seek && we.seq() < q.fromSeq {
+				continue
+			}
+			if q.snapshot != nil && q.snapshot.excludes(we.seq()) {
+				continue
+			}
+			q.winEntries = append(q.winEntries, query{topicHash: topic.hash, seq: we.seq(), expiresAt: we.expiryTime()})
+		}
+	}
+	// sort.Slice(q.winEntries[:], func(i, j int) bool {
+	// 	return q.winEntries[i].seq > q.winEntries[j].seq
+	// })
+	if q.seek {
+		sort.Slice(q.winEntries[:], func(i, j int) bool {
+			return q.winEntries[i].seq < q.winEntries[j].seq
+		})
+	}
+	return nil
+}
+
+// newBlock adds new block to DB and it returns block offset.
+func (db *DB) newBlock() (int64, error) {
+	off, err := db.index.extend(blockSize)
+	db.addBlocks(1)
+	return off, err
+}
+
+// extendBlocks adds blocks to DB.
+func (db *DB) extendBlocks(nBlocks int32) error {
+	if _, err := db.index.extend(uint32(nBlocks) * blockSize); err != nil {
+		return err
+	}
+	db.addBlocks(nBlocks)
+	return nil
+}
+
+func (db *DB) parseTopic(contract uint32, topic []byte) (*message.Topic, uint32, error) {
+	t := new(message.Topic)
+
+	//Parse the Key.
+	t.ParseKey(db.normalizeTopic(topic))
+	// Parse the topic.
+	t.Parse(contract, true)
+	if err := validateTopic(t); err != nil {
+		return nil, 0, fmt.Errorf("db.parseTopic: %w", err)
+	}
+	// In case of ttl, add ttl to the msg and store to the db.
+	if ttl, ok := t.TTLAt(db.opts.clock.Now()); ok {
+		return t, ttl, nil
+	}
+	return t, 0, nil
+}
+
+// validateTopic validates the parsed topic and the format of its ttl option.
+func validateTopic(t *message.Topic) error {
+	if t.TopicType == message.TopicInvalid {
+		return fmt.Errorf("invalid topic: %w", ErrBadRequest)
+	}
+	for _, o := range t.Options {
+		if o.Key != "ttl" {
+			continue
+		}
+		if _, err := strconv.ParseInt(o.Value, 10, 64); err == nil {
+			continue
+		}
+		if _, err := time.ParseDuration(o.Value); err != nil {
+			return fmt.Errorf("invalid ttl %q: %w", o.Value, ErrBadRequest)
+		}
+	}
+	return nil
+}
+
+// parsePrefix parses topic prefix into parts, the contract is added as first part of the prefix.
+func parsePrefix(contract uint32, prefix []byte) []message.Part {
+	parts := []message.Part{{Hash: contract}}
+	for _, p := range bytes.Split(prefix, []byte{message.TopicSeparator}) {
+		switch {
+		case len(p) == 0:
+			continue
+		case string(p) == message.TopicGenericSymbol:
+			return parts
+		case len(p) == 1 && p[0] == message.TopicWildcardSymbol:
+			parts = append(parts, message.Part{Hash: message.Wildcard})
+		default:
+			parts = append(parts, message.Part{Hash: hash.WithSalt(p, contract)})
+		}
+	}
+	return parts
+}
+
+// topicMutex returns the mutex of the prefix of the topic, it is the mutex a query on the topic holds.
+func (db *DB) topicMutex(contract uint32, name []byte) *sync.RWMutex {
+	return db.getMutex(message.Prefix(parsePrefix(contract, name)))
+}
+
+// reuseSeqs reports whether free sequences are reused by new entries. An entry with a reused sequence
+// may be below the sequence of an open snapshot or a subscriber checkpoint, so free sequences are not
+// reused while a snapshot or a subscriber is open.
+func (db *DB) reuseSeqs() bool {
+	return atomic.LoadInt32(&db.snapshots) == 0 && atomic.LoadInt32(&db.subscribers) == 0
+}
+
+// validateID validates the user supplied ID of the entry. The ID sequence must be leased
+// by the DB and the ID contract must match contract of the entry.
+func (db *DB) validateID(e *Entry) error {
+	id := message.ID(e.ID)
+	if len(id) != id.Size() {
+		return fmt.Errorf("db.validateID: ID size %d: %w", len(id), errMsgIDInvalid)
+	}
+	if seq := id.Sequence(); seq == 0 || seq > db.seq() {
+		return fmt.Errorf("db.validateID: ID sequence %d out of range: %w", seq, errMsgIDInvalid)
+	}
+	if contract := id.Contract(); contract != message.MasterContract && contract != e.Contract {
+		return errMsgIDPrefixMismatch
+	}
+	return nil
+}
+
+func (db *DB) setEntry(timeID int64, e *Entry) error {
+	var id message.ID
+	var seq uint64
+	var rawTopic []byte
+	if !e.parsed {
+		if e.Contract == 0 {
+			e.Contract = message.MasterContract
+		}
+		t, ttl, err := db.parseTopic(e.Contract, e.Topic)
+		if err != nil {
+			return err
+		}
+		if e.ExpiresAt == 0 && ttl > 0 {
+			e.ExpiresAt = ttl
+		}
+		t.AddContract(e.Contract)
+		e.topicHash = t.GetHash(e.Contract)
+		// topic is packed if it is new topic entry
+		if _, ok := db.trie.getOffset(e.topicHash); !ok {
+			rawTopic = t.Marshal()
+			e.topicSize = uint16(len(rawTopic))
+		}
+		e.parsed = true
+	}
+	if e.ID != nil {
+		if err := db.validateID(e); err != nil {
+			return err
+		}
+		id = message.ID(e.ID)
+		seq = id.Sequence()
+		db.freeList.addLease(timeID, seq)
+		// the entry may reuse a sequence below the sequence of an open snapshot.
+		if atomic.LoadInt32(&db.snapshots) > 0 {
+			db.snapshotChanges.write(seq)
+		}
+	} else {
+		if db.reuseSeqs() {
+			if ok, s := db.freeList.getSlot(); ok {
+				db.meter.Leases.Inc(1)
+				seq = s
+			}
+		}
+		if seq == 0 {
+			seq = db.nextSeq()
+		}
+		id = message.NewID(seq)
+	}
+	if seq == 0 {
+		panic("db.setEntry: seq is zero")
+	}
+
+	id.SetContract(e.Contract)
+	e.seq = seq
+	e.expiresAt = e.ExpiresAt
+	val, flags := e.value, e.flags
+	if val == nil {
+		val, flags = db.encodeValue(e.Payload, db.encryption == 1 || e.Encryption)
+	}
+	e.valueSize = uint32(len(val))
+	mLen := entrySize + idSize + uint32(e.topicSize) + uint32(e.valueSize)
+	e.cache = make([]byte, mLen)
+	entryData, err := e.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	copy(e.cache, entryData)
+	copy(e.cache[entrySize:], id.Prefix())
+	e.cache[entrySize+idSize-1] = flags
+	// topic data is added on first entry for the topic.
+	if e.topicSize != 0 {
+		copy(e.cache[entrySize+idSize:], rawTopic)
+	}
+	copy(e.cache[entrySize+idSize+uint32(e.topicSize):], val)
+	return nil
+}
+
+// waitMem blocks puts while memdb is full until sync frees memdb space.
+// It returns ErrFull if sync does not free memdb space within ten sync intervals.
+// Puts are not blocked while sync is paused, memdb grows beyond its size until sync is resumed.
+func (db *DB) waitMem() error {
+	if db.mem.Occupancy() < 1 || atomic.LoadUint32(&db.syncPaused) == 1 {
+		return nil
+	}
+	if err := db.evictWarmed(); err != nil {
+		return err
+	}
+	timeout := time.NewTimer(10 * db.opts.syncDurationType * time.Duration(db.opts.maxSyncDurations))
+	defer timeout.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for db.mem.Occupancy() >= 1 {
+		select {
+		case <-db.closeC:
+			return ErrClosed
+		case <-timeout.C:
+			return fmt.Errorf("db.waitMem: memdb size exceeded: %w", ErrFull)
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// tinyWrite writes tiny batch to DB WAL.
+func (db *DB) tinyWrite(tinyBatch *tinyBatch) error {
+	// Backoff to limit excess memroy usage
+	db.mem.Backoff()
+
+	logWriter, err := db.wal.NewWriter()
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range tinyBatch.entries {
+		blockID := startBlockIndex(seq)
+		memseq := db.cacheID ^ seq
+		data, err := db.mem.Get(uint64(blockID), memseq)
+		if err != nil {
+			// Record is deleted
+			continue
+		}
+		if err := <-logWriter.Append(data); err != nil {
+			return err
+		}
+		data = nil
+	}
+	// Log records are written after the entries, so recovery applies them with the entries of the batch.
+	for _, rec := range tinyBatch.records {
+		if err := <-logWriter.Append(rec); err != nil {
+			return err
+		}
+	}
+
+	if err := <-logWriter.SignalInitWrite(tinyBatch.timeID()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// tinyCommit commits tiny batch to DB.
+func (db *DB) tinyCommit(tinyBatch *tinyBatch) (err error) {
+	db.closeW.Add(1)
+	defer func() {
+		tinyBatch.err = err
+		tinyBatch.abort()
+		db.closeW.Done()
+	}()
+
+	// Acquire time lock on timeID
+	timeLock := db.mutex.getMutex(uint64(tinyBatch.timeID()))
+	timeLock.RLock()
+	defer timeLock.RUnlock()
+
+	if tinyBatch.len() == 0 {
+		return nil
+	}
+
+	if err := db.tinyWrite(tinyBatch); err != nil {
+		return err
+	}
+
+	if !tinyBatch.managed {
+		db.releaseTimeID(tinyBatch.timeID())
+	}
+	db.meter.Puts.Inc(int64(tinyBatch.len()))
+	db.opts.metricsSink.Put(int64(tinyBatch.len()))
+	db.runCommitHooks(tinyBatch.entries)
+	for _, we := range tinyBatch.watched {
+		db.watchers.fanout(we.topicHash, func() *Entry { return we.e })
+	}
+
+	return nil
+}
+
+func (db *DB) rollback(tinyBatch *tinyBatch) error {
+	// Acquire time lock on timeID
+	timeLock := db.mutex.getMutex(uint64(tinyBatch.timeID()))
+	timeLock.Lock()
+	defer timeLock.Unlock()
+
+	entryCount := tinyBatch.len()
+	tinyBatch.reset()
+	// dedup keys of the entries not committed are forgotten, so a retry of the entries is not skipped.
+	db.dedup.forgetAll(tinyBatch.dedupKeys)
+	tinyBatch.dedupKeys = nil
+
+	// Abort signals WAL to release log.
+	if err := db.wal.SignalLogApplied(tinyBatch.timeID()); err != nil {
+		logger.Error().Err(err).Str("context", "db.abort")
+		return err
+	}
+	db.timeWindow.abortTimeID(tinyBatch.timeID())
+	db.meter.Aborts.Inc(int64(entryCount))
+	return nil
+}
+
+func (db *DB) abort() {
+	err := db.timeWindow.abort(func(wEntries windowEntries) (bool, error) {
 		for _, we := range wEntries {
 			db.freeList.freeSlot(we.seq())
+			if err := db.externalIDs.remove(we.seq()); err != nil {
+				return true, err
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Str("context", "db.rollback")
+	}
+}
+
+// delete deletes the given key from the DB.
+func (db *DB) delete(topicHash, seq uint64) error {
+	if db.opts.immutable {
+		return nil
+	}
+	// Sync writes index and window blocks, so it is blocked during the delete.
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	return db.idelete(topicHash, seq)
+}
+
+// idelete deletes the entry of the sequence from memdb, the time window and the index block.
+// The caller must hold the sync lock and the tiny batch lock.
+func (db *DB) idelete(topicHash, seq uint64) error {
+	s, err := db.readEntry(topicHash, seq)
+	if err != nil {
+		if errors.Is(err, errMsgIDDeleted) {
+			return nil // entry is already deleted.
+		}
+		if !errors.Is(err, io.EOF) && !errors.Is(err, ErrMsgIDDoesNotExist) {
+			return err
+		}
+	}
+	db.meter.Dels.Inc(1)
+	db.opts.metricsSink.Del(1)
+	// The entry is kept for the open snapshots and deleted once the last snapshot is closed.
+	if atomic.LoadInt32(&db.snapshots) > 0 {
+		db.snapshotChanges.delete(seq)
+		return db.externalIDs.remove(seq)
+	}
+	return db.deleteSlot(topicHash, s, seq)
+}
+
+// deleteSlot deletes the entry of the sequence read by idelete. A zero topic hash is an entry of unknown topic.
+// The caller must hold the sync lock and the tiny batch lock.
+func (db *DB) deleteSlot(topicHash uint64, s slot, seq uint64) error {
+	// The topic is loaded from the entry carrying the topic name on open, so the entry is
+	// marked as deleted and kept until the last entry of the topic is deleted.
+	if s.seq == seq && s.topicSize != 0 {
+		off, _ := db.trie.getOffset(topicHash)
+		winTopicHash, ok, err := db.timeWindow.topicIn(topicHash, off, seq)
+		if err != nil {
+			return err
+		}
+		if ok {
+			seqs, err := db.topicSeqs(winTopicHash, 2)
+			if err != nil {
+				return err
+			}
+			if len(seqs) > 1 {
+				if err := db.markDeleted(seq); err != nil {
+					return err
+				}
+				return db.externalIDs.remove(seq)
+			}
+		}
+	}
+	winTopicHash, ok, err := db.purge(topicHash, seq)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return db.removeTopicIfEmpty(winTopicHash)
+	}
+	return nil
+}
+
+// purge removes the entry of the sequence from memdb, the time window and the index block, and frees
+// its sequence and data block. The window entry is looked up in the window blocks of the topic unless the
+// topic hash is zero. It returns the topic hash of the window entry of the sequence, if any.
+func (db *DB) purge(topicHash, seq uint64) (uint64, bool, error) {
+	blockID := startBlockIndex(seq)
+	memseq := db.cacheID ^ seq
+	if err := db.unwarm(seq); err != nil {
+		return 0, false, err
+	}
+	if err := db.mem.Remove(uint64(blockID), memseq); err != nil {
+		return 0, false, err
+	}
+	// The window entry is removed so the sequence is not returned for the topic once it is reused.
+	off, _ := db.trie.getOffset(topicHash)
+	topicHash, ok, err := db.timeWindow.delIn(topicHash, off, seq)
+	if err != nil {
+		return 0, false, err
+	}
+	db.freeList.freeSlot(seq)
+	if err := db.externalIDs.remove(seq); err != nil {
+		return 0, false, err
+	}
+
+	// Test filter block for the message id presence.
+	if !db.filter.Test(seq) || blockID > db.blocks() {
+		return topicHash, ok, nil
+	}
+	blockWriter := newBlockWriter(&db.index, nil)
+	e, err := blockWriter.del(seq)
+	if err != nil {
+		return 0, false, err
+	}
+	if e.seq == 0 {
+		return topicHash, ok, nil // entry is not synced to the index block.
+	}
+	db.freeList.freeBlock(e.msgOffset, e.mSize())
+	db.decount(1)
+	if db.syncWrites {
+		return topicHash, ok, db.sync()
+	}
+	return topicHash, ok, nil
+}
+
+// markDeleted sets the deleted flag in the message ID of the entry in memdb and in the data file.
+func (db *DB) markDeleted(seq uint64) error {
+	blockID := startBlockIndex(seq)
+	memseq := db.cacheID ^ seq
+	data, err := db.mem.Get(uint64(blockID), memseq)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		data = append([]byte(nil), data...)
+		data[entrySize+idSize-1] |= flagDeleted
+		if err := db.mem.Set(uint64(blockID), memseq, data); err != nil {
+			return err
+		}
+	}
+	s, ok, err := db.indexSlot(seq)
+	if err != nil || !ok {
+		return err
+	}
+	flags, err := db.data.flags(s)
+	if err != nil {
+		return err
+	}
+	if _, err := db.data.WriteAt([]byte{flags | flagDeleted}, s.msgOffset+int64(idSize)-1); err != nil {
+		return err
+	}
+	if db.syncWrites {
+		return db.sync()
+	}
+	return nil
+}
+
+// indexSlot reads the index slot of the sequence from the index block. It returns false if the
+// sequence is not synced to the index block.
+func (db *DB) indexSlot(seq uint64) (slot, bool, error) {
+	bh, entryIdx, ok, err := db.indexEntry(seq)
+	if !ok || err != nil {
+		return slot{}, false, err
+	}
+	return bh.entries[entryIdx], true, nil
+}
+
+// indexEntry reads the index block of the sequence and returns the index of the sequence in the block.
+// It returns false if the sequence is not synced to the index block.
+func (db *DB) indexEntry(seq uint64) (blockHandle, int, bool, error) {
+	blockID := startBlockIndex(seq)
+	bh := blockHandle{file: db.index, offset: blockOffset(blockID)}
+	// Test filter block for the message id presence.
+	if !db.filter.Test(seq) || blockID > db.blocks() {
+		return bh, -1, false, nil
+	}
+	if err := bh.read(); err != nil {
+		if errors.Is(err, io.EOF) {
+			return bh, -1, false, nil
+		}
+		return bh, -1, false, err
+	}
+	for i := 0; i < entriesPerIndexBlock; i++ {
+		if bh.entries[i].seq == seq {
+			return bh, i, true, nil
+		}
+	}
+	return bh, -1, false, nil
+}
+
+// moveTopic moves the entries of the old topic synced to the DB files to the new topic. The topic stored with the entries
+// is rewritten first and then the window blocks of the old topic are moved to the new topic, and the trie is updated last.
+// Messages and window blocks are written back if the move fails. The caller must hold the sync lock and the tiny batch lock.
+func (db *DB) moveTopic(oldT, newT *message.Topic, contract uint32) (err error) {
+	oldHash, newHash := oldT.GetHash(contract), newT.GetHash(contract)
+	oldOff, _ := db.trie.getOffset(oldHash)
+	newOff, ok := db.trie.getOffset(newHash)
+	if !ok {
+		newOff = 0
+	}
+
+	// queries of both topics are blocked during the move.
+	oldMu, newMu := db.topicMutex(contract, oldT.Topic), db.topicMutex(contract, newT.Topic)
+	oldMu.Lock()
+	defer oldMu.Unlock()
+	if newMu != oldMu {
+		newMu.Lock()
+		defer newMu.Unlock()
+	}
+
+	seqs, err := db.timeWindow.seqs(oldHash, oldOff, math.MaxInt32)
+	if err != nil {
+		return err
+	}
+	oldRaw, newRaw := oldT.Marshal(), newT.Marshal()
+	type movedMessage struct {
+		seq       uint64
+		topicSize uint16
+		msg       []byte
+	}
+	var prev []movedMessage
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(prev) - 1; i >= 0; i-- {
+			bh, entryIdx, ok, err := db.indexEntry(prev[i].seq)
+			if err != nil || !ok {
+				logger.Error().Err(err).Str("context", "db.moveTopic").Msgf("Error reading index entry %d", prev[i].seq)
+				continue
+			}
+			if err := db.rewriteTopicMessage(&bh, entryIdx, prev[i].topicSize, prev[i].msg); err != nil {
+				logger.Error().Err(err).Str("context", "db.moveTopic").Msgf("Error restoring message %d", prev[i].seq)
+			}
+		}
+	}()
+	for _, seq := range seqs {
+		bh, entryIdx, ok, err := db.indexEntry(seq)
+		if err != nil {
+			return err
+		}
+		if !ok || bh.entries[entryIdx].topicSize == 0 {
+			continue
+		}
+		s := bh.entries[entryIdx]
+		topic, err := db.data.readTopic(s)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(topic, oldRaw) {
+			continue // sequence is reused by an entry of another topic.
+		}
+		id, val, err := db.data.readMessage(s)
+		if err != nil {
+			return err
+		}
+		msg := append(append(append([]byte(nil), id...), topic...), val...)
+		if err := db.rewriteTopicMessage(&bh, entryIdx, uint16(len(newRaw)), append(append(append([]byte(nil), id...), newRaw...), val...)); err != nil {
+			return err
+		}
+		prev = append(prev, movedMessage{seq: seq, topicSize: s.topicSize, msg: msg})
+		if err := db.unwarm(seq); err != nil {
+			return err
 		}
-		return false, nil
-	})
+	}
+
+	head, blocks, err := db.timeWindow.moveBlocks(oldHash, oldOff, newHash, newOff)
 	if err != nil {
-		logger.Error().Err(err).Str("context", "db.rollback")
+		return err
+	}
+	if err := db.sync(); err != nil {
+		if err := db.timeWindow.writeBlocks(blocks); err != nil {
+			logger.Error().Err(err).Str("context", "db.moveTopic").Msgf("Error restoring window blocks")
+		}
+		return err
+	}
+	db.trie.remove(oldHash)
+	if ok := db.trie.setOffset(topic{hash: newHash, offset: head}); !ok {
+		db.trie.add(newTopic(newHash, head, newT.Topic), newT.Parts, newT.Depth)
 	}
+	return nil
 }
 
-// delete deletes the given key from the DB.
-func (db *DB) delete(topicHash, seq uint64) error {
-	if db.opts.immutable {
-		return nil
-	}
+// rewriteMessage writes the message of the index block entry to newly allocated space of the data file and then
+// writes the index block, so a crash before the index block is written keeps the previous message. Space of the
+// previous message is freed last. The caller must hold the sync lock.
+func (db *DB) rewriteMessage(bh *blockHandle, entryIdx int, msg []byte) error {
+	return db.rewriteTopicMessage(bh, entryIdx, bh.entries[entryIdx].topicSize, msg)
+}
 
-	db.freeList.freeSlot(seq)
-	db.meter.Dels.Inc(1)
-	blockID := startBlockIndex(seq)
-	memseq := db.cacheID ^ seq
-	if err := db.mem.Remove(uint64(blockID), memseq); err != nil {
+// rewriteTopicMessage is rewriteMessage for a message with a topic of the topic size.
+func (db *DB) rewriteTopicMessage(bh *blockHandle, entryIdx int, topicSize uint16, msg []byte) error {
+	s := bh.entries[entryIdx]
+	msgOffset := db.data.lease.allocate(uint32(len(msg)))
+	if msgOffset == -1 {
+		var err error
+		if msgOffset, err = db.data.extend(uint32(len(msg))); err != nil {
+			return err
+		}
+		if err := db.writeDataSize(); err != nil {
+			return err
+		}
+	}
+	if _, err := db.data.writeAt(msg, msgOffset); err != nil {
+		db.freeList.freeBlock(msgOffset, uint32(len(msg)))
+		return err
+	}
+	if err := db.data.Sync(); err != nil {
+		db.freeList.freeBlock(msgOffset, uint32(len(msg)))
+		return err
+	}
+	bh.entries[entryIdx].msgOffset = msgOffset
+	bh.entries[entryIdx].topicSize = topicSize
+	bh.entries[entryIdx].valueSize = uint32(len(msg)) - idSize - uint32(topicSize)
+	if _, err := db.index.WriteAt(bh.MarshalBinary(), bh.offset); err != nil {
+		bh.entries[entryIdx] = s
+		db.freeList.freeBlock(msgOffset, uint32(len(msg)))
+		return err
+	}
+	if err := db.index.Sync(); err != nil {
 		return err
 	}
+	db.freeList.freeBlock(s.msgOffset, s.mSize())
+	return nil
+}
 
-	// Test filter block for the message id presence.
-	if !db.filter.Test(seq) {
+// deleteRecord packs a log record that deletes the entry of the message ID when the log is recovered. It returns
+// ErrMsgIDDoesNotExist if the sequence of the ID is reused by another entry. The record keeps the ID of the entry,
+// so an entry put later with the reused sequence is not deleted.
+func (db *DB) deleteRecord(msgID []byte) ([]byte, error) {
+	seq := message.ID(msgID).Sequence()
+	// topic hash is not used to read the index slot.
+	s, err := db.readEntry(0, seq)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, errMsgIDDeleted) {
+			return nil, ErrMsgIDDoesNotExist
+		}
+		return nil, err
+	}
+	if s.seq != seq {
+		return nil, ErrMsgIDDoesNotExist
+	}
+	id, _, err := db.data.readMessage(s)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(id[:idSize-1], msgID[:idSize-1]) {
+		return nil, ErrMsgIDDoesNotExist // sequence is reused by another entry.
+	}
+	e := entry{seq: seq}
+	entryData, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	rec := make([]byte, entrySize+idSize)
+	copy(rec, entryData)
+	copy(rec[entrySize:], id[:idSize-1])
+	rec[entrySize+idSize-1] = flagDeleted
+	return rec, nil
+}
+
+// commitDeletes commits the tiny batch with the delete log records written after its entries, so recovery applies the
+// entries and the deletes together. The entries of the sequences are deleted once the tiny batch is committed.
+// If the commit fails the tiny batch is rolled back and no entry is deleted. The caller must hold the sync lock and
+// the tiny batch lock.
+func (db *DB) commitDeletes(seqs []uint64, recs [][]byte) error {
+	tinyBatch := db.tinyBatch
+	tinyBatch.records = append(tinyBatch.records, recs...)
+	db.batchPool.write(tinyBatch)
+	db.tinyBatch = db.newTinyBatch()
+	<-tinyBatch.doneChan
+	if tinyBatch.err != nil {
+		return tinyBatch.err
+	}
+	for _, seq := range seqs {
+		if err := db.idelete(0, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyDeleteRecord deletes the entry of the delete log record if the entry still has the ID of the record.
+// The caller must hold the sync lock and the tiny batch lock.
+func (db *DB) applyDeleteRecord(rec []byte) error {
+	var e entry
+	if err := e.UnmarshalBinary(rec[:entrySize]); err != nil {
+		return err
+	}
+	s, err := db.readEntry(0, e.seq)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, errMsgIDDeleted) || errors.Is(err, ErrMsgIDDoesNotExist) {
+			return nil // entry is already deleted.
+		}
+		return err
+	}
+	if s.seq != e.seq {
 		return nil
 	}
+	id, _, err := db.data.readMessage(s)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(id[:idSize-1], rec[entrySize:entrySize+idSize-1]) {
+		return nil // sequence is reused by another entry.
+	}
+	return db.idelete(0, e.seq)
+}
 
-	blockIdx := startBlockIndex(seq)
-	if blockIdx > db.blocks() {
-		return nil // no record to delete.
+// externalIDLogRecord packs a log record that maps the external ID to the entry of the message ID when the log is
+// recovered. A record with empty external ID removes the mapping of the sequence of the entry.
+func externalIDLogRecord(seq uint64, id, xid []byte) ([]byte, error) {
+	e := entry{seq: seq, valueSize: externalIDSize}
+	entryData, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
 	}
-	blockWriter := newBlockWriter(&db.index, nil)
-	e, err := blockWriter.del(seq)
+	rec := make([]byte, entrySize+idSize+externalIDSize)
+	copy(rec, entryData)
+	copy(rec[entrySize:], id[:idSize-1])
+	rec[entrySize+idSize-1] = flagExternalID
+	copy(rec[entrySize+idSize:], xid)
+	return rec, nil
+}
+
+// setExternalID maps the external ID of the entry to its sequence, or removes the mapping of a reused sequence if the
+// entry has no external ID, and adds the log record of the mapping to the tiny batch so the mapping is recovered with
+// the entry. The caller must hold the lock of the tiny batch.
+func (db *DB) setExternalID(tinyBatch *tinyBatch, e *Entry) error {
+	ok, err := db.externalIDs.add(e.ExternalID, e.seq)
+	if err != nil || !ok {
+		return err
+	}
+	rec, err := externalIDLogRecord(e.seq, e.cache[entrySize:entrySize+idSize], e.ExternalID)
 	if err != nil {
 		return err
 	}
-	db.freeList.freeBlock(e.msgOffset, e.mSize())
-	db.decount(1)
-	if db.syncWrites {
-		return db.sync()
+	tinyBatch.records = append(tinyBatch.records, rec)
+	return nil
+}
+
+// applyExternalIDRecord maps the external ID of the external ID log record to the sequence of the record if the
+// entry still has the ID of the record.
+func (db *DB) applyExternalIDRecord(rec []byte) error {
+	var e entry
+	if err := e.UnmarshalBinary(rec[:entrySize]); err != nil {
+		return err
+	}
+	s, err := db.readEntry(0, e.seq)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, errMsgIDDeleted) || errors.Is(err, ErrMsgIDDoesNotExist) {
+			return nil // entry is deleted.
+		}
+		return err
+	}
+	if s.seq != e.seq {
+		return nil
+	}
+	id, _, err := db.data.readMessage(s)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(id[:idSize-1], rec[entrySize:entrySize+idSize-1]) {
+		return nil // sequence is reused by another entry.
+	}
+	_, err = db.externalIDs.add(rec[entrySize+idSize:], e.seq)
+	return err
+}
+
+// removeTopicIfEmpty removes the topic from the trie once its last entry is deleted, and purges the entry
+// carrying the topic name if it is marked as deleted. A topic put again is added back to the trie and its
+// name is stored with its first entry.
+func (db *DB) removeTopicIfEmpty(topicHash uint64) error {
+	seqs, err := db.topicSeqs(topicHash, 2)
+	if err != nil || len(seqs) > 1 {
+		return err
+	}
+	if len(seqs) == 1 {
+		if _, err := db.readEntry(topicHash, seqs[0]); !errors.Is(err, errMsgIDDeleted) {
+			return err
+		}
+		if _, _, err := db.purge(topicHash, seqs[0]); err != nil {
+			return err
+		}
 	}
+	db.trie.remove(topicHash)
 	return nil
 }
 
+// contractTopics returns topics of the contract in topic order.
+func (db *DB) contractTopics(contract uint32) topics {
+	tops := db.trie.subtree(parsePrefix(contract, nil))
+	sort.Slice(tops, func(i, j int) bool {
+		return bytes.Compare(tops[i].name, tops[j].name) < 0
+	})
+	return tops
+}
+
+// scanTopic calls fn on each entry of the topic in order of sequence with its window entry, slot and a copy of its
+// message ID and stored value. Window entries of the topic are read one page at a time, the entries of a page are read
+// under the prefix mutex of the topic and fn is called once the mutex is released. Deleted and expired entries, and
+// window entries whose sequence is reused by another entry, are skipped.
+func (db *DB) scanTopic(t topic, fn func(we winEntry, s slot, id, val []byte) error) error {
+	prefix, ok := db.trie.prefix(t.hash)
+	if !ok {
+		return nil // topic is removed.
+	}
+	mu := db.getMutex(prefix)
+	type item struct {
+		we      winEntry
+		s       slot
+		id, val []byte
+	}
+	return db.timeWindow.foreachPage(t.hash, t.offset, func(wEntries windowEntries) error {
+		items := make([]item, 0, len(wEntries))
+		if err := func() error {
+			mu.RLock()
+			defer mu.RUnlock()
+			for _, we := range wEntries {
+				s, err := db.readEntry(t.hash, we.seq())
+				if err != nil {
+					if errors.Is(err, io.EOF) || errors.Is(err, errMsgIDDeleted) || errors.Is(err, ErrMsgIDDoesNotExist) {
+						continue
+					}
+					return err
+				}
+				if s.seq != we.seq() {
+					continue // entry is deleted.
+				}
+				id, val, err := db.data.readMessage(s)
+				if err != nil {
+					return err
+				}
+				s.cacheBlock = nil
+				items = append(items, item{we: we, s: s, id: append([]byte(nil), id...), val: append([]byte(nil), val...)})
+			}
+			return nil
+		}(); err != nil {
+			return err
+		}
+		for _, it := range items {
+			if err := fn(it.we, it.s, it.id, it.val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// topicSeqs returns up to max sequences of the topic that are not removed from the time window.
+func (db *DB) topicSeqs(topicHash uint64, max int) ([]uint64, error) {
+	off, ok := db.trie.getOffset(topicHash)
+	if !ok {
+		return nil, nil
+	}
+	return db.timeWindow.seqs(topicHash, off, max)
+}
+
+// countEntries reads all index blocks and sums the entry count of each block.
+func (db *DB) countEntries() (uint64, error) {
+	var count uint64
+	nBlocks := db.blocks()
+	for blockIdx := int32(0); blockIdx <= nBlocks; blockIdx++ {
+		b := blockHandle{file: db.index, offset: blockOffset(blockIdx)}
+		if err := b.read(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return count, err
+		}
+		count += uint64(b.entryIdx)
+	}
+	return count, nil
+}
+
+// orphanedData returns data file regions not used by index entries nor free blocks. The caller must hold the sync lock.
+func (db *DB) orphanedData() (map[int64]uint32, error) {
+	used := db.data.lease.allFreeBlocks()
+	nBlocks := db.blocks()
+	for blockIdx := int32(0); blockIdx <= nBlocks; blockIdx++ {
+		b := blockHandle{file: db.index, offset: blockOffset(blockIdx)}
+		if err := b.read(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		for _, s := range b.entries {
+			if s.seq == 0 || s.mSize() == 0 {
+				continue
+			}
+			used = append(used, freeblock{offset: s.msgOffset, size: s.mSize()})
+		}
+	}
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].offset < used[j].offset
+	})
+
+	orphans := make(map[int64]uint32)
+	addOrphan := func(off, end int64) {
+		for ; end-off > math.MaxUint32; off += math.MaxUint32 {
+			orphans[off] = math.MaxUint32
+		}
+		if end > off {
+			orphans[off] = uint32(end - off)
+		}
+	}
+	// data file starts with space reserved for the header.
+	end := int64(headerSize)
+	for _, b := range used {
+		if b.offset > end {
+			addOrphan(end, b.offset)
+		}
+		if bEnd := b.offset + int64(b.size); bEnd > end {
+			end = bEnd
+		}
+	}
+	addOrphan(end, db.data.offset)
+	return orphans, nil
+}
+
+// entryTime returns time of the entry read from its message ID.
+func (db *DB) entryTime(seq uint64) (time.Time, error) {
+	s, err := db.readEntry(0, seq)
+	if err != nil {
+		if err == io.EOF {
+			return time.Time{}, ErrMsgIDDoesNotExist
+		}
+		return time.Time{}, err
+	}
+	if s.seq != seq {
+		return time.Time{}, ErrMsgIDDoesNotExist
+	}
+	id, _, err := db.data.readMessage(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(uid.Time(id), 0), nil
+}
+
 // seq current seq of the DB.
 func (db *DB) seq() uint64 {
 	return atomic.LoadUint64(&db.sequence)
@@ -464,7 +1814,44 @@ func (db *DB) nextSeq() uint64 {
 	return atomic.AddUint64(&db.sequence, 1)
 }
 
-// blocks returns the total blocks in the DB.
+// checkExternalID returns an error if the external ID of the entry is mapped to an existing entry.
+func (db *DB) checkExternalID(e *Entry) error {
+	if len(e.ExternalID) == 0 {
+		return nil
+	}
+	seq, ok := db.externalIDs.lookup(e.ExternalID)
+	if !ok {
+		return nil
+	}
+	exists, err := db.hasSeq(seq)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errDuplicateExternalID
+	}
+	return nil
+}
+
+// hasSeq reports whether an entry with the sequence exists in mem store or in the index, or the sequence
+// is assigned to a batch entry not yet written to mem store.
+func (db *DB) hasSeq(seq uint64) (bool, error) {
+	if db.batchSeqs.has(seq) {
+		return true, nil
+	}
+	data, err := db.mem.Get(uint64(startBlockIndex(seq)), db.cacheID^seq)
+	if err != nil {
+		// entry is deleted.
+		return false, nil
+	}
+	if data != nil {
+		return true, nil
+	}
+	_, ok, err := db.indexSlot(seq)
+	return ok, err
+}
+
+// blocks returns index of the last index block in the DB, -1 if the DB has no index blocks.
 func (db *DB) blocks() int32 {
 	return atomic.LoadInt32(&db.blockIdx)
 }
@@ -503,7 +1890,213 @@ func (db *DB) isClosed() bool {
 // ok checks read ok status.
 func (db *DB) ok() error {
 	if db.isClosed() {
-		return errors.New("db is closed")
+		return ErrClosed
+	}
+	return nil
+}
+
+// runWriteHooks calls registered write hooks on the entry in order, it stops on the first error.
+func (db *DB) runWriteHooks(e *Entry) error {
+	db.writeHooksMu.RLock()
+	defer db.writeHooksMu.RUnlock()
+	for _, hook := range db.writeHooks {
+		if err := hook(e); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+// runSyncHooks calls registered sync hooks in order with the sequences of the entries written to the DB files.
+func (db *DB) runSyncHooks(seqs []uint64) {
+	db.syncHooksMu.RLock()
+	defer db.syncHooksMu.RUnlock()
+	if len(db.syncHooks) == 0 {
+		return
+	}
+	for _, hook := range db.syncHooks {
+		hook(seqs)
+	}
+}
+
+// runCommitHooks calls registered commit hooks in order with the sequences of the committed entries.
+func (db *DB) runCommitHooks(entries []uint64) {
+	db.commitHooksMu.RLock()
+	defer db.commitHooksMu.RUnlock()
+	if len(db.commitHooks) == 0 {
+		return
+	}
+	seqs := make([]uint64, len(entries))
+	copy(seqs, entries)
+	for _, hook := range db.commitHooks {
+		if err := hook(seqs); err != nil {
+			logger.Error().Err(err).Str("context", "db.runCommitHooks").Msg("Error calling commit hook")
+		}
+	}
+}
+
+// hasReadHooks returns true if read hooks are registered.
+func (db *DB) hasReadHooks() bool {
+	db.readHooksMu.RLock()
+	defer db.readHooksMu.RUnlock()
+	return len(db.readHooks) != 0
+}
+
+// runReadHooks calls registered read hooks in order on the entry read from the DB and returns its payload.
+func (db *DB) runReadHooks(seq uint64, id, topic, val []byte) ([]byte, error) {
+	db.readHooksMu.RLock()
+	defer db.readHooksMu.RUnlock()
+	if len(db.readHooks) == 0 {
+		return val, nil
+	}
+	e := &Entry{ID: messageID(id, seq), Topic: topic, Payload: val}
+	for _, hook := range db.readHooks {
+		if err := hook(e); err != nil {
+			return nil, err
+		}
+	}
+	return e.Payload, nil
+}
+
+// fanout adds the entry to the tiny batch, so it is sent to the watchers of its topic once the tiny batch is committed.
+// It must be called after the entry is set and before it is reset. The caller must hold the tiny batch lock.
+func (db *DB) fanout(e *Entry) {
+	if !db.watchers.watched(e.topicHash) {
+		return
+	}
+	db.tinyBatch.watched = append(db.tinyBatch.watched, watchedEntry{topicHash: e.topicHash, e: &Entry{
+		ID:         messageID(e.cache[entrySize:entrySize+idSize], e.seq),
+		Topic:      append([]byte(nil), e.Topic...),
+		Payload:    append([]byte(nil), e.Payload...),
+		ExpiresAt:  e.ExpiresAt,
+		Contract:   e.Contract,
+		Encryption: e.Encryption,
+	}})
+}
+
+// messageID returns message ID from the ID prefix of the stored message and the sequence.
+func messageID(prefix []byte, seq uint64) []byte {
+	id := make([]byte, 16)
+	copy(id, prefix[:8])
+	binary.LittleEndian.PutUint64(id[8:16], seq)
+	return id
+}
+
+// newQueryOptions returns query options of the DB.
+func (db *DB) newQueryOptions() *queryOptions {
+	return &queryOptions{defaultQueryLimit: db.opts.defaultQueryLimit, maxQueryLimit: db.opts.maxQueryLimit, topicNormalizer: db.opts.topicNormalizer}
+}
+
+// normalizeTopic normalizes topic using the topic normalizer if it is set.
+func (db *DB) normalizeTopic(topic []byte) []byte {
+	if db.opts.topicNormalizer == nil {
+		return topic
+	}
+	return db.opts.topicNormalizer(topic)
+}
+
+// setExpiry sets expiry of the entry for the ID to the expiry returned by f. The expiry of an entry not yet synced is
+// set in memdb and in its time window entry, and an update log record is written so recovery of the log keeps the expiry.
+// The expiry of an entry synced to the DB files is set in the window file. It returns errMsgExpired if the entry has expired.
+func (db *DB) setExpiry(id []byte, f func(expiresAt uint32) (uint32, error)) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	switch {
+	case len(id) == 0:
+		return errMsgIDEmpty
+	case len(id) < message.ID(id).Size():
+		return ErrBadRequest
+	}
+
+	// Sync moves time window entries to the window file so it is blocked during the update.
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	seq := message.ID(id).Sequence()
+	s, err := db.readEntry(0, seq)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, errMsgIDDeleted) {
+			return ErrMsgIDDoesNotExist
+		}
+		return err
+	}
+	msgID, val, err := db.data.readMessage(s)
+	if err != nil {
+		return err
+	}
+	if s.seq != seq || !bytes.Equal(msgID[:idSize-1], id[:idSize-1]) {
+		return ErrMsgIDDoesNotExist // sequence is reused by another entry.
+	}
+
+	now := uint32(db.opts.clock.Now().Unix())
+	expiry := func(expiresAt uint32) (uint32, error) {
+		if expiresAt != 0 && expiresAt <= now {
+			return 0, errMsgExpired
+		}
+		return f(expiresAt)
+	}
+	me, timeID, ok, err := db.pendingEntry(seq)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		topicHash, ok, err := db.timeWindow.liveTopicOf(seq, now)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if _, ok, err := db.timeWindow.topicOf(seq); err != nil || ok {
+				if err != nil {
+					return err
+				}
+				return errMsgExpired
+			}
+			return ErrMsgIDDoesNotExist
+		}
+		found, err := db.setWindowExpiry(topicHash, seq, expiry)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrMsgIDDoesNotExist
+		}
+		return nil
+	}
+
+	expiresAt, err := expiry(me.expiresAt)
+	if err != nil {
+		return err
+	}
+	topic, err := db.data.readTopic(s)
+	if err != nil {
+		return err
+	}
+	e := entry{seq: seq, topicSize: s.topicSize, valueSize: s.valueSize, expiresAt: expiresAt, topicHash: me.topicHash}
+	rec, err := updateRecord(e, msgID, topic, val, msgID[idSize-1])
+	if err != nil {
+		return err
+	}
+	return db.logUpdate(timeID, rec)
+}
+
+// setWindowExpiry sets expiry of the time window entry of the sequence in the topic to the expiry returned by f.
+// The window blocks of the topic are written under the prefix mutex of the topic, the mutex a query on the topic holds.
+func (db *DB) setWindowExpiry(topicHash, seq uint64, f func(expiresAt uint32) (uint32, error)) (bool, error) {
+	off, ok := db.trie.getOffset(topicHash)
+	if !ok {
+		return false, nil
+	}
+	if prefix, ok := db.trie.prefix(topicHash); ok {
+		mu := db.getMutex(prefix)
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	return db.timeWindow.setExpiry(topicHash, off, seq, f)
+}
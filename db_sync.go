@@ -74,7 +74,7 @@ func (db *syncHandle) startSync() bool {
 
 	db.winOff = db.timeWindow.currSize()
 	db.blockOff = db.index.currSize()
-	db.dataOff = db.data.currSize()
+	db.dataOff = db.data.offset
 	db.syncStatusOk = true
 
 	return db.syncStatusOk
@@ -98,7 +98,7 @@ func (db *syncHandle) status() (ok bool) {
 }
 
 func (in *internal) reset() error {
-	in.lastSyncSeq = in.upperSeq
+	atomic.StoreUint64(&in.lastSyncSeq, in.upperSeq)
 	in.count = 0
 	in.inBytes = 0
 	in.upperSeq = 0
@@ -110,7 +110,7 @@ func (in *internal) reset() error {
 
 	in.winOff = in.timeWindow.currSize()
 	in.blockOff = in.index.currSize()
-	in.dataOff = in.data.currSize()
+	in.dataOff = in.data.offset
 
 	return nil
 }
@@ -142,6 +142,8 @@ func (db *syncHandle) abort() error {
 
 func (db *DB) startSyncer(interval time.Duration) {
 	syncTicker := time.NewTicker(interval)
+	stopC := make(chan struct{})
+	db.syncStopC = stopC
 	go func() {
 		defer func() {
 			syncTicker.Stop()
@@ -150,6 +152,8 @@ func (db *DB) startSyncer(interval time.Duration) {
 			select {
 			case <-db.closeC:
 				return
+			case <-stopC:
+				return
 			case <-syncTicker.C:
 				if err := db.Sync(); err != nil {
 					logger.Error().Err(err).Str("context", "startSyncer").Msg("Error syncing to db")
@@ -165,7 +169,7 @@ func (db *DB) startExpirer(durType time.Duration, maxDur int) {
 		for {
 			select {
 			case <-expirerTicker.C:
-				db.expireEntries()
+				db.expireInBackground()
 			case <-db.closeC:
 				expirerTicker.Stop()
 				return
@@ -174,6 +178,30 @@ func (db *DB) startExpirer(durType time.Duration, maxDur int) {
 	}()
 }
 
+func (db *DB) startDefragger(interval time.Duration) {
+	defragTicker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-defragTicker.C:
+				db.defrag()
+			case <-db.closeC:
+				defragTicker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// defrag merges adjacent free blocks. It runs under sync lock so that free blocks are not written to the lease file during defrag.
+func (db *DB) defrag() {
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.freeList.defrag()
+}
+
 func (db *DB) sync() error {
 	// writeHeader information to persist correct seq information to disk, also sync freeblocks to disk.
 	if err := db.writeHeader(); err != nil {
@@ -188,7 +216,7 @@ func (db *DB) sync() error {
 	if err := db.data.Sync(); err != nil {
 		return err
 	}
-	return nil
+	return db.externalIDs.sync()
 }
 
 func (db *syncHandle) sync(recovery bool) error {
@@ -202,6 +230,9 @@ func (db *syncHandle) sync(recovery bool) error {
 		logger.Error().Err(err).Str("context", "data.write")
 		return err
 	}
+	if err := db.writeDataSize(); err != nil {
+		return err
+	}
 
 	nBlocks := int32((db.internal.upperSeq - 1) / entriesPerIndexBlock)
 	if nBlocks > db.blocks() {
@@ -229,6 +260,8 @@ func (db *syncHandle) sync(recovery bool) error {
 	db.meter.Syncs.Inc(db.internal.count)
 	db.meter.InMsgs.Inc(db.internal.count)
 	db.meter.InBytes.Inc(db.internal.inBytes)
+	db.opts.metricsSink.Sync(db.internal.count)
+	db.opts.metricsSink.InBytes(db.internal.inBytes)
 	db.syncComplete = true
 	return nil
 }
@@ -240,17 +273,15 @@ func (db *syncHandle) Sync() error {
 	// // CPU profiling by default
 	// defer profile.Start().Stop()
 	var err1 error
-	baseSeq := db.internal.lastSyncSeq
 	err := db.timeWindow.foreachTimeWindow(func(timeID int64, wEntries windowEntries) (bool, error) {
 		winEntries := make(map[uint64]windowEntries)
+		// synced are sequences of the entries written to the DB files.
+		var synced []uint64
 		for _, we := range wEntries {
 			if we.seq() == 0 {
 				db.entriesInvalid++
 				continue
 			}
-			if we.seq() < baseSeq {
-				baseSeq = we.seq()
-			}
 			if we.seq() > db.internal.upperSeq {
 				db.internal.upperSeq = we.seq()
 			}
@@ -293,6 +324,7 @@ func (db *syncHandle) Sync() error {
 			} else {
 				winEntries[e.topicHash] = windowEntries{we}
 			}
+			synced = append(synced, we.seq())
 
 			db.filter.Append(we.seq())
 			db.internal.count++
@@ -311,8 +343,6 @@ func (db *syncHandle) Sync() error {
 				return true, errors.New("db:Sync: timeWindow sync error: unable to set topic offset in trie")
 			}
 		}
-		blockID := startBlockIndex(baseSeq)
-		db.mem.Free(uint64(blockID), db.cacheID^baseSeq)
 		if err1 != nil {
 			return true, err1
 		}
@@ -325,6 +355,11 @@ func (db *syncHandle) Sync() error {
 				logger.Error().Err(err).Str("context", "wal.SignalLogApplied")
 				return true, err
 			}
+			// entries are synced to DB, so memdb space of the entries is freed to reuse.
+			for _, we := range wEntries {
+				db.mem.Delete(uint64(startBlockIndex(we.seq())), db.cacheID^we.seq())
+			}
+			db.runSyncHooks(synced)
 		}
 		// db.freeList.releaseLease(timeID)
 		return false, nil
@@ -343,6 +378,27 @@ func (db *syncHandle) Sync() error {
 	return db.sync(false)
 }
 
+// readExpiryNotice reads topic and message ID of the entry to notify expiry.
+func (db *DB) readExpiryNotice(topicHash uint64, s slot) (expiryNotice, error) {
+	id, _, err := db.data.readMessage(s)
+	if err != nil {
+		return expiryNotice{}, err
+	}
+	topic, _ := db.trie.getName(topicHash)
+	return expiryNotice{topic: topic, id: messageID(id, s.seq)}, nil
+}
+
+// expireInBackground runs expirer unless background expiry is paused. The expiry lock is held
+// during the run, so PauseBackgroundExpiry waits for it to finish.
+func (db *DB) expireInBackground() error {
+	db.expiryMu.Lock()
+	defer db.expiryMu.Unlock()
+	if atomic.LoadUint32(&db.expiryPaused) == 1 {
+		return nil
+	}
+	return db.expireEntries()
+}
+
 // expireEntries run expirer to delete entries from db if ttl was set on entries and that has expired.
 func (db *DB) expireEntries() error {
 	// sync happens synchronously.
@@ -351,8 +407,14 @@ func (db *DB) expireEntries() error {
 		<-db.syncLockC
 	}()
 	expiredEntries := db.timeWindow.getExpiredEntries(db.opts.defaultQueryLimit)
+	var notified []expiryNotice
+	defer func() {
+		if db.expiryNotifier != nil {
+			db.expiryNotifier.push(notified)
+		}
+	}()
 	for _, expiredEntry := range expiredEntries {
-		we := expiredEntry.(winEntry)
+		we := expiredEntry.(expiryEntry)
 		/// Test filter block if message hash presence.
 		if !db.filter.Test(we.seq()) {
 			continue
@@ -377,7 +439,20 @@ func (db *DB) expireEntries() error {
 			return nil
 		}
 		e := b.entries[entryIdx]
+		if db.expiryNotifier != nil {
+			ee, err := db.readExpiryNotice(we.topicHash, e)
+			if err != nil {
+				return err
+			}
+			notified = append(notified, ee)
+		}
+		if err := db.unwarm(e.seq); err != nil {
+			return err
+		}
 		db.freeList.free(e.seq, e.msgOffset, e.mSize())
+		if err := db.externalIDs.remove(e.seq); err != nil {
+			return err
+		}
 		db.decount(1)
 	}
 
@@ -17,20 +17,44 @@
 package unitdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/unitdbtest"
+	"github.com/unit-io/unitdb/wal"
 )
 
 func cleanup(path string) {
 	os.Remove(path + indexPostfix)
 	os.Remove(path + dataPostfix)
 	os.Remove(path + logPostfix)
+	os.Remove(path + leasePostfix)
 	os.Remove(path + lockPostfix)
 	os.Remove(path + windowPostfix)
 	os.Remove(path + filterPostfix)
+	os.Remove(path + metaPostfix)
+	os.Remove(path + externalIDPostfix)
+	os.Remove(path + subscriberPostfix)
+	os.Remove(path + shardPostfix)
+	os.Remove(path + reEncryptPostfix)
+	os.Remove(path + windowPostfix + compactPostfix)
+
 }
 
 func TestSimple(t *testing.T) {
@@ -197,6 +221,84 @@ func TestBatch(t *testing.T) {
 	verifyMsgsAndClose()
 }
 
+func TestBatchProgress(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit1.test")
+	var n = 10
+	var written, total int
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		b.OnProgress(func(w, t int) {
+			written, total = w, t
+		})
+		for i := 0; i < n; i++ {
+			if err := b.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				return err
+			}
+			if i == n/2 {
+				if err := b.Write(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != n || total != n {
+		t.Fatalf("expected progress %d/%d; got %d/%d", n, n, written, total)
+	}
+}
+
+func TestBatchReset(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit1.test")
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		for i := 0; i < 5; i++ {
+			if err := b.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				return err
+			}
+		}
+		if b.Len() != 5 || b.Size() == 0 {
+			t.Fatalf("expected 5 pending entries; got %d of size %d", b.Len(), b.Size())
+		}
+		if err := b.Reset(); err != nil {
+			return err
+		}
+		if b.Len() != 0 || b.Size() != 0 {
+			t.Fatalf("expected empty batch after reset; got %d of size %d", b.Len(), b.Size())
+		}
+		for i := 0; i < 3; i++ {
+			if err := b.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 3 {
+		t.Fatalf("expected 3 entries; got %d", len(v))
+	}
+}
+
 func TestExpiry(t *testing.T) {
 	cleanup("test.db")
 	db, err := Open("test.db", WithMutable(), WithBackgroundKeyExpiry())
@@ -238,79 +340,4081 @@ func TestExpiry(t *testing.T) {
 	db.expireEntries()
 }
 
-func TestLeasing(t *testing.T) {
+func TestExpiryWithClock(t *testing.T) {
 	cleanup("test.db")
-	db, err := Open("test.db", WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithMinimumFreeBlocksSize(1<<4), WithMutable(), WithBackgroundKeyExpiry())
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer db.Close()
-	var i uint16
-	var n uint16 = 100
+	topic := []byte("unit4.test")
+	entry := &Entry{Topic: topic, Payload: []byte("msg"), ExpiresAt: uint32(clock.Now().Add(time.Minute).Unix())}
+	if err := db.PutEntry(entry); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(NewQuery(topic)); len(data) != 1 || err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(2 * time.Minute)
+	if data, err := db.Get(NewQuery(topic)); len(data) != 0 || err != nil {
+		t.Fatal(err)
+	}
+}
 
-	topic := []byte("unit1.test")
-	var ids [][]byte
-	for i = 0; i < n; i++ {
-		messageID := db.NewID()
-		val := []byte(fmt.Sprintf("msg.%2d", i))
-		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
+func TestDedupKey(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock), WithDedupWindow(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit4.test")
+	for i := 0; i < 3; i++ {
+		if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithDedupKey([]byte("key1"))); err != nil {
 			t.Fatal(err)
 		}
-		ids = append(ids, messageID)
 	}
-	if err := db.Sync(); err != nil {
+	if data, err := db.Get(NewQuery(topic)); len(data) != 1 || err != nil {
+		t.Fatalf("expected 1 entry; got %d %v", len(data), err)
+	}
+	clock.Add(2 * time.Minute)
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithDedupKey([]byte("key1"))); err != nil {
 		t.Fatal(err)
 	}
-	for _, id := range ids {
-		db.Delete(id, topic)
+	if data, err := db.Get(NewQuery(topic)); len(data) != 2 || err != nil {
+		t.Fatalf("expected 2 entries; got %d %v", len(data), err)
 	}
-	for i = 0; i < n; i++ {
-		messageID := db.NewID()
-		val := []byte(fmt.Sprintf("msg.%2d", i))
-		if err := db.Put(topic, val); err != nil {
+	// dedup keys of an aborted batch are forgotten, so the retry is written.
+	errAbort := errors.New("abort")
+	for _, abort := range []bool{true, false} {
+		err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+			if err := b.PutEntry(NewEntry(topic, []byte("msg")).WithDedupKey([]byte("key2"))); err != nil {
+				return err
+			}
+			if abort {
+				return errAbort
+			}
+			return nil
+		})
+		if abort && !errors.Is(err, errAbort) || !abort && err != nil {
+			t.Fatalf("unexpected batch error %v", err)
+		}
+	}
+	if data, err := db.Get(NewQuery(topic)); len(data) != 3 || err != nil {
+		t.Fatalf("expected 3 entries; got %d %v", len(data), err)
+	}
+}
+
+func TestHasEntry(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit4.has")
+	put := func() []byte {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id)); err != nil {
 			t.Fatal(err)
 		}
-		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
+		if err := db.FlushBatch(); err != nil {
 			t.Fatal(err)
 		}
-		ids = append(ids, messageID)
+		return id
 	}
+	syncedID := put()
+	clock.Add(time.Second)
 	if err := db.Sync(); err != nil {
 		t.Fatal(err)
 	}
-	for _, id := range ids {
-		db.Delete(id, topic)
+	pendingID := put()
+	for _, id := range [][]byte{syncedID, pendingID} {
+		if ok, err := db.HasEntry(id); !ok || err != nil {
+			t.Fatalf("expected entry %d; got %v %v", message.ID(id).Sequence(), ok, err)
+		}
+		// an ID with the sequence of an entry of another contract does not match the entry.
+		staleID := message.ID(append([]byte(nil), id...))
+		staleID.SetContract(contract)
+		if ok, err := db.HasEntry(staleID); ok || err != nil {
+			t.Fatalf("expected no entry for stale ID %d; got %v %v", message.ID(id).Sequence(), ok, err)
+		}
 	}
 }
 
-func TestWildcardTopics(t *testing.T) {
+func TestEntryPool(t *testing.T) {
 	cleanup("test.db")
-	db, err := Open("test.db", WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithMinimumFreeBlocksSize(1<<16), WithMutable(), WithBackgroundKeyExpiry())
+	db, err := Open("test.db", WithMutable())
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer db.Close()
+	topics := [][]byte{[]byte("unit4.test1"), []byte("unit4.test2")}
+	for _, topic := range topics {
+		e := db.AcquireEntry()
+		e.Topic = topic
+		for i := 0; i < 3; i++ {
+			if err := db.PutEntry(e.WithPayload([]byte(fmt.Sprintf("msg.%2d", i)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.ReleaseEntry(e)
+	}
+	for _, topic := range topics {
+		if data, err := db.Get(NewQuery(topic)); len(data) != 3 || err != nil {
+			t.Fatalf("expected 3 entries for topic %s; got %d %v", topic, len(data), err)
+		}
+	}
+}
 
-	tests := []struct {
-		wtopic []byte
-		topic  []byte
-		msg    []byte
-	}{
-		{[]byte("..."), []byte("unit.b.b1"), []byte("...1")},
-		{[]byte("unit.b..."), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.b...1")},
-		{[]byte("unit.*.b1.b11.*.*.b11111.*"), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.*.b1.b11.*.*.b11111.*.1")},
-		{[]byte("unit.*.b1.*.*.*.b11111.*"), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.*.b1.*.*.*.b11111.*.1")},
-		{[]byte("unit.b.b1"), []byte("unit.b.b1"), []byte("unit.b.b1.1")},
-		{[]byte("unit.b.b1.b11"), []byte("unit.b.b1.b11"), []byte("unit.b.b1.b11.1")},
-		{[]byte("unit.b"), []byte("unit.b"), []byte("unit.b.1")},
+func TestWriteHook(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
 	}
-	for _, tt := range tests {
-		db.Put(tt.wtopic, tt.msg)
-		if msg, err := db.Get(NewQuery(tt.wtopic).WithLimit(10)); len(msg) == 0 || err != nil {
+	defer db.Close()
+	errRejected := errors.New("rejected")
+	if err := db.RegisterWriteHook(func(e *Entry) error {
+		e.Payload = append([]byte("v1:"), e.Payload...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RegisterWriteHook(func(e *Entry) error {
+		if string(e.Payload) == "v1:bad" {
+			return errRejected
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit4.test")
+	if err := db.Put(topic, []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, []byte("bad")); err != errRejected {
+		t.Fatalf("expected hook error; got %v", err)
+	}
+	data, err := db.Get(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || string(data[0]) != "v1:msg" {
+		t.Fatalf("expected [v1:msg]; got %q", data)
+	}
+
+	// hooks run before the write lock, so a hook can write to the DB.
+	if err := db.RegisterWriteHook(func(e *Entry) error {
+		if string(e.Payload) == "v1:audit" {
+			return db.Put([]byte("unit4.audit"), []byte("audited"))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, []byte("audit")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(NewQuery([]byte("unit4.audit"))); len(data) != 1 || string(data[0]) != "v1:audited" || err != nil {
+		t.Fatalf("expected [v1:audited]; got %q %v", data, err)
+	}
+	// internal copies do not run the hooks again.
+	id := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("copy")).WithID(id)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DuplicateEntry(id, []byte("unit4.copy"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MoveEntry(id, []byte("unit4.move"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, copyTopic := range []string{"unit4.copy", "unit4.move"} {
+		if data, err := db.Get(NewQuery([]byte(copyTopic))); len(data) != 1 || string(data[0]) != "v1:copy" || err != nil {
+			t.Fatalf("expected [v1:copy] for topic %s; got %q %v", copyTopic, data, err)
+		}
+	}
+}
+
+func TestQueryCursor(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit4.test")
+	var n = 25
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
 			t.Fatal(err)
 		}
-		if msg, err := db.Get(NewQuery(tt.topic).WithLimit(10)); len(msg) == 0 || err != nil {
+	}
+	var vals [][]byte
+	var cursor uint64
+	q := NewQuery(topic).WithLimit(10)
+	for {
+		items, err := db.Get(q.WithCursor(cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) == 0 {
+			break
+		}
+		vals = append(vals, items...)
+		cursor = q.Cursor()
+	}
+	if len(vals) != n {
+		t.Fatalf("expected %d entries; got %d", n, len(vals))
+	}
+	for i, val := range vals {
+		if want := fmt.Sprintf("msg.%2d", i); string(val) != want {
+			t.Fatalf("expected %s; got %s", want, val)
+		}
+	}
+}
+
+func TestReadHook(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.RegisterReadHook(func(e *Entry) error {
+		if string(e.Payload) == "bad" {
+			return ErrSkipEntry
+		}
+		e.Payload = bytes.ToUpper(e.Payload)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit4.test")
+	for _, val := range []string{"msg1", "bad", "msg2"} {
+		if err := db.Put(topic, []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := db.Get(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{[]byte("MSG2"), []byte("MSG1")}; !reflect.DeepEqual(data, want) {
+		t.Fatalf("expected %q; got %q", want, data)
+	}
+	// skipped entries do not count toward the limit.
+	if err := db.Put(topic, []byte("bad")); err != nil {
+		t.Fatal(err)
+	}
+	data, err = db.Get(NewQuery(topic).WithLimit(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{[]byte("MSG2"), []byte("MSG1")}; !reflect.DeepEqual(data, want) {
+		t.Fatalf("expected %q with limit 2; got %q", want, data)
+	}
+	it, err := db.Items(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for it.First(); it.Valid(); it.Next() {
+		if bytes.Equal(it.Item().Value(), []byte("bad")) {
+			t.Fatal("expected skipped entry not to be returned")
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 items; got %d", n)
+	}
+}
+
+func TestGetItems(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit4.test")
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	items, err := db.GetItems(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items; got %d", len(items))
+	}
+	for i, item := range items {
+		j := len(ids) - i - 1
+		if want := fmt.Sprintf("msg.%2d", j); string(item.Value()) != want || !bytes.Equal(item.Topic(), topic) {
+			t.Fatalf("expected %s; got %s", want, item.Value())
+		}
+		if message.ID(item.ID()).Sequence() != message.ID(ids[j]).Sequence() {
+			t.Fatalf("expected ID of entry %d", j)
+		}
+		if item.Time().IsZero() {
+			t.Fatal("expected item time to be set")
+		}
+	}
+	if err := db.Delete(items[0].ID(), topic); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(NewQuery(topic)); len(data) != 2 || err != nil {
+		t.Fatalf("expected 2 entries after delete; got %d %v", len(data), err)
+	}
+
+	// items of entries put to a wildcard topic matching the query carry the topic of the entry.
+	if err := db.Put([]byte("unit4.*"), []byte("msg.wildcard")); err != nil {
+		t.Fatal(err)
+	}
+	items, err = db.GetItems(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items; got %d", len(items))
+	}
+	for _, item := range items {
+		want := topic
+		if string(item.Value()) == "msg.wildcard" {
+			want = []byte("unit4.*")
+		}
+		if !bytes.Equal(item.Topic(), want) {
+			t.Fatalf("expected topic %s of item %s; got %s", want, item.Value(), item.Topic())
+		}
+	}
+}
+
+func TestDeletePersisted(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit4.delete")
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	other := []byte("unit4.delete.other")
+	otherID := db.NewID()
+	if err := db.PutEntry(NewEntry(other, []byte("other")).WithID(otherID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	// time window entries are written on sync after the clock moves past their release.
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// the first entry of the topic carries the topic name.
+	for _, id := range ids[:2] {
+		if err := db.Delete(id, topic); err != nil {
 			t.Fatal(err)
 		}
 	}
+	if err := db.DeleteBySeq(message.ID(otherID).Sequence()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	ot, _, err := db.parseTopic(message.MasterContract, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot.AddContract(message.MasterContract)
+	if _, ok := db.trie.getOffset(ot.GetHash(message.MasterContract)); ok {
+		t.Fatal("expected topic to be removed once its last entry is deleted")
+	}
+	seq := message.ID(ids[1]).Sequence()
+	bh := blockHandle{file: db.index, offset: blockOffset(startBlockIndex(seq))}
+	if err := bh.read(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range bh.entries {
+		if s.seq == seq {
+			t.Fatal("expected deleted entry to be removed from the index block")
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	data, err := db.Get(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{[]byte("msg. 2")}; !reflect.DeepEqual(data, want) {
+		t.Fatalf("expected %q after reopen; got %q", want, data)
+	}
+	if data, err := db.Get(NewQuery(other)); len(data) != 0 || err != nil {
+		t.Fatalf("expected no entries for deleted topic; got %d %v", len(data), err)
+	}
+	if _, err := db.GetBySeq(seq); err != ErrSeqNotFound {
+		t.Fatalf("expected deleted entry to be removed after reopen; got %v", err)
+	}
+}
+
+func TestGetBySeq(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit4.seq")
+	var seqs []uint64
+	for i := 0; i < 3; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, message.ID(id).Sequence())
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	verify := func() {
+		for i, seq := range seqs {
+			e, err := db.GetBySeq(seq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("msg.%2d", i); string(e.Payload) != want {
+				t.Fatalf("expected %s; got %s", want, e.Payload)
+			}
+			if i == 0 && !bytes.Equal(e.Topic, topic) {
+				t.Fatalf("expected topic of the first entry; got %s", e.Topic)
+			}
+		}
+		if _, err := db.GetBySeq(seqs[2] + 100); err != ErrSeqNotFound {
+			t.Fatalf("expected ErrSeqNotFound; got %v", err)
+		}
+	}
+	verify()
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify()
+}
+
+func TestMaxTopicSize(t *testing.T) {
+	cleanup("test.db")
+	if _, err := Open("test.db", WithMaxTopicSize(maxTopicLength+1)); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for topic size above the maximum; got %v", err)
+	}
+	if _, err := Open("test.db", WithMaxValueSize(0)); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for zero value size; got %v", err)
+	}
+	db, err := Open("test.db", WithMutable(), WithMaxTopicSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit4.topic.size")
+	if err := db.Put(topic, []byte("msg")); err != ErrTopicTooLarge {
+		t.Fatalf("expected ErrTopicTooLarge on put; got %v", err)
+	}
+	if _, err := db.Get(NewQuery(topic)); err != ErrTopicTooLarge {
+		t.Fatalf("expected ErrTopicTooLarge on get; got %v", err)
+	}
+	if _, err := db.EntriesAfterSeq(topic, 0, 1); err != ErrTopicTooLarge {
+		t.Fatalf("expected ErrTopicTooLarge on EntriesAfterSeq; got %v", err)
+	}
+}
+
+func TestGetEntryMetadata(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit4.test?ttl=1h")
+	id := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id)); err != nil {
+		t.Fatal(err)
+	}
+	md, err := db.GetEntryMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := md.ExpiresAt
+	if md.Seq != message.ID(id).Sequence() || md.TopicSize == 0 || md.ValueSize == 0 || md.ExpiresAt == 0 || md.MsgOffset != 0 {
+		t.Fatalf("unexpected metadata of unsynced entry %+v", md)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	md, err = db.GetEntryMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Seq != message.ID(id).Sequence() || md.ValueSize == 0 || md.ExpiresAt != expiresAt || md.MsgOffset == 0 {
+		t.Fatalf("unexpected metadata of synced entry %+v", md)
+	}
+	if _, err := db.GetEntryMetadata(db.NewID()); err != ErrMsgIDDoesNotExist {
+		t.Fatalf("expected ErrMsgIDDoesNotExist; got %v", err)
+	}
+	// an ID with the sequence of an entry of another contract does not match the entry.
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleID := message.ID(append([]byte(nil), id...))
+	staleID.SetContract(contract)
+	if _, err := db.GetEntryMetadata(staleID); err != ErrMsgIDDoesNotExist {
+		t.Fatalf("expected ErrMsgIDDoesNotExist for stale ID; got %v", err)
+	}
+}
+
+func TestTopicNormalizer(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable(), WithTopicNormalizer(LowerCaseTopic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("Dev1.Temp"), []byte("msg1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("dev1.temp"), []byte("msg2")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(NewQuery([]byte("DEV1.temp"))); len(data) != 2 || err != nil {
+		t.Fatalf("expected 2 entries; got %d %v", len(data), err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("test.db", WithMutable()); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected open without normalizer to fail; got %v", err)
+	}
+	db, err = Open("test.db", WithMutable(), WithTopicNormalizer(LowerCaseTopic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+}
+
+func TestExtendExpiry(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit4.test")
+	id := db.NewID()
+	if err := db.PutEntry(&Entry{ID: id, Topic: topic, Payload: []byte("msg"), ExpiresAt: uint32(clock.Now().Add(time.Minute).Unix())}); err != nil {
+		t.Fatal(err)
+	}
+	noExpiryID := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(noExpiryID)); err != nil {
+		t.Fatal(err)
+	}
+	// extend expiry of the pending window entry.
+	if err := db.ExtendExpiry(id, 2*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ExtendExpiry(noExpiryID, time.Minute); err != ErrEntryHasNoExpiry {
+		t.Fatalf("expected ErrEntryHasNoExpiry; got %v", err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(2 * time.Minute)
+	if data, err := db.Get(NewQuery(topic)); len(data) != 2 || err != nil {
+		t.Fatalf("expected 2 entries; got %d %v", len(data), err)
+	}
+	// set expiry of the window entry in the window file.
+	if err := db.SetExpiry(id, clock.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(2 * time.Minute)
+	if data, err := db.Get(NewQuery(topic)); len(data) != 1 || err != nil {
+		t.Fatalf("expected 1 entry; got %d %v", len(data), err)
+	}
+}
+
+func TestScanContract(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"unit4.b", "unit4.a"} {
+		for i := 0; i < 2; i++ {
+			if err := db.PutEntry(NewEntry([]byte(topic), []byte(fmt.Sprintf("%s.%d", topic, i))).WithContract(contract)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Put([]byte("unit4.a"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	var vals []string
+	if err := db.ScanContract(contract, func(topic, payload []byte) error {
+		vals = append(vals, string(payload))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"unit4.a.0", "unit4.a.1", "unit4.b.0", "unit4.b.1"}; !reflect.DeepEqual(vals, want) {
+		t.Fatalf("expected %v; got %v", want, vals)
+	}
+
+	// entries synced to the window file are scanned before the pending entries of the topic.
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit4.a"), []byte("unit4.a.2")).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	vals = vals[:0]
+	if err := db.ScanContract(contract, func(topic, payload []byte) error {
+		if string(topic) == "unit4.a" {
+			vals = append(vals, string(payload))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"unit4.a.0", "unit4.a.1", "unit4.a.2"}; !reflect.DeepEqual(vals, want) {
+		t.Fatalf("expected %v; got %v", want, vals)
+	}
+}
+
+func TestClearExpiry(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit4.test")
+	id := db.NewID()
+	if err := db.PutEntry(&Entry{ID: id, Topic: topic, Payload: []byte("msg"), ExpiresAt: uint32(clock.Now().Add(time.Minute).Unix())}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ClearExpiry(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ClearExpiry(id); err != ErrEntryAlreadyPermanent {
+		t.Fatalf("expected ErrEntryAlreadyPermanent; got %v", err)
+	}
+	clock.Add(2 * time.Minute)
+	if data, err := db.Get(NewQuery(topic)); len(data) != 1 || err != nil {
+		t.Fatalf("expected 1 entry; got %d %v", len(data), err)
+	}
+}
+
+func TestSetExpiryRecovery(t *testing.T) {
+	cleanup("test.db")
+	cleanup("test2.db")
+	defer cleanup("test2.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit4.expiry")
+	expiresAt := uint32(clock.Now().Add(time.Minute).Unix())
+	syncedID := db.NewID()
+	if err := db.PutEntry(&Entry{ID: syncedID, Topic: topic, Payload: []byte("msg.synced"), ExpiresAt: expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	pendingID := db.NewID()
+	if err := db.PutEntry(&Entry{ID: pendingID, Topic: topic, Payload: []byte("msg.pending"), ExpiresAt: expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range [][]byte{syncedID, pendingID} {
+		if err := db.ClearExpiry(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// copy the DB files before the entry is synced to simulate a crash, recovery of the log keeps the expiry.
+	for _, postfix := range []string{indexPostfix, dataPostfix, logPostfix, leasePostfix, windowPostfix, filterPostfix, metaPostfix, externalIDPostfix} {
+		data, err := os.ReadFile("test.db" + postfix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile("test2.db"+postfix, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(2 * time.Minute)
+	for _, path := range []string{"test.db", "test2.db"} {
+		db, err := Open(path, WithMutable(), WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := db.Get(NewQuery(topic)); len(data) != 2 || err != nil {
+			t.Fatalf("expected 2 entries after reopen of %s; got %d %v", path, len(data), err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEntryValidate(t *testing.T) {
+	if err := NewEntry([]byte("unit4.test?ttl=1m"), []byte("msg")).Validate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewEntry(nil, []byte("msg")).Validate(0); err != errTopicEmpty {
+		t.Fatalf("expected errTopicEmpty; got %v", err)
+	}
+	if err := NewEntry([]byte("unit4.test"), nil).Validate(0); err != errValueEmpty {
+		t.Fatalf("expected errValueEmpty; got %v", err)
+	}
+	if err := NewEntry([]byte("unit4.test?ttl=1x"), []byte("msg")).Validate(0); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for invalid ttl; got %v", err)
+	}
+}
+
+func TestValidateEntry(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable(), WithMaxTopicSize(20), WithTopicNormalizer(func(topic []byte) []byte {
+		return bytes.TrimSuffix(topic, []byte("?ttl=never"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.ValidateEntry(NewEntry([]byte("unit4.test?ttl=1m"), []byte("msg")), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ValidateEntry(NewEntry(nil, []byte("msg")), 0); err != errTopicEmpty {
+		t.Fatalf("expected errTopicEmpty; got %v", err)
+	}
+	if err := db.ValidateEntry(NewEntry([]byte("unit4.test"), nil), 0); err != errValueEmpty {
+		t.Fatalf("expected errValueEmpty; got %v", err)
+	}
+	if err := db.ValidateEntry(NewEntry([]byte("unit4.test?ttl=1x"), []byte("msg")), 0); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for invalid ttl; got %v", err)
+	}
+	if err := db.Put([]byte("unit4.test?ttl=1x"), []byte("msg")); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for invalid ttl; got %v", err)
+	}
+	// the configured maximum topic size is checked as on put.
+	topic := []byte("unit4.test.topic.size")
+	if err := db.ValidateEntry(NewEntry(topic, []byte("msg")), 0); err != ErrTopicTooLarge {
+		t.Fatalf("expected ErrTopicTooLarge; got %v", err)
+	}
+	if err := db.Put(topic, []byte("msg")); err != ErrTopicTooLarge {
+		t.Fatalf("expected ErrTopicTooLarge on put; got %v", err)
+	}
+	// the topic is validated after it is normalized.
+	if err := db.ValidateEntry(NewEntry([]byte("unit4.test?ttl=never"), []byte("msg")), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEntryCreatedAt(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ts := time.Now().Add(-time.Hour).Truncate(time.Second)
+	e := NewEntry([]byte("unit4.test"), []byte("msg"))
+	if err := db.PutWithTimestamp(e, ts); err != nil {
+		t.Fatal(err)
+	}
+	items, err := db.GetItems(NewQuery([]byte("unit4.test")))
+	if err != nil || len(items) != 1 {
+		t.Fatalf("expected 1 item; got %d %v", len(items), err)
+	}
+	createdAt, err := db.EntryCreatedAt(items[0].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !createdAt.Equal(ts) {
+		t.Fatalf("expected %v; got %v", ts, createdAt)
+	}
+	if _, err := db.EntryCreatedAt(db.NewID()); err != ErrMsgIDDoesNotExist {
+		t.Fatalf("expected ErrMsgIDDoesNotExist; got %v", err)
+	}
+}
+
+func TestLeasing(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithMinimumFreeBlocksSize(1<<4), WithMutable(), WithBackgroundKeyExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var i uint16
+	var n uint16 = 100
+
+	topic := []byte("unit1.test")
+	var ids [][]byte
+	for i = 0; i < n; i++ {
+		messageID := db.NewID()
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, messageID)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		db.Delete(id, topic)
+	}
+	for i = 0; i < n; i++ {
+		messageID := db.NewID()
+		val := []byte(fmt.Sprintf("msg.%2d", i))
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutEntry(NewEntry(topic, val).WithID(messageID)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, messageID)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		db.Delete(id, topic)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	cleanup("test.db")
+	if _, err := Open("test.db", WithConcurrency(0)); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for zero concurrency; got %v", err)
+	}
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock), WithConcurrency(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.freeList.nShards != 4 || db.timeWindow.windowBlocks.nShards != 4 {
+		t.Fatalf("expected 4 shards; got %d %d", db.freeList.nShards, db.timeWindow.windowBlocks.nShards)
+	}
+	var n = 100
+	for i := 0; i < n; i++ {
+		topic := []byte(fmt.Sprintf("unit9.concurrency.%d", i%8))
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// free lists of the lease file are read into a different number of shards.
+	db, err = Open("test.db", WithMutable(), WithClock(clock), WithConcurrency(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	for i := 0; i < 8; i++ {
+		items, err := db.Get(NewQuery([]byte(fmt.Sprintf("unit9.concurrency.%d", i))).WithLimit(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		count += len(items)
+	}
+	if count != n {
+		t.Fatalf("expected %d items after reopen; got %d", n, count)
+	}
+}
+
+func TestWarmCacheEvict(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit10.warm")
+	var n = 50
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// warmed entries fill the memdb, these are evicted on next put instead of blocking it.
+	db, err = Open("test.db", WithMutable(), WithClock(clock), WithMemdbSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.WarmCache([][]byte{topic}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.warmed.seqs) != n || db.mem.Occupancy() < 1 {
+		t.Fatalf("expected %d warmed entries filling memdb; got %d entries, occupancy %.2f", n, len(db.warmed.seqs), db.mem.Occupancy())
+	}
+	if err := db.Put(topic, []byte("msg.50")); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.warmed.seqs) != 0 || db.mem.Occupancy() >= 1 {
+		t.Fatalf("expected warmed entries evicted; got %d entries, occupancy %.2f", len(db.warmed.seqs), db.mem.Occupancy())
+	}
+	items, err := db.Get(NewQuery(topic).WithLimit(2 * n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n+1 {
+		t.Fatalf("expected %d items; got %d", n+1, len(items))
+	}
+}
+
+func TestWithoutFilter(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock), WithoutFilter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit11.nofilter")
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// delete reads the index block directly as there is no filter.
+	if err := db.Delete(ids[2], topic); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the flag is read from the header on reopen.
+	db, err = Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.noFilter != 1 || db.filter.filterBlock != nil {
+		t.Fatal("expected filter to stay disabled on reopen")
+	}
+	data, err := db.Get(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || string(data[0]) != "msg. 1" || string(data[1]) != "msg. 0" {
+		t.Fatalf("unexpected items %q", data)
+	}
+}
+
+func TestFreeBlockHistogram(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, b := range []freeblock{{offset: 1 << 20, size: 5}, {offset: 2 << 20, size: 100}, {offset: 3 << 20, size: 120}, {offset: 4 << 20, size: 4096}} {
+		db.freeList.freeBlock(b.offset, b.size)
+	}
+	hist, err := db.FreeBlockHistogram()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hist) != 32 {
+		t.Fatalf("expected 32 bins; got %d", len(hist))
+	}
+	for i, want := range map[int]FreeBin{
+		2:  {MinSize: 4, MaxSize: 7, Count: 1, TotalBytes: 5},
+		6:  {MinSize: 64, MaxSize: 127, Count: 2, TotalBytes: 220},
+		12: {MinSize: 4096, MaxSize: 8191, Count: 1, TotalBytes: 4096},
+	} {
+		if hist[i] != want {
+			t.Fatalf("expected bin %d %+v; got %+v", i, want, hist[i])
+		}
+	}
+	var count int
+	for _, bin := range hist {
+		count += bin.Count
+	}
+	if count != 4 {
+		t.Fatalf("expected 4 free blocks; got %d", count)
+	}
+}
+
+func TestSnapshotTimeWindow(t *testing.T) {
+	cleanup("test.db")
+	cleanup("test2.db")
+	defer cleanup("test2.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit12.window")
+	xid := []byte("0123456789abcdef")
+	var seqs []uint64
+	for i := 0; i < 3; i++ {
+		id := db.NewID()
+		e := NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)
+		if i == 0 {
+			e.WithExternalID(xid)
+		}
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, message.ID(id).Sequence())
+	}
+	// window entries are not released to the window file until the clock moves.
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := db.SnapshotTimeWindow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4+8+int(blockSize)+externalIDRecordSize {
+		t.Fatalf("expected a single window block and external ID in the snapshot; got %d bytes", len(data))
+	}
+
+	db2, err := Open("test2.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if err := db2.RestoreTimeWindow(data); err != nil {
+		t.Fatal(err)
+	}
+	tp, _, err := db.parseTopic(message.MasterContract, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.AddContract(message.MasterContract)
+	wEntries, _ := db2.timeWindow.ilookup(tp.GetHash(message.MasterContract), 10)
+	if len(wEntries) != len(seqs) {
+		t.Fatalf("expected %d restored window entries; got %d", len(seqs), len(wEntries))
+	}
+	for i, we := range wEntries {
+		if we.seq() != seqs[len(seqs)-1-i] {
+			t.Fatalf("expected restored seq %d; got %d", seqs[len(seqs)-1-i], we.seq())
+		}
+	}
+	if id, ok := db2.externalIDs.lookupSeq(seqs[0]); !ok || string(id) != string(xid) {
+		t.Fatalf("expected restored external ID of seq %d; got %q", seqs[0], id)
+	}
+	if err := db2.RestoreTimeWindow(data[:len(data)-1]); err == nil {
+		t.Fatal("expected error restoring truncated snapshot")
+	}
+}
+
+func TestTopicsBySize(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sizes := map[string]int{"unit13.small": 10, "unit13.large": 1000, "unit13.medium": 100}
+	for topic, size := range sizes {
+		for i := 0; i < 3; i++ {
+			// random values so the size is not reduced by compression.
+			val := make([]byte, size)
+			rand.Read(val)
+			if err := db.Put([]byte(topic), val); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	top, err := db.TopicsBySize(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].Topic != "unit13.large" || top[1].Topic != "unit13.medium" {
+		t.Fatalf("unexpected topics by size %+v", top)
+	}
+	for _, ts := range top {
+		if ts.Bytes < int64(3*sizes[ts.Topic]) {
+			t.Fatalf("expected topic %s size at least %d; got %d", ts.Topic, 3*sizes[ts.Topic], ts.Bytes)
+		}
+	}
+}
+
+func TestMemdbBackpressure(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock), WithMemdbSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit14.memdb")
+	val := make([]byte, 100)
+	for db.mem.Occupancy() < 1 {
+		if err := db.Put(topic, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errC := make(chan error, 1)
+	go func() {
+		errC <- db.Put(topic, val)
+	}()
+	select {
+	case err := <-errC:
+		t.Fatalf("expected put to wait while memdb is full; got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// sync frees memdb space and unblocks the put.
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		clock.Add(time.Second)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-errC:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if i < 10 {
+				continue
+			}
+			t.Fatal("expected put to complete after sync")
+		}
+		break
+	}
+
+	// a batch larger than memdb is rejected as its entries are held in memdb until commit.
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		for i := 0; i < 20; i++ {
+			if err := b.Put(topic, val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull for batch larger than memdb; got %v", err)
+	}
+}
+
+func TestPutWithTimestamp(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit15.backfill")
+	e := NewEntry(topic, []byte("historical"))
+	if err := db.PutWithTimestamp(e, time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != nil {
+		t.Fatal("expected entry ID of the caller not to be set")
+	}
+	if err := db.Put(topic, []byte("current")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		last, err := db.Get(NewQuery(append(topic, []byte("?last=1h")...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(last) != 1 || string(last[0]) != "current" {
+			t.Fatalf("expected only current entry within last hour; got %q", last)
+		}
+		all, err := db.Get(NewQuery(append(topic, []byte("?last=3h")...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 2 {
+			t.Fatalf("expected 2 entries within last 3 hours; got %q", all)
+		}
+		if err := db.FlushBatch(); err != nil {
+			t.Fatal(err)
+		}
+		clock.Add(time.Second)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMoveEntry(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := []byte("unit16.src")
+	dst := []byte("unit16.dst")
+	val := bytes.Repeat([]byte("msg."), 64)
+	var ids [][]byte
+	for i := 0; i < 2; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(append(src, []byte("?ttl=1h")...), val).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// an ID with the sequence of an entry of another contract does not match the entry.
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleID := message.ID(append([]byte(nil), ids[1]...))
+	staleID.SetContract(contract)
+	if _, err := db.DuplicateEntry(staleID, dst, contract); !errors.Is(err, ErrMsgIDDoesNotExist) {
+		t.Fatalf("expected ErrMsgIDDoesNotExist duplicating with a stale ID; got %v", err)
+	}
+	if err := db.MoveEntry(staleID, dst, contract); !errors.Is(err, ErrMsgIDDoesNotExist) {
+		t.Fatalf("expected ErrMsgIDDoesNotExist moving with a stale ID; got %v", err)
+	}
+	if err := db.MoveEntry(ids[0], dst, 0); err != nil {
+		t.Fatal(err)
+	}
+	check := func(stage string) {
+		srcItems, err := db.Get(NewQuery(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(srcItems) != 1 {
+			t.Fatalf("%s: expected 1 entry in the source topic; got %d", stage, len(srcItems))
+		}
+		items, err := db.GetItems(NewQuery(dst))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 1 || !bytes.Equal(items[0].Value(), val) {
+			t.Fatalf("%s: expected moved entry in the new topic; got %d items", stage, len(items))
+		}
+		// the expiry of the synced source entry is kept.
+		if items[0].ExpiresAt().IsZero() {
+			t.Fatalf("%s: expected moved entry to keep its expiry", stage)
+		}
+	}
+	check("before sync")
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	check("after sync")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("after reopen")
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	db, err := Open("test.db", WithMutable(), WithClock(clock), WithEncryption(), WithEncryptionKey(oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit17.rotation")
+	if err := db.Put(topic, []byte("old key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries written with the old key are read with the old keys after rotation.
+	db, err = Open("test.db", WithMutable(), WithClock(clock), WithEncryption(), WithEncryptionKeys(newKey, [][]byte{oldKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, []byte("new key")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := db.Get(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || string(data[0]) != "new key" || string(data[1]) != "old key" {
+		t.Fatalf("unexpected entries after key rotation %q", data)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// without the old key the entries written with it cannot be decrypted.
+	db, err = Open("test.db", WithMutable(), WithClock(clock), WithEncryption(), WithEncryptionKey(newKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(NewQuery(topic)); err == nil {
+		t.Fatal("expected error reading entries of the old key without the old key")
+	}
+}
+
+func TestReEncrypt(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	db, err := Open("test.db", WithMutable(), WithClock(clock), WithEncryption(), WithEncryptionKey(oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit17.reencrypt")
+	for i := 0; i < 3; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// simulate a crash after the new key was switched.
+	if err := db.writeReEncryptState(keyFingerprints(newKey, oldKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the interrupted re-encryption needs both keys.
+	if _, err := Open("test.db", WithMutable(), WithClock(clock), WithEncryption(), WithEncryptionKey(oldKey)); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest opening the DB without the new key, got %v", err)
+	}
+	db, err = Open("test.db", WithMutable(), WithClock(clock), WithEncryption(), WithEncryptionKeys(newKey, [][]byte{oldKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReEncrypt(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db", WithMutable(), WithClock(clock), WithEncryption(), WithEncryptionKey(newKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	data, err := db.Get(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 3 || string(data[0]) != "msg. 2" || string(data[2]) != "msg. 0" {
+		t.Fatalf("unexpected entries after re-encryption %q", data)
+	}
+}
+
+func TestEntriesAfterSeq(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit18.cursor")
+	var seqs []uint64
+	for i, ttl := range []string{"", "?ttl=1m", "", ""} {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(append(topic, []byte(ttl)...), []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, message.ID(id).Sequence())
+	}
+	clock.Add(2 * time.Minute)
+	entries, err := db.EntriesAfterSeq(topic, seqs[0], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the expired entry is skipped.
+	if len(entries) != 2 || message.ID(entries[0].ID).Sequence() != seqs[2] || message.ID(entries[1].ID).Sequence() != seqs[3] {
+		t.Fatalf("unexpected entries after seq %d: %v", seqs[0], entries)
+	}
+	entries, err = db.EntriesAfterSeq(topic, seqs[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].Payload) != "msg. 2" {
+		t.Fatalf("expected limit of 1 entry; got %v", entries)
+	}
+}
+
+func TestEntryWithIDValidation(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit19.id")
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := db.NewID()
+	otherContract := message.ID(db.NewID())
+	otherContract.SetContract(contract + 1)
+	for _, tc := range []struct {
+		name string
+		e    *Entry
+		err  error
+	}{
+		{"short ID", NewEntry(topic, []byte("msg")).WithID(id[:len(id)-1]), errMsgIDInvalid},
+		{"zero sequence", NewEntry(topic, []byte("msg")).WithID(message.NewID(0)), errMsgIDInvalid},
+		{"sequence not leased", NewEntry(topic, []byte("msg")).WithID(message.NewID(db.seq() + 100)), errMsgIDInvalid},
+		{"contract mismatch", NewEntry(topic, []byte("msg")).WithContract(contract).WithID(otherContract), errMsgIDPrefixMismatch},
+	} {
+		if err := db.PutEntry(tc.e); !errors.Is(err, tc.err) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+	if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(NewQuery(topic)); err != nil || !reflect.DeepEqual(data, [][]byte{[]byte("msg")}) {
+		t.Fatalf("expected entry put with the ID; got %q %v", data, err)
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit19.slow")
+	for i := 0; i < 3; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, w := io.Pipe()
+	defer r.Close()
+	db.SlowQueryLog(time.Nanosecond, w)
+	if _, err := db.Get(NewQuery(topic).WithLimit(2)); err != nil {
+		t.Fatal(err)
+	}
+	var q struct {
+		Timestamp   time.Time `json:"timestamp"`
+		Topic       string    `json:"topic"`
+		Contract    uint32    `json:"contract"`
+		Limit       int       `json:"limit"`
+		ResultCount int       `json:"result_count"`
+		DurationMs  float64   `json:"duration_ms"`
+	}
+	if err := json.NewDecoder(r).Decode(&q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Topic != string(topic) || q.Limit != 2 || q.ResultCount != 2 || q.DurationMs <= 0 || q.Timestamp.IsZero() {
+		t.Fatalf("unexpected slow query %+v", q)
+	}
+
+	// queries are not written once the slow query log is disabled.
+	db.SlowQueryLog(0, nil)
+	if _, err := db.Get(NewQuery(topic)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if data, err := io.ReadAll(r); err != nil || len(data) != 0 {
+		t.Fatalf("expected no slow query after disable; got %q %v", data, err)
+	}
+}
+
+func TestFreeBlocksDefrag(t *testing.T) {
+	fbs := &freeBlocks{cache: make(map[int64]bool)}
+	// adjacent blocks are merged into a single block, the last block is not adjacent.
+	for _, b := range []freeblock{{offset: 200, size: 100}, {offset: 0, size: 100}, {offset: 100, size: 100}, {offset: 400, size: 50}} {
+		fbs.insert(b)
+	}
+	fbs.defrag()
+	if fbs.len() != 2 {
+		t.Fatalf("expected 2 free blocks after defrag, got %d", fbs.len())
+	}
+	if fbs.fb[0] != (freeblock{offset: 400, size: 50}) || fbs.fb[1] != (freeblock{offset: 0, size: 300}) {
+		t.Fatalf("unexpected free blocks after defrag %v", fbs.fb)
+	}
+	if len(fbs.cache) != 2 || !fbs.cache[0] || !fbs.cache[400] {
+		t.Fatalf("unexpected free blocks cache after defrag %v", fbs.cache)
+	}
+}
+
+func TestWildcardTopics(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithBufferSize(1<<16), WithMemdbSize(1<<16), WithLogSize(1<<16), WithMinimumFreeBlocksSize(1<<16), WithMutable(), WithBackgroundKeyExpiry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		wtopic []byte
+		topic  []byte
+		msg    []byte
+	}{
+		{[]byte("..."), []byte("unit.b.b1"), []byte("...1")},
+		{[]byte("unit.b..."), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.b...1")},
+		{[]byte("unit.*.b1.b11.*.*.b11111.*"), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.*.b1.b11.*.*.b11111.*.1")},
+		{[]byte("unit.*.b1.*.*.*.b11111.*"), []byte("unit.b.b1.b11.b111.b1111.b11111.b111111"), []byte("unit.*.b1.*.*.*.b11111.*.1")},
+		{[]byte("unit.b.b1"), []byte("unit.b.b1"), []byte("unit.b.b1.1")},
+		{[]byte("unit.b.b1.b11"), []byte("unit.b.b1.b11"), []byte("unit.b.b1.b11.1")},
+		{[]byte("unit.b"), []byte("unit.b"), []byte("unit.b.1")},
+	}
+	for _, tt := range tests {
+		db.Put(tt.wtopic, tt.msg)
+		if msg, err := db.Get(NewQuery(tt.wtopic).WithLimit(10)); len(msg) == 0 || err != nil {
+			t.Fatal(err)
+		}
+		if msg, err := db.Get(NewQuery(tt.topic).WithLimit(10)); len(msg) == 0 || err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable(), WithBatchEncryption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := [][]byte{[]byte("unit9.test"), []byte("unit9.batch")}
+	val := []byte("plaintext message")
+	verify := func() {
+		for _, topic := range topics {
+			items, err := db.Get(NewQuery(topic))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != 1 || !bytes.Equal(items[0], val) {
+				t.Fatalf("expected %q, got %q", val, items)
+			}
+		}
+	}
+	if err := db.PutEntry(NewEntry(topics[0], val).WithEncryption()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		return b.Put(topics[1], val)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	verify()
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile("test.db" + dataPostfix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, val) {
+		t.Fatal("value is not encrypted in the data file")
+	}
+
+	db, err = Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify()
+}
+
+type sliceIterator struct {
+	entries []*Entry
+	i       int
+}
+
+func (it *sliceIterator) Next() bool {
+	it.i++
+	return it.i <= len(it.entries)
+}
+
+func (it *sliceIterator) Entry() *Entry {
+	return it.entries[it.i-1]
+}
+
+func (it *sliceIterator) Error() error {
+	return nil
+}
+
+func TestBulkLoad(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit10.test")
+	var n = 1000
+	it := &sliceIterator{}
+	for i := 0; i < n; i++ {
+		it.entries = append(it.entries, NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))))
+	}
+	if err := db.BulkLoad(it, &BulkLoadOptions{PreAllocateBlocks: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != uint64(n) {
+		t.Fatalf("expected %d entries, got %d", n, count)
+	}
+	items, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d items, got %d", n, len(items))
+	}
+	if err := db.BulkLoad(&sliceIterator{}, nil); err == nil {
+		t.Fatal("expected bulk load into non empty DB to fail")
+	}
+}
+
+func TestDataPrealloc(t *testing.T) {
+	cleanup("test.db")
+	const preallocSize = 1 << 20
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithDataPreallocSize(preallocSize), WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit11.test")
+	var n = 100
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if size := db.data.Size(); size != preallocSize {
+		t.Fatalf("expected data file size %d, got %d", preallocSize, size)
+	}
+	items, err := db.Get(NewQuery(topic).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d items, got %d", n, len(items))
+	}
+	off := db.data.offset
+	// copy the DB files to simulate a crash, the preallocated tail is truncated on Open.
+	cleanup("test2.db")
+	defer cleanup("test2.db")
+	for _, postfix := range []string{indexPostfix, dataPostfix, logPostfix, leasePostfix, windowPostfix, filterPostfix, metaPostfix, externalIDPostfix} {
+		data, err := os.ReadFile("test.db" + postfix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile("test2.db"+postfix, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat("test.db" + dataPostfix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != off {
+		t.Fatalf("expected data file truncated to %d, got %d", off, fi.Size())
+	}
+
+	db, err = Open("test2.db", WithDataPreallocSize(preallocSize), WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if size := db.data.Size(); size != off || db.data.offset != off {
+		t.Fatalf("expected data file truncated to %d on Open, got size %d offset %d", off, size, db.data.offset)
+	}
+	if items, err := db.Get(NewQuery(topic).WithLimit(n)); err != nil || len(items) != n {
+		t.Fatalf("expected %d items after crash, got %d %v", n, len(items), err)
+	}
+}
+
+func TestLoadFactor(t *testing.T) {
+	cleanup("test.db")
+	if _, err := Open("test.db", WithLoadFactor(1.5)); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for load factor above 1; got %v", err)
+	}
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock), WithLoadFactor(0.01))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit12.test")
+	var n = 10
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// window blocks are filled with 3 entries before a new window block is chained.
+	if winBlocks := db.timeWindow.Size() / int64(blockSize); winBlocks < 4 {
+		t.Fatalf("expected at least 4 window blocks, got %d", winBlocks)
+	}
+	if items, err := db.Get(NewQuery(topic).WithLimit(n)); len(items) != n || err != nil {
+		t.Fatalf("expected %d items, got %d %v", n, len(items), err)
+	}
+}
+
+func TestCompactTimeWindow(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := []byte("unit12.expired")
+	live := []byte("unit12.live")
+	var n = 1000
+	for i := 0; i < n; i++ {
+		expiresAt := uint32(clock.Now().Add(time.Minute).Unix())
+		if err := db.PutEntry(&Entry{Topic: expired, Payload: []byte(fmt.Sprintf("msg.%2d", i)), ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put(live, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	// time window entries are written on sync after the clock moves past their release.
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(2 * time.Minute)
+	items, err := db.Get(NewQuery(live).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d items, got %d", n, len(items))
+	}
+	size := db.timeWindow.Size()
+	// queries run concurrently with the compaction.
+	stopC := make(chan struct{})
+	errC := make(chan error, 1)
+	go func() {
+		defer close(errC)
+		for {
+			select {
+			case <-stopC:
+				return
+			default:
+			}
+			got, err := db.Get(NewQuery(live).WithLimit(n))
+			if err != nil {
+				errC <- err
+				return
+			}
+			if len(got) != n {
+				errC <- fmt.Errorf("expected %d items during compaction, got %d", n, len(got))
+				return
+			}
+		}
+	}()
+	if err := db.CompactTimeWindow(); err != nil {
+		t.Fatal(err)
+	}
+	close(stopC)
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+	if db.timeWindow.Size() >= size {
+		t.Fatalf("expected window file smaller than %d, got %d", size, db.timeWindow.Size())
+	}
+	compacted, err := db.Get(NewQuery(live).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(items, compacted) {
+		t.Fatal("expected same items after compaction")
+	}
+	if items, err := db.Get(NewQuery(expired).WithLimit(n)); len(items) != 0 || err != nil {
+		t.Fatal(err)
+	}
+
+	// the compacted window file is used after reopen.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	reopened, err := db.Get(NewQuery(live).WithLimit(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(items, reopened) {
+		t.Fatalf("expected same items after reopen of the compacted DB, got %d", len(reopened))
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable(), WithCompressionThreshold(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit13.test")
+	payloads := [][]byte{[]byte("42"), bytes.Repeat([]byte("a"), 200), []byte("12"), []byte("1234")}
+	for i, payload := range payloads {
+		// the last two payloads are encrypted.
+		if err := db.PutEntry(&Entry{Topic: topic, Payload: payload, Encryption: i >= 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := db.readEntry(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.valueSize != uint32(len(payloads[0])) {
+		t.Fatalf("expected uncompressed value size %d, got %d", len(payloads[0]), s.valueSize)
+	}
+	if s, err = db.readEntry(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if s.valueSize >= uint32(len(payloads[1])) {
+		t.Fatalf("expected compressed value size less than %d, got %d", len(payloads[1]), s.valueSize)
+	}
+	for i, payload := range payloads {
+		e, err := db.GetBySeq(uint64(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(e.Payload, payload) {
+			t.Fatalf("expected payload %q, got %q", payload, e.Payload)
+		}
+	}
+}
+
+func TestExportImportCSV(t *testing.T) {
+	cleanup("test.db")
+	cleanup("test2.db")
+	defer cleanup("test2.db")
+	if _, err := Open("test2.db", WithImportBatchSize(-1)); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest on negative import batch size; got %v", err)
+	}
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topics := [][]byte{[]byte("unit14.csv1"), []byte("unit14.csv2")}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topics[i%2], []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.ExportCSV(nil, 0); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest on nil writer; got %v", err)
+	}
+	if err := db.ExportCSV(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := Open("test2.db", WithMutable(), WithImportBatchSize(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	n, err := db2.ImportCSV(&buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Fatalf("expected 10 entries imported, got %d", n)
+	}
+	for _, topic := range topics {
+		want, err := db.Get(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := db2.Get(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected imported items %q, got %q", want, got)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	cleanup("test.db")
+	defer os.Remove("unit14" + checkpointPostfix)
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit14.test")
+	xid, newXID := []byte("0123456789abcdef"), []byte("fedcba9876543210")
+	var n = 100
+	for i := 0; i < n; i++ {
+		e := NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i)))
+		if i == 0 {
+			e.WithExternalID(xid)
+		}
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Checkpoint("unit14"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", n+i))); err != nil {
+			t.Fatal(err)
+		}
+		e := NewEntry([]byte("unit14.new"), []byte(fmt.Sprintf("msg.%2d", i)))
+		if i == 0 {
+			e.WithExternalID(newXID)
+		}
+		if err := db.PutEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.RestoreCheckpoint("unit14"); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != uint64(n) {
+		t.Fatalf("expected %d entries, got %d", n, count)
+	}
+	items, err := db.Get(NewQuery(topic).WithLimit(2 * n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d items, got %d", n, len(items))
+	}
+	if items, err := db.Get(NewQuery([]byte("unit14.new"))); len(items) != 0 || err != nil {
+		t.Fatalf("expected no items of the topic written after the checkpoint, got %d %v", len(items), err)
+	}
+	if e, err := db.GetByID(xid); err != nil || string(e.Payload) != "msg. 0" {
+		t.Fatalf("expected entry of the external ID at the checkpoint; got %v", err)
+	}
+	if _, ok := db.externalIDs.lookup(newXID); ok {
+		t.Fatal("expected external ID written after the checkpoint removed")
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", n+i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if items, err = db.Get(NewQuery(topic).WithLimit(2 * n)); len(items) != n+10 || err != nil {
+		t.Fatalf("expected %d items after restore, got %d %v", n+10, len(items), err)
+	}
+	if err := db.RestoreCheckpoint("unit14.missing"); err == nil {
+		t.Fatal("expected restore of a missing checkpoint to fail")
+	}
+	if err := db.Checkpoint("../unit14"); err == nil {
+		t.Fatal("expected invalid checkpoint name to fail")
+	}
+}
+
+func TestCheckpointSeqReuse(t *testing.T) {
+	cleanup("test.db")
+	defer os.Remove("unit14" + checkpointPostfix)
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := func() {
+		if err := db.FlushBatch(); err != nil {
+			t.Fatal(err)
+		}
+		clock.Add(time.Second)
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	topic := []byte("unit14.reuse")
+	var n = 10
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync()
+	seq := uint64(n)
+	if err := db.DeleteBySeq(seq); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	if err := db.Checkpoint("unit14"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sequence free at the checkpoint is reused by an entry written after the checkpoint.
+	if err := db.Put([]byte("unit14.reused"), []byte("msg.reused")); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	if e, err := db.GetBySeq(seq); err != nil || string(e.Payload) != "msg.reused" {
+		t.Fatalf("expected sequence %d to be reused, got %v", seq, err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit14.reused"), []byte("msg.pending"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RestoreCheckpoint("unit14"); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func() {
+		if count := db.Count(); count != uint64(n-1) {
+			t.Fatalf("expected %d entries, got %d", n-1, count)
+		}
+		items, err := db.Get(NewQuery(topic).WithLimit(2 * n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != n-1 {
+			t.Fatalf("expected %d items, got %d", n-1, len(items))
+		}
+		for i, item := range items {
+			if want := fmt.Sprintf("msg.%2d", n-2-i); string(item) != want {
+				t.Fatalf("expected item %q, got %q", want, item)
+			}
+		}
+		if items, err := db.Get(NewQuery([]byte("unit14.reused"))); len(items) != 0 || err != nil {
+			t.Fatalf("expected no items of the entries written after the checkpoint, got %q %v", items, err)
+		}
+		if _, err := db.GetBySeq(seq); !errors.Is(err, ErrSeqNotFound) {
+			t.Fatalf("expected reused sequence %d to be removed, got %v", seq, err)
+		}
+	}
+	verify()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify()
+
+	// the sequence is free again after the restore.
+	if err := db.Put(topic, []byte("msg.new")); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	if e, err := db.GetBySeq(seq); err != nil || string(e.Payload) != "msg.new" {
+		t.Fatalf("expected sequence %d to be free after restore, got %v", seq, err)
+	}
+	if items, err := db.Get(NewQuery(topic).WithLimit(2 * n)); len(items) != n || err != nil {
+		t.Fatalf("expected %d items after restore, got %q %v", n, items, err)
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit15.test")
+	var n = 100
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i%10))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	match := func(payload []byte) bool { return string(payload) == "msg.3" }
+	items, err := db.Get(NewQuery(topic).WithLimit(5).WithFilter(match))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 5 {
+		t.Fatalf("expected 5 items, got %d", len(items))
+	}
+	for _, item := range items {
+		if !match(item) {
+			t.Fatalf("unexpected item %q", item)
+		}
+	}
+	it, err := db.Items(NewQuery(topic).WithLimit(n).WithFilter(match))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for it.First(); it.Valid(); it.Next() {
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if !match(it.Item().Value()) {
+			t.Fatalf("unexpected item %q", it.Item().Value())
+		}
+		count++
+	}
+	if count != n/10 {
+		t.Fatalf("expected %d items, got %d", n/10, count)
+	}
+}
+
+func TestGrowIndex(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.GrowIndex(10); err != nil {
+		t.Fatal(err)
+	}
+	size := db.index.currSize()
+	nBlocks := db.blocks()
+	topic := []byte("unit16.test")
+	var n = 3 * entriesPerIndexBlock
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if count := db.Count(); count != uint64(n) {
+		t.Fatalf("expected %d entries, got %d", n, count)
+	}
+	// writes use the pre-allocated blocks so the index file is not extended.
+	if db.index.currSize() != size || db.blocks() != nBlocks {
+		t.Fatalf("expected index size %d and %d blocks, got %d and %d", size, nBlocks, db.index.currSize(), db.blocks())
+	}
+}
+
+// truncateCountingFS counts Truncate calls, each a system call, of the files opened with the name suffix.
+type truncateCountingFS struct {
+	fs.FileSystem
+	suffix    string
+	truncates int64
+}
+
+type truncateCountingFile struct {
+	fs.FileManager
+	truncates *int64
+}
+
+func (f *truncateCountingFile) Truncate(size int64) error {
+	atomic.AddInt64(f.truncates, 1)
+	return f.FileManager.Truncate(size)
+}
+
+func (fsys *truncateCountingFS) OpenFile(name string, flag int, perm os.FileMode) (fs.FileManager, error) {
+	f, err := fsys.FileSystem.OpenFile(name, flag, perm)
+	if err != nil || !strings.HasSuffix(name, fsys.suffix) {
+		return f, err
+	}
+	return &truncateCountingFile{FileManager: f, truncates: &fsys.truncates}, nil
+}
+
+func TestGrowIndexSyscalls(t *testing.T) {
+	// bulkWrite returns the number of index file extends during the bulk write.
+	bulkWrite := func(extraBlocks uint32) int64 {
+		cleanup("test.db")
+		fsys := &truncateCountingFS{FileSystem: fs.FileIO, suffix: indexPostfix}
+		clock := unitdbtest.NewMockClock(time.Now())
+		db, err := Open("test.db", WithMutable(), WithClock(clock), WithFileSystem(fsys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.GrowIndex(extraBlocks); err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt64(&fsys.truncates, 0)
+		topic := []byte("unit16.bulk")
+		for i := 0; i < 4; i++ {
+			for j := 0; j < entriesPerIndexBlock; j++ {
+				if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d.%d", i, j))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.FlushBatch(); err != nil {
+				t.Fatal(err)
+			}
+			clock.Add(time.Second)
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if count := db.Count(); count != 4*entriesPerIndexBlock {
+			t.Fatalf("expected %d entries, got %d", 4*entriesPerIndexBlock, count)
+		}
+		return atomic.LoadInt64(&fsys.truncates)
+	}
+	extends := bulkWrite(0)
+	if extends == 0 {
+		t.Fatal("expected bulk write to extend the index file")
+	}
+	if grown := bulkWrite(4); grown != 0 {
+		t.Fatalf("expected no index file extends after GrowIndex, got %d, %d without GrowIndex", grown, extends)
+	}
+}
+
+func TestWALReplication(t *testing.T) {
+	cleanup("test.db")
+	cleanup("standby.db")
+	defer cleanup("standby.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r, err := db.WALReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := db.WALReader(); err == nil {
+		t.Fatal("expected second WAL reader to fail")
+	}
+	topic := []byte("unit15.test")
+	var n = 50
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	var records []WALRecord
+	if err := r.Read(0, func(rec WALRecord) (bool, error) {
+		records = append(records, rec)
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != n {
+		t.Fatalf("expected %d records, got %d", n, len(records))
+	}
+
+	standby, err := Open("standby.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+	if err := standby.ApplyWAL(records); err != nil {
+		t.Fatal(err)
+	}
+	items, err := standby.Get(NewQuery(topic).WithLimit(2 * n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d items on standby, got %d", n, len(items))
+	}
+	for i, item := range items {
+		if want := fmt.Sprintf("msg.%2d", n-1-i); string(item) != want {
+			t.Fatalf("expected %s, got %s", want, item)
+		}
+	}
+
+	lastID := records[len(records)-1].LogID
+	if err := r.Ack(lastID); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := r.Read(lastID, func(rec WALRecord) (bool, error) {
+		count++
+		return false, nil
+	}); err != nil || count != 0 {
+		t.Fatalf("expected no records after acknowledged log, got %d %v", count, err)
+	}
+}
+
+func TestShrinkIndex(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.GrowIndex(10); err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit17.test")
+	var n = 2 * entriesPerIndexBlock
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ShrinkIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if db.blocks() != 1 || db.index.currSize() != blockOffset(2) {
+		t.Fatalf("expected 2 index blocks, got blockIdx %d and index size %d", db.blocks(), db.index.currSize())
+	}
+	if err := db.Put(topic, []byte("msg.new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := db.Get(NewQuery(topic).WithLimit(2 * n)); len(items) != n+1 || err != nil {
+		t.Fatalf("expected %d items, got %d %v", n+1, len(items), err)
+	}
+}
+
+func TestSyncTornWrite(t *testing.T) {
+	cleanup("test.db")
+	faultyFS := fs.NewFaultyFS(fs.FileIO)
+	db, err := Open("test.db", WithFileSystem(faultyFS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit17.test")
+	var n = 100
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	faultyFS.Inject(dataPostfix, fs.Faults{TornWriteAt: 1})
+	// sync recovers entries from the log on write failure.
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items, err := db.Get(NewQuery(topic).WithLimit(2 * n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Fatalf("expected %d items, got %d", n, len(items))
+	}
+}
+
+func TestOrphanedData(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit18.test")
+	for i := 0; i < 100; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if offsets, err := db.ScanOrphanedData(); len(offsets) != 0 || err != nil {
+		t.Fatalf("expected no orphaned data, got %v %v", offsets, err)
+	}
+	// simulate record written to the data file but not to the index.
+	off := db.data.offset
+	if _, err := db.data.writeAt([]byte("orphaned record"), off); err != nil {
+		t.Fatal(err)
+	}
+	db.data.offset += int64(len("orphaned record"))
+	offsets, err := db.ScanOrphanedData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(offsets, []int64{off}) {
+		t.Fatalf("expected orphaned data at %d, got %v", off, offsets)
+	}
+	if err := db.FreeOrphanedData(offsets); err != nil {
+		t.Fatal(err)
+	}
+	if offsets, err := db.ScanOrphanedData(); len(offsets) != 0 || err != nil {
+		t.Fatalf("expected no orphaned data after free, got %v %v", offsets, err)
+	}
+	if err := db.FreeOrphanedData([]int64{off}); err == nil {
+		t.Fatal("expected free of data that is not orphaned to fail")
+	}
+}
+
+func TestRecoveryBestEffort(t *testing.T) {
+	cleanup("test.db")
+	cleanup("scratch.db")
+	defer cleanup("scratch.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit18.test"), []byte("msg.synced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// pack entries using a scratch DB, sequences follow the entry synced to the DB.
+	scratch, err := Open("scratch.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scratch.nextSeq()
+	var records [][]byte
+	for i := 0; i < 2; i++ {
+		e := NewEntry([]byte("unit18.test"), []byte(fmt.Sprintf("msg.%2d", i)))
+		if err := scratch.setEntry(1, e); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, e.cache)
+	}
+	if err := scratch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// second record is torn.
+	records[1] = records[1][:len(records[1])-1]
+
+	o := &options{}
+	WithDefaultOptions().set(o)
+	w, _, err := wal.New(wal.Options{Path: "test.db" + logPostfix, TargetSize: o.logSize, BufferSize: o.bufferSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logWriter, err := w.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err := <-logWriter.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-logWriter.SignalInitWrite(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db", WithRecoveryMode(RecoveryBestEffort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if skipped := db.RecoverySkipped(); !reflect.DeepEqual(skipped, []uint64{3}) {
+		t.Fatalf("expected skipped seq 3, got %v", skipped)
+	}
+	items, err := db.Get(NewQuery([]byte("unit18.test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || string(items[0]) != "msg. 0" {
+		t.Fatalf("expected recovered item msg. 0, got %q", items)
+	}
+}
+
+func TestUpdateEntry(t *testing.T) {
+	cleanup("test.db")
+	cleanup("test2.db")
+	defer cleanup("test2.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit18.update")
+	syncedID := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.synced")).WithID(syncedID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	pendingID := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.pending")).WithID(pendingID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range [][]byte{syncedID, pendingID} {
+		if err := db.UpdateEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.updated.%d", message.ID(id).Sequence()))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := [][]byte{
+		[]byte(fmt.Sprintf("msg.updated.%d", message.ID(pendingID).Sequence())),
+		[]byte(fmt.Sprintf("msg.updated.%d", message.ID(syncedID).Sequence())),
+	}
+	if data, err := db.Get(NewQuery(topic)); err != nil || !reflect.DeepEqual(data, want) {
+		t.Fatalf("expected updated entries; got %q %v", data, err)
+	}
+	if err := db.UpdateEntry(NewEntry(topic, []byte("msg")).WithID(db.NewID())); !errors.Is(err, ErrMsgIDDoesNotExist) {
+		t.Fatalf("expected ErrMsgIDDoesNotExist updating a missing entry, got %v", err)
+	}
+	// the sequence of a deleted entry is reused under another contract, the old ID does not update the entry reusing it.
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit18.update.stale"), []byte("msg.stale")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := db.GetBySeq(db.seq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleID := stale.ID
+	if err := db.Delete(staleID, []byte("unit18.update.stale")); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit18.update.reused"), []byte("msg.reused")).WithContract(contract)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := db.GetBySeq(message.ID(staleID).Sequence()); err != nil || string(e.Payload) != "msg.reused" {
+		t.Fatalf("expected sequence of the deleted entry to be reused, got %v", err)
+	}
+	if err := db.UpdateEntry(NewEntry([]byte("unit18.update.stale"), []byte("msg")).WithID(staleID)); !errors.Is(err, ErrMsgIDDoesNotExist) {
+		t.Fatalf("expected ErrMsgIDDoesNotExist updating with a stale ID, got %v", err)
+	}
+	if e, err := db.GetBySeq(message.ID(staleID).Sequence()); err != nil || string(e.Payload) != "msg.reused" {
+		t.Fatalf("expected entry reusing the sequence to be kept, got %q %v", e.Payload, err)
+	}
+
+	// copy the DB files before the pending entry is synced to simulate a crash, recovery of the log keeps the update.
+	for _, postfix := range []string{indexPostfix, dataPostfix, logPostfix, leasePostfix, windowPostfix, filterPostfix, metaPostfix, externalIDPostfix} {
+		data, err := os.ReadFile("test.db" + postfix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile("test2.db"+postfix, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"test.db", "test2.db"} {
+		db, err := Open(path, WithMutable(), WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := db.Get(NewQuery(topic)); err != nil || !reflect.DeepEqual(data, want) {
+			t.Fatalf("expected updated entries after reopen of %s; got %q %v", path, data, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAtomicSwapEntry(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit18.swap")
+	oldID := db.NewID()
+	if err := db.PutEntry(NewEntry(topic, []byte("msg.old")).WithID(oldID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// an ID with the sequence of an entry of another contract does not match the entry.
+	contract, err := db.NewContract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleID := message.ID(append([]byte(nil), oldID...))
+	staleID.SetContract(contract)
+	if _, err := db.AtomicSwapEntry(staleID, NewEntry(topic, []byte("msg.stale"))); !errors.Is(err, ErrMsgIDDoesNotExist) {
+		t.Fatalf("expected ErrMsgIDDoesNotExist swapping a stale ID; got %v", err)
+	}
+	newID, err := db.AtomicSwapEntry(oldID, NewEntry(topic, []byte("msg.new")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(NewQuery(topic)); err != nil || !reflect.DeepEqual(data, [][]byte{[]byte("msg.new")}) {
+		t.Fatalf("expected swapped entry; got %q %v", data, err)
+	}
+
+	// crash after the swap is committed to the log and before the old entry is deleted.
+	crashID := db.NewID()
+	e := NewEntry(topic, []byte("msg.crash")).WithID(crashID)
+	if err := db.setEntry(1, e); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := db.deleteRecord(newID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := [][]byte{e.cache, rec}
+	clock.Add(time.Second)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	o := &options{}
+	WithDefaultOptions().set(o)
+	w, _, err := wal.New(wal.Options{Path: "test.db" + logPostfix, TargetSize: o.logSize, BufferSize: o.bufferSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logWriter, err := w.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err := <-logWriter.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-logWriter.SignalInitWrite(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if data, err := db.Get(NewQuery(topic)); err != nil || !reflect.DeepEqual(data, [][]byte{[]byte("msg.crash")}) {
+		t.Fatalf("expected entry of the recovered swap; got %q %v", data, err)
+	}
+	for _, id := range [][]byte{oldID, newID} {
+		if _, err := db.GetBySeq(message.ID(id).Sequence()); err != ErrSeqNotFound {
+			t.Fatalf("expected replaced entry to be deleted; got %v", err)
+		}
+	}
+}
+
+func TestGetTopicWindow(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit19.test")
+	if _, _, err := db.GetTopicWindow(topic, 0); err != ErrNoEntries {
+		t.Fatalf("expected ErrNoEntries, got %v", err)
+	}
+	start := time.Unix(1600000000, 0)
+	for i := 0; i < 3; i++ {
+		if err := db.PutWithTimestamp(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))), start.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func() {
+		earliest, latest, err := db.GetTopicWindow(topic, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !earliest.Equal(start) || !latest.Equal(start.Add(2*time.Hour)) {
+			t.Fatalf("expected window %v - %v, got %v - %v", start, start.Add(2*time.Hour), earliest, latest)
+		}
+	}
+	check()
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestFlush(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r, err := db.WALReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	topic := []byte("unit19.test")
+	var n = 100
+	for i := 0; i < n; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := r.Read(0, func(rec WALRecord) (bool, error) {
+		count++
+		return false, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Fatalf("expected %d records in the log, got %d", n, count)
+	}
+}
+
+func TestWatchStat(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit20.test"), []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	statC := db.WatchStat(10 * time.Millisecond)
+	s := <-statC
+	if s.Seq != 1 {
+		t.Fatalf("expected seq 1, got %d", s.Seq)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range statC {
+	}
+}
+
+func TestExpiryCallback(t *testing.T) {
+	cleanup("test.db")
+	expiredC := make(chan []byte, 100)
+	db, err := Open("test.db", WithMutable(), WithBackgroundKeyExpiry(), WithExpiryCallback(func(topic, id []byte) {
+		if string(topic) != "unit20.test" {
+			t.Errorf("expected topic unit20.test, got %s", topic)
+		}
+		expiredC <- id
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit20.test")
+	var n = 10
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	for i := 0; i < n; i++ {
+		if err := db.PutEntry(&Entry{Topic: topic, Payload: []byte(fmt.Sprintf("msg.%2d", i)), ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(NewQuery(topic).WithLimit(n)); len(data) != 0 || err != nil {
+		t.Fatalf("expected no items, got %d %v", len(data), err)
+	}
+	if err := db.expireEntries(); err != nil {
+		t.Fatal(err)
+	}
+	seqs := make(map[uint64]bool)
+	timeout := time.After(time.Second)
+	for len(seqs) < n {
+		select {
+		case id := <-expiredC:
+			seqs[message.ID(id).Sequence()] = true
+		case <-timeout:
+			t.Fatalf("expected %d expired entries, got %d", n, len(seqs))
+		}
+	}
+}
+
+func TestTopicEntryCounts(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, topic := range []string{"unit21.a", "unit21.b", "unit21.b.c"} {
+		for j := 0; j <= i; j++ {
+			if err := db.Put([]byte(topic), []byte(fmt.Sprintf("msg.%2d", j))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	counts, err := db.TopicEntryCounts(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]uint64{"unit21.a": 1, "unit21.b": 2, "unit21.b.c": 3}; !reflect.DeepEqual(counts, want) {
+		t.Fatalf("expected counts %v, got %v", want, counts)
+	}
+	db.opts.maxQueryLimit = 2
+	if counts, err := db.TopicEntryCounts(0); !errors.Is(err, ErrResultsTruncated) || len(counts) != 2 {
+		t.Fatalf("expected 2 counts and ErrResultsTruncated, got %v %v", counts, err)
+	}
+}
+
+func TestPauseSync(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PauseSync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PauseSync(); err != nil {
+		t.Fatal(err)
+	}
+	if !db.IsSyncPaused() {
+		t.Fatal("expected sync to be paused")
+	}
+	if err := db.Put([]byte("unit4.test"), []byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ResumeSync(0); err != nil {
+		t.Fatal(err)
+	}
+	if db.IsSyncPaused() {
+		t.Fatal("expected sync to be resumed")
+	}
+
+	// puts more than memdb size while sync is paused.
+	cleanup("test.db")
+	db, err = Open("test.db", WithMemdbSize(1<<12), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PauseSync(); err != nil {
+		t.Fatal(err)
+	}
+	// random payloads do not compress.
+	payload := make([]byte, 1<<8)
+	rand.Read(payload)
+	n := 4 * (1 << 12) / len(payload)
+	for i := 0; i < n; i++ {
+		if err := db.Put([]byte("unit4.test"), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.ResumeSync(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(NewQuery([]byte("unit4.test")).WithLimit(n)); len(data) != n || err != nil {
+		t.Fatalf("expected %d entries; got %d %v", n, len(data), err)
+	}
+}
+
+func TestPauseBackgroundExpiry(t *testing.T) {
+	cleanup("test.db")
+	if _, err := Open("test.db", WithBackgroundKeyExpiry(), WithExpiryGranularity(-time.Second)); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for negative expiry granularity; got %v", err)
+	}
+	expiredC := make(chan []byte, 100)
+	db, err := Open("test.db", WithMutable(), WithBackgroundKeyExpiry(), WithExpiryCallback(func(topic, id []byte) {
+		expiredC <- id
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit21.test")
+	expiresAt := uint32(time.Now().Add(-1 * time.Hour).Unix())
+	if err := db.PutEntry(&Entry{Topic: topic, Payload: []byte("msg"), ExpiresAt: expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// query adds the expired entry to the expiry window.
+	if data, err := db.Get(NewQuery(topic)); len(data) != 0 || err != nil {
+		t.Fatalf("expected no items, got %d %v", len(data), err)
+	}
+
+	// pause waits for a background expiry run in progress.
+	db.expiryMu.Lock()
+	pausedC := make(chan error, 1)
+	go func() {
+		pausedC <- db.PauseBackgroundExpiry()
+	}()
+	select {
+	case <-pausedC:
+		t.Fatal("expected pause to wait for the expiry run")
+	case <-time.After(50 * time.Millisecond):
+	}
+	db.expiryMu.Unlock()
+	if err := <-pausedC; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.expireInBackground(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-expiredC:
+		t.Fatal("expected no entries expired while expiry is paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := db.ResumeBackgroundExpiry(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.expireInBackground(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-expiredC:
+	case <-time.After(time.Second):
+		t.Fatal("expected entry expired after expiry is resumed")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PauseBackgroundExpiry(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed; got %v", err)
+	}
+}
+
+func TestMoveTopic(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTopic, newTopic := []byte("unit4.old"), []byte("unit4.new")
+	if err := db.Put(newTopic, []byte("msg.0")); err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]string)
+	for i := 1; i <= 3; i++ {
+		entry := &Entry{Topic: oldTopic, Payload: []byte(fmt.Sprintf("msg.%d", i))}
+		if err := db.PutEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+		ids[string(entry.Payload)] = string(entry.ID)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MoveTopic(oldTopic, newTopic, 0); err != nil {
+		t.Fatal(err)
+	}
+	verify := func(db *DB) {
+		if data, err := db.Get(NewQuery(oldTopic)); len(data) != 0 || err != nil {
+			t.Fatalf("expected no entries in old topic; got %d %v", len(data), err)
+		}
+		items, err := db.GetItems(NewQuery(newTopic))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 4 {
+			t.Fatalf("expected 4 entries in new topic; got %d", len(items))
+		}
+		// entries are returned newest first.
+		for i, item := range items {
+			if want := fmt.Sprintf("msg.%d", 3-i); string(item.Value()) != want {
+				t.Fatalf("expected %s; got %s", want, item.Value())
+			}
+			if id, ok := ids[string(item.Value())]; ok && id != string(item.ID()) {
+				t.Fatalf("expected ID of %s to be kept", item.Value())
+			}
+		}
+	}
+	verify(db)
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	verify(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify(db)
+}
+
+func TestWriteLockStats(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte("unit4.test"), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := db.WriteLockStats(); stats.TotalAcquisitions < 10 || stats.MaxWaitNs < 0 {
+		t.Fatalf("expected at least 10 lock acquisitions; got %+v", stats)
+	}
+}
+
+func TestPutEntryAtSeq(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	seq := uint64(100)
+	if err := db.PutEntryAtSeq(seq, NewEntry([]byte("unit4.test"), []byte("msg"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntryAtSeq(seq, NewEntry([]byte("unit4.test"), []byte("msg"))); err != errSeqExists {
+		t.Fatalf("expected errSeqExists; got %v", err)
+	}
+	e, err := db.GetBySeq(seq)
+	if err != nil || string(e.Payload) != "msg" {
+		t.Fatalf("expected msg; got %v", err)
+	}
+	if db.seq() != seq {
+		t.Fatalf("expected sequence %d; got %d", seq, db.seq())
+	}
+	// sequence of a batch entry not yet written.
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		if err := b.Put([]byte("unit4.test"), []byte("batch")); err != nil {
+			return err
+		}
+		if err := db.PutEntryAtSeq(db.seq(), NewEntry([]byte("unit4.test"), []byte("msg"))); err != errSeqExists {
+			t.Fatalf("expected errSeqExists; got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := db.GetBySeq(seq + 1); err != nil || string(e.Payload) != "batch" {
+		t.Fatalf("expected batch; got %v", err)
+	}
+}
+
+func TestHookAfterSync(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var synced []uint64
+	if err := db.HookAfterSync(func(seqs []uint64) {
+		synced = append(synced, seqs...)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit4.test")
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	// deleted entry is not synced.
+	if err := db.Delete(ids[1], topic); err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Second)
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(synced) != 2 {
+		t.Fatalf("expected 2 synced sequences; got %v", synced)
+	}
+	for _, seq := range synced {
+		if seq == message.ID(ids[1]).Sequence() {
+			t.Fatalf("expected deleted sequence %d not synced; got %v", seq, synced)
+		}
+	}
+}
+
+func TestExternalID(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xid := []byte("0123456789abcdef")
+	id := db.NewID()
+	if err := db.PutEntry(NewEntry([]byte("unit4.test"), []byte("msg")).WithID(id).WithExternalID(xid)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit4.test"), []byte("msg")).WithExternalID(xid)); err != errDuplicateExternalID {
+		t.Fatalf("expected errDuplicateExternalID; got %v", err)
+	}
+	if err := db.PutEntry(NewEntry([]byte("unit4.test"), []byte("msg")).WithExternalID(xid[:4])); err != errExternalIDInvalid {
+		t.Fatalf("expected errExternalIDInvalid; got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	e, err := db.GetByID(xid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(e.Payload) != "msg" || !bytes.Equal(e.ID, id) {
+		t.Fatalf("unexpected entry %s %v", e.Payload, e.ID)
+	}
+	if got, err := db.ExternalID(id); err != nil || !bytes.Equal(got, xid) {
+		t.Fatalf("expected external ID %s; got %s %v", xid, got, err)
+	}
+}
+
+func TestExternalIDRecovery(t *testing.T) {
+	cleanup("test.db")
+	cleanup("test2.db")
+	defer cleanup("test2.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit4.xid")
+	xids := [][]byte{[]byte("0123456789abcdef"), []byte("fedcba9876543210")}
+	var ids [][]byte
+	for i, xid := range xids {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id).WithExternalID(xid)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		if err := db.FlushBatch(); err != nil {
+			t.Fatal(err)
+		}
+		// the first entry is synced so the log of the second entry is recovered.
+		if i == 0 {
+			clock.Add(time.Second)
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// copy the DB files before the entry is synced and drop the external ID file to simulate a crash,
+	// recovery of the log maps the external ID of the entry.
+	for _, postfix := range []string{indexPostfix, dataPostfix, logPostfix, leasePostfix, windowPostfix, filterPostfix, metaPostfix, externalIDPostfix} {
+		data, err := os.ReadFile("test.db" + postfix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if postfix == externalIDPostfix {
+			data = data[:externalIDRecordSize]
+		}
+		if err := os.WriteFile("test2.db"+postfix, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db2, err := Open("test2.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := db2.GetByID(xids[1]); err != nil || !bytes.Equal(e.ID, ids[1]) {
+		t.Fatalf("expected entry of the external ID after recovery; got %v", err)
+	}
+	if err := db2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// delete removes the mapping of the entry, and the external ID file is compacted on open.
+	if err := db.Delete(ids[0], topic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.externalIDs.lookup(xids[0]); ok {
+		t.Fatal("expected external ID of the deleted entry removed")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if size := db.externalIDs.file.Size(); size != externalIDRecordSize {
+		t.Fatalf("expected compacted external ID file of one record; got %d bytes", size)
+	}
+	if e, err := db.GetByID(xids[1]); err != nil || !bytes.Equal(e.ID, ids[1]) {
+		t.Fatalf("expected entry of the external ID after reopen; got %v", err)
+	}
+}
+
+func TestCommitHook(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var mu sync.Mutex
+	var committed []uint64
+	if err := db.CommitHook(func(seqs []uint64) error {
+		mu.Lock()
+		defer mu.Unlock()
+		committed = append(committed, seqs...)
+		return errors.New("hook error")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Put([]byte("unit4.test"), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(committed) != 3 {
+		t.Fatalf("expected 3 committed sequences; got %v", committed)
+	}
+}
+
+func TestFlushCommitError(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// a tiny batch in flight fails to commit after Flush starts waiting.
+	errCommit := errors.New("commit error")
+	db.batchPool.enqueue()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		db.batchPool.done(errCommit)
+	}()
+	if err := db.Flush(); !errors.Is(err, errCommit) {
+		t.Fatalf("expected commit error of the tiny batch in flight, got %v", err)
+	}
+	// concurrent writes and flushes.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := db.Put([]byte("unit4.flush"), []byte("msg")); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := db.Flush(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSnapshot(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit4.test")
+	var ids [][]byte
+	for i := 0; i < 3; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte("msg")).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// entries of a batch pending when the snapshot is taken are not returned by the snapshot.
+	var snap *Snapshot
+	err = db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		if err := b.Put(topic, []byte("batch")); err != nil {
+			return err
+		}
+		snap, err = db.Snapshot()
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Put(topic, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(ids[1], topic); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutEntryAtSeq(message.ID(ids[1]).Sequence(), NewEntry(topic, []byte("reuse"))); err != errWriteConflict {
+		t.Fatalf("expected errWriteConflict; got %v", err)
+	}
+	q := NewQuery(topic).WithLimit(10)
+	data, err := snap.Get(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 3 {
+		t.Fatalf("expected 3 entries in snapshot; got %d", len(data))
+	}
+	if q.snapshot != nil {
+		t.Fatal("expected query not to be modified by the snapshot")
+	}
+	if data, err := db.Get(q); len(data) != 5 || err != nil {
+		t.Fatalf("expected 5 entries in DB; got %d %v", len(data), err)
+	}
+	if ok, err := db.HasEntry(message.ID(ids[1])); ok || err != nil {
+		t.Fatalf("expected deleted entry to be hidden; got %v %v", ok, err)
+	}
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.HasEntry(message.ID(ids[1])); ok || err != nil {
+		t.Fatalf("expected deleted entry to be removed once snapshot is closed; got %v %v", ok, err)
+	}
+	if _, err := snap.Get(NewQuery(topic)); err != errSnapshotClosed {
+		t.Fatalf("expected errSnapshotClosed; got %v", err)
+	}
+}
+
+func TestTopicSubscribeOnce(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := []byte("unit4.reply")
+	ch, err := db.TopicSubscribeOnce(topic, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit4.other"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, ok := <-ch
+	if !ok || string(e.Payload) != "msg.0" || !bytes.Equal(e.Topic, topic) {
+		t.Fatalf("expected msg.0; got %v", e)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("expected channel to be closed")
+	}
+
+	if len(db.watchers.m) != 0 {
+		t.Fatal("expected watcher to be removed on delivery")
+	}
+
+	// subscription is released and its channel is closed when the DB is closed.
+	ch, err = db.TopicSubscribeOnce(topic, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("expected channel to be closed on close")
+	}
+	if len(db.watchers.m) != 0 {
+		t.Fatal("expected watcher to be removed on close")
+	}
+}
+
+func TestStaleLockFile(t *testing.T) {
+	cleanup("test.db")
+	// lock file left by a crashed process is not locked.
+	if err := os.WriteFile("test.db"+lockPostfix, []byte("999999999 0\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// owner recorded in the lock file of a live DB is not alive in this PID namespace.
+	if err := os.WriteFile("test.db"+lockPostfix, []byte("999999999 0\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("test.db", WithOpenTimeout(50*time.Millisecond)); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked for a lock held by a live process; got %v", err)
+	}
+}
+
+func TestReadHeaderValidation(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile("test.db"+indexPostfix, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// files of version 1 do not have the header flags and the value flags of the message ID.
+	for _, v := range []byte{1, 99} {
+		if _, err := f.WriteAt([]byte{v, 0, 0, 0}, 8); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open("test.db"); !errors.Is(err, ErrVersionMismatch) {
+			t.Fatalf("expected ErrVersionMismatch for version %d; got %v", v, err)
+		}
+	}
+	if _, err := f.WriteAt([]byte("notadb!"), 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := Open("test.db"); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted; got %v", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := db.Subscribe([]byte("unit4.*"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("unit5.test"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("unit4.test%d", i)), []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		e := <-sub.Entries()
+		if want := fmt.Sprintf("msg.%d", i); e == nil || string(e.Payload) != want {
+			t.Fatalf("expected %s; got %v", want, e)
+		}
+	}
+	if lag := sub.Lag(); lag != 0 {
+		t.Fatalf("expected no lag; got %d", lag)
+	}
+	// entries put while the subscription buffer is full are dropped and reported.
+	n := subscriptionBufferSize + 10
+	for i := 0; i < n; i++ {
+		if err := db.Put([]byte("unit4.test0"), []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.FlushBatch(); err != nil {
+		t.Fatal(err)
+	}
+	if dropped := sub.Dropped(); dropped == 0 || sub.Lag()+dropped != uint64(n) {
+		t.Fatalf("expected %d entries lagging or dropped; got lag %d dropped %d", n, sub.Lag(), dropped)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// buffered entries are received before the subscription is closed.
+	for range sub.Entries() {
+	}
+	sub.Stop()
+}
+
+func TestNewReader(t *testing.T) {
+	cleanup("test.db")
+	// the reader pages through the topic in pages of the maximum query limit.
+	db, err := Open("test.db", WithMaxQueryLimit(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	topic := []byte("unit4.test")
+	for i := 0; i < 5; i++ {
+		if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := db.NewReader(topic, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	readFrame := func() string {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, binary.LittleEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			t.Fatal(err)
+		}
+		return string(frame[16:])
+	}
+	if got := readFrame(); got != "msg.0" {
+		t.Fatalf("expected msg.0; got %s", got)
+	}
+	if pos, err := r.Seek(3, io.SeekStart); pos != 3 || err != nil {
+		t.Fatalf("expected position 3; got %d %v", pos, err)
+	}
+	if got := readFrame(); got != "msg.3" {
+		t.Fatalf("expected msg.3; got %s", got)
+	}
+	if _, err := r.Seek(-4, io.SeekCurrent); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFrame(); got != "msg.0" {
+		t.Fatalf("expected msg.0; got %s", got)
+	}
+	if pos, err := r.Seek(0, io.SeekEnd); pos != 5 || err != nil {
+		t.Fatalf("expected position 5; got %d %v", pos, err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF; got %v", err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if got, want := readFrame(), fmt.Sprintf("msg.%d", i); got != want {
+			t.Fatalf("expected %s; got %s", want, got)
+		}
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF; got %v", err)
+	}
+}
+
+func TestNewSubscriber(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topics := [][]byte{[]byte("unit4.test1"), []byte("unit4.test2")}
+	for i := 0; i < 3; i++ {
+		for _, topic := range topics {
+			if err := db.Put(topic, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ctx := context.Background()
+	sub := db.NewSubscriber(topics, 0).WithName("sub1")
+	if entries, err := sub.Poll(ctx, 4); err != nil || len(entries) != 4 {
+		t.Fatalf("expected 4 entries; got %d %v", len(entries), err)
+	}
+	if entries, err := sub.Poll(ctx, 4); err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 entries; got %d %v", len(entries), err)
+	}
+	if err := sub.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topics[0], []byte("msg.3")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := sub.Poll(ctx, 4); err != nil || len(entries) != 1 {
+		t.Fatalf("expected 1 entry; got %d %v", len(entries), err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries polled after the commit are delivered again.
+	db, err = Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	sub = db.NewSubscriber(topics, 0).WithName("sub1")
+	entries, err := sub.Poll(ctx, 4)
+	if err != nil || len(entries) != 1 || string(entries[0].Payload) != "msg.3" {
+		t.Fatalf("expected msg.3; got %v %v", entries, err)
+	}
+	if err := sub.Reset(topics[1]); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := sub.Poll(ctx, 10); err != nil || len(entries) != 3 {
+		t.Fatalf("expected 3 entries; got %d %v", len(entries), err)
+	}
+	if err := sub.Reset([]byte("unit4.test3")); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest; got %v", err)
+	}
+	// subscribers of different names keep separate checkpoints.
+	sub2 := db.NewSubscriber(topics, 0).WithName("sub2")
+	if entries, err := sub2.Poll(ctx, 10); err != nil || len(entries) != 7 {
+		t.Fatalf("expected 7 entries; got %d %v", len(entries), err)
+	}
+	// free sequences are not reused while subscribers are open.
+	if db.reuseSeqs() {
+		t.Fatal("expected free sequences not to be reused")
+	}
+	for _, s := range []*Subscriber{sub, sub2} {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !db.reuseSeqs() {
+		t.Fatal("expected free sequences to be reused once subscribers are closed")
+	}
+	if _, err := sub.Poll(ctx, 10); err != errSubscriberClosed {
+		t.Fatalf("expected errSubscriberClosed; got %v", err)
+	}
+}
+
+func TestShardFor(t *testing.T) {
+	cleanup("test.db")
+	if _, err := Open("test.db", WithShards(4, 3)); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest for capacity less than shards; got %v", err)
+	}
+	db, err := Open("test.db", WithShards(4, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := make(map[uint32]int)
+	for contract := uint32(1); contract <= 1000; contract++ {
+		shard := db.ShardFor(contract)
+		if shard < 0 || shard >= 4 {
+			t.Fatalf("expected shard in [0, 4); got %d", shard)
+		}
+		shards[contract] = shard
+	}
+	shard, err := db.AddShard()
+	if err != nil || shard != 4 || db.Shards() != 5 {
+		t.Fatalf("expected shard 4; got %d %v", shard, err)
+	}
+	if _, err := db.AddShard(); !errors.Is(err, errShardCapacity) {
+		t.Fatalf("expected errShardCapacity; got %v", err)
+	}
+	for contract, old := range shards {
+		if shard := db.ShardFor(contract); shard != old && shard != 4 {
+			t.Fatalf("expected contract %d to stay on shard %d or move to shard 4; got %d", contract, old, shard)
+		}
+	}
+	if err := db.RemoveShard(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RemoveShard(4); !errors.Is(err, errShardInvalid) {
+		t.Fatalf("expected errShardInvalid; got %v", err)
+	}
+	for contract, old := range shards {
+		if shard := db.ShardFor(contract); shard != old {
+			t.Fatalf("expected contract %d on shard %d; got %d", contract, old, shard)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// shards that start out removed can be added back and the ring changes are kept on reopen.
+	cleanup("test.db")
+	db, err = Open("test.db", WithShards(3, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shard, err := db.AddShard(); err != nil || shard != 3 {
+		t.Fatalf("expected shard 3; got %d %v", shard, err)
+	}
+	if err := db.RemoveShard(0); err != nil {
+		t.Fatal(err)
+	}
+	for contract := uint32(1); contract <= 1000; contract++ {
+		shard := db.ShardFor(contract)
+		if shard < 1 || shard > 3 {
+			t.Fatalf("expected shard in [1, 3]; got %d", shard)
+		}
+		shards[contract] = shard
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("test.db", WithShards(3, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Shards() != 3 {
+		t.Fatalf("expected 3 shards; got %d", db.Shards())
+	}
+	for contract, old := range shards {
+		if shard := db.ShardFor(contract); shard != old {
+			t.Fatalf("expected contract %d on shard %d after reopen; got %d", contract, old, shard)
+		}
+	}
+}
+
+func TestTeeWriter(t *testing.T) {
+	cleanup("test.db")
+	cleanup("test2.db")
+	defer cleanup("test2.db")
+	db, err := Open("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := Open("test2.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := db.NewTeeWriter(sink)
+	topic := []byte("unit4.test")
+	for i := 0; i < 3; i++ {
+		if err := w.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%d", i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := sink.Get(NewQuery(topic).WithLimit(10))
+	if err != nil || len(items) != 3 {
+		t.Fatalf("expected 3 items in sink; got %d %v", len(items), err)
+	}
+	// the entry has the same ID in the primary and the sink. Entries may be written to the sink in another
+	// order than to the primary, so IDs are compared sorted.
+	ids := func(db *DB) [][]byte {
+		it, err := db.Items(NewQuery(topic).WithLimit(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids [][]byte
+		for it.First(); it.Valid(); it.Next() {
+			ids = append(ids, it.Item().ID())
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return bytes.Compare(ids[i], ids[j]) < 0
+		})
+		return ids
+	}
+	if got, want := ids(sink), ids(db); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected sink IDs %v; got %v", want, got)
+	}
+	// writes to the primary made without the writer do not count as lag.
+	if err := db.Put([]byte("unit4.other"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if lag := w.Lag()["test2.db"]; lag != 0 {
+		t.Fatalf("expected no lag; got %d", lag)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = w.PutEntry(NewEntry(topic, []byte("msg.3")))
+	var merr *MultiError
+	if !errors.As(err, &merr) || len(merr.Errors) != 1 || !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected MultiError of ErrClosed; got %v", err)
+	}
+	if lag := w.Lag()["test2.db"]; lag != 1 {
+		t.Fatalf("expected lag 1; got %d", lag)
+	}
+	if err := w.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed of closed sink; got %v", err)
+	}
+}
+
+func TestReplaceFileWithoutRenamer(t *testing.T) {
+	cleanup("test.db")
+	defer cleanup("test.db")
+	// a file system without Rename replaces the file by copying the temporary file.
+	fsys := struct{ fs.FileSystem }{fs.FileIO}
+	name := "test.db" + subscriberPostfix
+	for _, data := range []string{"first state", "state"} {
+		if err := replaceFile(fsys, name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(name); err != nil || string(got) != data {
+			t.Fatalf("expected %q; got %q %v", data, got, err)
+		}
+	}
+	if _, err := os.Stat(name + compactPostfix); !os.IsNotExist(err) {
+		t.Fatalf("expected temporary file to be removed; got %v", err)
+	}
+}
+
+func BenchmarkDelete(b *testing.B) {
+	cleanup("test.db")
+	defer cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	type item struct {
+		id    []byte
+		topic []byte
+	}
+	var items []item
+	put := func() {
+		// deletes walk the window blocks of the topic, so entries are spread over topics.
+		for i := 0; i < 20000; i++ {
+			it := item{id: db.NewID(), topic: []byte(fmt.Sprintf("unit8.delete.%d", i%100))}
+			if err := db.PutEntry(NewEntry(it.topic, []byte("msg")).WithID(it.id)); err != nil {
+				b.Fatal(err)
+			}
+			items = append(items, it)
+		}
+		if err := db.FlushBatch(); err != nil {
+			b.Fatal(err)
+		}
+		clock.Add(time.Second)
+		if err := db.Sync(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(items) == 0 {
+			b.StopTimer()
+			put()
+			b.StartTimer()
+		}
+		it := items[len(items)-1]
+		items = items[:len(items)-1]
+		if err := db.Delete(it.id, it.topic); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
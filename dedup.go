@@ -0,0 +1,117 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+const (
+	// maxDedupKeys limits number of dedup keys kept in the dedup cache.
+	maxDedupKeys = 1 << 16
+)
+
+type (
+	dedupKey struct {
+		key       string
+		expiresAt time.Time
+	}
+
+	// dedupCache is a bounded cache of dedup keys seen within the dedup window.
+	dedupCache struct {
+		sync.Mutex
+		window time.Duration
+		clock  Clock
+		keys   map[string]time.Time
+		order  []dedupKey // keys in the order they were added.
+	}
+)
+
+func newDedupCache(window time.Duration, clock Clock) *dedupCache {
+	return &dedupCache{window: window, clock: clock, keys: make(map[string]time.Time)}
+}
+
+// dedupKeyOf returns dedup key of the entry, the key is scoped to contract and topic of the entry.
+func dedupKeyOf(e *Entry) string {
+	contract := e.Contract
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	var scratch [4]byte
+	binary.LittleEndian.PutUint32(scratch[:], contract)
+	key := make([]byte, 0, len(scratch)+len(e.Topic)+len(e.DedupKey)+1)
+	key = append(key, scratch[:]...)
+	key = append(key, e.Topic...)
+	key = append(key, 0)
+	key = append(key, e.DedupKey...)
+	return string(key)
+}
+
+// seen checks if the key was added within the dedup window, otherwise it adds the key.
+func (c *dedupCache) seen(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	now := c.clock.Now()
+	c.evict(now)
+	if expiresAt, ok := c.keys[key]; ok && now.Before(expiresAt) {
+		return true
+	}
+	if len(c.order) >= maxDedupKeys {
+		c.remove(c.order[0])
+		c.order = c.order[1:]
+	}
+	expiresAt := now.Add(c.window)
+	c.keys[key] = expiresAt
+	c.order = append(c.order, dedupKey{key: key, expiresAt: expiresAt})
+	return false
+}
+
+// forget removes the key so the entry can be written again, it is used if the write fails.
+func (c *dedupCache) forget(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.keys, key)
+}
+
+// forgetAll removes the keys of entries not committed, so the entries can be written again.
+func (c *dedupCache) forgetAll(keys []string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, key := range keys {
+		delete(c.keys, key)
+	}
+}
+
+// evict removes keys older than the dedup window.
+func (c *dedupCache) evict(now time.Time) {
+	i := 0
+	for ; i < len(c.order) && !now.Before(c.order[i].expiresAt); i++ {
+		c.remove(c.order[i])
+	}
+	c.order = c.order[i:]
+}
+
+// remove removes the key unless it was added again after k.
+func (c *dedupCache) remove(k dedupKey) {
+	if expiresAt, ok := c.keys[k.key]; ok && expiresAt.Equal(k.expiresAt) {
+		delete(c.keys, k.key)
+	}
+}
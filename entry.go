@@ -19,8 +19,11 @@ package unitdb
 import (
 	"encoding/binary"
 	"strconv"
+	"sync"
 	"time"
 	"unsafe"
+
+	"github.com/unit-io/unitdb/message"
 )
 
 const (
@@ -37,6 +40,9 @@ type (
 		parsed    bool
 		topicHash uint64 // topicHash for recovery from log and not persisted to the DB.
 		cache     []byte // entry from memdb if it exist.
+
+		value []byte // value is the stored value of a copied entry, it is written with its flags without encoding the payload.
+		flags uint8
 	}
 	// Entry entry is a message entry structure.
 	Entry struct {
@@ -47,9 +53,22 @@ type (
 		ExpiresAt  uint32 // The time expiry of the message.
 		Contract   uint32 // The contract is used to as salt to hash topic parts and also used as prefix in the message ID.
 		Encryption bool
+		DedupKey   []byte // The dedup key is used to skip duplicate writes of the entry within the dedup window.
+		ExternalID []byte // The external ID of the message, such as a UUID, it is indexed to look up the entry by GetByID.
 	}
 )
 
+// EntryMetadata is the metadata of an entry read from the index without reading its payload.
+type EntryMetadata struct {
+	Seq       uint64 // The sequence of the message.
+	TopicSize uint16 // The size of the topic stored with the message, it is only set for the first entry of a topic.
+	ValueSize uint32 // The size of the stored payload, after compression and encryption.
+	ExpiresAt uint32 // The time expiry of the message, it is zero if the message does not expire.
+	MsgOffset int64  // The offset of the message in the data file, it is zero if the entry is not yet synced to the DB files.
+}
+
+var entryPool sync.Pool
+
 // NewEntry creates a new entry structure from the topic.
 func NewEntry(topic, payload []byte) *Entry {
 	return &Entry{
@@ -94,12 +113,64 @@ func (e *Entry) WithEncryption() *Entry {
 	return e
 }
 
+// WithExternalID sets a 16 byte external ID, such as a UUID, on entry to look up the entry by DB.GetByID.
+func (e *Entry) WithExternalID(id []byte) *Entry {
+	e.ExternalID = id
+	return e
+}
+
+// WithDedupKey sets dedup key on entry. The entry is not written if an entry with the same
+// topic and dedup key was written within the dedup window.
+func (e *Entry) WithDedupKey(key []byte) *Entry {
+	e.DedupKey = key
+	return e
+}
+
+// Validate validates the entry for the contract without writing it. It checks the topic and its options,
+// and sizes of the topic and payload against the maximum sizes. If contract is zero the contract of the entry is used.
+// Use DB.ValidateEntry to validate the entry with the maximum sizes and the topic normalizer of a DB.
+func (e *Entry) Validate(contract uint32) error {
+	if err := e.validate(maxTopicLength, maxValueLength); err != nil {
+		return err
+	}
+	if contract == 0 {
+		contract = e.Contract
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	t := new(message.Topic)
+	t.ParseKey(e.Topic)
+	t.Parse(contract, true)
+	return validateTopic(t)
+}
+
+// validate validates sizes of the topic and payload of the entry.
+func (e *Entry) validate(maxTopicSize, maxValueSize int) error {
+	switch {
+	case len(e.Topic) == 0:
+		return errTopicEmpty
+	case len(e.Topic) > maxTopicSize:
+		return ErrTopicTooLarge
+	case len(e.Payload) == 0:
+		return errValueEmpty
+	case len(e.Payload) > maxValueSize:
+		return ErrValueTooLarge
+	case len(e.ExternalID) != 0 && len(e.ExternalID) != externalIDSize:
+		return errExternalIDInvalid
+	}
+	return nil
+}
+
 func (e *Entry) reset() {
 	e.seq = 0
 	e.topicSize = 0
 	e.cache = nil
+	e.value = nil
 	e.ID = nil
 	e.Payload = nil
+	e.DedupKey = nil
+	e.ExternalID = nil
 }
 
 func (e entry) ExpiresAt() uint32 {
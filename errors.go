@@ -20,25 +20,62 @@ import (
 	"errors"
 )
 
+var (
+	// ErrTopicTooLarge is returned if topic is larger than the maximum topic size.
+	ErrTopicTooLarge = errors.New("Topic is too large")
+	// ErrValueTooLarge is returned if payload is larger than the maximum value size.
+	ErrValueTooLarge = errors.New("value is too large")
+	// ErrMsgIDDoesNotExist is returned if message ID does not exist in the database.
+	ErrMsgIDDoesNotExist = errors.New("Message ID does not exist in database")
+	// ErrFull is returned if the database is full.
+	ErrFull = errors.New("database is full")
+	// ErrCorrupted is returned if the database files are corrupted.
+	ErrCorrupted = errors.New("database is corrupted")
+	// ErrVersionMismatch is returned if the database files are written by an incompatible version.
+	ErrVersionMismatch = errors.New("database version mismatch")
+	// ErrLocked is returned if the database is locked by another process.
+	ErrLocked = errors.New("database is locked")
+	// ErrClosed is returned if the database is closed.
+	ErrClosed = errors.New("database is closed")
+	// ErrBadRequest is returned if the request is invalid, such as an invalid topic.
+	ErrBadRequest = errors.New("The request was invalid or cannot be otherwise served")
+	// ErrSkipEntry is returned by a read hook to exclude the entry from the query result.
+	ErrSkipEntry = errors.New("skip entry")
+	// ErrResultsTruncated is returned with partial results if the results are truncated at the query limit.
+	ErrResultsTruncated = errors.New("results are truncated")
+	// ErrDuplicateLabel is returned if the contract label is already used by another contract.
+	ErrDuplicateLabel = errors.New("contract label already exists")
+	// ErrSeqNotFound is returned if the sequence does not exist in the database.
+	ErrSeqNotFound = errors.New("Sequence does not exist in database")
+	// ErrNoEntries is returned if the topic has no entries.
+	ErrNoEntries = errors.New("Topic has no entries")
+	// ErrEntryHasNoExpiry is returned if the expiry of an entry without expiry is changed.
+	ErrEntryHasNoExpiry = errors.New("entry has no expiry")
+	// ErrEntryAlreadyPermanent is returned if the expiry of an entry without expiry is cleared.
+	ErrEntryAlreadyPermanent = errors.New("entry is already permanent")
+)
+
 var (
 	errTopicEmpty          = errors.New("Topic is empty")
 	errMsgIDEmpty          = errors.New("Message ID is empty")
 	errMsgIDDeleted        = errors.New("Message ID is deleted")
-	errMsgIDDoesNotExist   = errors.New("Message ID does not exist in database")
+	errMsgIDInvalid        = errors.New("Message ID is invalid")
+	errSeqExists           = errors.New("Sequence already exists in database")
+	errExternalIDInvalid   = errors.New("external ID is invalid, it must be 16 bytes")
+	errDuplicateExternalID = errors.New("external ID already exists in database")
+	errSnapshotClosed      = errors.New("snapshot is closed")
+	errShardCapacity       = errors.New("shard ring is at capacity")
+	errShardInvalid        = errors.New("shard is invalid or not working")
+	errReaderClosed        = errors.New("reader is closed")
+	errSubscriberClosed    = errors.New("subscriber is closed")
 	errMsgIDPrefixMismatch = errors.New("Message ID does not match topic or Contract")
 	errTtlTooLarge         = errors.New("TTL is too large")
-	errTopicTooLarge       = errors.New("Topic is too large")
 	errMsgExpired          = errors.New("Message has expired")
 	errValueEmpty          = errors.New("Payload is empty")
-	errValueTooLarge       = errors.New("value is too large")
 	errEntryInvalid        = errors.New("entry is invalid")
 	errImmutable           = errors.New("database is immutable")
-	errFull                = errors.New("database is full")
-	errCorrupted           = errors.New("database is corrupted")
-	errLocked              = errors.New("database is locked")
-	errClosed              = errors.New("database is closed")
 	errBatchSeqComplete    = errors.New("batch seq is complete")
 	errWriteConflict       = errors.New("batch write conflict")
-	errBadRequest          = errors.New("The request was invalid or cannot be otherwise served")
+	errWALReaderOpen       = errors.New("WAL reader is already open")
 	errForbidden           = errors.New("The request is understood, but it has been refused or access is not allowed")
 )
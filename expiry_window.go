@@ -72,10 +72,11 @@ type expiryWindowBucket struct {
 	maxExpDurations     int
 	backgroundKeyExpiry bool
 	earliestExpiryHash  int64
+	clock               Clock
 }
 
-func newExpiryWindowBucket(bgKeyExp bool, expDurType time.Duration, maxExpDur int) *expiryWindowBucket {
-	ex := &expiryWindowBucket{backgroundKeyExpiry: bgKeyExp, expDurationType: expDurType, maxExpDurations: maxExpDur}
+func newExpiryWindowBucket(bgKeyExp bool, expDurType time.Duration, maxExpDur int, clock Clock) *expiryWindowBucket {
+	ex := &expiryWindowBucket{backgroundKeyExpiry: bgKeyExp, expDurationType: expDurType, maxExpDurations: maxExpDur, clock: clock}
 	ex.expiryWindows = newExpiryWindows()
 	return ex
 }
@@ -85,17 +86,21 @@ func (wb *expiryWindowBucket) getExpiredEntries(maxResults int) []timeWindowEntr
 		return nil
 	}
 	var expiredEntries []timeWindowEntry
-	startTime := uint32(time.Now().Unix())
+	startTime := uint32(wb.clock.Now().Unix())
 
 	if atomic.LoadInt64(&wb.earliestExpiryHash) > int64(startTime) {
 		return expiredEntries
 	}
 
-	for i := 0; i < wb.maxExpDurations; i++ {
+	// expiry is added to the shard of the expiry time, so all shards are scanned.
+	for i := 0; i < len(wb.expiryWindows.expiry) && len(expiredEntries) <= maxResults; i++ {
 		// get windows shard.
 		ws := wb.expiryWindows.expiry[i]
 		ws.mu.Lock()
-		defer ws.mu.Unlock()
+		if len(ws.windows) == 0 {
+			ws.mu.Unlock()
+			continue
+		}
 		windowTimes := make([]int64, 0, len(ws.windows))
 		for windowTime := range ws.windows {
 			windowTimes = append(windowTimes, windowTime)
@@ -118,6 +123,7 @@ func (wb *expiryWindowBucket) getExpiredEntries(maxResults int) []timeWindowEntr
 				delete(ws.windows, windowTimes[i])
 			}
 		}
+		ws.mu.Unlock()
 	}
 	atomic.StoreInt64(&wb.earliestExpiryHash, 0)
 	return expiredEntries
@@ -144,3 +150,60 @@ func (wb *expiryWindowBucket) addExpiry(e timeWindowEntry) error {
 
 	return nil
 }
+
+type expiryNotice struct {
+	topic []byte
+	id    []byte
+}
+
+// expiryNotifier calls the expiry callback for entries freed by the expirer.
+type expiryNotifier struct {
+	mu      sync.Mutex
+	queue   []expiryNotice
+	notifyC chan struct{}
+	fn      func(topic, id []byte)
+}
+
+func newExpiryNotifier(fn func(topic, id []byte)) *expiryNotifier {
+	return &expiryNotifier{notifyC: make(chan struct{}, 1), fn: fn}
+}
+
+// push queues expired entries without waiting for the callback.
+func (n *expiryNotifier) push(entries []expiryNotice) {
+	if len(entries) == 0 {
+		return
+	}
+	n.mu.Lock()
+	n.queue = append(n.queue, entries...)
+	n.mu.Unlock()
+	select {
+	case n.notifyC <- struct{}{}:
+	default:
+	}
+}
+
+// notify calls the callback for the queued entries.
+func (n *expiryNotifier) notify() {
+	n.mu.Lock()
+	entries := n.queue
+	n.queue = nil
+	n.mu.Unlock()
+	for _, e := range entries {
+		n.fn(e.topic, e.id)
+	}
+}
+
+// run calls the callback for queued entries until closeC is closed. Entries queued before close are notified.
+func (n *expiryNotifier) run(closeC <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-closeC:
+				n.notify()
+				return
+			case <-n.notifyC:
+				n.notify()
+			}
+		}
+	}()
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"github.com/unit-io/unitdb/message"
+)
+
+// QueryPlan describes how a query is resolved by the DB. It is used to diagnose
+// why a query returns fewer items than expected.
+type QueryPlan struct {
+	Topic     []byte         // The topic of the query.
+	Contract  uint32         // The contract used to resolve the topic.
+	Parts     []message.Part // The parts are resolved hashes of the topic including contract.
+	Depth     uint8          // The depth of the topic.
+	TopicType uint8          // The type of the topic i.e. static or wildcard.
+	Prefix    uint64         // The prefix is generated from contract and first of the topic.
+	Cutoff    int64          // The cutoff is time limit check on message IDs.
+	Limit     int            // The maximum number of elements to return.
+
+	Topics   int // Number of topics matched in the trie.
+	Matched  int // Number of sequences matched by the topics including expired sequences.
+	Expired  int // Number of sequences skipped as expired.
+	Deleted  int // Number of sequences not found in the DB.
+	Filtered int // Number of sequences filtered by cutoff or contract.
+	Returned int // Number of sequences the query would return.
+}
+
+// Explain resolves the query without reading payloads and returns the query plan.
+// The query is not modified, so it can be passed to Get afterwards.
+func (db *DB) Explain(q *Query) (*QueryPlan, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	q = q.clone()
+	switch {
+	case len(q.Topic) == 0:
+		return nil, errTopicEmpty
+	case len(q.Topic) > db.opts.maxTopicSize:
+		return nil, ErrTopicTooLarge
+	}
+	q.opts = db.newQueryOptions()
+	if err := q.parse(); err != nil {
+		return nil, err
+	}
+	mu := db.getMutex(q.prefix)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	plan := &QueryPlan{
+		Topic:     q.Topic,
+		Contract:  q.Contract,
+		Parts:     q.parts,
+		Depth:     q.depth,
+		TopicType: q.topicType,
+		Prefix:    q.prefix,
+		Cutoff:    q.cutoff,
+		Limit:     q.Limit,
+		Topics:    len(db.trie.lookup(q.parts, q.depth, q.topicType)),
+	}
+	db.lookup(q)
+	plan.Expired = q.expired
+	plan.Matched = len(q.winEntries) + q.expired
+	for _, we := range q.winEntries {
+		if we.seq == 0 {
+			continue
+		}
+		s, err := db.readEntry(we.topicHash, we.seq)
+		if err != nil || s.seq == 0 {
+			plan.Deleted++
+			continue
+		}
+		id, _, err := db.data.readMessage(s)
+		if err != nil {
+			return plan, err
+		}
+		if !message.ID(id).EvalPrefix(q.Contract, q.cutoff) {
+			plan.Filtered++
+			continue
+		}
+		plan.Returned++
+	}
+	if plan.Returned > q.Limit {
+		plan.Returned = q.Limit
+	}
+	return plan, nil
+}
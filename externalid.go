@@ -0,0 +1,264 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/unit-io/unitdb/fs"
+)
+
+const (
+	// externalIDSize is size of the external IDs of entries, such as UUIDs.
+	externalIDSize = 16
+	// externalIDRecordSize is size of the external ID record in the external ID file.
+	externalIDRecordSize = externalIDSize + 8
+)
+
+type externalID [externalIDSize]byte
+
+// externalIDs maps external IDs of entries to their sequence and back. Records are appended
+// to the external ID file, a record with zero external ID removes the mapping of the sequence.
+// The file is synced with the DB files, mappings not yet synced are recovered from the log
+// records of the entries. The file is compacted on open.
+type externalIDs struct {
+	mu      sync.RWMutex
+	fs      fs.FileSystem
+	path    string
+	file    file
+	records int64 // number of records in the external ID file.
+	seqs    map[externalID]uint64
+	ids     map[uint64]externalID
+}
+
+func newExternalIDs(fsys fs.FileSystem, path string, f file) *externalIDs {
+	return &externalIDs{fs: fsys, path: path, file: f, seqs: make(map[externalID]uint64), ids: make(map[uint64]externalID)}
+}
+
+// read loads external ID mapping from the external ID file, and compacts the file if it has
+// records of removed or replaced mappings.
+func (x *externalIDs) read() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	size := x.file.currSize() / externalIDRecordSize * externalIDRecordSize
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if _, err := x.file.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	for off := 0; off < len(buf); off += externalIDRecordSize {
+		var xid externalID
+		copy(xid[:], buf[off:off+externalIDSize])
+		x.set(xid, binary.LittleEndian.Uint64(buf[off+externalIDSize:off+externalIDRecordSize]))
+	}
+	x.records = size / externalIDRecordSize
+	if x.records == int64(len(x.ids)) && size == x.file.currSize() {
+		return nil
+	}
+	return x.compact()
+}
+
+// set maps the external ID to the sequence. The caller must hold the lock.
+func (x *externalIDs) set(xid externalID, seq uint64) {
+	if old, ok := x.ids[seq]; ok {
+		delete(x.seqs, old)
+		delete(x.ids, seq)
+	}
+	if xid == (externalID{}) {
+		return
+	}
+	if oldSeq, ok := x.seqs[xid]; ok {
+		delete(x.ids, oldSeq)
+	}
+	x.seqs[xid] = seq
+	x.ids[seq] = xid
+}
+
+// write appends the record of the mapping to the external ID file. The caller must hold the lock.
+func (x *externalIDs) write(xid externalID, seq uint64) error {
+	if _, err := x.file.write(externalIDRecord(xid, seq)); err != nil {
+		return err
+	}
+	x.records++
+	return nil
+}
+
+// add maps the external ID to the sequence and appends the record to the external ID file.
+// An empty or zero external ID removes the mapping of the sequence if any. It returns false
+// if the mapping is not changed.
+func (x *externalIDs) add(id []byte, seq uint64) (bool, error) {
+	var xid externalID
+	copy(xid[:], id)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if old, ok := x.ids[seq]; (!ok && xid == (externalID{})) || (ok && old == xid) {
+		return false, nil
+	}
+	if err := x.write(xid, seq); err != nil {
+		return false, err
+	}
+	x.set(xid, seq)
+	return true, nil
+}
+
+// remove removes the mapping of the sequence if any, it is called when the sequence is freed.
+func (x *externalIDs) remove(seq uint64) error {
+	_, err := x.add(nil, seq)
+	return err
+}
+
+// lookup returns sequence of the external ID.
+func (x *externalIDs) lookup(id []byte) (uint64, bool) {
+	var xid externalID
+	copy(xid[:], id)
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	seq, ok := x.seqs[xid]
+	return seq, ok
+}
+
+// lookupSeq returns external ID of the sequence.
+func (x *externalIDs) lookupSeq(seq uint64) ([]byte, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	xid, ok := x.ids[seq]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), xid[:]...), true
+}
+
+// snapshot returns the records of the mappings of the sequences, or of all mappings if seqs is nil.
+func (x *externalIDs) snapshot(seqs []uint64) []byte {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	var buf bytes.Buffer
+	if seqs == nil {
+		for seq, xid := range x.ids {
+			buf.Write(externalIDRecord(xid, seq))
+		}
+		return buf.Bytes()
+	}
+	for _, seq := range seqs {
+		if xid, ok := x.ids[seq]; ok {
+			buf.Write(externalIDRecord(xid, seq))
+		}
+	}
+	return buf.Bytes()
+}
+
+// restore adds the mappings of the records returned by snapshot.
+func (x *externalIDs) restore(data []byte) error {
+	if len(data)%externalIDRecordSize != 0 {
+		return fmt.Errorf("externalIDs.restore: invalid size %d: %w", len(data), ErrCorrupted)
+	}
+	for ; len(data) > 0; data = data[externalIDRecordSize:] {
+		seq := binary.LittleEndian.Uint64(data[externalIDSize:externalIDRecordSize])
+		if _, err := x.add(data[:externalIDSize], seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset replaces the mappings with the mappings of the records returned by snapshot that keep returns
+// true for, and compacts the external ID file.
+func (x *externalIDs) reset(data []byte, keep func(seq uint64) bool) error {
+	if len(data)%externalIDRecordSize != 0 {
+		return fmt.Errorf("externalIDs.reset: invalid size %d: %w", len(data), ErrCorrupted)
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.seqs = make(map[externalID]uint64)
+	x.ids = make(map[uint64]externalID)
+	for ; len(data) > 0; data = data[externalIDRecordSize:] {
+		var xid externalID
+		copy(xid[:], data[:externalIDSize])
+		if seq := binary.LittleEndian.Uint64(data[externalIDSize:externalIDRecordSize]); keep(seq) {
+			x.set(xid, seq)
+		}
+	}
+	return x.compact()
+}
+
+// compact writes the mappings to a new file that replaces the external ID file, so a crash keeps
+// either file. The caller must hold the lock.
+func (x *externalIDs) compact() error {
+	buf := make([]byte, 0, len(x.ids)*externalIDRecordSize)
+	for seq, xid := range x.ids {
+		buf = append(buf, externalIDRecord(xid, seq)...)
+	}
+	tmpPath := x.path + compactPostfix
+	f, err := newFile(x.fs, tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := f.truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := x.file.Close(); err != nil {
+		return err
+	}
+	renameErr := fs.Rename(x.fs, tmpPath, x.path)
+	if x.file, err = newFile(x.fs, x.path); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	x.records = int64(len(x.ids))
+	return nil
+}
+
+// sync syncs the external ID file, it is called when the DB files are synced.
+func (x *externalIDs) sync() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.file.Sync()
+}
+
+func (x *externalIDs) close() error {
+	if err := x.file.Sync(); err != nil {
+		return err
+	}
+	return x.file.Close()
+}
+
+// externalIDRecord packs the record of the mapping of the external ID to the sequence.
+func externalIDRecord(xid externalID, seq uint64) []byte {
+	rec := make([]byte, externalIDRecordSize)
+	copy(rec[:externalIDSize], xid[:])
+	binary.LittleEndian.PutUint64(rec[externalIDSize:], seq)
+	return rec
+}
@@ -46,6 +46,33 @@ func newFile(fs fs.FileSystem, name string) (file, error) {
 	return f, err
 }
 
+// replaceFile replaces the file with the data. The data is written to a temporary file that is synced
+// and renamed to the file, so a crash keeps either the previous or the new contents of the file if the file
+// system implements fs.Renamer.
+func replaceFile(fsys fs.FileSystem, name string, data []byte) error {
+	tmpName := name + compactPostfix
+	f, err := newFile(fsys, tmpName)
+	if err != nil {
+		return err
+	}
+	if err := f.truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(fsys, tmpName, name)
+}
+
 func (f *file) truncate(size int64) error {
 	if err := f.Truncate(size); err != nil {
 		return err
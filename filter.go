@@ -18,35 +18,58 @@ package unitdb
 
 import (
 	"github.com/unit-io/unitdb/filter"
-	"github.com/unit-io/unitdb/memdb"
 )
 
-// Filter filter is bloom filter generator.
+// Filter filter is bloom filter generator. Filter is disabled if filterBlock is nil.
 type Filter struct {
 	file
 	filterBlock *filter.Generator
-	cache       *memdb.DB
+	cache       *filter.Cache
 	cacheID     uint64
 }
 
 // Append appends an entry to bloom filter.
 func (f *Filter) Append(h uint64) {
+	if f.filterBlock == nil {
+		return
+	}
 	f.filterBlock.Append(h)
 }
 
 // Test tests entry in bloom filter. It returns false if entry definitely does not exist or entry maybe existing in DB.
 func (f *Filter) Test(h uint64) bool {
+	if f.filterBlock == nil {
+		// filter is disabled, entry maybe existing in DB.
+		return true
+	}
 	/// Test filter block for presence.
 	fltr, _ := f.getFilterBlock(true)
 	if fltr != nil && !fltr.Test(h) {
-		return false
+		// filter block is written to file on close, so test entries appended since DB open.
+		return f.filterBlock.Test(h)
 	}
 	return true
 }
 
+// load initializes filter block generator from filter file so that
+// entries appended before DB open are kept when filter block is written on close.
+func (f *Filter) load() error {
+	if f.filterBlock == nil || f.size <= 0 {
+		return nil
+	}
+	raw := make([]byte, f.size)
+	if _, err := f.ReadAt(raw, 0); err != nil {
+		return err
+	}
+	f.filterBlock = filter.NewFilterGeneratorFromBytes(raw)
+	return nil
+}
+
 // Close finalizes writing filter to file.
 func (f *Filter) close() error {
-	f.writeFilterBlock()
+	if f.filterBlock != nil {
+		f.writeFilterBlock()
+	}
 	if err := f.Close(); err != nil {
 		return err
 	}
@@ -70,8 +93,8 @@ func (f *Filter) getFilterBlock(fillCache bool) (*filter.Block, error) {
 	var cacheKey uint64
 	if f.cache != nil {
 		cacheKey = f.cacheID ^ uint64(f.size)
-		if data, err := f.cache.Get(0, cacheKey); data != nil {
-			return filter.NewFilterBlock(data), err
+		if data, ok := f.cache.Get(cacheKey); ok {
+			return filter.NewFilterBlock(data), nil
 		}
 	}
 
@@ -81,7 +104,7 @@ func (f *Filter) getFilterBlock(fillCache bool) (*filter.Block, error) {
 	}
 
 	if f.cache != nil && fillCache {
-		f.cache.Set(0, cacheKey, raw)
+		f.cache.Set(cacheKey, raw)
 	}
 	return filter.NewFilterBlock(raw), nil
 }
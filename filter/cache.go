@@ -0,0 +1,112 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filter
+
+import (
+	"container/list"
+	"sync"
+)
+
+type cacheEntry struct {
+	key  uint64
+	data []byte
+}
+
+// Cache is a size bounded LRU cache for filter blocks.
+// All Cache methods are safe for concurrent use by multiple goroutines.
+type Cache struct {
+	mu          sync.Mutex
+	ll          *list.List
+	items       map[uint64]*list.Element
+	currentSize int64
+	maxSize     int64
+}
+
+// NewCache creates a new filter block cache. The least recently used
+// filter blocks are evicted once cache grows larger than maxSize bytes.
+func NewCache(maxSize int64) *Cache {
+	return &Cache{
+		ll:      list.New(),
+		items:   make(map[uint64]*list.Element),
+		maxSize: maxSize,
+	}
+}
+
+// Get gets filter block for the given key.
+func (c *Cache) Get(key uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*cacheEntry).data, true
+	}
+	return nil, false
+}
+
+// Set adds filter block to the cache under the given key.
+func (c *Cache) Set(key uint64, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*cacheEntry)
+		c.currentSize += int64(len(data) - len(e.data))
+		e.data = data
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&cacheEntry{key: key, data: data})
+		c.currentSize += int64(len(data))
+	}
+	for c.currentSize > c.maxSize && c.ll.Len() > 0 {
+		c.removeOldest()
+	}
+}
+
+// Remove removes filter block for the given key from the cache.
+func (c *Cache) Remove(key uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// Len returns number of filter blocks in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Size returns total size of filter blocks in the cache.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.currentSize
+}
+
+func (c *Cache) removeOldest() {
+	if el := c.ll.Back(); el != nil {
+		c.removeElement(el)
+	}
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	e := el.Value.(*cacheEntry)
+	delete(c.items, e.key)
+	c.currentSize -= int64(len(e.data))
+}
@@ -15,6 +15,16 @@ func NewFilterGenerator() *Generator {
 	return &Generator{filter: newFilter(bloomBits, bloomHashes)}
 }
 
+// NewFilterGeneratorFromBytes returns a filter generator initialized from existing filter block.
+func NewFilterGeneratorFromBytes(b []byte) *Generator {
+	return &Generator{filter: newFilterFromBytes(b, bloomBits, bloomHashes)}
+}
+
+// Test is used to test for key presence in the filter block being generated.
+func (b *Generator) Test(h uint64) bool {
+	return b.filter.Test(h)
+}
+
 // Append adds a key to the filter block.
 func (b *Generator) Append(h uint64) {
 	b.filter.Add(h)
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package fs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrInjected is returned by a Faulty file when a fault is injected.
+var ErrInjected = errors.New("fs: injected fault")
+
+// Faults configures the faults injected by a Faulty file.
+type Faults struct {
+	// FailWriteAt fails the Nth WriteAt call, counting from one. Zero disables the fault.
+	FailWriteAt int
+	// TornWriteAt writes only the first half of the data of the Nth WriteAt call and fails it.
+	TornWriteAt int
+	// FailSync fails every Sync call.
+	FailSync bool
+}
+
+// Faulty wraps a FileManager and injects write and sync faults. It is used to
+// test recovery against failed and torn writes.
+type Faulty struct {
+	FileManager
+
+	mu     sync.Mutex
+	faults Faults
+	writes int
+}
+
+// NewFaulty returns a file that injects faults into the writes of the given file.
+func NewFaulty(f FileManager, faults Faults) *Faulty {
+	return &Faulty{FileManager: f, faults: faults}
+}
+
+// SetFaults replaces the faults and resets the write count.
+func (f *Faulty) SetFaults(faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = faults
+	f.writes = 0
+}
+
+// Type indicate type of filesystem.
+func (f *Faulty) Type() string {
+	return "Faulty"
+}
+
+// WriteAt writes data to the file at the given offset unless a fault is injected.
+func (f *Faulty) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	f.writes++
+	n := f.writes
+	faults := f.faults
+	f.mu.Unlock()
+	switch n {
+	case faults.FailWriteAt:
+		return 0, ErrInjected
+	case faults.TornWriteAt:
+		written, err := f.FileManager.WriteAt(p[:len(p)/2], off)
+		if err != nil {
+			return written, err
+		}
+		return written, ErrInjected
+	}
+	return f.FileManager.WriteAt(p, off)
+}
+
+// Sync flush the changes to the file unless a fault is injected.
+func (f *Faulty) Sync() error {
+	f.mu.Lock()
+	failSync := f.faults.FailSync
+	f.mu.Unlock()
+	if failSync {
+		return ErrInjected
+	}
+	return f.FileManager.Sync()
+}
+
+// FaultyFS wraps a FileSystem and injects faults into files opened by name suffix.
+type FaultyFS struct {
+	FileSystem
+
+	mu     sync.Mutex
+	faults map[string]Faults
+	files  map[string]*Faulty
+}
+
+// NewFaultyFS returns a file system that opens files of the given file system.
+func NewFaultyFS(fs FileSystem) *FaultyFS {
+	return &FaultyFS{
+		FileSystem: fs,
+		faults:     make(map[string]Faults),
+		files:      make(map[string]*Faulty),
+	}
+}
+
+// Inject sets faults for files with the name suffix, including the files already open.
+func (fs *FaultyFS) Inject(suffix string, faults Faults) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults[suffix] = faults
+	for name, f := range fs.files {
+		if strings.HasSuffix(name, suffix) {
+			f.SetFaults(faults)
+		}
+	}
+}
+
+// Rename renames the file of the given file system.
+func (fs *FaultyFS) Rename(oldname, newname string) error {
+	return Rename(fs.FileSystem, oldname, newname)
+}
+
+// OpenFile opens the file and wraps it in a Faulty file.
+func (fs *FaultyFS) OpenFile(name string, flag int, perm os.FileMode) (FileManager, error) {
+	fi, err := fs.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var faults Faults
+	for suffix, fa := range fs.faults {
+		if strings.HasSuffix(name, suffix) {
+			faults = fa
+		}
+	}
+	f := NewFaulty(fi, faults)
+	fs.files[name] = f
+	return f, nil
+}
@@ -17,10 +17,15 @@
 package fs
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"time"
 )
 
+// processStart is the start time of the current process recorded in the lock file.
+var processStart = time.Now()
+
 // File is the interface compatible with os.File.
 type File interface {
 	io.Closer
@@ -52,3 +57,81 @@ type FileSystem interface {
 	Stat(name string) (os.FileInfo, error)
 	Remove(name string) error
 }
+
+// Renamer is implemented by a file system that renames files in place.
+type Renamer interface {
+	Rename(oldname, newname string) error
+}
+
+// Rename renames the file replacing the file newname if it exists. If the file system does not implement Renamer
+// the file is copied to newname and removed, so the rename is not atomic.
+func Rename(fs FileSystem, oldname, newname string) error {
+	if r, ok := fs.(Renamer); ok {
+		return r.Rename(oldname, newname)
+	}
+	src, err := fs.OpenFile(oldname, os.O_RDONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, fi.Size())
+	if _, err := src.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	dst, err := fs.OpenFile(newname, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	if err := dst.Truncate(0); err != nil {
+		dst.Close()
+		return err
+	}
+	if _, err := dst.WriteAt(buf, 0); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return fs.Remove(oldname)
+}
+
+// LockOwner is the process that holds the lock file.
+type LockOwner struct {
+	PID   int
+	Start time.Time
+}
+
+// lockOwnerInfo returns lock file content of the current process.
+func lockOwnerInfo() []byte {
+	return []byte(fmt.Sprintf("%d %d\n", os.Getpid(), processStart.UnixNano()))
+}
+
+// ReadLockOwner reads the owning process from the lock file.
+func ReadLockOwner(fs FileSystem, name string) (LockOwner, error) {
+	var o LockOwner
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0666)
+	if err != nil {
+		return o, err
+	}
+	defer f.Close()
+	buf := make([]byte, 64)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return o, err
+	}
+	var start int64
+	if _, err := fmt.Sscanf(string(buf[:n]), "%d %d", &o.PID, &start); err != nil {
+		return o, err
+	}
+	o.Start = time.Unix(0, start)
+	return o, nil
+}
@@ -55,5 +55,13 @@ func newLockFile(name string) (LockFile, error) {
 		f.Close()
 		return nil, err
 	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt(lockOwnerInfo(), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
 	return &unixFileLock{f, name}, nil
 }
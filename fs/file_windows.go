@@ -80,5 +80,9 @@ func newLockFile(name string) (LockFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	var n uint32
+	if err = syscall.WriteFile(fd, lockOwnerInfo(), &n, nil); err != nil {
+		return nil, err
+	}
 	return &windowsFileLock{fd, name}, nil
 }
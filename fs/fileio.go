@@ -55,6 +55,11 @@ func (fs *iofs) Remove(name string) error {
 	return os.Remove(name)
 }
 
+// Rename renames the file replacing the file newname if it exists.
+func (fs *iofs) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
 // Type indicate type of filesystem.
 func (f *IOFile) Type() string {
 	return "FileIO"
@@ -60,6 +60,17 @@ func (fs *memfs) Remove(name string) error {
 	return os.ErrNotExist
 }
 
+// Rename renames the file replacing the file newname if it exists.
+func (fs *memfs) Rename(oldname, newname string) error {
+	f, ok := fs.files[oldname]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = f
+	return nil
+}
+
 // MemFile mem file is used to write buffer to memory store.
 type MemFile struct {
 	buf    []byte
@@ -29,7 +29,7 @@ type header struct {
 	signature [7]byte
 	version   uint32
 	dbInfo
-	_ [12]byte
+	_ [2]byte
 }
 
 // MarshalBinary serializes header into binary data.
@@ -43,6 +43,9 @@ func (h header) MarshalBinary() ([]byte, error) {
 	binary.LittleEndian.PutUint32(buf[28:32], uint32(h.windowIdx))
 	binary.LittleEndian.PutUint32(buf[32:36], uint32(h.blockIdx))
 	binary.LittleEndian.PutUint64(buf[36:44], h.cacheID)
+	buf[44] = uint8(h.noFilter)
+	buf[45] = uint8(h.normalized)
+	binary.LittleEndian.PutUint64(buf[46:54], uint64(h.dataSize))
 	return buf, nil
 }
 
@@ -50,11 +53,15 @@ func (h header) MarshalBinary() ([]byte, error) {
 func (h *header) UnmarshalBinary(data []byte) error {
 	copy(h.signature[:], data[:7])
 	h.encryption = int8(data[7])
+	h.version = binary.LittleEndian.Uint32(data[8:12])
 	h.sequence = binary.LittleEndian.Uint64(data[12:20])
 	h.count = binary.LittleEndian.Uint64(data[20:28])
 	h.windowIdx = int32(binary.LittleEndian.Uint32(data[28:32]))
 	h.blockIdx = int32(binary.LittleEndian.Uint32(data[32:36]))
 	h.cacheID = binary.LittleEndian.Uint64(data[36:44])
+	h.noFilter = int8(data[44])
+	h.normalized = int8(data[45])
+	h.dataSize = int64(binary.LittleEndian.Uint64(data[46:54]))
 
 	return nil
 }
@@ -17,17 +17,21 @@
 package unitdb
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"sync"
-
-	"github.com/golang/snappy"
+	"time"
 
 	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/uid"
 )
 
 // Item items returned by the iterator.
 type Item struct {
 	topic     []byte
 	value     []byte
+	id        []byte
 	expiresAt uint32
 	err       error
 }
@@ -37,6 +41,7 @@ type (
 	query struct {
 		topicHash uint64
 		seq       uint64
+		expiresAt uint32
 	}
 	internalQuery struct {
 		parts      []message.Part // The parts represents a topic which contains a contract and a list of hashes for various parts of the topic.
@@ -45,6 +50,12 @@ type (
 		prefix     uint64 // The prefix is generated from contract and first of the topic.
 		cutoff     int64  // The cutoff is time limit check on message IDs.
 		winEntries []query
+		seek       bool                      // The seek query returns entries in ascending order of sequence.
+		fromSeq    uint64                    // The fromSeq is the lowest sequence returned by the seek query.
+		cursor     uint64                    // The cursor is the sequence of the last entry returned by the seek query.
+		snapshot   *Snapshot                 // The snapshot excludes entries written after it is taken.
+		expired    int                       // The expired is number of expired entries skipped by the lookup.
+		filter     func(payload []byte) bool // The filter is a predicate on the decoded payload.
 
 		opts *queryOptions
 	}
@@ -63,6 +74,13 @@ func NewQuery(topic []byte) *Query {
 	}
 }
 
+// clone returns a copy of the query that does not share the looked up entries with the query.
+func (q *Query) clone() *Query {
+	c := *q
+	c.winEntries = nil
+	return &c
+}
+
 // WithContract sets contract on query.
 func (q *Query) WithContract(contract uint32) *Query {
 	q.Contract = contract
@@ -75,6 +93,32 @@ func (q *Query) WithLimit(limit int) *Query {
 	return q
 }
 
+// WithCursor sets the query to return entries with sequence greater than afterSeq in ascending order of sequence.
+// Use it with WithLimit to page through a topic, pass the Cursor of the previous page to get the next page.
+// The query can be reused for the next page, entries looked up for the previous page are discarded.
+func (q *Query) WithCursor(afterSeq uint64) *Query {
+	q.seek = true
+	q.fromSeq = afterSeq + 1
+	q.cursor = afterSeq
+	q.winEntries = q.winEntries[:0]
+	q.expired = 0
+	return q
+}
+
+// Cursor returns sequence of the last entry returned by the query set using WithCursor.
+// It returns the cursor the query was set with if the query returned no entries.
+func (q *Query) Cursor() uint64 {
+	return q.cursor
+}
+
+// WithFilter sets a predicate on the decoded payload. Only entries for which the predicate
+// returns true are returned and counted toward the limit. The predicate runs under the read
+// lock so it must be fast and non-blocking.
+func (q *Query) WithFilter(fn func(payload []byte) bool) *Query {
+	q.filter = fn
+	return q
+}
+
 // ItemIterator is an iterator over DB topic->key/value pairs. It iterates the items in an unspecified order.
 type ItemIterator struct {
 	db          *DB
@@ -84,6 +128,10 @@ type ItemIterator struct {
 	queue       []*Item
 	next        int
 	invalidKeys int
+	loaded      bool // loaded is set once window entries of the query are looked up.
+
+	// topics maps topic hash to topic name for the prefix iterator, its window entries are loaded on creation.
+	topics map[uint64][]byte
 }
 
 func (q *Query) parse() error {
@@ -91,12 +139,16 @@ func (q *Query) parse() error {
 		q.Contract = message.MasterContract
 	}
 	topic := new(message.Topic)
+	rawTopic := q.Topic
+	if q.opts.topicNormalizer != nil {
+		rawTopic = q.opts.topicNormalizer(rawTopic)
+	}
 	//Parse the Key.
-	topic.ParseKey(q.Topic)
+	topic.ParseKey(rawTopic)
 	// Parse the topic.
 	topic.Parse(q.Contract, true)
 	if topic.TopicType == message.TopicInvalid {
-		return errBadRequest
+		return fmt.Errorf("query.parse: invalid topic: %w", ErrBadRequest)
 	}
 	topic.AddContract(q.Contract)
 	q.parts = topic.Parts
@@ -136,9 +188,17 @@ func (it *ItemIterator) Next() {
 				if we.seq == 0 {
 					return nil
 				}
-				s, err := it.db.readEntry(we.topicHash, we.seq)
+				// entry may have expired after the window entries were looked up.
+				if we.expiresAt != 0 && we.expiresAt <= uint32(it.db.opts.clock.Now().Unix()) {
+					it.invalidKeys++
+					if err := it.db.timeWindow.addExpiry(expiryEntry{winEntry: newWinEntry(we.seq, we.expiresAt), topicHash: we.topicHash}); err != nil {
+						logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
+					}
+					return nil
+				}
+				s, err := it.db.readQueryEntry(it.query, we.topicHash, we.seq)
 				if err != nil {
-					if err == errMsgIDDoesNotExist {
+					if errors.Is(err, ErrMsgIDDoesNotExist) {
 						logger.Error().Err(err).Str("context", "db.readEntry")
 						return err
 					}
@@ -156,30 +216,41 @@ func (it *ItemIterator) Next() {
 					return nil
 				}
 
-				// last bit of ID is an encryption flag.
-				if uint8(id[idSize-1]) == 1 {
-					val, err = it.db.mac.Decrypt(nil, val)
-					if err != nil {
-						logger.Error().Err(err).Str("context", "mac.Decrypt")
-						return err
-					}
+				val, err = it.db.decodeValue(id, val)
+				if err != nil {
+					logger.Error().Err(err).Str("context", "db.decodeValue")
+					return err
+				}
+				topic := it.query.Topic
+				if name := it.topics[we.topicHash]; name != nil {
+					topic = name
+				}
+				val, err = it.db.runReadHooks(we.seq, id, topic, val)
+				if errors.Is(err, ErrSkipEntry) {
+					it.invalidKeys++
+					return nil
 				}
-				var buffer []byte
-				val, err = snappy.Decode(buffer, val)
 				if err != nil {
-					logger.Error().Err(err).Str("context", "snappy.Decode")
 					return err
 				}
-				it.queue = append(it.queue, &Item{topic: it.query.Topic, value: val, err: err})
+				if it.query.filter != nil && !it.query.filter(val) {
+					it.invalidKeys++
+					return nil
+				}
+				it.queue = append(it.queue, &Item{topic: topic, value: val, id: messageID(id, we.seq), expiresAt: we.expiresAt, err: err})
 				it.db.meter.Gets.Inc(1)
 				it.db.meter.OutMsgs.Inc(1)
 				it.db.meter.OutBytes.Inc(int64(s.valueSize))
+				it.db.opts.metricsSink.Get(1)
+				it.db.opts.metricsSink.OutBytes(int64(s.valueSize))
 				return nil
 			}()
+			it.next++
+			// the iteration stops at the error, so it is not overwritten by the next entry.
 			if err != nil {
 				it.item = &Item{err: err}
+				return
 			}
-			it.next++
 			if len(it.queue) > 0 {
 				break
 			}
@@ -193,14 +264,69 @@ func (it *ItemIterator) Next() {
 }
 
 // First is similar to init. It query and loads window entries from trie/timeWindowBucket or summary file if available.
+// The lookup time is recorded by the slow query log.
 func (it *ItemIterator) First() {
-	it.db.lookup(it.query)
+	it.load()
 	if len(it.query.winEntries) == 0 || it.next >= 1 {
 		return
 	}
 	it.Next()
 }
 
+// load looks up window entries of the query once, the prefix iterator loads its window entries on creation.
+func (it *ItemIterator) load() {
+	if it.topics != nil || it.loaded {
+		return
+	}
+	start := time.Now()
+	it.db.lookup(it.query)
+	it.db.logSlowQuery(it.query, start, len(it.query.winEntries))
+	it.loaded = true
+}
+
+// SeekTo positions the iterator at the first entry in iteration order with sequence greater than or equal to seq.
+// It returns false if all entries are below seq. It can be called before or after First.
+func (it *ItemIterator) SeekTo(seq uint64) bool {
+	it.load()
+	it.mu.Lock()
+	next := len(it.query.winEntries)
+	for i, we := range it.query.winEntries {
+		if we.seq >= seq {
+			next = i
+			break
+		}
+	}
+	// skipped entries do not count toward the limit. Seeking backward reads the entries
+	// from seq again, so the count restarts from the entries before the seek position.
+	if next < it.next {
+		it.invalidKeys = next
+	} else {
+		it.invalidKeys += next - it.next
+	}
+	it.next = next
+	it.queue = nil
+	it.item = nil
+	it.mu.Unlock()
+	if next == len(it.query.winEntries) {
+		return false
+	}
+	it.Next()
+	return true
+}
+
+// Count returns number of entries available to the iterator, less the entries skipped so far.
+// It counts the window entries of the query without reading the entries.
+func (it *ItemIterator) Count() int {
+	it.load()
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	n := len(it.query.winEntries) - it.invalidKeys
+	if n > it.query.Limit {
+		n = it.query.Limit
+	}
+	return n
+}
+
 // Item returns pointer to the current item.
 // This item is only valid until it.Next() gets called.
 func (it *ItemIterator) Item() *Item {
@@ -221,6 +347,9 @@ func (it *ItemIterator) Valid() bool {
 // Error returns any accumulated error. Exhausting all the key/value pairs
 // is not considered to be an error. A memory iterator cannot encounter errors.
 func (it *ItemIterator) Error() error {
+	if it.item == nil {
+		return nil
+	}
 	return it.item.err
 }
 
@@ -238,6 +367,82 @@ func (item *Item) Value() []byte {
 	return item.value
 }
 
+// ID returns the message ID of the current item. It can be used to delete the entry.
+func (item *Item) ID() []byte {
+	return item.id
+}
+
+// ExpiresAt returns the expiry time of the current item, or zero time if the item does not expire.
+func (item *Item) ExpiresAt() time.Time {
+	if item.expiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(item.expiresAt), 0)
+}
+
+// Time returns the time the current item was written to the DB. The time is derived from the message ID.
+func (item *Item) Time() time.Time {
+	if len(item.id) < 4 {
+		return time.Time{}
+	}
+	return time.Unix(uid.Time(item.id), 0)
+}
+
+// TopicIterator is an iterator over topics in the DB. It iterates the topics in an unspecified order.
+// The topics are a point-in-time view of the DB taken under the read lock when the iterator is created,
+// topics added afterwards are not returned.
+type TopicIterator struct {
+	db     *DB
+	topics []topicNode
+	next   int
+	seq    uint64
+}
+
+// First positions the iterator at the first topic.
+func (it *TopicIterator) First() {
+	it.next = -1
+	it.Next()
+}
+
+// Next moves the iterator to the next topic.
+func (it *TopicIterator) Next() {
+	it.next++
+	if !it.Valid() {
+		return
+	}
+	it.seq = 0
+	t := it.topics[it.next]
+	wEntries, _ := it.db.timeWindow.ilookup(t.hash, math.MaxInt32)
+	if len(wEntries) == 0 {
+		wEntries, _ = it.db.timeWindow.lookup(t.hash, t.offset, 0, 1)
+	}
+	for _, we := range wEntries {
+		if we.seq() > it.seq {
+			it.seq = we.seq()
+		}
+	}
+}
+
+// Valid returns false when iteration is done.
+func (it *TopicIterator) Valid() bool {
+	return it.next >= 0 && it.next < len(it.topics)
+}
+
+// Topic returns the current topic, or nil if the topic was persisted without a name.
+func (it *TopicIterator) Topic() []byte {
+	return it.topics[it.next].name
+}
+
+// Depth returns depth of the current topic.
+func (it *TopicIterator) Depth() uint8 {
+	return it.topics[it.next].depth
+}
+
+// Seq returns the latest sequence written to the current topic, or zero if the topic has no live entries.
+func (it *TopicIterator) Seq() uint64 {
+	return it.seq
+}
+
 // Release releases associated resources. Release should always succeed and can
 // be called multiple times without causing error.
 func (it *ItemIterator) Release() {
@@ -17,9 +17,13 @@
 package unitdb
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 	"time"
+
+	"github.com/unit-io/unitdb/message"
+	"github.com/unit-io/unitdb/unitdbtest"
 )
 
 func TestIteratorEmpty(t *testing.T) {
@@ -85,3 +89,176 @@ func TestIterator(t *testing.T) {
 		t.Fatalf("expected %d records; got %d", n, i)
 	}
 }
+
+func TestTopicIterator(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topics := map[string]bool{"unit6.test": false, "unit6.test.a": false}
+	for topic := range topics {
+		for i := 0; i < 5; i++ {
+			if err := db.Put([]byte(topic), []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := db.NewTopicIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.First(); it.Valid(); it.Next() {
+		topic := string(it.Topic())
+		if _, ok := topics[topic]; !ok {
+			t.Fatalf("unexpected topic %q", topic)
+		}
+		if it.Seq() == 0 {
+			t.Fatalf("topic %q has no sequence", topic)
+		}
+		topics[topic] = true
+	}
+	for topic, ok := range topics {
+		if !ok {
+			t.Fatalf("topic %q not iterated", topic)
+		}
+	}
+}
+
+func TestPrefixIterator(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topics := []string{"unit7.floor1.room1", "unit7.floor1.room2", "unit7.floor2.room1"}
+	var n = 5
+	for i := 0; i < n; i++ {
+		for _, topic := range topics {
+			if err := db.Put([]byte(topic), []byte(fmt.Sprintf("msg.%2d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := db.NewPrefixIterator([]byte("unit7.floor1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	for it.First(); it.Valid(); it.Next() {
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+		item := it.Item()
+		if !bytes.HasPrefix(item.Topic(), []byte("unit7.floor1.")) {
+			t.Fatalf("unexpected topic %q", item.Topic())
+		}
+		// topics are written in turn so items in sequence order have the payloads in write order.
+		if val := fmt.Sprintf("msg.%2d", count/2); string(item.Value()) != val {
+			t.Fatalf("expected value %q, got %q", val, item.Value())
+		}
+		count++
+	}
+	if count != 2*n {
+		t.Fatalf("expected %d items, got %d", 2*n, count)
+	}
+}
+
+func TestIteratorSeekTo(t *testing.T) {
+	cleanup("test.db")
+	db, err := Open("test.db", WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit6.test")
+	var ids [][]byte
+	for i := 0; i < 10; i++ {
+		id := db.NewID()
+		if err := db.PutEntry(NewEntry(topic, []byte(fmt.Sprintf("msg.%2d", i))).WithID(id)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	it, err := db.SeekIterator(topic, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := it.Count(); n != 10 {
+		t.Fatalf("expected count 10; got %d", n)
+	}
+	if !it.SeekTo(message.ID(ids[6]).Sequence()) {
+		t.Fatal("expected seek position to be found")
+	}
+	var n int
+	for it.First(); it.Valid(); it.Next() {
+		if want := fmt.Sprintf("msg.%2d", n+6); string(it.Item().Value()) != want {
+			t.Fatalf("expected %s; got %s", want, it.Item().Value())
+		}
+		n++
+	}
+	if n != 4 || it.Count() != 4 {
+		t.Fatalf("expected 4 items; got %d count %d", n, it.Count())
+	}
+	// seek backward after the entries are consumed.
+	if !it.SeekTo(message.ID(ids[2]).Sequence()) {
+		t.Fatal("expected seek position to be found")
+	}
+	n = 0
+	for ; it.Valid(); it.Next() {
+		if want := fmt.Sprintf("msg.%2d", n+2); string(it.Item().Value()) != want {
+			t.Fatalf("expected %s; got %s", want, it.Item().Value())
+		}
+		n++
+	}
+	if n != 8 || it.Count() != 8 {
+		t.Fatalf("expected 8 items; got %d count %d", n, it.Count())
+	}
+	if it.SeekTo(message.ID(ids[9]).Sequence() + 1) {
+		t.Fatal("expected seek position not to be found")
+	}
+}
+
+func TestIteratorExpired(t *testing.T) {
+	cleanup("test.db")
+	clock := unitdbtest.NewMockClock(time.Now())
+	db, err := Open("test.db", WithMutable(), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	topic := []byte("unit6.test")
+	if err := db.PutEntry(&Entry{Topic: topic, Payload: []byte("msg"), ExpiresAt: uint32(clock.Now().Add(time.Minute).Unix())}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(topic, []byte("permanent")); err != nil {
+		t.Fatal(err)
+	}
+	it, err := db.Items(NewQuery(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Count()
+	clock.Add(2 * time.Minute)
+	var vals []string
+	for it.First(); it.Valid(); it.Next() {
+		vals = append(vals, string(it.Item().Value()))
+	}
+	if len(vals) != 1 || vals[0] != "permanent" {
+		t.Fatalf("expected only the permanent entry; got %v", vals)
+	}
+}
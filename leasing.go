@@ -18,9 +18,13 @@ package unitdb
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
+	"math/bits"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/unit-io/unitdb/hash"
 )
@@ -45,6 +49,7 @@ type lease struct {
 	blocks                []*freeBlocks
 	size                  int64 // Total size of free blocks.
 	minimumFreeBlocksSize int64 // Minimum free blocks size before free blocks are reused for new allocation.
+	nShards               int   // Number of shards of leases, free slots and free blocks.
 	consistent            *hash.Consistent
 }
 
@@ -60,14 +65,15 @@ type freeBlocks struct {
 }
 
 // newLeaswing creates a new concurrent freeblocks.
-func newLease(f file, minimumSize int64) *lease {
+func newLease(f file, minimumSize int64, nShards int) *lease {
 	l := &lease{
 		file:                  f,
 		leases:                make([]*leases, nShards),
 		slots:                 make([]*freeslots, nShards),
 		blocks:                make([]*freeBlocks, nShards),
 		minimumFreeBlocksSize: minimumSize,
-		consistent:            hash.InitConsistent(int(nShards), int(nShards)),
+		nShards:               nShards,
+		consistent:            hash.InitConsistent(nShards, nShards),
 	}
 
 	for i := 0; i < nShards; i++ {
@@ -164,7 +170,7 @@ func (l *lease) addLease(timeID int64, seq uint64) {
 // releaseLease revokes leases for given timeID.
 func (l *lease) releaseLease(timeID int64) {
 	// Get shard.
-	for i := uint64(0); i < nShards; i++ {
+	for i := 0; i < l.nShards; i++ {
 		lb := l.leases[i]
 		lb.Lock()
 		delete(lb.ls, timeID)
@@ -193,7 +199,7 @@ func (l *lease) freeSlots(blockID uint64) *freeslots {
 // getSlot gets seq from free slot.
 func (l *lease) getSlot() (ok bool, seq uint64) {
 	// Get shard.
-	for i := uint64(0); i < nShards; i++ {
+	for i := 0; i < l.nShards; i++ {
 		fss := l.slots[i]
 		fss.Lock()
 		if len(fss.fs) == 0 {
@@ -235,6 +241,24 @@ func (l *lease) freeSlot(seq uint64) (ok bool) {
 	return true
 }
 
+// takeSlot removes seq from free slots so that it is not reallocated.
+func (l *lease) takeSlot(seq uint64) {
+	// Get shard.
+	fss := l.freeSlots(seq)
+	fss.Lock()
+	defer fss.Unlock()
+	if ok := fss.cache[seq]; !ok {
+		return
+	}
+	delete(fss.cache, seq)
+	for i, s := range fss.fs {
+		if s == seq {
+			fss.fs = append(fss.fs[:i], fss.fs[i+1:]...)
+			break
+		}
+	}
+}
+
 func (fs *freeslots) len() int {
 	return len(fs.fs)
 }
@@ -244,12 +268,32 @@ func (l *lease) freeBlocks(blockID uint64) *freeBlocks {
 	return l.blocks[l.consistent.FindBlock(blockID)]
 }
 
+// search returns index of the smallest free block that fits the size. Free blocks are ordered by size.
 func (s *freeBlocks) search(size uint32) int {
 	return sort.Search(len(s.fb), func(i int) bool {
 		return s.fb[i].size >= size
 	})
 }
 
+// insert adds free block keeping free blocks ordered by size.
+func (s *freeBlocks) insert(b freeblock) {
+	i := s.search(b.size)
+	s.fb = append(s.fb, freeblock{})
+	copy(s.fb[i+1:], s.fb[i:])
+	s.fb[i] = b
+	s.cache[b.offset] = true
+}
+
+// remove removes free block at index i.
+func (s *freeBlocks) remove(i int) freeblock {
+	b := s.fb[i]
+	copy(s.fb[i:], s.fb[i+1:])
+	s.fb[len(s.fb)-1] = freeblock{}
+	s.fb = s.fb[:len(s.fb)-1]
+	delete(s.cache, b.offset)
+	return b
+}
+
 func (b *freeBlocks) len() int {
 	return len(b.fb)
 }
@@ -279,16 +323,90 @@ func (b *freeBlocks) defrag() {
 	sort.Slice(merged, func(i, j int) bool {
 		return merged[i].size < merged[j].size
 	})
-	copy(b.fb[:l], merged)
+	b.fb = append(b.fb[:0], merged...)
 }
 
 func (l *lease) defrag() {
-	for i := 0; i < nShards; i++ {
+	for i := 0; i < l.nShards; i++ {
 		fbs := l.blocks[i]
+		fbs.Lock()
 		fbs.defrag()
+		fbs.Unlock()
 	}
 }
 
+// fragmentation returns ratio of free space not in the largest free block to the total free space.
+// It is 0 if all free space is in a single block and approaches 1 as free space is fragmented.
+func (l *lease) fragmentation() float64 {
+	var total, largest int64
+	for i := 0; i < l.nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.RLock()
+		for _, b := range fbs.fb {
+			total += int64(b.size)
+		}
+		if n := len(fbs.fb); n > 0 && int64(fbs.fb[n-1].size) > largest {
+			largest = int64(fbs.fb[n-1].size)
+		}
+		fbs.RUnlock()
+	}
+	if total == 0 {
+		return 0
+	}
+	return 1 - float64(largest)/float64(total)
+}
+
+// FreeBin is a bin of free blocks histogram.
+type FreeBin struct {
+	MinSize    uint32
+	MaxSize    uint32
+	Count      int
+	TotalBytes int64
+}
+
+// histogram returns free blocks distribution across all shards using power of 2 bins.
+// Bin i holds free blocks of size [2^i, 2^(i+1)), the last bin holds all larger free blocks.
+func (l *lease) histogram(bins int) []FreeBin {
+	if bins <= 0 || bins > 32 {
+		bins = 32
+	}
+	hist := make([]FreeBin, bins)
+	for i := range hist {
+		hist[i].MinSize = 1 << uint(i)
+		hist[i].MaxSize = 1<<uint(i+1) - 1
+	}
+	hist[bins-1].MaxSize = math.MaxUint32
+	for i := 0; i < l.nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.RLock()
+		for _, b := range fbs.fb {
+			if b.size == 0 {
+				continue
+			}
+			bin := bits.Len32(b.size) - 1
+			if bin >= bins {
+				bin = bins - 1
+			}
+			hist[bin].Count++
+			hist[bin].TotalBytes += int64(b.size)
+		}
+		fbs.RUnlock()
+	}
+	return hist
+}
+
+// allFreeBlocks returns free blocks of all shards.
+func (l *lease) allFreeBlocks() []freeblock {
+	var blocks []freeblock
+	for i := 0; i < l.nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.RLock()
+		blocks = append(blocks, fbs.fb...)
+		fbs.RUnlock()
+	}
+	return blocks
+}
+
 func (l *lease) freeBlock(off int64, size uint32) {
 	fbs := l.freeBlocks(uint64(off))
 	fbs.Lock()
@@ -297,9 +415,8 @@ func (l *lease) freeBlock(off int64, size uint32) {
 	if fbs.cache[off] {
 		return
 	}
-	fbs.fb = append(fbs.fb, freeblock{offset: off, size: size})
-	fbs.cache[off] = true
-	l.size += int64(size)
+	fbs.insert(freeblock{offset: off, size: size})
+	atomic.AddInt64(&l.size, int64(size))
 }
 
 func (l *lease) free(seq uint64, off int64, size uint32) {
@@ -310,70 +427,88 @@ func (l *lease) free(seq uint64, off int64, size uint32) {
 	l.freeBlock(off, size)
 }
 
+// allocate finds the best fit free block across all shards. Free blocks are sharded by offset,
+// so the search visits every shard and holds the lock of the shard with best fit block found so far.
 func (l *lease) allocate(size uint32) int64 {
 	if size == 0 {
 		panic("unable to allocate zero bytes")
 	}
-	if l.size < l.minimumFreeBlocksSize {
+	if atomic.LoadInt64(&l.size) < l.minimumFreeBlocksSize {
 		return -1
 	}
-	fbs := l.freeBlocks(uint64(size))
-	fbs.Lock()
-	defer fbs.Unlock()
-	i := fbs.search(size)
-	if i >= len(fbs.fb) {
+	var best *freeBlocks
+	bestIdx := -1
+	for i := 0; i < l.nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.Lock()
+		j := fbs.search(size)
+		if j < len(fbs.fb) && (best == nil || fbs.fb[j].size < best.fb[bestIdx].size) {
+			if best != nil {
+				best.Unlock()
+			}
+			best, bestIdx = fbs, j
+			if fbs.fb[j].size == size {
+				// exact fit.
+				break
+			}
+			continue
+		}
+		fbs.Unlock()
+	}
+	if best == nil {
 		return -1
 	}
-	off := fbs.fb[i].offset
-	if fbs.fb[i].size == size {
-		copy(fbs.fb[i:], fbs.fb[i+1:])
-		fbs.fb[len(fbs.fb)-1] = freeblock{}
-		fbs.fb = fbs.fb[:len(fbs.fb)-1]
-	} else {
-		fbs.fb[i].size -= size
-		fbs.fb[i].offset += int64(size)
+	b := best.remove(bestIdx)
+	best.Unlock()
+	atomic.AddInt64(&l.size, -int64(b.size))
+	if b.size > size {
+		// return remaining space of the block to the free blocks.
+		l.freeBlock(b.offset+int64(size), b.size-size)
 	}
-	delete(fbs.cache, off)
-	l.size -= int64(size)
-	return off
+	return b.offset
 }
 
-func (l *lease) read() error {
-	off := int64(0)
-	slots := &freeslots{cache: make(map[uint64]bool)}
-	buf := make([]byte, 4)
-	if _, err := l.ReadAt(buf, off); err != nil {
-		if err == io.EOF {
-			return nil
+// trim removes free slots with sequence greater than seq and free blocks beyond the offset off.
+func (l *lease) trim(seq uint64, off int64) {
+	for i := 0; i < l.nShards; i++ {
+		fss := l.slots[i]
+		fss.Lock()
+		slots := fss.fs[:0]
+		for _, s := range fss.fs {
+			if s > seq {
+				delete(fss.cache, s)
+				continue
+			}
+			slots = append(slots, s)
 		}
-		return err
-	}
-	size := binary.LittleEndian.Uint32(buf)
-	off += 4
-	buf = make([]byte, 8*size)
-	if _, err := l.ReadAt(buf, off); err != nil {
-		return err
+		fss.fs = slots
+		fss.Unlock()
 	}
-	off += int64(8 * size)
-	slots.UnmarshalBinary(buf, size)
-
-	for _, seq := range slots.fs {
-		l.freeSlot(seq)
+	for i := 0; i < l.nShards; i++ {
+		fbs := l.blocks[i]
+		fbs.Lock()
+		for j := len(fbs.fb) - 1; j >= 0; j-- {
+			if fbs.fb[j].offset+int64(fbs.fb[j].size) > off {
+				b := fbs.remove(j)
+				atomic.AddInt64(&l.size, -int64(b.size))
+			}
+		}
+		fbs.Unlock()
 	}
+}
 
-	blocks := &freeBlocks{cache: make(map[int64]bool)}
-	buf = make([]byte, 4)
-	if _, err := l.ReadAt(buf, off); err != nil {
+func (l *lease) read() error {
+	data := make([]byte, l.Size())
+	if _, err := l.ReadAt(data, 0); err != nil && err != io.EOF {
 		return err
 	}
-	size = binary.LittleEndian.Uint32(buf)
-	off += 4
-	buf = make([]byte, 12*size)
-	if _, err := l.ReadAt(buf, off); err != nil {
+	slots, blocks, _, err := parseSnapshot(data)
+	if err != nil {
 		return err
 	}
-	blocks.UnmarshalBinary(buf, size)
-
+	for _, seq := range slots.fs {
+		l.freeSlot(seq)
+	}
 	for _, b := range blocks.fb {
 		l.freeBlock(b.offset, b.size)
 	}
@@ -388,35 +523,125 @@ func (l *lease) write() error {
 	if err := l.Truncate(0); err != nil {
 		return err
 	}
-	var off int64
+	slots, blocks := l.snapshot()
+	if _, err := l.WriteAt(append(slots.MarshalBinary(), blocks.MarshalBinary()...), 0); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// snapshot returns a copy of free slots and free blocks across all shards.
+func (l *lease) snapshot() (*freeslots, *freeBlocks) {
 	slots := &freeslots{cache: make(map[uint64]bool)}
-	for i := 0; i < nShards; i++ {
+	for i := 0; i < l.nShards; i++ {
 		fss := l.slots[i]
-		if fss.len() == 0 {
-			continue
-		}
+		fss.RLock()
 		slots.fs = append(slots.fs, fss.fs...)
+		fss.RUnlock()
 	}
-	data := slots.MarshalBinary()
-	n, err := l.WriteAt(data, off)
-	if err != nil {
-		return err
+	for _, seq := range slots.fs {
+		slots.cache[seq] = true
 	}
-	off += int64(n)
-
 	blocks := &freeBlocks{cache: make(map[int64]bool)}
-	for i := 0; i < nShards; i++ {
+	for i := 0; i < l.nShards; i++ {
 		fbs := l.blocks[i]
-		if fbs.len() == 0 {
-			continue
-		}
+		fbs.RLock()
 		blocks.fb = append(blocks.fb, fbs.fb...)
+		fbs.RUnlock()
 	}
+	return slots, blocks
+}
 
-	data = blocks.MarshalBinary()
-	if _, err = l.WriteAt(data, off); err != nil {
-		return err
+// reset replaces free slots and free blocks. Free blocks must not overlap.
+func (l *lease) reset(slots []uint64, blocks []freeblock) {
+	for i := 0; i < l.nShards; i++ {
+		fss := l.slots[i]
+		fss.Lock()
+		fss.fs = fss.fs[:0]
+		fss.cache = make(map[uint64]bool)
+		fss.Unlock()
+		fbs := l.blocks[i]
+		fbs.Lock()
+		fbs.fb = fbs.fb[:0]
+		fbs.cache = make(map[int64]bool)
+		fbs.Unlock()
+	}
+	atomic.StoreInt64(&l.size, 0)
+	for _, seq := range slots {
+		l.freeSlot(seq)
+	}
+	for _, b := range blocks {
+		l.freeBlock(b.offset, b.size)
 	}
+}
 
-	return nil
+// subtractBlocks merges free blocks and removes the space of used blocks from the free blocks.
+// The returned free blocks do not overlap.
+func subtractBlocks(free, used []freeblock) []freeblock {
+	sort.Slice(free, func(i, j int) bool {
+		return free[i].offset < free[j].offset
+	})
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].offset < used[j].offset
+	})
+	var blocks []freeblock
+	add := func(start, end int64) {
+		for start < end {
+			size := end - start
+			if size > math.MaxUint32 {
+				size = math.MaxUint32
+			}
+			blocks = append(blocks, freeblock{offset: start, size: uint32(size)})
+			start += size
+		}
+	}
+	j := 0
+	for i := 0; i < len(free); {
+		// merge overlapping and adjacent free blocks.
+		start, end := free[i].offset, free[i].offset+int64(free[i].size)
+		for i++; i < len(free) && free[i].offset <= end; i++ {
+			if e := free[i].offset + int64(free[i].size); e > end {
+				end = e
+			}
+		}
+		for ; j < len(used) && used[j].offset+int64(used[j].size) <= start; j++ {
+		}
+		for k := j; k < len(used) && used[k].offset < end; k++ {
+			if used[k].offset > start {
+				add(start, used[k].offset)
+			}
+			if e := used[k].offset + int64(used[k].size); e > start {
+				start = e
+			}
+		}
+		add(start, end)
+	}
+	return blocks
+}
+
+// parseSnapshot parses free slots and free blocks of the lease snapshot, it returns the data following the free blocks.
+func parseSnapshot(data []byte) (*freeslots, *freeBlocks, []byte, error) {
+	slots := &freeslots{cache: make(map[uint64]bool)}
+	blocks := &freeBlocks{cache: make(map[int64]bool)}
+	if len(data) == 0 {
+		return slots, blocks, nil, nil
+	}
+	if len(data) < 4 {
+		return nil, nil, nil, fmt.Errorf("lease.parseSnapshot: truncated free slots: %w", ErrCorrupted)
+	}
+	size := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	if uint64(len(data)) < 8*uint64(size)+4 {
+		return nil, nil, nil, fmt.Errorf("lease.parseSnapshot: truncated free slots: %w", ErrCorrupted)
+	}
+	slots.UnmarshalBinary(data, size)
+	data = data[8*size:]
+	size = binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	if uint64(len(data)) < 12*uint64(size) {
+		return nil, nil, nil, fmt.Errorf("lease.parseSnapshot: truncated free blocks: %w", ErrCorrupted)
+	}
+	blocks.UnmarshalBinary(data, size)
+	return slots, blocks, data[12*size:], nil
 }
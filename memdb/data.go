@@ -16,10 +16,18 @@
 
 package memdb
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/unit-io/unitdb/fs"
+)
+
+// copyChunkSize is size of the chunks used to move data to front of a file backed table on shrink.
+const copyChunkSize = 1 << 16
 
 type dataTable struct {
 	buf    []byte
+	file   fs.FileManager // file backs the table if mem store uses a file system, buf is unused.
 	size   int64
 	closed bool
 }
@@ -51,6 +59,9 @@ func (t *dataTable) close() error {
 		return errors.New("table closed")
 	}
 	t.closed = true
+	if t.file != nil {
+		return t.file.Close()
+	}
 	return nil
 }
 
@@ -59,6 +70,12 @@ func (t *dataTable) writeAt(p []byte, off int64) (int, error) {
 		return 0, errors.New("table closed")
 	}
 	n := len(p)
+	if t.file != nil {
+		if off+int64(n) > t.size {
+			panic("trying to write past EOF - undefined behavior")
+		}
+		return t.file.WriteAt(p, off)
+	}
 	if off == t.size {
 		t.buf = append(t.buf, p...)
 		t.size += int64(n)
@@ -74,6 +91,13 @@ func (t *dataTable) truncate(size int64) error {
 	if t.closed {
 		return errors.New("table closed")
 	}
+	if t.file != nil {
+		if err := t.file.Truncate(size); err != nil {
+			return err
+		}
+		t.size = size
+		return nil
+	}
 	if size > t.size {
 		diff := int(size - t.size)
 		t.buf = append(t.buf, make([]byte, diff)...)
@@ -89,6 +113,26 @@ func (t *dataTable) truncateFront(off int64) error {
 		return errors.New("table closed")
 	}
 	if off > t.size {
+		off = t.size
+	}
+	if t.file != nil {
+		// move remaining data to front of the file so the file does not keep growing.
+		buf := make([]byte, copyChunkSize)
+		for pos := off; pos < t.size; pos += copyChunkSize {
+			n := t.size - pos
+			if n > copyChunkSize {
+				n = copyChunkSize
+			}
+			if _, err := t.file.ReadAt(buf[:n], pos); err != nil {
+				return err
+			}
+			if _, err := t.file.WriteAt(buf[:n], pos-off); err != nil {
+				return err
+			}
+		}
+		return t.truncate(t.size - off)
+	}
+	if off == t.size {
 		t.buf = nil
 		t.size = 0
 		return nil
@@ -102,5 +146,8 @@ func (t *dataTable) slice(start int64, end int64) ([]byte, error) {
 	if t.closed {
 		return nil, errors.New("table closed")
 	}
+	if t.file != nil {
+		return t.file.Slice(start, end)
+	}
 	return t.buf[start:end], nil
 }
@@ -21,9 +21,12 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"os"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/unit-io/unitdb/fs"
 	"github.com/unit-io/unitdb/hash"
 )
 
@@ -43,6 +46,9 @@ const (
 	defaultDrainInterval = 1 * time.Second
 	defaultDrainFactor   = 0.7
 	defaultShrinkFactor  = 0.33 // shrinker try to free 33% of total mem store size.
+
+	// minCompactKeys is the peak number of keys of a block before its key map is compacted.
+	minCompactKeys = 1 << 10
 )
 
 var timerPool sync.Pool
@@ -50,13 +56,87 @@ var timerPool sync.Pool
 // To avoid lock bottlenecks block cache is divided into several (nShards) shards.
 type blockCache []*block
 
+type freeSlot struct {
+	offset int64
+	size   uint32
+}
+
 type block struct {
 	data         dataTable
 	freeOffset   int64            // mem cache keep lowest offset that can be free.
+	freeSlots    []freeSlot       // data regions of deleted keys that are reused on Set.
 	m            map[uint64]int64 // map[key]offset
+	peak         int              // peak number of keys since the key map was created.
 	sync.RWMutex                  // Read Write mutex, guards access to internal map.
 }
 
+// compact rebuilds the key map once it has shrunk to a quarter of its peak size,
+// as a map does not release memory of the deleted keys. The caller must hold the block lock.
+func (b *block) compact() {
+	n := len(b.m)
+	if n > b.peak {
+		b.peak = n
+		return
+	}
+	if b.peak < minCompactKeys || n > b.peak/4 {
+		return
+	}
+	m := make(map[uint64]int64, n)
+	for k, off := range b.m {
+		m[k] = off
+	}
+	b.m = m
+	b.peak = n
+}
+
+// allocate allocates data region from free slots of the block, it returns false if no free slot fits the size.
+func (b *block) allocate(size uint32) (int64, bool) {
+	for i, s := range b.freeSlots {
+		if s.size < size {
+			continue
+		}
+		if s.size > size {
+			b.freeSlots[i] = freeSlot{offset: s.offset + int64(size), size: s.size - size}
+		} else {
+			b.freeSlots = append(b.freeSlots[:i], b.freeSlots[i+1:]...)
+		}
+		return s.offset, true
+	}
+	return -1, false
+}
+
+// free returns data region at the offset to the free slots and returns size of the region.
+func (b *block) free(off int64) (uint32, error) {
+	if off == -1 {
+		// data region is already free.
+		return 0, nil
+	}
+	scratch, err := b.data.readRaw(off, 4) // read data length.
+	if err != nil {
+		return 0, err
+	}
+	size := binary.LittleEndian.Uint32(scratch[:4])
+	b.freeSlots = append(b.freeSlots, freeSlot{offset: off, size: size})
+	return size, nil
+}
+
+// freePrefix returns size of contiguous free slots from the start of the data table.
+func (b *block) freePrefix() int64 {
+	sort.Slice(b.freeSlots, func(i, j int) bool {
+		return b.freeSlots[i].offset < b.freeSlots[j].offset
+	})
+	var end int64
+	for _, s := range b.freeSlots {
+		if s.offset > end {
+			break
+		}
+		if s.offset == end {
+			end += int64(s.size)
+		}
+	}
+	return end
+}
+
 // newBlockCache creates a new concurrent block cache.
 func newBlockCache(nShards int) blockCache {
 	m := make(blockCache, nShards)
@@ -66,6 +146,40 @@ func newBlockCache(nShards int) blockCache {
 	return m
 }
 
+// openStorage backs the block data tables by files of the given file system.
+func (m blockCache) openStorage(storage fs.FileSystem, path string) error {
+	for i, b := range m {
+		f, err := storage.OpenFile(blockFileName(path, i), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+		if err != nil {
+			m[:i].closeStorage(storage, path)
+			return err
+		}
+		b.data.file = f
+	}
+	return nil
+}
+
+// closeStorage closes and removes the block data table files.
+func (m blockCache) closeStorage(storage fs.FileSystem, path string) error {
+	var err error
+	for i, b := range m {
+		if b.data.file == nil {
+			continue
+		}
+		if e := b.data.close(); e != nil && err == nil {
+			err = e
+		}
+		if e := storage.Remove(blockFileName(path, i)); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func blockFileName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
 // DB represents the block cache mem store.
 // All DB methods are safe for concurrent use by multiple goroutines.
 type (
@@ -74,6 +188,7 @@ type (
 		sync.RWMutex
 
 		size       int64
+		used       int64 // used is size of entries in mem store excluding freed data regions.
 		targetSize int64
 
 		InitialInterval     time.Duration
@@ -90,6 +205,10 @@ type (
 		consistent *hash.Consistent
 		blockCache blockCache
 
+		// storage backs the block data tables if set.
+		storage fs.FileSystem
+		path    string
+
 		// Capacity
 		nBlocks int
 		cap     *Capacity
@@ -120,6 +239,8 @@ func Open(size int64, opts *Options) (*DB, error) {
 	db := &DB{
 		drainLockC: make(chan struct{}, 1),
 		blockCache: newBlockCache(opts.MaxBlocks),
+		storage:    opts.Storage,
+		path:       opts.Path,
 
 		// Capacity
 		nBlocks: opts.MaxBlocks,
@@ -129,6 +250,12 @@ func Open(size int64, opts *Options) (*DB, error) {
 		closeC: make(chan struct{}),
 	}
 
+	if db.storage != nil {
+		if err := db.blockCache.openStorage(db.storage, db.path); err != nil {
+			return nil, err
+		}
+	}
+
 	db.consistent = hash.InitConsistent(int(opts.MaxBlocks), int(opts.MaxBlocks))
 
 	go db.drain(opts.DrainFactor, opts.DrainInterval)
@@ -162,13 +289,26 @@ func (db *DB) shrinkDataTable() error {
 	for i := 0; i < db.nBlocks; i++ {
 		block := db.blockCache[i]
 		block.Lock()
+		if block.freeOffset == 0 {
+			block.freeOffset = block.freePrefix()
+		}
 		if block.freeOffset > 0 {
+			var dropped int64
+			for _, off := range block.m {
+				if off == -1 || off >= block.freeOffset {
+					continue
+				}
+				if scratch, err := block.data.readRaw(off, 4); err == nil {
+					dropped += int64(binary.LittleEndian.Uint32(scratch[:4]))
+				}
+			}
 			if err := block.data.shrink(block.freeOffset); err != nil {
 				block.Unlock()
 				return err
 			}
 			db.cap.Lock()
 			db.cap.size -= int64(block.freeOffset)
+			db.cap.used -= dropped
 			db.cap.Unlock()
 		}
 		for seq, off := range block.m {
@@ -178,7 +318,16 @@ func (db *DB) shrinkDataTable() error {
 				block.m[seq] = off - block.freeOffset
 			}
 		}
+		freeSlots := block.freeSlots[:0]
+		for _, s := range block.freeSlots {
+			if s.offset >= block.freeOffset {
+				s.offset -= block.freeOffset
+				freeSlots = append(freeSlots, s)
+			}
+		}
+		block.freeSlots = freeSlots
 		block.freeOffset = 0
+		block.compact()
 		block.Unlock()
 	}
 
@@ -197,6 +346,10 @@ func (db *DB) Close() error {
 
 	// Wait for all goroutines to exit.
 	db.closeW.Wait()
+
+	if db.storage != nil {
+		return db.blockCache.closeStorage(db.storage, db.path)
+	}
 	return nil
 }
 
@@ -231,17 +384,19 @@ func (db *DB) Get(blockID uint64, key uint64) ([]byte, error) {
 	return data[4:], nil
 }
 
-// Remove sets data offset to -1 for the key under a blockID.
+// Remove sets data offset to -1 for the key under a blockID and returns its data region to the block free slots.
 func (db *DB) Remove(blockID uint64, key uint64) error {
 	// Get block
 	block := db.getBlock(blockID)
-	block.RLock()
-	defer block.RUnlock()
+	block.Lock()
+	defer block.Unlock()
 	// Get item from block.
-	if _, ok := block.m[key]; ok {
-		block.m[key] = -1
+	off, ok := block.m[key]
+	if !ok {
+		return nil
 	}
-	return nil
+	block.m[key] = -1
+	return db.free(block, off)
 }
 
 // Set sets the value for the given entry for a blockID.
@@ -258,9 +413,12 @@ func (db *DB) Set(blockID uint64, key uint64, data []byte) error {
 	block.Lock()
 	defer block.Unlock()
 	dataLen := uint32(len(data) + 4)
-	off, err := block.data.allocate(dataLen)
-	if err != nil {
-		return err
+	off, reused := block.allocate(dataLen)
+	if !reused {
+		var err error
+		if off, err = block.data.allocate(dataLen); err != nil {
+			return err
+		}
 	}
 	var scratch [4]byte
 	binary.LittleEndian.PutUint32(scratch[0:4], dataLen)
@@ -271,11 +429,49 @@ func (db *DB) Set(blockID uint64, key uint64, data []byte) error {
 	if _, err := block.data.writeAt(data, off+4); err != nil {
 		return err
 	}
+	prev, ok := block.m[key]
 	block.m[key] = off
+	block.compact()
+	// free data region of the previous value of the key.
+	if ok && prev != -1 {
+		if err := db.free(block, prev); err != nil {
+			return err
+		}
+	}
 
 	db.cap.Lock()
 	defer db.cap.Unlock()
-	db.cap.size += int64(dataLen)
+	db.cap.used += int64(dataLen)
+	if !reused {
+		db.cap.size += int64(dataLen)
+	}
+	return nil
+}
+
+// Delete deletes the key under a blockID and returns its data region to the block free slots to reuse on Set.
+func (db *DB) Delete(blockID uint64, key uint64) error {
+	// Get block
+	block := db.getBlock(blockID)
+	block.Lock()
+	defer block.Unlock()
+	off, ok := block.m[key]
+	if !ok {
+		return nil
+	}
+	delete(block.m, key)
+	block.compact()
+	return db.free(block, off)
+}
+
+// free frees data region of the block at the offset. The caller must hold the block lock.
+func (db *DB) free(block *block, off int64) error {
+	size, err := block.free(off)
+	if err != nil {
+		return err
+	}
+	db.cap.Lock()
+	db.cap.used -= int64(size)
+	db.cap.Unlock()
 	return nil
 }
 
@@ -344,6 +540,20 @@ func (db *DB) Capacity() float64 {
 	return float64(db.cap.size) / float64(db.cap.targetSize)
 }
 
+// Used returns size of entries in mem store excluding freed data regions.
+func (db *DB) Used() int64 {
+	db.cap.RLock()
+	defer db.cap.RUnlock()
+	return db.cap.used
+}
+
+// Occupancy returns size of entries in mem store in proportion to target size.
+func (db *DB) Occupancy() float64 {
+	db.cap.RLock()
+	defer db.cap.RUnlock()
+	return float64(db.cap.used) / float64(db.cap.targetSize)
+}
+
 // Reset the interval back to the initial interval.
 // Reset must be called before using db.
 func (cap *Capacity) Reset() {
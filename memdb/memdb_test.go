@@ -17,9 +17,14 @@
 package memdb
 
 import (
+	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+
+	"github.com/unit-io/unitdb/fs"
 )
 
 func TestSimple(t *testing.T) {
@@ -107,3 +112,97 @@ func TestSimple(t *testing.T) {
 	}
 	verifyAndClose()
 }
+
+func TestDelete(t *testing.T) {
+	mdb, err := Open(1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+
+	blockID := uint64(1)
+	if err := mdb.Set(blockID, 1, []byte("msg.1")); err != nil {
+		t.Fatal(err)
+	}
+	size, _ := mdb.Size()
+	if err := mdb.Delete(blockID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := mdb.Get(blockID, 1); data != nil || err != nil {
+		t.Fatalf("expected deleted key; got %v %v", data, err)
+	}
+	if err := mdb.Set(blockID, 2, []byte("msg.2")); err != nil {
+		t.Fatal(err)
+	}
+	if newSize, _ := mdb.Size(); newSize != size {
+		t.Fatalf("expected data region to be reused; size %d got %d", size, newSize)
+	}
+	if data, err := mdb.Get(blockID, 2); err != nil || string(data) != "msg.2" {
+		t.Fatalf("expected msg.2; got %v %v", data, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	mdb, err := Open(1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdb.Close()
+
+	blockID := uint64(1)
+	n := uint64(4 * minCompactKeys)
+	for i := uint64(0); i < n; i++ {
+		if err := mdb.Set(blockID, i, []byte("msg")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := uint64(10); i < n; i++ {
+		if err := mdb.Delete(blockID, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	block := mdb.getBlock(blockID)
+	if block.peak >= minCompactKeys {
+		t.Fatalf("expected key map to be compacted; peak %d", block.peak)
+	}
+	for i := uint64(0); i < 10; i++ {
+		if data, err := mdb.Get(blockID, i); err != nil || string(data) != "msg" {
+			t.Fatalf("expected msg; got %v %v", data, err)
+		}
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mem")
+	mdb, err := Open(1<<20, &Options{Storage: fs.FileIO, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockID := uint64(1)
+	n := uint64(100)
+	for i := uint64(0); i < n; i++ {
+		if err := mdb.Set(blockID, i, []byte(fmt.Sprintf("msg.%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := uint64(0); i < n/2; i++ {
+		if err := mdb.Delete(blockID, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mdb.shrinkDataTable(); err != nil {
+		t.Fatal(err)
+	}
+	for i := n / 2; i < n; i++ {
+		if data, err := mdb.Get(blockID, i); err != nil || string(data) != fmt.Sprintf("msg.%d", i) {
+			t.Fatalf("expected msg.%d; got %s %v", i, data, err)
+		}
+	}
+	if err := mdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blockFileName(path, 0)); !os.IsNotExist(err) {
+		t.Fatalf("expected block file to be removed; got %v", err)
+	}
+}
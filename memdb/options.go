@@ -18,6 +18,8 @@ package memdb
 
 import (
 	"time"
+
+	"github.com/unit-io/unitdb/fs"
 )
 
 // Options holds the optional memdb parameters.
@@ -43,6 +45,12 @@ type Options struct {
 
 	// WriteBackOff to turn on Backoff for writes.
 	WriteBackOff bool
+
+	// Storage sets file system to back the block data tables, the data tables are kept in RAM if it is not set.
+	Storage fs.FileSystem
+
+	// Path sets prefix of the block data table files if Storage is set.
+	Path string
 }
 
 func (src *Options) copyWithDefaults() *Options {
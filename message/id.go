@@ -18,6 +18,7 @@ package message
 
 import (
 	"encoding/binary"
+	"time"
 
 	"github.com/unit-io/unitdb/uid"
 )
@@ -43,8 +44,13 @@ type ID []byte
 
 // NewID generates a new message identifier with a prefix. Master contract is adde to the ID and actual Contract is set later.
 func NewID(seq uint64) ID {
+	return NewIDAt(seq, time.Now())
+}
+
+// NewIDAt generates a new message identifier with the time portion set to the given time.
+func NewIDAt(seq uint64, t time.Time) ID {
 	id := make(ID, fixed)
-	binary.LittleEndian.PutUint32(id[0:4], uid.NewApoch())
+	binary.LittleEndian.PutUint32(id[0:4], uid.ApochAt(t))
 	binary.LittleEndian.PutUint32(id[4:8], MasterContract)
 	binary.LittleEndian.PutUint64(id[8:16], seq)
 
@@ -61,6 +67,11 @@ func (id ID) Sequence() uint64 {
 	return binary.LittleEndian.Uint64(id[8:16])
 }
 
+// Contract gets the contract for the id.
+func (id ID) Contract() uint32 {
+	return binary.LittleEndian.Uint32(id[4:8])
+}
+
 // SetContract sets Contract on ID.
 func (id *ID) SetContract(contract uint32) {
 	newid := make(ID, fixed)
@@ -106,13 +106,18 @@ func (splitFunc) splitOpsKeyValue(c rune) bool {
 
 // TTL returns a Time-To-Live option.
 func (t *Topic) TTL() (uint32, bool) {
+	return t.TTLAt(time.Now())
+}
+
+// TTLAt returns a Time-To-Live option relative to the given time.
+func (t *Topic) TTLAt(now time.Time) (uint32, bool) {
 	ttl, sec, ok := t.getOption("ttl")
 	if sec > 0 {
 		return uint32(time.Duration(sec) * time.Second), ok
 	}
 	var duration time.Duration
 	duration, _ = time.ParseDuration(ttl)
-	return uint32(time.Now().Add(duration).Unix()), ok
+	return uint32(now.Add(duration).Unix()), ok
 }
 
 // Last returns the 'last' option, which is a number of messages to retrieve.
@@ -306,6 +311,9 @@ func parseWildcardTopic(contract uint32, topic *Topic) (ok bool) {
 	return true
 }
 
+// topicNameFlag is set on the depth byte if topic string is packed with the parts.
+const topicNameFlag = 0x80
+
 // Marshal serializes topic to binary.
 func (t *Topic) Marshal() []byte {
 	// preallocate buffer of appropriate size
@@ -315,17 +323,27 @@ func (t *Topic) Marshal() []byte {
 	for range t.Parts {
 		size += 5
 	}
+	// topic string is packed after the parts along with parts count.
+	if len(t.Topic) > 0 {
+		size += 1 + len(t.Topic)
+	}
 	buf := make([]byte, size)
 
 	var n int
 	buf[n] = byte(t.Depth)
 	n++
+	if len(t.Topic) > 0 {
+		buf[0] |= topicNameFlag
+		buf[n] = byte(len(t.Parts))
+		n++
+	}
 	for _, part := range t.Parts {
 		buf[n] = byte(part.Wildchars)
 		n++
 		binary.LittleEndian.PutUint32(buf[n:], part.Hash)
 		n += 4
 	}
+	copy(buf[n:], t.Topic)
 	return buf
 }
 
@@ -335,7 +353,13 @@ func (t *Topic) Unmarshal(data []byte) error {
 
 	var parts []Part
 	depth := uint8(buf.Next(1)[0])
-	for i := 0; i <= int(depth); i++ {
+	nParts := int(depth) + 1
+	hasName := depth&topicNameFlag != 0
+	if hasName {
+		depth &^= topicNameFlag
+		nParts = int(buf.Next(1)[0])
+	}
+	for i := 0; i < nParts; i++ {
 		if buf.Len() == 0 {
 			break
 		}
@@ -348,6 +372,9 @@ func (t *Topic) Unmarshal(data []byte) error {
 	}
 	t.Depth = depth
 	t.Parts = parts
+	if hasName {
+		t.Topic = append([]byte(nil), buf.Bytes()...)
+	}
 	return nil
 }
 
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/unit-io/unitdb/metrics"
@@ -42,6 +43,27 @@ type Meter struct {
 	OutBytes   metrics.Counter
 }
 
+// MetricsSink receives DB events as they happen so that metrics can be exported
+// to an external system without polling Varz.
+type MetricsSink interface {
+	Put(n int64)
+	Get(n int64)
+	Del(n int64)
+	Sync(n int64)
+	InBytes(n int64)
+	OutBytes(n int64)
+}
+
+// noopSink is the default MetricsSink which discards all events.
+type noopSink struct{}
+
+func (noopSink) Put(int64)      {}
+func (noopSink) Get(int64)      {}
+func (noopSink) Del(int64)      {}
+func (noopSink) Sync(int64)     {}
+func (noopSink) InBytes(int64)  {}
+func (noopSink) OutBytes(int64) {}
+
 // NewMeter provide meter to capture statistics.
 func NewMeter() *Meter {
 	Metrics := metrics.NewMetrics()
@@ -101,17 +123,22 @@ type Varz struct {
 	OutMsgs  int64     `json:"out_msgs"`
 	InBytes  int64     `json:"in_bytes"`
 	OutBytes int64     `json:"out_bytes"`
-	HMean    float64   `json:"hmean"` // Event duration harmonic mean.
-	P50      float64   `json:"p50"`   // Event duration nth percentiles.
-	P75      float64   `json:"p75"`
-	P95      float64   `json:"p95"`
-	P99      float64   `json:"p99"`
-	P999     float64   `json:"p999"`
-	Long5p   float64   `json:"long_5p"`  // Average of the longest 5% event durations.
-	Short5p  float64   `json:"short_5p"` // Average of the shortest 5% event durations.
-	Max      float64   `json:"max"`      // Highest event duration.
-	Min      float64   `json:"min"`      // Lowest event duration.
-	StdDev   float64   `json:"stddev"`   // Standard deviation.
+	// MemdbSize is size of entries in memdb and MemdbOccupancy is its proportion to memdb size.
+	MemdbSize      int64   `json:"memdb_size"`
+	MemdbOccupancy float64 `json:"memdb_occupancy"`
+	// Fragmentation is ratio of free space not in the largest free block to the total free space.
+	Fragmentation float64 `json:"fragmentation"`
+	HMean         float64 `json:"hmean"` // Event duration harmonic mean.
+	P50           float64 `json:"p50"`   // Event duration nth percentiles.
+	P75           float64 `json:"p75"`
+	P95           float64 `json:"p95"`
+	P99           float64 `json:"p99"`
+	P999          float64 `json:"p999"`
+	Long5p        float64 `json:"long_5p"`  // Average of the longest 5% event durations.
+	Short5p       float64 `json:"short_5p"` // Average of the shortest 5% event durations.
+	Max           float64 `json:"max"`      // Highest event duration.
+	Min           float64 `json:"min"`      // Lowest event duration.
+	StdDev        float64 `json:"stddev"`   // Standard deviation.
 	// Range     		 time.Duration `json:"range"`    // Event duration range (Max-Min).
 	// // Per-second rate based on event duration avg. via Metrics.Cumulative / Metrics.Samples.
 	// Rate 			float64 `json:"rate"`
@@ -159,6 +186,9 @@ func (db *DB) Varz() (*Varz, error) {
 	v.OutMsgs = db.meter.OutMsgs.Count()
 	v.InBytes = db.meter.InBytes.Count()
 	v.OutBytes = db.meter.OutBytes.Count()
+	v.MemdbSize = db.mem.Used()
+	v.MemdbOccupancy = db.mem.Occupancy()
+	v.Fragmentation = db.freeList.fragmentation()
 	ts := db.meter.TimeSeries.Snapshot()
 	v.HMean = float64(ts.HMean())
 	v.P50 = float64(ts.P50())
@@ -175,6 +205,101 @@ func (db *DB) Varz() (*Varz, error) {
 	return v, nil
 }
 
+// Stats is a point in time snapshot of unitdb counters. Use DB.StatsInto to fill a Stats without allocating.
+type Stats struct {
+	Seq       uint64 // Current sequence of the DB.
+	Count     uint64 // Number of entries synced to the DB.
+	Blocks    int32  // Number of index blocks.
+	IndexSize int64  // Size of the index file in bytes.
+	DataSize  int64  // Size of the data file in bytes.
+	SyncLag   uint64 // Number of sequences not yet synced to the DB.
+	Gets      int64
+	Puts      int64
+	Leases    int64
+	Syncs     int64
+	Recovers  int64
+	Aborts    int64
+	Dels      int64
+	InMsgs    int64
+	OutMsgs   int64
+	InBytes   int64
+	OutBytes  int64
+}
+
+// StatsInto fills the caller provided Stats with current DB statistics.
+// It does not allocate so it is safe to call at high frequency from a monitoring goroutine.
+func (db *DB) StatsInto(s *Stats) {
+	s.Seq = db.seq()
+	s.Count = db.Count()
+	s.Blocks = db.blocks()
+	s.IndexSize = db.index.currSize()
+	s.DataSize = db.data.currSize()
+	s.SyncLag = 0
+	if lastSyncSeq := atomic.LoadUint64(&db.syncHandle.lastSyncSeq); s.Seq > lastSyncSeq {
+		s.SyncLag = s.Seq - lastSyncSeq
+	}
+	s.Gets = db.meter.Gets.Count()
+	s.Puts = db.meter.Puts.Count()
+	s.Leases = db.meter.Leases.Count()
+	s.Syncs = db.meter.Syncs.Count()
+	s.Recovers = db.meter.Recovers.Count()
+	s.Aborts = db.meter.Aborts.Count()
+	s.Dels = db.meter.Dels.Count()
+	s.InMsgs = db.meter.InMsgs.Count()
+	s.OutMsgs = db.meter.OutMsgs.Count()
+	s.InBytes = db.meter.InBytes.Count()
+	s.OutBytes = db.meter.OutBytes.Count()
+}
+
+// LockStatistics is a snapshot of the write lock contention statistics.
+type LockStatistics struct {
+	TotalAcquisitions uint64 // Number of times the write lock is acquired.
+	TotalWaitNs       uint64 // Total time waited for the write lock in nanoseconds.
+	MaxWaitNs         int64  // Longest time waited for the write lock in nanoseconds.
+}
+
+// WriteLockStats returns contention statistics of the write lock taken by puts, deletes and the tiny batch writer.
+// A consistently high MaxWaitNs suggests the tiny batch write interval or batch pool size is too small.
+func (db *DB) WriteLockStats() LockStatistics {
+	return LockStatistics{
+		TotalAcquisitions: atomic.LoadUint64(&db.lockAcquisitions),
+		TotalWaitNs:       atomic.LoadUint64(&db.lockWaitNs),
+		MaxWaitNs:         atomic.LoadInt64(&db.lockMaxWaitNs),
+	}
+}
+
+// WatchStat returns a channel that receives a Stats snapshot every interval. A snapshot is skipped
+// if the previous one is not yet received. The channel is closed when the DB is closed, or immediately
+// if interval is not positive.
+func (db *DB) WatchStat(interval time.Duration) <-chan Stats {
+	statC := make(chan Stats, 1)
+	if interval <= 0 {
+		close(statC)
+		return statC
+	}
+	statTicker := time.NewTicker(interval)
+	go func() {
+		defer func() {
+			statTicker.Stop()
+			close(statC)
+		}()
+		var s Stats
+		for {
+			select {
+			case <-db.closeC:
+				return
+			case <-statTicker.C:
+				db.StatsInto(&s)
+				select {
+				case statC <- s:
+				default:
+				}
+			}
+		}
+	}()
+	return statC
+}
+
 // HandleVarz will process HTTP requests for unitdb stats information.
 func (db *DB) HandleVarz(w http.ResponseWriter, r *http.Request) {
 	// As of now, no error is ever returned.
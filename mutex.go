@@ -17,6 +17,7 @@
 package unitdb
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/unit-io/unitdb/hash"
@@ -46,3 +47,27 @@ func newMutex() mutex {
 func (mu *mutex) getMutex(blockID uint64) *sync.RWMutex {
 	return mu.internal[mu.consistent.FindBlock(blockID)]
 }
+
+// lockAll locks mutexes of the blockIDs in the order of the mutexes, so callers locking
+// mutexes of overlapping blockIDs do not deadlock. It returns a func to unlock the mutexes.
+func (mu *mutex) lockAll(blockIDs []uint64) (unlock func()) {
+	var idx []int
+	seen := make(map[uint16]bool)
+	for _, blockID := range blockIDs {
+		i := mu.consistent.FindBlock(blockID)
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		idx = append(idx, int(i))
+	}
+	sort.Ints(idx)
+	for _, i := range idx {
+		mu.internal[i].Lock()
+	}
+	return func() {
+		for _, i := range idx {
+			mu.internal[i].Unlock()
+		}
+	}
+}
@@ -17,12 +17,25 @@
 package unitdb
 
 import (
+	"bytes"
+	"fmt"
+	"math"
 	"time"
 
 	"github.com/unit-io/unitdb/fs"
 	"github.com/unit-io/unitdb/message"
 )
 
+// RecoveryMode sets how log recovery handles unrecoverable entries.
+type RecoveryMode int
+
+const (
+	// RecoveryStrict fails recovery on the first unrecoverable entry.
+	RecoveryStrict RecoveryMode = iota
+	// RecoveryBestEffort skips and logs unrecoverable entries and recovers the rest.
+	RecoveryBestEffort
+)
+
 // flags holds various DB flags.
 type flags struct {
 	// immutable set immutable flag on database.
@@ -33,6 +46,9 @@ type flags struct {
 
 	// backgroundKeyExpiry sets flag to run key expirer.
 	backgroundKeyExpiry bool
+
+	// withoutFilter disables bloom filter on DB create.
+	withoutFilter bool
 }
 
 // batchOptions is used to set options when using batch operation.
@@ -49,6 +65,9 @@ type queryOptions struct {
 
 	// maxQueryLimit limits maximum number of records to fetch if the DB Get or DB Iterator method does not specify a limit or specify a limit larger than MaxQueryResults.
 	maxQueryLimit int
+
+	// topicNormalizer normalizes topic before it is parsed on put and query.
+	topicNormalizer func([]byte) []byte
 }
 
 // options holds the optional DB parameters.
@@ -69,6 +88,9 @@ type options struct {
 	// encryptionKey is used for message encryption.
 	encryptionKey []byte
 
+	// oldEncryptionKeys are used to decrypt messages encrypted before the encryption key was rotated.
+	oldEncryptionKeys [][]byte
+
 	// tinyBatchWriteInterval interval to group tiny batches and write into db on tiny batch interval.
 	// Setting the value to 0 immediately writes entries into db.
 	tinyBatchWriteInterval time.Duration
@@ -79,14 +101,81 @@ type options struct {
 	// memdbSize sets Size of memory db.
 	memdbSize int64
 
+	// memStorage sets file system to back the mem store, the mem store is kept in RAM if it is not set.
+	memStorage fs.FileSystem
+
 	// logSize sets Size of write ahead log.
 	logSize int64
 
+	// logCompression compresses write ahead log records.
+	logCompression bool
+
+	// dataPreallocSize sets size of the chunks the data file grows by.
+	// Setting the value to 0 grows the data file by the size of each write.
+	dataPreallocSize int64
+
 	// minimumFreeBlocksSize minimum freeblocks size before free blocks are allocated and reused.
 	minimumFreeBlocksSize int64
 
+	// filterCacheSize sets maximum size of the filter block cache.
+	filterCacheSize int64
+
+	// defragInterval sets interval to run background defrag of free blocks.
+	// Setting the value to 0 disables the background defrag, free blocks are defragmented on DB close.
+	defragInterval time.Duration
+
+	// maxTopicSize limits size of a topic in bytes on read and write. It cannot be larger than maxTopicLength.
+	maxTopicSize int
+
+	// maxValueSize limits size of a payload in bytes on write. It cannot be larger than maxValueLength.
+	maxValueSize int
+
+	// compressionThreshold sets minimum size of a payload in bytes to compress, smaller payloads are stored uncompressed.
+	// Setting the value to -1 compresses all payloads.
+	compressionThreshold int
+
+	// importBatchSize sets number of entries to write in a batch on CSV import.
+	importBatchSize int
+
+	// concurrency sets number of shards of free slots, free blocks and time window blocks.
+	concurrency int
+
+	// shards sets number of working shards of the shard ring used by DB.ShardFor.
+	shards int
+
+	// maxShards sets capacity of the shard ring, shards can be added up to maxShards.
+	maxShards int
+
+	// clock provides current time for message expiry and time window bookkeeping.
+	clock Clock
+
+	// loadFactor sets fraction of a window block filled with entries before a new window block is chained to it.
+	loadFactor float64
+
+	// dedupWindow sets duration to remember dedup keys of the written entries.
+	dedupWindow time.Duration
+
+	// expiryGranularity sets interval of the background expiry of entries.
+	expiryGranularity time.Duration
+
+	// metricsSink receives DB events in addition to the internal meter.
+	metricsSink MetricsSink
+
+	// openTimeout sets duration to retry acquiring the lock file on Open if the DB is locked by another process.
+	// Setting the value to 0 returns ErrLocked immediately.
+	openTimeout time.Duration
+
 	// fileSystem file storage type.
 	fileSystem fs.FileSystem
+
+	// recoveryMode sets how log recovery handles unrecoverable entries.
+	recoveryMode RecoveryMode
+
+	// expiryCallback is called for each entry freed by the background key expirer.
+	expiryCallback func(topic, id []byte)
+
+	// err is set by an option with an invalid value, Open returns the error.
+	err error
 }
 
 // Options it contains configurable options and flags for DB.
@@ -143,6 +232,14 @@ func WithBackgroundKeyExpiry() Options {
 	})
 }
 
+// WithoutFilter disables the bloom filter for append only workloads. Deletes and expiry
+// read index blocks directly. The flag is persisted on DB create and ignored on reopen.
+func WithoutFilter() Options {
+	return newFuncOption(func(o *options) {
+		o.flags.withoutFilter = true
+	})
+}
+
 // WithDefaultBatchOptions will set some default values for Batch operation.
 //   contract: MasterContract
 //   encryption: False
@@ -207,6 +304,45 @@ func WithDefaultOptions() Options {
 		if o.minimumFreeBlocksSize == 0 {
 			o.minimumFreeBlocksSize = 1 << 27 // minimum size of (128MB).
 		}
+		if o.filterCacheSize == 0 {
+			o.filterCacheSize = 1 << 26 // maximum size of filter block cache (64MB).
+		}
+		if o.maxTopicSize == 0 {
+			o.maxTopicSize = maxTopicLength
+		}
+		if o.maxValueSize == 0 {
+			o.maxValueSize = maxValueLength
+		}
+		if o.compressionThreshold == 0 {
+			o.compressionThreshold = 64
+		}
+		if o.importBatchSize == 0 {
+			o.importBatchSize = 1000
+		}
+		if o.concurrency == 0 {
+			o.concurrency = nShards
+		}
+		if o.shards == 0 {
+			o.shards = 1
+		}
+		if o.maxShards < o.shards {
+			o.maxShards = o.shards
+		}
+		if o.clock == nil {
+			o.clock = systemClock{}
+		}
+		if o.loadFactor == 0 {
+			o.loadFactor = 1
+		}
+		if o.dedupWindow == 0 {
+			o.dedupWindow = time.Minute
+		}
+		if o.expiryGranularity == 0 {
+			o.expiryGranularity = time.Minute
+		}
+		if o.metricsSink == nil {
+			o.metricsSink = noopSink{}
+		}
 		if o.encryptionKey == nil {
 			o.encryptionKey = []byte("4BWm1vZletvrCDGWsF6mex8oBSd59m6I")
 		}
@@ -259,6 +395,14 @@ func WithMemdbSize(size int64) Options {
 	})
 }
 
+// WithMemStorage sets the file system to back the mem store, for example fs.FileIO keeps
+// the staging area of the DB in files to limit RAM usage on devices with little memory.
+func WithMemStorage(fs fs.FileSystem) Options {
+	return newFuncOption(func(o *options) {
+		o.memStorage = fs
+	})
+}
+
 // WithLogSize sets Size of write ahead log.
 func WithLogSize(size int64) Options {
 	return newFuncOption(func(o *options) {
@@ -266,6 +410,22 @@ func WithLogSize(size int64) Options {
 	})
 }
 
+// WithLogCompression compresses write ahead log records using snappy.
+// A record is stored raw if compression does not reduce its size.
+func WithLogCompression() Options {
+	return newFuncOption(func(o *options) {
+		o.logCompression = true
+	})
+}
+
+// WithDataPreallocSize sets size of the chunks the data file is preallocated in.
+// The preallocated space beyond the data written is released on DB close.
+func WithDataPreallocSize(size int64) Options {
+	return newFuncOption(func(o *options) {
+		o.dataPreallocSize = size
+	})
+}
+
 // WithMinimumFreeBlocksSize sets minimum freeblocks size
 // before free blocks are allocated and reused.
 func WithMinimumFreeBlocksSize(size int64) Options {
@@ -280,3 +440,208 @@ func WithEncryptionKey(key []byte) Options {
 		o.encryptionKey = key
 	})
 }
+
+// WithEncryptionKeys sets primary encryption key to use for data encryption and
+// old keys to decrypt data encrypted before the primary key was rotated.
+func WithEncryptionKeys(primary []byte, old [][]byte) Options {
+	return newFuncOption(func(o *options) {
+		o.encryptionKey = primary
+		o.oldEncryptionKeys = old
+	})
+}
+
+// WithFilterCacheMaxSizeMB sets maximum size of the filter block cache in MB.
+// Least recently used filter blocks are evicted once cache grows larger than this size.
+// Open returns ErrBadRequest if the size is not positive.
+func WithFilterCacheMaxSizeMB(sizeMB int) Options {
+	return newFuncOption(func(o *options) {
+		if sizeMB <= 0 {
+			o.err = fmt.Errorf("db.WithFilterCacheMaxSizeMB: size %dMB: %w", sizeMB, ErrBadRequest)
+			return
+		}
+		o.filterCacheSize = int64(sizeMB) * 1024 * 1024
+	})
+}
+
+// WithMetricsSink sets sink to receive DB events such as puts, gets, deletes and syncs.
+func WithMetricsSink(sink MetricsSink) Options {
+	return newFuncOption(func(o *options) {
+		if sink == nil {
+			sink = noopSink{}
+		}
+		o.metricsSink = sink
+	})
+}
+
+// WithImportBatchSize sets number of entries to write in a batch on CSV import.
+// Open returns ErrBadRequest if the batch size is not positive.
+func WithImportBatchSize(n int) Options {
+	return newFuncOption(func(o *options) {
+		if n <= 0 {
+			o.err = fmt.Errorf("db.WithImportBatchSize: batch size %d: %w", n, ErrBadRequest)
+			return
+		}
+		o.importBatchSize = n
+	})
+}
+
+// WithClock sets clock to use for message expiry and time window bookkeeping.
+func WithClock(c Clock) Options {
+	return newFuncOption(func(o *options) {
+		if c == nil {
+			c = systemClock{}
+		}
+		o.clock = c
+	})
+}
+
+// WithDefragInterval sets interval to run background defrag of free blocks.
+func WithDefragInterval(dur time.Duration) Options {
+	return newFuncOption(func(o *options) {
+		o.defragInterval = dur
+	})
+}
+
+// WithMaxTopicSize limits size of a topic in bytes on read and write. Open returns ErrBadRequest
+// if the size is not positive or larger than the maximum topic length.
+func WithMaxTopicSize(size int) Options {
+	return newFuncOption(func(o *options) {
+		if size <= 0 || size > maxTopicLength {
+			o.err = fmt.Errorf("db.WithMaxTopicSize: size %d: %w", size, ErrBadRequest)
+			return
+		}
+		o.maxTopicSize = size
+	})
+}
+
+// WithMaxValueSize limits size of a payload in bytes on write. Open returns ErrBadRequest
+// if the size is not positive or larger than the maximum value length.
+func WithMaxValueSize(size int) Options {
+	return newFuncOption(func(o *options) {
+		if size <= 0 || size > maxValueLength {
+			o.err = fmt.Errorf("db.WithMaxValueSize: size %d: %w", size, ErrBadRequest)
+			return
+		}
+		o.maxValueSize = size
+	})
+}
+
+// WithCompressionThreshold sets minimum size of a payload in bytes to compress. Payloads smaller
+// than the threshold are stored uncompressed. Setting the value to -1 compresses all payloads.
+func WithCompressionThreshold(minBytes int) Options {
+	return newFuncOption(func(o *options) {
+		o.compressionThreshold = minBytes
+	})
+}
+
+// WithOpenTimeout sets duration for Open to retry with backoff if the DB is locked by another process.
+// Open returns ErrLocked if the lock is not released before the timeout elapses.
+func WithOpenTimeout(dur time.Duration) Options {
+	return newFuncOption(func(o *options) {
+		o.openTimeout = dur
+	})
+}
+
+// WithConcurrency sets number of shards of free slots, free blocks and time window blocks.
+// Larger number of shards reduces lock contention on writes, it can be tuned to number of cores.
+// Open returns ErrBadRequest if the number of shards is not positive or larger than math.MaxUint16.
+func WithConcurrency(n int) Options {
+	return newFuncOption(func(o *options) {
+		if n <= 0 || n > math.MaxUint16 {
+			o.err = fmt.Errorf("db.WithConcurrency: shards %d: %w", n, ErrBadRequest)
+			return
+		}
+		o.concurrency = n
+	})
+}
+
+// WithShards sets number of working shards and capacity of the shard ring used by DB.ShardFor.
+// Shards can be added up to the capacity using DB.AddShard. Open returns ErrBadRequest
+// if the number of shards is not positive or the capacity is less than the number of shards
+// or larger than math.MaxUint16.
+func WithShards(n, max int) Options {
+	return newFuncOption(func(o *options) {
+		if n <= 0 || max < n || max > math.MaxUint16 {
+			o.err = fmt.Errorf("db.WithShards: shards %d, capacity %d: %w", n, max, ErrBadRequest)
+			return
+		}
+		o.shards = n
+		o.maxShards = max
+	})
+}
+
+// WithFileSystem sets the file system used to store DB files. It is used to
+// store DB in memory or to inject faults in tests.
+func WithFileSystem(fs fs.FileSystem) Options {
+	return newFuncOption(func(o *options) {
+		o.fileSystem = fs
+	})
+}
+
+// WithRecoveryMode sets how log recovery handles malformed log records and entries that fail block validation.
+// RecoveryStrict is the default, use RecoveryBestEffort to skip such entries, see DB.RecoverySkipped.
+func WithRecoveryMode(mode RecoveryMode) Options {
+	return newFuncOption(func(o *options) {
+		o.recoveryMode = mode
+	})
+}
+
+// WithExpiryCallback sets a callback called with the topic and message ID of each entry freed by the
+// background key expirer. Callbacks are called in order from a separate goroutine so a slow callback
+// does not stall expiry. The topic is nil for topics persisted without a name.
+func WithExpiryCallback(fn func(topic, id []byte)) Options {
+	return newFuncOption(func(o *options) {
+		o.expiryCallback = fn
+	})
+}
+
+// WithDedupWindow sets duration to remember dedup keys of the written entries.
+// An entry with a dedup key seen within the window is not written.
+func WithDedupWindow(d time.Duration) Options {
+	return newFuncOption(func(o *options) {
+		o.dedupWindow = d
+	})
+}
+
+// WithExpiryGranularity sets interval of the background expiry of entries, it defaults to a minute.
+// Expired entries are not returned by queries even before they are deleted by the background expiry.
+// Open returns ErrBadRequest if the interval is not positive.
+func WithExpiryGranularity(d time.Duration) Options {
+	return newFuncOption(func(o *options) {
+		if d <= 0 {
+			o.err = fmt.Errorf("db.WithExpiryGranularity: interval %v: %w", d, ErrBadRequest)
+			return
+		}
+		o.expiryGranularity = d
+	})
+}
+
+// WithLoadFactor sets fraction of a window block filled with entries of a topic before
+// a new window block is chained to it using the next offset. A higher load factor packs
+// entries densely so a query reads fewer chained blocks. A lower load factor leaves room
+// in each window block and chains more blocks per topic, which grows the window file and
+// the number of blocks read by a query. The load factor defaults to 1.
+// Open returns ErrBadRequest if the load factor is not in (0, 1].
+func WithLoadFactor(f float64) Options {
+	return newFuncOption(func(o *options) {
+		if f <= 0 || f > 1 {
+			o.err = fmt.Errorf("db.WithLoadFactor: load factor %v: %w", f, ErrBadRequest)
+			return
+		}
+		o.loadFactor = f
+	})
+}
+
+// WithTopicNormalizer sets a function to normalize topic before it is hashed on put and query,
+// for example LowerCaseTopic. The normalizer receives the topic including its options.
+// A DB created with a normalizer cannot be opened without one.
+func WithTopicNormalizer(fn func([]byte) []byte) Options {
+	return newFuncOption(func(o *options) {
+		o.topicNormalizer = fn
+	})
+}
+
+// LowerCaseTopic is a topic normalizer that makes topics case insensitive.
+func LowerCaseTopic(topic []byte) []byte {
+	return bytes.ToLower(topic)
+}
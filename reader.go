@@ -0,0 +1,211 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// topicReader reads entries of a topic as binary frames in order of sequence. Each frame is the
+// 4 byte little endian size of the rest of the frame, the 16 byte message ID and the payload.
+// The topic is read in pages of the maximum query limit, each page starts after the sequence of
+// the last frame read from the previous page.
+type topicReader struct {
+	db       *DB
+	topic    []byte
+	contract uint32
+	limit    int // limit is number of frames in a page.
+	it       *ItemIterator
+	pageN    int    // number of frames read from the current page.
+	cursor   uint64 // sequence of the last frame read.
+	n        int64  // number of frames read.
+	buf      []byte // unread bytes of the current frame.
+	closed   bool
+}
+
+// NewReader returns a reader of the entries of the topic as binary frames in order of sequence.
+// Each frame is the 4 byte little endian size of the rest of the frame, the 16 byte message ID
+// and the payload. Seek offsets are in number of frames rather than bytes.
+func (db *DB) NewReader(topic []byte, contract uint32) (io.ReadSeekCloser, error) {
+	r := &topicReader{db: db, topic: topic, contract: contract, limit: db.opts.maxQueryLimit}
+	if err := r.reset(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reset creates a new iterator positioned before the first frame.
+func (r *topicReader) reset() error {
+	if err := r.page(0); err != nil {
+		return err
+	}
+	r.n, r.buf = 0, nil
+	return nil
+}
+
+// page creates a new iterator of the frames with sequence greater than cursor.
+func (r *topicReader) page(cursor uint64) error {
+	it, err := r.db.Items(r.query(cursor))
+	if err != nil {
+		return err
+	}
+	if r.it != nil {
+		r.it.Release()
+	}
+	r.it, r.pageN, r.cursor = it, 0, cursor
+	return nil
+}
+
+func (r *topicReader) query(cursor uint64) *Query {
+	return NewQuery(r.topic).WithContract(r.contract).WithLimit(r.limit).WithCursor(cursor)
+}
+
+// next moves the iterator to the next frame, it returns false if there are no more frames.
+// The next page is read once all frames of a full page are read.
+func (r *topicReader) next() (bool, error) {
+	for {
+		if r.pageN == 0 {
+			r.it.First()
+		} else {
+			r.it.Next()
+		}
+		if err := r.it.Error(); err != nil {
+			return false, err
+		}
+		if r.it.Valid() {
+			r.pageN++
+			r.n++
+			r.cursor = message.ID(r.it.Item().ID()).Sequence()
+			return true, nil
+		}
+		if r.pageN < r.limit {
+			return false, nil
+		}
+		if err := r.page(r.cursor); err != nil {
+			return false, err
+		}
+	}
+}
+
+// count returns number of frames of the topic.
+func (r *topicReader) count() (int64, error) {
+	var n int64
+	var cursor uint64
+	for {
+		it, err := r.db.Items(r.query(cursor))
+		if err != nil {
+			return 0, err
+		}
+		c := it.Count()
+		n += int64(c)
+		if c < r.limit {
+			it.Release()
+			return n, nil
+		}
+		cursor = it.query.winEntries[c-1].seq
+		it.Release()
+	}
+}
+
+// Read reads frames of the topic entries into p.
+func (r *topicReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errReaderClosed
+	}
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			ok, err := r.next()
+			if err != nil {
+				return n, err
+			}
+			if !ok {
+				if n == 0 {
+					return 0, io.EOF
+				}
+				return n, nil
+			}
+			item := r.it.Item()
+			r.buf = make([]byte, 4, 4+len(item.ID())+len(item.Value()))
+			binary.LittleEndian.PutUint32(r.buf, uint32(len(item.ID())+len(item.Value())))
+			r.buf = append(append(r.buf, item.ID()...), item.Value()...)
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Seek sets the position to the start of the frame at offset, offset and the returned position are in number of frames.
+// A partially read frame is counted as the current frame.
+func (r *topicReader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed {
+		return 0, errReaderClosed
+	}
+	pos := r.n
+	if len(r.buf) > 0 {
+		pos--
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += pos
+	case io.SeekEnd:
+		n, err := r.count()
+		if err != nil {
+			return 0, err
+		}
+		offset += n
+	default:
+		return 0, fmt.Errorf("topicReader.Seek: invalid whence %d: %w", whence, ErrBadRequest)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("topicReader.Seek: negative position %d: %w", offset, ErrBadRequest)
+	}
+	if offset < r.n {
+		if err := r.reset(); err != nil {
+			return 0, err
+		}
+	}
+	r.buf = nil
+	for r.n < offset {
+		ok, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+	}
+	return offset, nil
+}
+
+// Close releases the underlying iterator.
+func (r *topicReader) Close() error {
+	if r.closed {
+		return errReaderClosed
+	}
+	r.closed = true
+	r.it.Release()
+	r.it = nil
+	return nil
+}
@@ -42,6 +42,18 @@ func (db *syncHandle) recoverWindowBlocks(windowEntries map[uint64]windowEntries
 	return nil
 }
 
+// skipEntry skips the unrecoverable entry in best effort recovery mode, otherwise it returns err.
+func (db *syncHandle) skipEntry(seq uint64, err error) error {
+	if db.opts.recoveryMode != RecoveryBestEffort {
+		return err
+	}
+	logger.Warn().Err(err).Str("context", "db.recoverLog").Uint64("seq", seq).Msg("skipped unrecoverable entry")
+	if seq != 0 {
+		db.recoverySkipped = append(db.recoverySkipped, seq)
+	}
+	return nil
+}
+
 func (db *syncHandle) startRecovery() error {
 	// p := profile.Start(profile.MemProfile, profile.ProfilePath("."), profile.NoShutdownHook)
 	// defer p.Stop()
@@ -65,27 +77,46 @@ func (db *syncHandle) startRecovery() error {
 		return err
 	}
 	pendingEntries := make(map[uint64]windowEntries)
+	// delete and update records are applied once the entries of the log are recovered.
+	var records [][]byte
 	err = r.Read(func(timeID int64) (ok bool, err error) {
 		l := r.Count()
 		winEntries := make(map[uint64]windowEntries)
 		for i := uint32(0); i < l; i++ {
 			logData, ok, err := r.Next()
 			if err != nil {
-				return false, err
+				// remaining records of the log cannot be located.
+				if err := db.skipEntry(0, err); err != nil {
+					return false, err
+				}
+				break
 			}
 			if !ok {
 				break
 			}
+			if len(logData) < entrySize+idSize {
+				if err := db.skipEntry(0, fmt.Errorf("recovery: record size %d: %w", len(logData), errEntryInvalid)); err != nil {
+					return true, err
+				}
+				continue
+			}
 			if err := e.UnmarshalBinary(logData[:entrySize]); err != nil {
 				return true, err
 			}
+			if e.seq == 0 || uint32(len(logData)) != entrySize+idSize+uint32(e.topicSize)+e.valueSize {
+				if err := db.skipEntry(e.seq, fmt.Errorf("recovery: record seq %d: %w", e.seq, errEntryInvalid)); err != nil {
+					return true, err
+				}
+				continue
+			}
+			if logData[entrySize+idSize-1]&logRecordFlags != 0 {
+				records = append(records, append([]byte(nil), logData...))
+				continue
+			}
 			if db.freeList.isFree(timeID, e.seq) {
 				// If seq is present in free list it mean it was deleted but not get released from the WAL.
 				continue
 			}
-			if e.seq > db.internal.upperSeq {
-				db.internal.upperSeq = e.seq
-			}
 			s := slot{
 				seq:       e.seq,
 				topicSize: e.topicSize,
@@ -93,25 +124,38 @@ func (db *syncHandle) startRecovery() error {
 
 				cacheBlock: logData[entrySize:],
 			}
+			var t *message.Topic
+			if _, ok := topics[e.topicHash]; !ok && e.topicSize != 0 {
+				rawtopic, _ := db.dataWriter.readTopic(s)
+
+				t = new(message.Topic)
+				if err := t.Unmarshal(rawtopic); err != nil {
+					if err := db.skipEntry(e.seq, err); err != nil {
+						return true, err
+					}
+					continue
+				}
+			}
+			if e.seq > db.internal.upperSeq {
+				db.internal.upperSeq = e.seq
+			}
 			if s.msgOffset, err = db.dataWriter.append(s.cacheBlock); err != nil {
 				return true, err
 			}
 			exists, err := db.blockWriter.append(s, db.startBlockIdx)
 			if err != nil {
-				return true, err
+				if err := db.skipEntry(e.seq, err); err != nil {
+					return true, err
+				}
+				db.freeList.freeBlock(s.msgOffset, s.mSize())
+				continue
 			}
 			if exists {
 				db.freeList.free(s.seq, s.msgOffset, s.mSize())
 				continue
 			}
-			if _, ok := topics[e.topicHash]; !ok && e.topicSize != 0 {
-				rawtopic, _ := db.dataWriter.readTopic(s)
-
-				t := new(message.Topic)
-				if err := t.Unmarshal(rawtopic); err != nil {
-					return true, err
-				}
-				db.trie.add(newTopic(e.topicHash, 0), t.Parts, t.Depth)
+			if t != nil {
+				db.trie.add(newTopic(e.topicHash, 0, t.Topic), t.Parts, t.Depth)
 				topics[e.topicHash] = t
 			}
 			if _, ok := winEntries[e.topicHash]; ok {
@@ -152,12 +196,32 @@ func (db *syncHandle) startRecovery() error {
 		return err
 	}
 
+	for h, wEntries := range pendingEntries {
+		if _, ok := db.trie.getOffset(h); ok {
+			continue
+		}
+		// topic of the entries was not recovered.
+		for _, we := range wEntries {
+			if err := db.skipEntry(we.seq(), fmt.Errorf("recovery: topic %d not found: %w", h, errEntryInvalid)); err != nil {
+				return err
+			}
+		}
+		delete(pendingEntries, h)
+	}
 	if err := db.recoverWindowBlocks(pendingEntries); err != nil {
 		logger.Error().Err(err).Str("context", "db.recoverWindowBlocks")
 		return err
 	}
 
-	return db.sync(true)
+	if err := db.sync(true); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := db.applyLogRecord(rec); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (db *DB) recoverLog() error {
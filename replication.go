@@ -0,0 +1,185 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// WALRecord is a committed log record shipped to a replica.
+type WALRecord struct {
+	LogID int64  // The ID of the log holding the record.
+	Seq   uint64 // The sequence of the entry.
+	Data  []byte // The packed entry as written to the log.
+}
+
+// WALReader streams committed log records for replication. Logs are not
+// reclaimed by the DB until the replica acknowledges them using Ack.
+type WALReader struct {
+	db    *DB
+	acked int64
+}
+
+// WALReader returns a reader to stream committed log records. Only one reader
+// can be open at a time and the reader must be closed when replication stops.
+func (db *DB) WALReader() (*WALReader, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	if !atomic.CompareAndSwapUint32(&db.walReader, 0, 1) {
+		return nil, errWALReaderOpen
+	}
+	db.wal.Retain(0)
+	return &WALReader{db: db}, nil
+}
+
+// Read calls f for each record of the logs newer than the given log ID, in log order.
+// Pass zero to read from the oldest log not yet reclaimed.
+func (r *WALReader) Read(from int64, f func(rec WALRecord) (bool, error)) error {
+	if err := r.db.ok(); err != nil {
+		return err
+	}
+	var e entry
+	return r.db.wal.Scan(from, func(logID int64, records [][]byte) (bool, error) {
+		for _, data := range records {
+			if len(data) < entrySize+idSize {
+				return true, ErrCorrupted
+			}
+			if err := e.UnmarshalBinary(data[:entrySize]); err != nil {
+				return true, err
+			}
+			rec := WALRecord{LogID: logID, Seq: e.seq, Data: make([]byte, len(data))}
+			copy(rec.Data, data)
+			if stop, err := f(rec); stop || err != nil {
+				return true, err
+			}
+		}
+		return false, nil
+	})
+}
+
+// Ack acknowledges that the replica has applied logs up to the given log ID,
+// so the DB can reclaim them.
+func (r *WALReader) Ack(logID int64) error {
+	if err := r.db.ok(); err != nil {
+		return err
+	}
+	if logID <= r.acked {
+		return nil
+	}
+	r.acked = logID
+	r.db.wal.Retain(logID)
+	return nil
+}
+
+// Close closes the reader and lets the DB reclaim logs not yet acknowledged.
+func (r *WALReader) Close() error {
+	if r.db == nil {
+		return nil
+	}
+	r.db.wal.StopRetain()
+	atomic.StoreUint32(&r.db.walReader, 0)
+	r.db = nil
+	return nil
+}
+
+// ApplyWAL applies records read from the WAL of a primary DB. Entries keep
+// their sequence so message IDs match the primary. The standby DB must use
+// the same encryption key as the primary.
+func (db *DB) ApplyWAL(records []WALRecord) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if err := db.waitMem(); err != nil {
+		return err
+	}
+
+	// Delete and update records are applied after the entries, sync writes index and window blocks so it is blocked.
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+
+	var e entry
+	var logRecords [][]byte
+	for _, rec := range records {
+		if len(rec.Data) < entrySize+idSize {
+			return fmt.Errorf("db.ApplyWAL: record size %d: %w", len(rec.Data), ErrBadRequest)
+		}
+		if err := e.UnmarshalBinary(rec.Data[:entrySize]); err != nil {
+			return err
+		}
+		if e.seq == 0 || e.seq != rec.Seq || len(rec.Data) != int(entrySize+idSize+uint32(e.topicSize)+e.valueSize) {
+			return fmt.Errorf("db.ApplyWAL: record seq %d: %w", rec.Seq, ErrBadRequest)
+		}
+		if rec.Data[entrySize+idSize-1]&logRecordFlags != 0 {
+			logRecords = append(logRecords, rec.Data)
+			// external ID records are kept with the entries, so recovery of the standby maps the external IDs.
+			if rec.Data[entrySize+idSize-1]&flagExternalID != 0 {
+				db.tinyBatch.records = append(db.tinyBatch.records, append([]byte(nil), rec.Data...))
+			}
+			continue
+		}
+		if e.topicSize != 0 {
+			t := new(message.Topic)
+			if err := t.Unmarshal(rec.Data[entrySize+idSize : entrySize+idSize+uint32(e.topicSize)]); err != nil {
+				return err
+			}
+			db.trie.add(newTopic(e.topicHash, 0, t.Topic), t.Parts, t.Depth)
+		} else if _, ok := db.trie.getOffset(e.topicHash); !ok {
+			return fmt.Errorf("db.ApplyWAL: record seq %d topic not found: %w", rec.Seq, ErrBadRequest)
+		}
+		// Move the sequence past the replicated entry so new entries do not reuse it.
+		for {
+			seq := db.seq()
+			if e.seq <= seq || atomic.CompareAndSwapUint64(&db.sequence, seq, e.seq) {
+				break
+			}
+		}
+
+		if err := db.unwarm(e.seq); err != nil {
+			return err
+		}
+		// mapping of a reused sequence is removed, the external ID of the entry is mapped by its log record.
+		if err := db.setExternalID(db.tinyBatch, &Entry{entry: entry{seq: e.seq, cache: rec.Data}}); err != nil {
+			return err
+		}
+		data := make([]byte, len(rec.Data))
+		copy(data, rec.Data)
+		if err := db.mem.Set(uint64(startBlockIndex(e.seq)), db.cacheID^e.seq, data); err != nil {
+			return err
+		}
+		if ok := db.timeWindow.add(db.tinyBatch.timeID(), e.topicHash, newWinEntry(e.seq, e.expiresAt)); !ok {
+			return errForbidden
+		}
+		db.tinyBatch.entries = append(db.tinyBatch.entries, e.seq)
+		db.tinyBatch.incount()
+	}
+	for _, rec := range logRecords {
+		if err := db.applyLogRecord(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
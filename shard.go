@@ -0,0 +1,163 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/unit-io/unitdb/fs"
+	"github.com/unit-io/unitdb/hash"
+	"github.com/unit-io/unitdb/message"
+)
+
+// shardRing routes contracts to shards using consistent hashing, so only the contracts
+// of an added or removed shard move. All routers must apply shard changes in the same order.
+// Removed shards are persisted to the shard file in order of removal, so the ring is rebuilt
+// on open and contracts are routed to the same shards across restarts.
+type shardRing struct {
+	mu         sync.RWMutex
+	fs         fs.FileSystem
+	path       string
+	max        int
+	consistent *hash.Consistent
+}
+
+// shardState is the state of the shard ring persisted to the shard file as JSON.
+type shardState struct {
+	Max     int      `json:"max"`
+	Removed []uint16 `json:"removed"` // Removed holds the removed shards in order of removal.
+}
+
+// newShardRing returns a ring of max shards with n working shards. The ring persisted to the
+// shard file is used if it has the same capacity.
+func newShardRing(fsys fs.FileSystem, path string, n, max int) (*shardRing, error) {
+	r := &shardRing{fs: fsys, path: path, max: max}
+	removed := make([]uint16, 0, max-n)
+	for b := max - 1; b >= n; b-- {
+		removed = append(removed, uint16(b))
+	}
+	state, ok, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	if ok && state.Max == max {
+		removed = state.Removed
+	}
+	if len(removed) >= max {
+		return nil, fmt.Errorf("newShardRing: %d of %d shards removed: %w", len(removed), max, ErrCorrupted)
+	}
+	// The ring is built with all shards working and the shards are removed in order, as the
+	// ring state of shards that start out removed is not set, so they could not be added back.
+	r.consistent = hash.InitConsistent(max, max)
+	for _, b := range removed {
+		if int(b) >= max {
+			return nil, fmt.Errorf("newShardRing: shard %d: %w", b, ErrCorrupted)
+		}
+		r.consistent.RemoveBlock(b)
+	}
+	return r, nil
+}
+
+// read reads the ring state from the shard file, it returns false if the file does not exist.
+func (r *shardRing) read() (shardState, bool, error) {
+	var state shardState
+	if _, err := r.fs.Stat(r.path); err != nil {
+		if os.IsNotExist(err) {
+			return state, false, nil
+		}
+		return state, false, err
+	}
+	f, err := newFile(r.fs, r.path)
+	if err != nil {
+		return state, false, err
+	}
+	defer f.Close()
+	buf := make([]byte, f.currSize())
+	if len(buf) == 0 {
+		return state, false, nil
+	}
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return state, false, err
+	}
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return state, false, fmt.Errorf("shardRing.read: %v: %w", err, ErrCorrupted)
+	}
+	return state, true, nil
+}
+
+// write replaces the shard file with the ring state. The caller must hold the ring lock.
+func (r *shardRing) write() error {
+	data, err := json.Marshal(shardState{Max: r.max, Removed: r.consistent.R})
+	if err != nil {
+		return err
+	}
+	return replaceFile(r.fs, r.path, data)
+}
+
+// ShardFor returns the shard the contract maps to.
+func (db *DB) ShardFor(contract uint32) int {
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	db.shards.mu.RLock()
+	defer db.shards.mu.RUnlock()
+	return int(db.shards.consistent.FindBlock(uint64(contract)))
+}
+
+// Shards returns number of working shards.
+func (db *DB) Shards() int {
+	db.shards.mu.RLock()
+	defer db.shards.mu.RUnlock()
+	return int(db.shards.consistent.N)
+}
+
+// AddShard adds a shard to the ring and returns it. Shards removed earlier are added back in reverse order of removal.
+// The ring change is persisted, so it is kept on reopen.
+func (db *DB) AddShard() (int, error) {
+	db.shards.mu.Lock()
+	defer db.shards.mu.Unlock()
+	c := db.shards.consistent
+	if len(c.R) == 0 {
+		return 0, fmt.Errorf("db.AddShard: %w", errShardCapacity)
+	}
+	b := c.AddBlock()
+	if err := db.shards.write(); err != nil {
+		c.RemoveBlock(b)
+		return 0, err
+	}
+	return int(b), nil
+}
+
+// RemoveShard removes a working shard from the ring, its contracts move to the remaining shards.
+// The ring change is persisted, so it is kept on reopen.
+func (db *DB) RemoveShard(shard int) error {
+	db.shards.mu.Lock()
+	defer db.shards.mu.Unlock()
+	c := db.shards.consistent
+	if shard < 0 || shard >= len(c.A) || c.A[shard] != 0 || c.N == 1 {
+		return fmt.Errorf("db.RemoveShard: shard %d: %w", shard, errShardInvalid)
+	}
+	c.RemoveBlock(uint16(shard))
+	if err := db.shards.write(); err != nil {
+		c.AddBlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// slowQueryBufferSize is the number of slow queries buffered before queries are dropped.
+const slowQueryBufferSize = 1024
+
+// slowQuery is a query written to the slow query log.
+type slowQuery struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Topic       string    `json:"topic"`
+	Contract    uint32    `json:"contract"`
+	Limit       int       `json:"limit"`
+	ResultCount int       `json:"result_count"`
+	DurationMs  float64   `json:"duration_ms"`
+}
+
+// slowQueryLog records queries slower than the threshold.
+type slowQueryLog struct {
+	mu        sync.RWMutex
+	threshold time.Duration
+	queryC    chan slowQuery
+	stopC     chan struct{}
+}
+
+// SlowQueryLog writes Get and Items queries slower than the threshold as JSON lines to the sink.
+// Queries are written to the sink in the background and dropped if the sink cannot keep up.
+// Setting threshold to zero or sink to nil disables the slow query log.
+func (db *DB) SlowQueryLog(threshold time.Duration, sink io.Writer) {
+	l := &db.slowQueryLog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopC != nil {
+		close(l.stopC)
+		l.stopC = nil
+	}
+	l.threshold = 0
+	if threshold <= 0 || sink == nil {
+		return
+	}
+	l.threshold = threshold
+	l.queryC = make(chan slowQuery, slowQueryBufferSize)
+	l.stopC = make(chan struct{})
+	go db.slowQueryLoop(sink, l.queryC, l.stopC)
+}
+
+// logSlowQuery records the query if it is slower than the slow query log threshold.
+func (db *DB) logSlowQuery(q *Query, start time.Time, count int) {
+	l := &db.slowQueryLog
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.threshold == 0 {
+		return
+	}
+	dur := time.Since(start)
+	if dur <= l.threshold {
+		return
+	}
+	select {
+	case l.queryC <- slowQuery{Timestamp: start, Topic: string(q.Topic), Contract: q.Contract, Limit: q.Limit, ResultCount: count, DurationMs: float64(dur) / float64(time.Millisecond)}:
+	default:
+		// drop the query so the query is not blocked by a slow sink.
+	}
+}
+
+// slowQueryLoop writes slow queries to the sink.
+func (db *DB) slowQueryLoop(sink io.Writer, queryC <-chan slowQuery, stopC <-chan struct{}) {
+	db.closeW.Add(1)
+	defer db.closeW.Done()
+	enc := json.NewEncoder(sink)
+	for {
+		select {
+		case <-db.closeC:
+			return
+		case <-stopC:
+			return
+		case q := <-queryC:
+			if err := enc.Encode(q); err != nil {
+				logger.Error().Err(err).Str("context", "db.slowQueryLoop")
+			}
+		}
+	}
+}
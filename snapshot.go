@@ -0,0 +1,212 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Snapshot is a read handle of the DB that returns only entries with sequence up to the DB sequence
+// when the snapshot is taken, so reads through the snapshot are repeatable while writes continue.
+// Entries deleted after the snapshot is taken are still returned by the snapshot, entries expired
+// after the snapshot is taken are not.
+type Snapshot struct {
+	db      *DB
+	seq     uint64
+	gen     uint64
+	pending map[uint64]struct{} // pending holds sequences of batch entries not yet written when the snapshot is taken.
+	closed  uint32
+}
+
+// snapshotChanges holds changes to entries with sequence below the DB sequence made while snapshots are open.
+// Deleted entries are hidden from reads other than the snapshots taken before the delete, and are deleted
+// once the last snapshot is closed.
+type snapshotChanges struct {
+	sync.RWMutex
+	gen     uint64            // gen is incremented for each snapshot taken.
+	deletes map[uint64]uint64 // deletes maps sequence of the deleted entry to generation of the delete.
+	writes  map[uint64]uint64 // writes maps sequence of the entry written with an ID to generation of the write.
+}
+
+func newSnapshotChanges() *snapshotChanges {
+	return &snapshotChanges{deletes: make(map[uint64]uint64), writes: make(map[uint64]uint64)}
+}
+
+func (sc *snapshotChanges) next() uint64 {
+	sc.Lock()
+	defer sc.Unlock()
+	sc.gen++
+	return sc.gen
+}
+
+func (sc *snapshotChanges) delete(seq uint64) {
+	sc.Lock()
+	defer sc.Unlock()
+	if _, ok := sc.deletes[seq]; !ok {
+		sc.deletes[seq] = sc.gen
+	}
+}
+
+func (sc *snapshotChanges) write(seq uint64) {
+	sc.Lock()
+	defer sc.Unlock()
+	sc.writes[seq] = sc.gen
+}
+
+// deleted reports whether the entry of the sequence is deleted while snapshots are open.
+func (sc *snapshotChanges) deleted(seq uint64) bool {
+	sc.RLock()
+	defer sc.RUnlock()
+	_, ok := sc.deletes[seq]
+	return ok
+}
+
+// deletedAfter reports whether the entry of the sequence is deleted after the snapshot of the generation is taken.
+func (sc *snapshotChanges) deletedAfter(seq, gen uint64) bool {
+	sc.RLock()
+	defer sc.RUnlock()
+	g, ok := sc.deletes[seq]
+	return ok && g >= gen
+}
+
+// writtenAfter reports whether the entry of the sequence is written after the snapshot of the generation is taken.
+func (sc *snapshotChanges) writtenAfter(seq, gen uint64) bool {
+	sc.RLock()
+	defer sc.RUnlock()
+	g, ok := sc.writes[seq]
+	return ok && g >= gen
+}
+
+// reset clears the changes and returns sequences of the deleted entries.
+func (sc *snapshotChanges) reset() []uint64 {
+	sc.Lock()
+	defer sc.Unlock()
+	seqs := make([]uint64, 0, len(sc.deletes))
+	for seq := range sc.deletes {
+		seqs = append(seqs, seq)
+	}
+	sc.deletes = make(map[uint64]uint64)
+	sc.writes = make(map[uint64]uint64)
+	return seqs
+}
+
+// Snapshot returns a new Snapshot of the DB. Free sequences are not reused and deleted entries are kept
+// while a snapshot is open, so the snapshot must be released using Close.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	// Sequences are assigned under the tiny batch lock, so the sequence and the pending batch
+	// sequences are taken together.
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+	atomic.AddInt32(&db.snapshots, 1)
+	s := &Snapshot{db: db, seq: db.seq(), gen: db.snapshotChanges.next()}
+	s.pending = db.batchSeqs.below(s.seq)
+	return s, nil
+}
+
+// Seq returns sequence of the snapshot, entries with higher sequence are not returned by the snapshot.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Get returns items of the query as DB.Get does, excluding entries written after the snapshot is taken.
+// The query is not modified.
+func (s *Snapshot) Get(q *Query) ([][]byte, error) {
+	if err := s.ok(); err != nil {
+		return nil, err
+	}
+	q = q.clone()
+	q.snapshot = s
+	return s.db.Get(q)
+}
+
+// Items returns a new ItemIterator as DB.Items does, excluding entries written after the snapshot is taken.
+// The query is not modified.
+func (s *Snapshot) Items(q *Query) (*ItemIterator, error) {
+	if err := s.ok(); err != nil {
+		return nil, err
+	}
+	q = q.clone()
+	q.snapshot = s
+	return s.db.Items(q)
+}
+
+// Close releases the snapshot. Entries deleted while snapshots are open are deleted once the last snapshot is closed.
+func (s *Snapshot) Close() error {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return errSnapshotClosed
+	}
+	if atomic.AddInt32(&s.db.snapshots, -1) != 0 || s.db.ok() != nil {
+		return nil
+	}
+	return s.db.releaseSnapshotChanges()
+}
+
+// excludes reports whether the entry of the sequence is not returned by the snapshot.
+func (s *Snapshot) excludes(seq uint64) bool {
+	if seq > s.seq {
+		return true
+	}
+	if _, ok := s.pending[seq]; ok {
+		return true
+	}
+	return s.db.snapshotChanges.writtenAfter(seq, s.gen)
+}
+
+func (s *Snapshot) ok() error {
+	if atomic.LoadUint32(&s.closed) == 1 {
+		return errSnapshotClosed
+	}
+	return s.db.ok()
+}
+
+// releaseSnapshotChanges deletes the entries deleted while snapshots were open, if no snapshot is open.
+func (db *DB) releaseSnapshotChanges() error {
+	db.syncLockC <- struct{}{}
+	defer func() {
+		<-db.syncLockC
+	}()
+	db.lockTinyBatch()
+	defer func() {
+		<-db.tinyBatchLockC
+	}()
+	if atomic.LoadInt32(&db.snapshots) > 0 {
+		return nil
+	}
+	for _, seq := range db.snapshotChanges.reset() {
+		s, err := db.readSlot(0, seq)
+		if err != nil {
+			if errors.Is(err, errMsgIDDeleted) {
+				continue // entry is already deleted.
+			}
+			if !errors.Is(err, io.EOF) && !errors.Is(err, ErrMsgIDDoesNotExist) {
+				return err
+			}
+		}
+		if err := db.deleteSlot(0, s, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// subscriberRecordSize is size of the subscriber state record without the name and the topic, a record is
+// 4 byte contract, 8 byte sequence, 4 byte name size, 4 byte topic size, the name and the topic.
+const subscriberRecordSize = 20
+
+// subscriberKey identifies a topic checkpoint of a subscriber in the subscriber state file.
+type subscriberKey struct {
+	name     string
+	contract uint32
+	topic    string
+}
+
+// Subscriber polls new entries of its topics and keeps the last polled sequence of each topic.
+// Entries polled after the last Commit are delivered again by a new subscriber of the same name.
+type Subscriber struct {
+	db       *DB
+	mu       sync.Mutex
+	name     string
+	topics   [][]byte
+	contract uint32
+	lastSeq  []uint64 // lastSeq is the last polled sequence of each topic.
+	next     int      // next is the topic polled first, so that a busy topic does not starve the others.
+	closed   uint32
+}
+
+// NewSubscriber returns a subscriber of the topics for the contract. Its checkpoints are loaded from
+// the subscriber state file of the DB. Free sequences are not reused by the DB until the subscriber
+// is closed, so entries written while it is open are polled in order of sequence.
+func (db *DB) NewSubscriber(topics [][]byte, contract uint32) *Subscriber {
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	atomic.AddInt32(&db.subscribers, 1)
+	s := &Subscriber{db: db, topics: topics, contract: contract, lastSeq: make([]uint64, len(topics))}
+	s.load()
+	return s
+}
+
+// WithName sets name of the subscriber and loads its checkpoints. Subscribers of different names keep
+// separate checkpoints of the same topics.
+func (s *Subscriber) WithName(name string) *Subscriber {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+	s.load()
+	return s
+}
+
+// load loads checkpoints of the subscriber from the subscriber state file. The caller must hold s.mu
+// unless the subscriber is not yet returned.
+func (s *Subscriber) load() {
+	s.db.subscriberStateMu.Lock()
+	defer s.db.subscriberStateMu.Unlock()
+	state, err := s.db.readSubscriberState()
+	if err != nil {
+		logger.Error().Err(err).Str("context", "Subscriber.load")
+	}
+	for i, topic := range s.topics {
+		s.lastSeq[i] = state[subscriberKey{name: s.name, contract: s.contract, topic: string(topic)}]
+	}
+}
+
+// Close releases the subscriber, checkpoints not committed are lost. Free sequences are reused again once
+// the last subscriber is closed, an entry written with a reused sequence at or below a checkpoint is not
+// polled by subscribers of the checkpoint.
+func (s *Subscriber) Close() error {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return errSubscriberClosed
+	}
+	atomic.AddInt32(&s.db.subscribers, -1)
+	return nil
+}
+
+// Poll returns up to maxEntries entries of the subscribed topics written since the last Poll.
+// Checkpoints are not moved if it returns an error.
+func (s *Subscriber) Poll(ctx context.Context, maxEntries int) ([]*Entry, error) {
+	if atomic.LoadUint32(&s.closed) == 1 {
+		return nil, errSubscriberClosed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.topics) == 0 {
+		return nil, nil
+	}
+	if maxEntries <= 0 {
+		maxEntries = s.db.opts.defaultQueryLimit
+	}
+	seqs := append([]uint64(nil), s.lastSeq...)
+	var entries []*Entry
+	for n := 0; n < len(s.topics) && len(entries) < maxEntries; n++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		i := (s.next + n) % len(s.topics)
+		items, err := s.db.entriesAfterSeq(s.topics[i], s.contract, seqs[i], maxEntries-len(entries))
+		if err != nil {
+			return nil, err
+		}
+		if len(items) > 0 {
+			seqs[i] = message.ID(items[len(items)-1].ID).Sequence()
+		}
+		entries = append(entries, items...)
+	}
+	s.lastSeq = seqs
+	s.next = (s.next + 1) % len(s.topics)
+	return entries, nil
+}
+
+// Commit persists checkpoints of the subscribed topics to the subscriber state file.
+func (s *Subscriber) Commit() error {
+	if err := s.db.ok(); err != nil {
+		return err
+	}
+	if atomic.LoadUint32(&s.closed) == 1 {
+		return errSubscriberClosed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db.subscriberStateMu.Lock()
+	defer s.db.subscriberStateMu.Unlock()
+	state, err := s.db.readSubscriberState()
+	if err != nil {
+		return err
+	}
+	for i, topic := range s.topics {
+		state[subscriberKey{name: s.name, contract: s.contract, topic: string(topic)}] = s.lastSeq[i]
+	}
+	return s.db.writeSubscriberState(state)
+}
+
+// Reset resets checkpoint of the topic so the next Poll returns the topic entries from the start.
+// The checkpoint is persisted on Commit.
+func (s *Subscriber) Reset(topic []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.topics {
+		if bytes.Equal(t, topic) {
+			s.lastSeq[i] = 0
+			return nil
+		}
+	}
+	return fmt.Errorf("Subscriber.Reset: topic %q is not subscribed: %w", topic, ErrBadRequest)
+}
+
+// readSubscriberState reads checkpoints from the subscriber state file. The caller must hold subscriberStateMu.
+func (db *DB) readSubscriberState() (map[subscriberKey]uint64, error) {
+	state := make(map[subscriberKey]uint64)
+	path := db.path + subscriberPostfix
+	if _, err := db.opts.fileSystem.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	f, err := newFile(db.opts.fileSystem, path)
+	if err != nil {
+		return state, err
+	}
+	defer f.Close()
+	buf := make([]byte, f.currSize())
+	if len(buf) == 0 {
+		return state, nil
+	}
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return state, err
+	}
+	for off := 0; off < len(buf); {
+		if len(buf)-off < subscriberRecordSize {
+			return state, fmt.Errorf("db.readSubscriberState: truncated record at %d: %w", off, ErrCorrupted)
+		}
+		k := subscriberKey{contract: binary.LittleEndian.Uint32(buf[off : off+4])}
+		seq := binary.LittleEndian.Uint64(buf[off+4 : off+12])
+		nameSize := int(binary.LittleEndian.Uint32(buf[off+12 : off+16]))
+		topicSize := int(binary.LittleEndian.Uint32(buf[off+16 : off+subscriberRecordSize]))
+		off += subscriberRecordSize
+		if len(buf)-off < nameSize+topicSize {
+			return state, fmt.Errorf("db.readSubscriberState: truncated name and topic at %d: %w", off, ErrCorrupted)
+		}
+		k.name = string(buf[off : off+nameSize])
+		k.topic = string(buf[off+nameSize : off+nameSize+topicSize])
+		state[k] = seq
+		off += nameSize + topicSize
+	}
+	return state, nil
+}
+
+// writeSubscriberState replaces the subscriber state file with the checkpoints, a crash keeps the previous checkpoints.
+// The caller must hold subscriberStateMu.
+func (db *DB) writeSubscriberState(state map[subscriberKey]uint64) error {
+	var buf []byte
+	for k, seq := range state {
+		var rec [subscriberRecordSize]byte
+		binary.LittleEndian.PutUint32(rec[0:4], k.contract)
+		binary.LittleEndian.PutUint64(rec[4:12], seq)
+		binary.LittleEndian.PutUint32(rec[12:16], uint32(len(k.name)))
+		binary.LittleEndian.PutUint32(rec[16:subscriberRecordSize], uint32(len(k.topic)))
+		buf = append(append(append(buf, rec[:]...), k.name...), k.topic...)
+	}
+	return replaceFile(db.opts.fileSystem, db.path+subscriberPostfix, buf)
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// subscriptionBufferSize is number of entries buffered by a subscription before new entries are dropped.
+const subscriptionBufferSize = 1 << 8
+
+// Subscription receives entries put to the topics matching its pattern. Entries put while the
+// subscription buffer is full are dropped, use Lag and Dropped to detect a subscription falling behind.
+type Subscription struct {
+	db        *DB
+	w         *watcher
+	entries   chan *Entry
+	delivered uint64
+	stopC     chan struct{}
+	stopOnce  sync.Once
+}
+
+// Subscribe returns a new Subscription for entries put to the topics of the contract matching the pattern
+// using Put or PutEntry. The pattern may contain wildcards.
+// Entries are received once they are committed. The subscription is stopped when the DB is closed.
+func (db *DB) Subscribe(pattern []byte, contract uint32) (*Subscription, error) {
+	w, err := db.watch(pattern, contract)
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{
+		db:      db,
+		w:       w,
+		entries: make(chan *Entry),
+		stopC:   make(chan struct{}),
+	}
+	go s.forward()
+	return s, nil
+}
+
+// watch adds a watcher for the topics of the contract matching the pattern. The pattern is added to a
+// topic trie of the watcher and the parts of the entry topic are looked up in it, so the pattern matches
+// topics as a wildcard topic of the DB does.
+func (db *DB) watch(pattern []byte, contract uint32) (*watcher, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(pattern) == 0:
+		return nil, errTopicEmpty
+	case len(pattern) > db.opts.maxTopicSize:
+		return nil, ErrTopicTooLarge
+	}
+	if contract == 0 {
+		contract = message.MasterContract
+	}
+	t, _, err := db.parseTopic(contract, pattern)
+	if err != nil {
+		return nil, err
+	}
+	t.AddContract(contract)
+	pt := newTrie()
+	pt.add(newTopic(t.GetHash(contract), 0, nil), t.Parts, t.Depth)
+	match := func(topicHash uint64) bool {
+		parts, depth, ok := db.trie.parts(topicHash)
+		if !ok {
+			return false
+		}
+		return len(pt.lookup(parts, depth, message.TopicStatic)) != 0
+	}
+	return db.watchers.addPattern(match, subscriptionBufferSize), nil
+}
+
+// forward forwards new entries from the watcher to the subscription until the subscription is stopped.
+func (s *Subscription) forward() {
+	defer close(s.entries)
+	for e := range s.w.ch {
+		select {
+		case s.entries <- e:
+			atomic.AddUint64(&s.delivered, 1)
+		case <-s.stopC:
+			return
+		}
+	}
+}
+
+// Entries returns the channel of the subscription entries. The channel is closed when the subscription
+// is stopped or the DB is closed.
+func (s *Subscription) Entries() <-chan *Entry {
+	return s.entries
+}
+
+// Lag returns number of entries matched by the subscription that are buffered and not yet received.
+func (s *Subscription) Lag() uint64 {
+	sent, delivered := atomic.LoadUint64(&s.w.sent), atomic.LoadUint64(&s.delivered)
+	if sent <= delivered {
+		return 0
+	}
+	return sent - delivered
+}
+
+// Dropped returns number of entries matched by the subscription that are dropped as the subscription buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.w.dropped)
+}
+
+// Stop stops the subscription.
+func (s *Subscription) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopC)
+		s.w.cancel()
+	})
+}
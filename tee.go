@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/unit-io/unitdb/message"
+)
+
+// MultiError holds the errors of the DB instances written by a TeeWriter.
+type MultiError struct {
+	Errors []error
+}
+
+// Error returns the errors joined by semicolons.
+func (m *MultiError) Error() string {
+	msgs := make([]string, len(m.Errors))
+	for i, err := range m.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred: %s", len(m.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors so they can be matched by errors.Is and errors.As.
+func (m *MultiError) Unwrap() []error {
+	return m.Errors
+}
+
+// TeeWriter mirrors writes of the primary DB to the sink DBs.
+type TeeWriter struct {
+	primary *DB
+	sinks   []*DB
+	missed  []uint64 // missed is number of entries written to the primary but not to each sink.
+}
+
+// NewTeeWriter returns a writer that mirrors entries written to the DB to the sinks.
+func (db *DB) NewTeeWriter(sinks ...*DB) *TeeWriter {
+	return &TeeWriter{primary: db, sinks: sinks, missed: make([]uint64, len(sinks))}
+}
+
+// PutEntry puts the entry to the primary and sink DBs concurrently. An entry without an ID is assigned
+// an ID of the primary, and the sinks write the entry at the sequence of the ID, so the entry has the
+// same ID in each DB. It returns a MultiError holding the error of each DB the entry could not be written to.
+func (w *TeeWriter) PutEntry(e *Entry) error {
+	id := e.ID
+	if id == nil {
+		id = w.primary.NewID()
+	}
+	seq := message.ID(id).Sequence()
+	// each DB writes its own copy, as PutEntry sets and resets fields of the entry.
+	entries := make([]*Entry, len(w.sinks)+1)
+	for i := range entries {
+		entries[i] = &Entry{
+			ID:         append([]byte(nil), id...),
+			Topic:      append([]byte(nil), e.Topic...),
+			Payload:    append([]byte(nil), e.Payload...),
+			ExpiresAt:  e.ExpiresAt,
+			Contract:   e.Contract,
+			Encryption: e.Encryption,
+			DedupKey:   append([]byte(nil), e.DedupKey...),
+			ExternalID: append([]byte(nil), e.ExternalID...),
+		}
+	}
+	errs := make([]error, len(w.sinks)+1)
+	var wg sync.WaitGroup
+	wg.Add(len(w.sinks) + 1)
+	go func() {
+		defer wg.Done()
+		if err := w.primary.PutEntry(entries[0]); err != nil {
+			errs[0] = fmt.Errorf("TeeWriter.PutEntry: primary: %w", err)
+		}
+	}()
+	for i, sink := range w.sinks {
+		go func(i int, sink *DB) {
+			defer wg.Done()
+			if err := sink.PutEntryAtSeq(seq, entries[i+1]); err != nil {
+				errs[i+1] = fmt.Errorf("TeeWriter.PutEntry: sink %s: %w", sink.path, err)
+			}
+		}(i, sink)
+	}
+	wg.Wait()
+	if errs[0] == nil {
+		for i := range w.sinks {
+			if errs[i+1] != nil {
+				atomic.AddUint64(&w.missed[i], 1)
+			}
+		}
+	}
+	return multiError(errs)
+}
+
+// Close closes the primary and sink DBs.
+func (w *TeeWriter) Close() error {
+	errs := make([]error, 0, len(w.sinks)+1)
+	if err := w.primary.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("TeeWriter.Close: primary: %w", err))
+	}
+	for _, sink := range w.sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("TeeWriter.Close: sink %s: %w", sink.path, err))
+		}
+	}
+	return multiError(errs)
+}
+
+// Lag returns number of entries written to the primary by the writer that could not be written to each sink,
+// keyed by the sink path.
+func (w *TeeWriter) Lag() map[string]uint64 {
+	lag := make(map[string]uint64, len(w.sinks))
+	for i, sink := range w.sinks {
+		lag[sink.path] = atomic.LoadUint64(&w.missed[i])
+	}
+	return lag
+}
+
+// multiError returns a MultiError of the non nil errors, or nil if there are none.
+func multiError(errs []error) error {
+	var m MultiError
+	for _, err := range errs {
+		if err != nil {
+			m.Errors = append(m.Errors, err)
+		}
+	}
+	if len(m.Errors) == 0 {
+		return nil
+	}
+	return &m
+}
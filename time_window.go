@@ -24,6 +24,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/unit-io/unitdb/fs"
 	"github.com/unit-io/unitdb/hash"
 )
 
@@ -31,6 +32,13 @@ type (
 	winEntry struct {
 		sequence  uint64
 		expiresAt uint32
+
+		timestamp int64 // timestamp is time of the message ID, it sets window block cutoff and is not persisted.
+	}
+	// expiryEntry is a window entry added to the expiry window with hash of its topic.
+	expiryEntry struct {
+		winEntry
+		topicHash uint64
 	}
 	winBlock struct {
 		topicHash  uint64
@@ -39,8 +47,9 @@ type (
 		cutoffTime int64
 		entryIdx   uint16
 
-		dirty  bool // dirty used during timeWindow append and not persisted.
-		leased bool // leased used in timeWindow write and not persisted.
+		dirty  bool  // dirty used during timeWindow append and not persisted.
+		leased bool  // leased used in timeWindow write and not persisted.
+		latest int64 // latest is the latest timestamp of entries appended to the block and not persisted.
 	}
 )
 
@@ -56,8 +65,8 @@ func (e winEntry) expiryTime() uint32 {
 	return e.expiresAt
 }
 
-func (e winEntry) isExpired() bool {
-	return e.expiresAt != 0 && e.expiresAt <= uint32(time.Now().Unix())
+func (e winEntry) isExpired(now uint32) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now
 }
 
 func (w winBlock) cutoff(cutoff int64) bool {
@@ -120,6 +129,11 @@ type (
 		expDurationType     time.Duration
 		maxExpDurations     int
 		backgroundKeyExpiry bool
+		clock               Clock
+		nShards             int
+		// winBlockEntries is number of entries a window block is filled with before
+		// a new window block is chained to it.
+		winBlockEntries uint16
 	}
 	timeMark struct {
 		refs      int
@@ -156,11 +170,20 @@ func (src *timeOptions) copyWithDefaults() *timeOptions {
 	if opts.maxExpDurations == 0 {
 		opts.maxExpDurations = 1
 	}
+	if opts.clock == nil {
+		opts.clock = systemClock{}
+	}
+	if opts.nShards == 0 {
+		opts.nShards = nShards
+	}
+	if opts.winBlockEntries == 0 {
+		opts.winBlockEntries = seqsPerWindowBlock
+	}
 	return &opts
 }
 
-func (tm timeMark) isExpired(expDur time.Duration) bool {
-	if tm.lastUnref > 0 && tm.lastUnref+expDur.Nanoseconds() <= int64(time.Now().UTC().Nanosecond()) {
+func (tm timeMark) isExpired(now time.Time, expDur time.Duration) bool {
+	if tm.lastUnref > 0 && tm.lastUnref+expDur.Nanoseconds() <= int64(now.UTC().Nanosecond()) {
 		return true
 	}
 	return false
@@ -188,13 +211,15 @@ type timeWindow struct {
 type windowBlocks struct {
 	sync.RWMutex
 	window     []*timeWindow
+	nShards    int
 	consistent *hash.Consistent
 }
 
 // newWindowBlocks creates a new concurrent windows.
-func newWindowBlocks() *windowBlocks {
+func newWindowBlocks(nShards int) *windowBlocks {
 	wb := &windowBlocks{
 		window:     make([]*timeWindow, nShards),
+		nShards:    nShards,
 		consistent: hash.InitConsistent(nShards, nShards),
 	}
 
@@ -212,12 +237,21 @@ func (w *windowBlocks) getWindowBlock(blockID uint64) *timeWindow {
 	return w.window[w.consistent.FindBlock(blockID)]
 }
 
+// winBlockEntries returns number of entries of a window block for the load factor.
+func winBlockEntries(loadFactor float64) uint16 {
+	n := uint16(loadFactor * seqsPerWindowBlock)
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
 func newTimeWindowBucket(f file, opts *timeOptions) *timeWindowBucket {
 	opts = opts.copyWithDefaults()
 	l := &timeWindowBucket{file: f, timeInfo: timeInfo{windowIdx: -1}, timeRecords: make(map[int64]timeMark), releasedTimeRecords: make(map[int64]timeMark)}
-	l.releaseTimeMark = timeMark{lastUnref: time.Now().UTC().UnixNano()}
-	l.windowBlocks = newWindowBlocks()
-	l.expiryWindowBucket = newExpiryWindowBucket(opts.backgroundKeyExpiry, opts.expDurationType, opts.maxExpDurations)
+	l.releaseTimeMark = timeMark{lastUnref: opts.clock.Now().UTC().UnixNano()}
+	l.windowBlocks = newWindowBlocks(opts.nShards)
+	l.expiryWindowBucket = newExpiryWindowBucket(opts.backgroundKeyExpiry, opts.expDurationType, opts.maxExpDurations, opts.clock)
 	l.opts = opts.copyWithDefaults()
 	return l
 }
@@ -244,11 +278,11 @@ func (tw *timeWindowBucket) add(timeID int64, topicHash uint64, e winEntry) (ok
 // foreachTimeWindow iterates timewindow entries during sync or recovery process when writing entries to window file.
 func (tw *timeWindowBucket) foreachTimeWindow(f func(timeID int64, w windowEntries) (bool, error)) (err error) {
 	tw.Lock()
-	tw.releaseTimeMark = timeMark{lastUnref: time.Now().UTC().UnixNano()}
+	tw.releaseTimeMark = timeMark{lastUnref: tw.opts.clock.Now().UTC().UnixNano()}
 	tw.Unlock()
 
 	var keys []key
-	for i := 0; i < nShards; i++ {
+	for i := 0; i < tw.windowBlocks.nShards; i++ {
 		wb := tw.windowBlocks.window[i]
 		wb.mu.RLock()
 		for k := range wb.entries {
@@ -276,7 +310,7 @@ func (tw *timeWindowBucket) foreachTimeWindow(f func(timeID int64, w windowEntri
 			continue
 		}
 
-		for i := 0; i < nShards; i++ {
+		for i := 0; i < tw.windowBlocks.nShards; i++ {
 			wb := tw.windowBlocks.window[i]
 			wb.mu.Lock()
 			if _, ok := wb.entries[k]; !ok {
@@ -299,7 +333,13 @@ func (tw *timeWindowBucket) foreachTimeWindow(f func(timeID int64, w windowEntri
 }
 
 // foreachWindowBlock iterates winBlocks on DB init to store topic hash and last offset of topic into trie.
+// The start sequence of a topic is read from the first window block of the topic, and the last offset is the
+// window block of the topic that is not linked by another window block.
 func (tw *timeWindowBucket) foreachWindowBlock(f func(startSeq, topicHash uint64, off int64) (bool, error)) (err error) {
+	var topicHashes []uint64
+	startSeqs := make(map[uint64]uint64)
+	offsets := make(map[uint64][]int64)
+	linked := make(map[int64]bool)
 	winBlockIdx := int32(0)
 	nWinBlocks := tw.windowIndex()
 	for winBlockIdx <= nWinBlocks {
@@ -307,23 +347,183 @@ func (tw *timeWindowBucket) foreachWindowBlock(f func(startSeq, topicHash uint64
 		b := windowHandle{file: tw.file, offset: off}
 		if err := b.read(); err != nil {
 			if err == io.EOF {
-				return nil
+				break
 			}
 			return err
 		}
 		winBlockIdx++
-		if b.entryIdx == 0 || b.next != 0 {
+		if b.entryIdx == 0 || b.entryIdx > seqsPerWindowBlock {
+			continue
+		}
+		if b.next != 0 {
+			linked[b.next] = true
+		}
+		if _, ok := offsets[b.topicHash]; !ok {
+			topicHashes = append(topicHashes, b.topicHash)
+		}
+		offsets[b.topicHash] = append(offsets[b.topicHash], off)
+		if b.next != 0 {
+			continue
+		}
+		// the first window entry not deleted is the start sequence of the topic.
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.sequence != 0 {
+				startSeqs[b.topicHash] = we.sequence
+				break
+			}
+		}
+	}
+	for _, topicHash := range topicHashes {
+		startSeq, ok := startSeqs[topicHash]
+		if !ok || startSeq == 0 {
+			continue
+		}
+		var lastOff int64
+		for _, off := range offsets[topicHash] {
+			if !linked[off] && off > lastOff {
+				lastOff = off
+			}
+		}
+		if stop, err := f(startSeq, topicHash, lastOff); stop || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact rewrites the window file at path keeping window blocks that have unexpired entries. Window blocks of a topic are
+// chained in the order of their block index. It returns the offset of the last window block of each topic.
+func (tw *timeWindowBucket) compact(fsys fs.FileSystem, path string) (map[uint64]int64, error) {
+	now := uint32(tw.opts.clock.Now().Unix())
+	var topicHashes []uint64
+	topics := make(map[uint64][]winBlock)
+	nWinBlocks := tw.windowIndex()
+	for winBlockIdx := int32(0); winBlockIdx <= nWinBlocks; winBlockIdx++ {
+		b := windowHandle{file: tw.file, offset: winBlockOffset(winBlockIdx)}
+		if err := b.read(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if b.entryIdx == 0 || b.entryIdx > seqsPerWindowBlock {
+			continue
+		}
+		expired := true
+		for _, we := range b.entries[:b.entryIdx] {
+			if !we.isExpired(now) {
+				expired = false
+				break
+			}
+		}
+		if expired {
+			for _, we := range b.entries[:b.entryIdx] {
+				if err := tw.addExpiry(expiryEntry{winEntry: we, topicHash: b.topicHash}); err != nil {
+					logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
+				}
+			}
+			continue
+		}
+		if _, ok := topics[b.topicHash]; !ok {
+			topicHashes = append(topicHashes, b.topicHash)
+		}
+		topics[b.topicHash] = append(topics[b.topicHash], b.winBlock)
+	}
+
+	// window block 0 is not used as window offset 0 ends the chain of window blocks of a topic.
+	buf := make([]byte, blockSize)
+	offsets := make(map[uint64]int64, len(topics))
+	winBlockIdx := int32(0)
+	for _, topicHash := range topicHashes {
+		var next int64
+		for _, w := range topics[topicHash] {
+			winBlockIdx++
+			w.next = next
+			buf = append(buf, w.MarshalBinary()...)
+			next = winBlockOffset(winBlockIdx)
+		}
+		offsets[topicHash] = next
+	}
+	if winBlockIdx == 0 {
+		buf = buf[:0]
+	}
+	// The window blocks are written to a new file that replaces the window file, so a crash keeps either file.
+	tmpPath := path + compactPostfix
+	f, err := newFile(fsys, tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.write(buf); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := tw.file.Close(); err != nil {
+		return nil, err
+	}
+	renameErr := fs.Rename(fsys, tmpPath, path)
+	if tw.file, err = newFile(fsys, path); err != nil {
+		return nil, err
+	}
+	if renameErr != nil {
+		return nil, renameErr
+	}
+	tw.setWindowIndex(winBlockIdx)
+	return offsets, nil
+}
+
+// rollback truncates the window file after the window block windowIdx, and removes entries with sequence
+// greater than seq or in the removed sequences from the remaining window blocks.
+func (tw *timeWindowBucket) rollback(windowIdx int32, seq uint64, removed map[uint64]bool) error {
+	if size := winBlockOffset(windowIdx + 1); tw.Size() > size {
+		if err := tw.truncate(size); err != nil {
+			return err
+		}
+	}
+	for winBlockIdx := int32(0); winBlockIdx <= windowIdx; winBlockIdx++ {
+		b := windowHandle{file: tw.file, offset: winBlockOffset(winBlockIdx)}
+		if err := b.read(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if b.entryIdx > seqsPerWindowBlock {
+			continue
+		}
+		w := b.winBlock
+		w.entryIdx = 0
+		w.entries = [seqsPerWindowBlock]winEntry{}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.sequence > seq || removed[we.sequence] {
+				continue
+			}
+			w.entries[w.entryIdx] = we
+			w.entryIdx++
+		}
+		if w.entryIdx == b.entryIdx {
 			continue
 		}
-		if stop, err := f(b.entries[0].sequence, b.topicHash, b.offset); stop || err != nil {
+		if _, err := tw.WriteAt(w.MarshalBinary(), b.offset); err != nil {
 			return err
 		}
 	}
+	tw.setWindowIndex(windowIdx)
 	return nil
 }
 
 // ilookup lookups window entries from timeWindowBucket and not yet sync to DB.
-func (tw *timeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries windowEntries) {
+func (tw *timeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries windowEntries, nExpired int) {
 	winEntries = make([]winEntry, 0)
 	// get windowBlock shard.
 	wb := tw.getWindowBlock(topicHash)
@@ -331,6 +531,7 @@ func (tw *timeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries win
 	defer wb.mu.RUnlock()
 	var l int
 	var expiryCount int
+	now := uint32(tw.opts.clock.Now().Unix())
 
 	for key := range wb.entries {
 		if key.topicHash != topicHash || tw.isAborted(key.timeID) {
@@ -345,8 +546,12 @@ func (tw *timeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries win
 			// for _, we := range wEntries[len(wEntries)-l:] {
 			for i := len(wEntries) - 1; i >= len(wEntries)-l; i-- {
 				we := wEntries[i]
-				if we.isExpired() {
-					if err := tw.addExpiry(we); err != nil {
+				if we.seq() == 0 {
+					continue // window entry is deleted.
+				}
+				if we.isExpired(now) {
+					nExpired++
+					if err := tw.addExpiry(expiryEntry{winEntry: we, topicHash: topicHash}); err != nil {
 						expiryCount++
 						logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
 					}
@@ -357,15 +562,15 @@ func (tw *timeWindowBucket) ilookup(topicHash uint64, limit int) (winEntries win
 			}
 		}
 	}
-	return winEntries
+	return winEntries, nExpired
 }
 
-// lookup lookups window entries from window file.
-func (tw *timeWindowBucket) lookup(topicHash uint64, off, cutoff int64, limit int) (winEntries windowEntries) {
+// lookup lookups window entries from window file. It also returns number of expired entries skipped by the lookup.
+func (tw *timeWindowBucket) lookup(topicHash uint64, off, cutoff int64, limit int) (winEntries windowEntries, nExpired int) {
 	winEntries = make([]winEntry, 0)
-	winEntries = tw.ilookup(topicHash, limit)
+	winEntries, nExpired = tw.ilookup(topicHash, limit)
 	if len(winEntries) >= limit {
-		return winEntries
+		return winEntries, nExpired
 	}
 	next := func(blockOff int64, f func(windowHandle) (bool, error)) error {
 		for {
@@ -383,6 +588,7 @@ func (tw *timeWindowBucket) lookup(topicHash uint64, off, cutoff int64, limit in
 		}
 	}
 	expiryCount := 0
+	now := uint32(tw.opts.clock.Now().Unix())
 	err := next(off, func(curb windowHandle) (bool, error) {
 		b := &curb
 		if b.topicHash != topicHash {
@@ -391,10 +597,14 @@ func (tw *timeWindowBucket) lookup(topicHash uint64, off, cutoff int64, limit in
 		if len(winEntries) > limit-int(b.entryIdx) {
 			limit = limit - len(winEntries)
 			// for _, we := range b.entries[b.entryIdx-uint16(limit) : b.entryIdx] {
-			for i := len(b.entries) - 1; i >= len(b.entries)-limit; i-- {
+			for i := int(b.entryIdx) - 1; i >= 0 && i >= int(b.entryIdx)-limit; i-- {
 				we := b.entries[i]
-				if we.isExpired() {
-					if err := tw.addExpiry(we); err != nil {
+				if we.seq() == 0 {
+					continue // window entry is deleted.
+				}
+				if we.isExpired(now) {
+					nExpired++
+					if err := tw.addExpiry(expiryEntry{winEntry: we, topicHash: topicHash}); err != nil {
 						expiryCount++
 						logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
 					}
@@ -408,10 +618,14 @@ func (tw *timeWindowBucket) lookup(topicHash uint64, off, cutoff int64, limit in
 			}
 		}
 		// for _, we := range b.entries[:b.entryIdx] {
-		for i := len(b.entries) - 1; i >= 0; i-- {
+		for i := int(b.entryIdx) - 1; i >= 0; i-- {
 			we := b.entries[i]
-			if we.isExpired() {
-				if err := tw.addExpiry(we); err != nil {
+			if we.seq() == 0 {
+				continue // window entry is deleted.
+			}
+			if we.isExpired(now) {
+				nExpired++
+				if err := tw.addExpiry(expiryEntry{winEntry: we, topicHash: topicHash}); err != nil {
 					expiryCount++
 					logger.Error().Err(err).Str("context", "timeWindow.addExpiry")
 				}
@@ -427,10 +641,422 @@ func (tw *timeWindowBucket) lookup(topicHash uint64, off, cutoff int64, limit in
 		return false, nil
 	})
 	if err != nil {
-		return winEntries
+		return winEntries, nExpired
+	}
+
+	return winEntries, nExpired
+}
+
+// setExpiry sets expiry of the window entry of the sequence in the topic to the expiry returned by f. It looks up
+// the pending window entries of the topic and then the window blocks of the topic starting at the offset, newest
+// window entries first, as the window entry of an expired entry freed for reuse may have the same sequence.
+func (tw *timeWindowBucket) setExpiry(topicHash uint64, off int64, seq uint64, f func(expiresAt uint32) (uint32, error)) (bool, error) {
+	wb := tw.getWindowBlock(topicHash)
+	found, err := func() (bool, error) {
+		wb.mu.Lock()
+		defer wb.mu.Unlock()
+		for k, wEntries := range wb.entries {
+			if k.topicHash != topicHash {
+				continue
+			}
+			for j := len(wEntries) - 1; j >= 0; j-- {
+				if wEntries[j].sequence != seq {
+					continue
+				}
+				expiresAt, err := f(wEntries[j].expiresAt)
+				if err != nil {
+					return true, err
+				}
+				wEntries[j].expiresAt = expiresAt
+				return true, nil
+			}
+		}
+		return false, nil
+	}()
+	if found || err != nil {
+		return found, err
+	}
+
+	for {
+		b := windowHandle{file: tw.file, offset: off}
+		if err := b.read(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return false, err
+		}
+		if b.topicHash != topicHash || b.entryIdx > seqsPerWindowBlock {
+			break
+		}
+		for j := int(b.entryIdx) - 1; j >= 0; j-- {
+			if b.entries[j].sequence != seq {
+				continue
+			}
+			expiresAt, err := f(b.entries[j].expiresAt)
+			if err != nil {
+				return true, err
+			}
+			b.entries[j].expiresAt = expiresAt
+			if _, err := tw.WriteAt(b.MarshalBinary(), b.offset); err != nil {
+				return true, err
+			}
+			return true, nil
+		}
+		if b.next == 0 {
+			break
+		}
+		off = b.next
+	}
+	return false, nil
+}
+
+// seqs returns up to max sequences of the topic that are not deleted, expired entries included.
+func (tw *timeWindowBucket) seqs(topicHash uint64, off int64, max int) ([]uint64, error) {
+	var seqs []uint64
+	wb := tw.getWindowBlock(topicHash)
+	wb.mu.RLock()
+	for k, wEntries := range wb.entries {
+		if k.topicHash != topicHash {
+			continue
+		}
+		for _, we := range wEntries {
+			if we.sequence != 0 && len(seqs) < max {
+				seqs = append(seqs, we.sequence)
+			}
+		}
+	}
+	wb.mu.RUnlock()
+
+	for len(seqs) < max {
+		b := windowHandle{file: tw.file, offset: off}
+		if err := b.read(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if b.topicHash != topicHash || b.entryIdx > seqsPerWindowBlock {
+			break
+		}
+		for _, we := range b.entries[:b.entryIdx] {
+			if we.sequence != 0 && len(seqs) < max {
+				seqs = append(seqs, we.sequence)
+			}
+		}
+		if b.next == 0 {
+			break
+		}
+		off = b.next
+	}
+	return seqs, nil
+}
+
+// foreachPage calls f on the window entries of the topic one page at a time, oldest first. A page holds the window
+// entries of one window block of the topic read from the window file starting at the offset, and the pending window
+// entries of the topic are the last page. Deleted and expired window entries are skipped.
+func (tw *timeWindowBucket) foreachPage(topicHash uint64, off int64, f func(wEntries windowEntries) error) error {
+	now := uint32(tw.opts.clock.Now().Unix())
+	live := func(wEntries windowEntries) windowEntries {
+		page := make(windowEntries, 0, len(wEntries))
+		for _, we := range wEntries {
+			if we.seq() != 0 && !we.isExpired(now) {
+				page = append(page, we)
+			}
+		}
+		return page
+	}
+
+	// window blocks of the topic are linked newest first.
+	var offs []int64
+	for {
+		b := windowHandle{file: tw.file, offset: off}
+		if err := b.read(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if b.topicHash != topicHash || b.entryIdx > seqsPerWindowBlock {
+			break
+		}
+		offs = append(offs, off)
+		if b.next == 0 {
+			break
+		}
+		off = b.next
+	}
+	for i := len(offs) - 1; i >= 0; i-- {
+		b := windowHandle{file: tw.file, offset: offs[i]}
+		if err := b.read(); err != nil {
+			return err
+		}
+		if err := f(live(b.entries[:b.entryIdx])); err != nil {
+			return err
+		}
+	}
+
+	wb := tw.getWindowBlock(topicHash)
+	wb.mu.RLock()
+	var keys []key
+	for k := range wb.entries {
+		if k.topicHash == topicHash && !tw.isAborted(k.timeID) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].timeID < keys[j].timeID
+	})
+	var pending windowEntries
+	for _, k := range keys {
+		pending = append(pending, live(wb.entries[k])...)
+	}
+	wb.mu.RUnlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return f(pending)
+}
+
+// hasPending returns true if the topic has window entries not yet synced to the window file.
+func (tw *timeWindowBucket) hasPending(topicHash uint64) bool {
+	wb := tw.getWindowBlock(topicHash)
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	for k, wEntries := range wb.entries {
+		if k.topicHash != topicHash || tw.isAborted(k.timeID) {
+			continue
+		}
+		for _, we := range wEntries {
+			if we.seq() != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blocks returns the window blocks of the topic linked from the window block at the offset, newest first.
+// A zero offset is a topic without window blocks.
+func (tw *timeWindowBucket) blocks(topicHash uint64, off int64) ([]windowHandle, error) {
+	var blocks []windowHandle
+	for off != 0 {
+		b := windowHandle{file: tw.file, offset: off}
+		if err := b.read(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if b.topicHash != topicHash || b.entryIdx > seqsPerWindowBlock {
+			break
+		}
+		blocks = append(blocks, b)
+		off = b.next
+	}
+	return blocks, nil
+}
+
+// moveBlocks moves the window blocks of the topic linked from the offset to the new topic and merges them with the
+// window blocks of the new topic linked from newOff. Merged window blocks are linked newest first, the window blocks
+// not yet cut first and then by cutoff time, so a lookup with a cutoff stops at the first window block cut before it.
+// It returns offset of the newest window block and the window blocks as they were before the move.
+func (tw *timeWindowBucket) moveBlocks(topicHash uint64, off int64, newTopicHash uint64, newOff int64) (int64, []windowHandle, error) {
+	blocks, err := tw.blocks(topicHash, off)
+	if err != nil {
+		return 0, nil, err
+	}
+	newBlocks, err := tw.blocks(newTopicHash, newOff)
+	if err != nil {
+		return 0, nil, err
+	}
+	prev := append(append([]windowHandle(nil), blocks...), newBlocks...)
+	merged := append([]windowHandle(nil), prev...)
+	sort.SliceStable(merged, func(i, j int) bool {
+		bi, bj := merged[i], merged[j]
+		if (bi.cutoffTime == 0) != (bj.cutoffTime == 0) {
+			return bi.cutoffTime == 0
+		}
+		if bi.cutoffTime != bj.cutoffTime {
+			return bi.cutoffTime > bj.cutoffTime
+		}
+		return bi.offset > bj.offset
+	})
+	for i := range merged {
+		merged[i].topicHash = newTopicHash
+		merged[i].next = 0
+		if i+1 < len(merged) {
+			merged[i].next = merged[i+1].offset
+		}
+	}
+	if err := tw.writeBlocks(merged); err != nil {
+		tw.writeBlocks(prev)
+		return 0, nil, err
+	}
+	if len(merged) == 0 {
+		return newOff, prev, nil
+	}
+	return merged[0].offset, prev, nil
+}
+
+// writeBlocks writes the window blocks to the window file.
+func (tw *timeWindowBucket) writeBlocks(blocks []windowHandle) error {
+	for _, b := range blocks {
+		if _, err := tw.WriteAt(b.MarshalBinary(), b.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// topicOf returns the hash of the topic of the window entry of the sequence. It looks up the pending
+// window entries and then the window file.
+func (tw *timeWindowBucket) topicOf(seq uint64) (uint64, bool, error) {
+	topicHash, _, ok, err := tw.find(seq, false)
+	return topicHash, ok, err
+}
+
+// entryOf returns the window entry of the sequence. It looks up the pending window entries and then the window file.
+func (tw *timeWindowBucket) entryOf(seq uint64) (winEntry, bool, error) {
+	_, we, ok, err := tw.find(seq, false)
+	return we, ok, err
+}
+
+// topicIn is topicOf that looks up the window entries of the topic first, see findIn.
+func (tw *timeWindowBucket) topicIn(topicHash uint64, off int64, seq uint64) (uint64, bool, error) {
+	topicHash, _, ok, err := tw.findIn(topicHash, off, seq, false)
+	return topicHash, ok, err
+}
+
+// delIn removes the window entry of the sequence. It looks up the window entries of the topic first, see findIn.
+// Removed window entries keep their position in the window block with a zero sequence. It returns the hash of
+// the topic of the window entry, or false if the window entry is not found.
+func (tw *timeWindowBucket) delIn(topicHash uint64, off int64, seq uint64) (uint64, bool, error) {
+	topicHash, _, ok, err := tw.findIn(topicHash, off, seq, true)
+	return topicHash, ok, err
+}
+
+// liveTopicOf returns the hash of the topic of the window entry of the sequence not expired at now. The sequence of an
+// expired entry is reused once the entry is freed, so the window entry of an expired entry may have the same sequence.
+func (tw *timeWindowBucket) liveTopicOf(seq uint64, now uint32) (uint64, bool, error) {
+	topicHash, _, ok, err := tw.findFunc(seq, false, func(we winEntry) bool {
+		return we.expiresAt != 0 && we.expiresAt <= now
+	})
+	return topicHash, ok, err
+}
+
+// find looks up the window entry of the sequence and removes it if del is set.
+// It returns the hash of the topic and the window entry as it was before the removal.
+func (tw *timeWindowBucket) find(seq uint64, del bool) (uint64, winEntry, bool, error) {
+	return tw.findFunc(seq, del, nil)
+}
+
+// findIn is find that looks up the pending window entries of the topic and the window blocks of the topic linked
+// from the offset, so it does not scan the window file. It falls back to find if the topic hash is zero or the
+// window entry is not found in the window entries of the topic.
+func (tw *timeWindowBucket) findIn(topicHash uint64, off int64, seq uint64, del bool) (uint64, winEntry, bool, error) {
+	if topicHash == 0 {
+		return tw.find(seq, del)
+	}
+	wb := tw.getWindowBlock(topicHash)
+	we, found := func() (winEntry, bool) {
+		wb.mu.Lock()
+		defer wb.mu.Unlock()
+		for k, wEntries := range wb.entries {
+			if k.topicHash != topicHash {
+				continue
+			}
+			for j := range wEntries {
+				if wEntries[j].sequence == seq {
+					we := wEntries[j]
+					if del {
+						wEntries[j] = winEntry{}
+					}
+					return we, true
+				}
+			}
+		}
+		return winEntry{}, false
+	}()
+	if found {
+		return topicHash, we, true, nil
+	}
+
+	blocks, err := tw.blocks(topicHash, off)
+	if err != nil {
+		return 0, winEntry{}, false, err
+	}
+	for _, b := range blocks {
+		for j := range b.entries[:b.entryIdx] {
+			if b.entries[j].sequence != seq {
+				continue
+			}
+			we := b.entries[j]
+			if !del {
+				return topicHash, we, true, nil
+			}
+			b.entries[j] = winEntry{}
+			if _, err := tw.WriteAt(b.MarshalBinary(), b.offset); err != nil {
+				return 0, winEntry{}, false, err
+			}
+			return topicHash, we, true, nil
+		}
 	}
+	return tw.find(seq, del)
+}
 
-	return winEntries
+// findFunc is find that skips the window entries for which skip returns true.
+func (tw *timeWindowBucket) findFunc(seq uint64, del bool, skip func(we winEntry) bool) (uint64, winEntry, bool, error) {
+	for i := 0; i < tw.windowBlocks.nShards; i++ {
+		wb := tw.windowBlocks.window[i]
+		topicHash, we, found := func() (uint64, winEntry, bool) {
+			wb.mu.Lock()
+			defer wb.mu.Unlock()
+			for k, wEntries := range wb.entries {
+				for j := range wEntries {
+					if wEntries[j].sequence == seq && (skip == nil || !skip(wEntries[j])) {
+						we := wEntries[j]
+						if del {
+							wEntries[j] = winEntry{}
+						}
+						return k.topicHash, we, true
+					}
+				}
+			}
+			return 0, winEntry{}, false
+		}()
+		if found {
+			return topicHash, we, true, nil
+		}
+	}
+
+	nWinBlocks := tw.windowIndex()
+	for winBlockIdx := int32(0); winBlockIdx <= nWinBlocks; winBlockIdx++ {
+		b := windowHandle{file: tw.file, offset: winBlockOffset(winBlockIdx)}
+		if err := b.read(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, winEntry{}, false, err
+		}
+		if b.entryIdx > seqsPerWindowBlock {
+			continue
+		}
+		for j := range b.entries[:b.entryIdx] {
+			if b.entries[j].sequence != seq || (skip != nil && skip(b.entries[j])) {
+				continue
+			}
+			we := b.entries[j]
+			if !del {
+				return b.topicHash, we, true, nil
+			}
+			b.entries[j] = winEntry{}
+			if _, err := tw.WriteAt(b.MarshalBinary(), b.offset); err != nil {
+				return 0, winEntry{}, false, err
+			}
+			return b.topicHash, we, true, nil
+		}
+	}
+	return 0, winEntry{}, false, nil
 }
 
 func (w winBlock) validation(topicHash uint64) error {
@@ -495,6 +1121,24 @@ func (tw *timeWindowBucket) isAborted(timeID int64) bool {
 	return false
 }
 
+// timeIDOf returns the timeID of the window entry of the sequence not yet synced to the window file.
+func (tw *timeWindowBucket) timeIDOf(topicHash, seq uint64) (int64, bool) {
+	wb := tw.getWindowBlock(topicHash)
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	for k, wEntries := range wb.entries {
+		if k.topicHash != topicHash {
+			continue
+		}
+		for _, we := range wEntries {
+			if we.seq() == seq {
+				return k.timeID, true
+			}
+		}
+	}
+	return 0, false
+}
+
 func (tw *timeWindowBucket) abortTimeID(timeID int64) {
 	tw.Lock()
 	defer tw.Unlock()
@@ -513,7 +1157,7 @@ func (tw *timeWindowBucket) abort(f func(w windowEntries) (bool, error)) (err er
 	defer tw.RUnlock()
 	for timeID, tm := range releasedTimeRecords {
 		if tm.refs == -1 {
-			for i := 0; i < nShards; i++ {
+			for i := 0; i < tw.windowBlocks.nShards; i++ {
 				wb := tw.windowBlocks.window[i]
 				wb.mu.Lock()
 				for k := range wb.entries {
@@ -534,19 +1178,100 @@ func (tw *timeWindowBucket) abort(f func(w windowEntries) (bool, error)) (err er
 	return nil
 }
 
+// pendingSeqs returns sequences of time window entries not yet written to the window file.
+func (tw *timeWindowBucket) pendingSeqs() []uint64 {
+	var seqs []uint64
+	for i := 0; i < tw.windowBlocks.nShards; i++ {
+		wb := tw.windowBlocks.window[i]
+		wb.mu.RLock()
+		for _, wEntries := range wb.entries {
+			for _, we := range wEntries {
+				seqs = append(seqs, we.seq())
+			}
+		}
+		wb.mu.RUnlock()
+	}
+	return seqs
+}
+
+// discard removes time window entries not yet written to the window file and returns them by timeID.
+func (tw *timeWindowBucket) discard() map[int64]windowEntries {
+	discarded := make(map[int64]windowEntries)
+	for i := 0; i < tw.windowBlocks.nShards; i++ {
+		wb := tw.windowBlocks.window[i]
+		wb.mu.Lock()
+		for k, wEntries := range wb.entries {
+			discarded[k.timeID] = append(discarded[k.timeID], wEntries...)
+		}
+		wb.entries = make(map[key]windowEntries)
+		wb.mu.Unlock()
+	}
+	return discarded
+}
+
+// Snapshot marshals pending time window entries that are not yet written to the window file.
+// Each record is a timeID followed by a window block in the window file format.
+func (tw *timeWindowBucket) Snapshot() ([]byte, error) {
+	var data []byte
+	var scratch [8]byte
+	for i := 0; i < tw.windowBlocks.nShards; i++ {
+		wb := tw.windowBlocks.window[i]
+		wb.mu.RLock()
+		for k, wEntries := range wb.entries {
+			for len(wEntries) > 0 {
+				n := len(wEntries)
+				if n > seqsPerWindowBlock {
+					n = seqsPerWindowBlock
+				}
+				w := winBlock{topicHash: k.topicHash, entryIdx: uint16(n)}
+				copy(w.entries[:], wEntries[:n])
+				wEntries = wEntries[n:]
+				binary.LittleEndian.PutUint64(scratch[:], uint64(k.timeID))
+				data = append(data, scratch[:]...)
+				data = append(data, w.MarshalBinary()...)
+			}
+		}
+		wb.mu.RUnlock()
+	}
+	return data, nil
+}
+
+// Restore unmarshals time window entries from the snapshot and adds them to the pending time window entries.
+func (tw *timeWindowBucket) Restore(data []byte) error {
+	recordSize := 8 + int(blockSize)
+	if len(data)%recordSize != 0 {
+		return fmt.Errorf("timeWindow.Restore: invalid snapshot size %d", len(data))
+	}
+	for ; len(data) > 0; data = data[recordSize:] {
+		timeID := int64(binary.LittleEndian.Uint64(data[:8]))
+		var w winBlock
+		if err := w.UnmarshalBinary(data[8:recordSize]); err != nil {
+			return err
+		}
+		if w.entryIdx > seqsPerWindowBlock {
+			return fmt.Errorf("timeWindow.Restore: invalid window block entry count %d", w.entryIdx)
+		}
+		for _, e := range w.entries[:w.entryIdx] {
+			tw.add(timeID, w.topicHash, e)
+		}
+	}
+	return nil
+}
+
 func (tw *timeWindowBucket) startReleaser() {
 	tw.Lock()
 	defer tw.Unlock()
 
 	releasedTimeIDs := make(map[int64]struct{})
+	now := tw.opts.clock.Now()
 	for timeID, tm := range tw.releasedTimeRecords {
-		if tm.isExpired(tw.opts.maxDuration) {
+		if tm.isExpired(now, tw.opts.maxDuration) {
 			releasedTimeIDs[timeID] = struct{}{}
 			delete(tw.releasedTimeRecords, timeID)
 		}
 	}
 
-	for i := 0; i < nShards; i++ {
+	for i := 0; i < tw.windowBlocks.nShards; i++ {
 		wb := tw.windowBlocks.window[i]
 		wb.mu.Lock()
 		for k := range wb.entries {
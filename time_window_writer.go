@@ -19,7 +19,6 @@ package unitdb
 import (
 	"io"
 	"sort"
-	"time"
 
 	"github.com/unit-io/bpool"
 )
@@ -104,11 +103,14 @@ func (wb *windowWriter) append(topicHash uint64, off int64, wEntries windowEntri
 		if entryIdx == -1 {
 			continue
 		}
-		if w.entryIdx == seqsPerWindowBlock {
+		if w.entryIdx >= wb.opts.winBlockEntries {
 			topicHash := w.topicHash
 			next := int64(blockSize * uint32(winIdx))
-			// set approximate cutoff on winBlock.
-			w.cutoffTime = time.Now().Unix()
+			// set approximate cutoff on winBlock, entries can have a timestamp later than the current time.
+			w.cutoffTime = wb.opts.clock.Now().Unix()
+			if w.latest > w.cutoffTime {
+				w.cutoffTime = w.latest
+			}
 			wb.winBlocks[winIdx] = w
 			wb.windowIdx++
 			winIdx = wb.windowIdx
@@ -118,6 +120,9 @@ func (wb *windowWriter) append(topicHash uint64, off int64, wEntries windowEntri
 			wb.leasing[winIdx] = append(wb.leasing[winIdx], we.sequence)
 		}
 		w.entries[w.entryIdx] = winEntry{sequence: we.sequence, expiresAt: we.expiresAt}
+		if we.timestamp > w.latest {
+			w.latest = we.timestamp
+		}
 		w.dirty = true
 		w.entryIdx++
 	}
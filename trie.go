@@ -29,12 +29,13 @@ const (
 type topic struct {
 	hash   uint64
 	offset int64
+	name   []byte // name is the topic string, it is nil for topics persisted without a name.
 }
 
 type topics []topic
 
-func newTopic(hash uint64, off int64) topic {
-	return topic{hash: hash, offset: off}
+func newTopic(hash uint64, off int64, name []byte) topic {
+	return topic{hash: hash, offset: off, name: name}
 }
 
 // addUnique adds topic to the set.
@@ -42,6 +43,9 @@ func (top *topics) addUnique(value topic) (added bool) {
 	for i, v := range *top {
 		if v.hash == value.hash {
 			(*top)[i].offset = value.offset
+			if value.name != nil {
+				(*top)[i].name = value.name
+			}
 			return false
 		}
 	}
@@ -69,7 +73,7 @@ func (n *node) orphan() {
 	}
 
 	delete(n.parent.children, n.part)
-	if len(n.parent.children) == 0 {
+	if len(n.parent.children) == 0 && len(n.parent.topics) == 0 {
 		n.parent.orphan()
 	}
 }
@@ -152,6 +156,38 @@ func (t *trie) add(topic topic, parts []message.Part, depth uint8) (added bool)
 	return
 }
 
+// remove removes a topic from the trie, nodes left without topics and children are removed.
+func (t *trie) remove(topicHash uint64) (removed bool) {
+	// Get mutex
+	mu := t.getMutex(topicHash)
+	mu.Lock()
+	defer mu.Unlock()
+	t.Lock()
+	defer t.Unlock()
+	curr, ok := t.topicTrie.summary[topicHash]
+	if !ok {
+		return false
+	}
+	for i, top := range curr.topics {
+		if top.hash == topicHash {
+			curr.topics = append(curr.topics[:i], curr.topics[i+1:]...)
+			break
+		}
+	}
+	delete(t.topicTrie.summary, topicHash)
+	if len(curr.topics) == 0 && len(curr.children) == 0 {
+		curr.orphan()
+	}
+	return true
+}
+
+// reset removes all topics from the trie.
+func (t *trie) reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.topicTrie = newTopicTrie()
+}
+
 // lookup returns window entry set for given topic.
 func (t *trie) lookup(query []message.Part, depth, topicType uint8) (tops topics) {
 	t.RLock()
@@ -187,6 +223,54 @@ func (t *trie) ilookup(query []message.Part, depth, topicType uint8, tops *topic
 	}
 }
 
+// subtree returns all topics under the given prefix parts.
+// A wildcard part in the prefix matches any child node.
+func (t *trie) subtree(prefix []message.Part) (tops topics) {
+	t.RLock()
+	defer t.RUnlock()
+	t.isubtree(prefix, &tops, t.topicTrie.root)
+	return
+}
+
+func (t *trie) isubtree(prefix []message.Part, tops *topics, currNode *node) {
+	if len(prefix) == 0 {
+		for _, topic := range currNode.topics {
+			tops.addUnique(topic)
+		}
+		for _, n := range currNode.children {
+			t.isubtree(prefix, tops, n)
+		}
+		return
+	}
+
+	p := prefix[0]
+	for part, n := range currNode.children {
+		if p.Hash == message.Wildcard || p.Hash == part.hash {
+			t.isubtree(prefix[1:], tops, n)
+		}
+	}
+}
+
+// topicNode is a topic with the depth of its trie node.
+type topicNode struct {
+	topic
+	depth uint8
+}
+
+// all returns all topics in the trie.
+func (t *trie) all() (tops []topicNode) {
+	t.RLock()
+	defer t.RUnlock()
+	for topicHash, n := range t.topicTrie.summary {
+		for _, top := range n.topics {
+			if top.hash == topicHash {
+				tops = append(tops, topicNode{topic: top, depth: n.depth})
+			}
+		}
+	}
+	return
+}
+
 func (t *trie) getOffset(topicHash uint64) (off int64, ok bool) {
 	t.RLock()
 	defer t.RUnlock()
@@ -200,6 +284,51 @@ func (t *trie) getOffset(topicHash uint64) (off int64, ok bool) {
 	return off, ok
 }
 
+// prefix returns the prefix of the topic from the parts of its trie node, it is the prefix of the mutex a query on the topic holds.
+func (t *trie) prefix(topicHash uint64) (uint64, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	curr, ok := t.topicTrie.summary[topicHash]
+	if !ok {
+		return 0, false
+	}
+	var parts []message.Part
+	for ; curr.parent != nil; curr = curr.parent {
+		parts = append([]message.Part{{Hash: curr.part.hash}}, parts...)
+	}
+	return message.Prefix(parts), true
+}
+
+// parts returns the parts and depth of the topic from its trie node.
+func (t *trie) parts(topicHash uint64) ([]message.Part, uint8, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	curr, ok := t.topicTrie.summary[topicHash]
+	if !ok {
+		return nil, 0, false
+	}
+	depth := curr.depth
+	var parts []message.Part
+	for ; curr.parent != nil; curr = curr.parent {
+		parts = append([]message.Part{{Hash: curr.part.hash, Wildchars: curr.part.wildchars}}, parts...)
+	}
+	return parts, depth, true
+}
+
+// getName returns name of the topic, it is nil for topics persisted without a name.
+func (t *trie) getName(topicHash uint64) (name []byte, ok bool) {
+	t.RLock()
+	defer t.RUnlock()
+	if curr, ok := t.topicTrie.summary[topicHash]; ok {
+		for _, topic := range curr.topics {
+			if topic.hash == topicHash {
+				return topic.name, ok
+			}
+		}
+	}
+	return name, false
+}
+
 func (t *trie) setOffset(top topic) (ok bool) {
 	t.Lock()
 	defer t.Unlock()
@@ -42,8 +42,13 @@ type LID uint64
 
 // NewApoch creates an appoch to generate unique id.
 func NewApoch() uint32 {
-	now := uint32(time.Now().Unix() - Offset)
-	return math.MaxUint32 - now
+	return ApochAt(time.Now())
+}
+
+// ApochAt creates an appoch for the given time.
+func ApochAt(t time.Time) uint32 {
+	at := uint32(t.Unix() - Offset)
+	return math.MaxUint32 - at
 }
 
 // NewUnique return unique value to use generating unique id.
@@ -19,7 +19,9 @@ package wal
 import (
 	"encoding/binary"
 	"errors"
+	"sort"
 
+	"github.com/golang/snappy"
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/uid"
 )
@@ -30,6 +32,7 @@ type Reader struct {
 	Id      uid.LID
 	logData []byte
 	offset  int64
+	version uint16
 
 	entryCount uint32
 
@@ -113,6 +116,7 @@ func (r *Reader) Read(f func(timeID int64) (bool, error)) (err error) {
 				return err
 			}
 			r.entryCount = ul.entryCount
+			r.version = ul.version
 			r.logData = data
 			r.offset = 0
 			if stop, err := f(ul.timeID); stop || err != nil {
@@ -153,5 +157,81 @@ func (r *Reader) Next() ([]byte, bool, error) {
 		return nil, false, errors.New("logData error")
 	}
 	r.offset += int64(dataLen)
-	return logData[4:dataLen], true, nil
+	data, err := decodeRecord(r.version, logData[4:dataLen])
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// decodeRecord strips the codec byte from a record of the given log version and decodes it.
+func decodeRecord(version uint16, data []byte) ([]byte, error) {
+	if version < logVersionCodec {
+		return data, nil
+	}
+	if len(data) == 0 {
+		return nil, errors.New("logData error")
+	}
+	switch data[0] {
+	case codecNone:
+		return data[1:], nil
+	case codecSnappy:
+		return snappy.Decode(nil, data[1:])
+	}
+	return nil, errors.New("logData error - unknown record codec")
+}
+
+// Scan calls f in timeID order for each log newer than id that is not yet released, with
+// the records of the log. Records are valid only until f returns.
+func (wal *WAL) Scan(id int64, f func(timeID int64, records [][]byte) (bool, error)) error {
+	if err := wal.ok(); err != nil {
+		return err
+	}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	var scanLogs []logInfo
+	for _, all := range []logs{wal.logs, wal.pendingReleaseLogs} {
+		for _, logs := range all {
+			for _, l := range logs {
+				if l.timeID > id && l.status != logStatusReleased && l.entryCount != 0 {
+					scanLogs = append(scanLogs, l)
+				}
+			}
+		}
+	}
+	sort.Slice(scanLogs, func(i, j int) bool {
+		if scanLogs[i].timeID == scanLogs[j].timeID {
+			return scanLogs[i].offset < scanLogs[j].offset
+		}
+		return scanLogs[i].timeID < scanLogs[j].timeID
+	})
+
+	for _, l := range scanLogs {
+		data := make([]byte, l.size)
+		if _, err := wal.logFile.readAt(data, l.offset); err != nil {
+			return err
+		}
+		data = data[logHeaderSize:]
+		records := make([][]byte, 0, l.entryCount)
+		for i := uint32(0); i < l.entryCount; i++ {
+			if len(data) < 4 {
+				return errors.New("logData error")
+			}
+			dataLen := binary.LittleEndian.Uint32(data[0:4])
+			if dataLen < 4 || uint32(len(data)) < dataLen {
+				return errors.New("logData error")
+			}
+			record, err := decodeRecord(l.version, data[4:dataLen])
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+			data = data[dataLen:]
+		}
+		if stop, err := f(l.timeID, records); stop || err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -50,6 +50,13 @@ const (
 	defaultLogReleaseInterval = 15 * time.Second
 	defaultBufferSize         = 1 << 27
 	version                   = 1 // file format version
+	logVersion                = 1 // log format version of logs with raw records
+	logVersionCodec           = 2 // log format version of logs written with compression, records carry a codec byte
+)
+
+const (
+	codecNone   byte = iota // record is stored raw.
+	codecSnappy             // record is snappy compressed.
 )
 
 type (
@@ -74,6 +81,10 @@ type (
 		pendingLogs        []logInfo // used only for log recovery.
 		pendingReleaseLogs logs      // pendingReleaseLogs are logs applied but not yet merged.
 
+		// retain holds logs newer than retainID from being merged with free blocks.
+		retain   bool
+		retainID int64
+
 		bufPool *bpool.BufferPool
 		logFile file
 
@@ -91,6 +102,8 @@ type (
 		TargetSize int64
 		BufferSize int64
 		Reset      bool
+		// Compression compresses log records using snappy.
+		Compression bool
 	}
 )
 
@@ -194,7 +207,6 @@ func (wal *WAL) recoverWal() error {
 }
 
 func (wal *WAL) put(id int64, log logInfo) error {
-	log.version = version
 	wal.logCountWritten++
 	wal.entriesWritten += int64(log.entryCount)
 	if _, ok := wal.logs[id]; ok {
@@ -205,8 +217,8 @@ func (wal *WAL) put(id int64, log logInfo) error {
 	return nil
 }
 
-func (wal *WAL) logMerge(log logInfo) error {
-	if log.status == logStatusWritten {
+func (wal *WAL) logMerge(log *logInfo) error {
+	if log.status == logStatusWritten || (wal.retain && log.timeID > wal.retainID) {
 		return nil
 	}
 	released := wal.logFile.segments.free(log.offset, log.size)
@@ -240,7 +252,7 @@ func (wal *WAL) SignalLogApplied(id int64) error {
 			wal.entriesApplied += int64(logs[i].entryCount)
 		}
 		logs[i].status = logStatusApplied
-		if err := wal.logMerge(logs[i]); err != nil {
+		if err := wal.logMerge(&logs[i]); err != nil {
 			return err
 		}
 		if logs[i].status == logStatusReleased {
@@ -264,6 +276,22 @@ func (wal *WAL) SignalLogApplied(id int64) error {
 	return err1
 }
 
+// Retain holds logs newer than id from being merged with free blocks,
+// so they can still be scanned. Calling Retain again moves the watermark.
+func (wal *WAL) Retain(id int64) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	wal.retain = true
+	wal.retainID = id
+}
+
+// StopRetain lets the releaser merge retained logs with free blocks.
+func (wal *WAL) StopRetain() {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	wal.retain = false
+}
+
 // Reset resets log file and log segments.
 func (wal *WAL) Reset() error {
 	wal.logs = make(map[int64][]logInfo)
@@ -334,9 +362,12 @@ func (wal *WAL) releaseLogs() error {
 		wal.wg.Done()
 	}()
 
-	var allLogs []logInfo
-	for _, logs := range wal.pendingReleaseLogs {
-		allLogs = append(allLogs, logs...)
+	var allLogs []*logInfo
+	for id := range wal.pendingReleaseLogs {
+		logs := wal.pendingReleaseLogs[id]
+		for i := range logs {
+			allLogs = append(allLogs, &logs[i])
+		}
 	}
 
 	// sort wal logs by offset so that adjacent free blocks can be merged
@@ -19,6 +19,7 @@ package wal
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -164,3 +165,92 @@ func TestSimple(t *testing.T) {
 	}
 
 }
+
+func TestCompression(t *testing.T) {
+	os.Remove("test.db.log")
+	wal, _, err := New(Options{Path: "test.db.log", TargetSize: 1 << 8, BufferSize: 1 << 8, Compression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	var n = 100
+	logWriter, err := wal.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		val := []byte(fmt.Sprintf("msg.%2d.%s", i, strings.Repeat("a", i)))
+		if err := <-logWriter.Append(val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-logWriter.SignalInitWrite(int64(n)); err != nil {
+		t.Fatal(err)
+	}
+	if v := wal.logs[int64(n)][0].version; v != logVersionCodec {
+		t.Fatalf("expected log version %d, got %d", logVersionCodec, v)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, needRecovery, err := newTestWal("test.db", false)
+	if !needRecovery || err != nil {
+		t.Fatal(err)
+	}
+	r, err := wal.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	err = r.Read(func(timeID int64) (bool, error) {
+		for {
+			data, ok, err := r.Next()
+			if err != nil {
+				return true, err
+			}
+			if !ok {
+				break
+			}
+			if want := fmt.Sprintf("msg.%2d.%s", i, strings.Repeat("a", i)); string(data) != want {
+				t.Fatalf("record %d: expected %q, got %q", i, want, data)
+			}
+			i++
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != n {
+		t.Fatalf("expected %d records, got %d", n, i)
+	}
+}
+
+func TestLogVersion(t *testing.T) {
+	wal, _, err := newTestWal("test.db", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logWriter, err := wal.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-logWriter.Append([]byte("msg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-logWriter.SignalInitWrite(1); err != nil {
+		t.Fatal(err)
+	}
+	// logs written without compression keep the log format without a codec byte.
+	if v := wal.logs[1][0].version; v != logVersion {
+		t.Fatalf("expected log version %d, got %d", logVersion, v)
+	}
+	if size := wal.logs[1][0].size; size != uint32(logHeaderSize)+4+uint32(len("msg")) {
+		t.Fatalf("expected raw record, got log size %d", size)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
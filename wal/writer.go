@@ -20,6 +20,7 @@ import (
 	"encoding/binary"
 	"errors"
 
+	"github.com/golang/snappy"
 	"github.com/unit-io/bpool"
 	"github.com/unit-io/unitdb/uid"
 )
@@ -64,11 +65,23 @@ func (w *Writer) append(data []byte) error {
 
 	w.entryCount++
 
-	var scratch [4]byte
-	dataLen := uint32(len(data) + 4)
+	// The codec byte is only written to logs written with compression, so logs written
+	// without compression keep the log format older versions read.
+	var scratch [5]byte
+	n := 4
+	if w.wal.opts.Compression {
+		codec := codecNone
+		if enc := snappy.Encode(nil, data); len(enc) < len(data) {
+			codec = codecSnappy
+			data = enc
+		}
+		scratch[4] = codec
+		n = 5
+	}
+	dataLen := uint32(len(data) + n)
 	binary.LittleEndian.PutUint32(scratch[0:4], dataLen)
 
-	if _, err := w.buffer.Write(scratch[:]); err != nil {
+	if _, err := w.buffer.Write(scratch[:n]); err != nil {
 		return err
 	}
 	w.logSize += dataLen
@@ -94,6 +107,14 @@ func (w *Writer) Append(data []byte) <-chan error {
 	return done
 }
 
+// logVersion returns the log format version of the log, records carry a codec byte only if the WAL compresses records.
+func (w *Writer) logVersion() uint16 {
+	if w.wal.opts.Compression {
+		return logVersionCodec
+	}
+	return logVersion
+}
+
 // writeLog writes log by setting correct header and status.
 func (w *Writer) writeLog(id int64) error {
 	w.writeCompleted <- struct{}{}
@@ -115,6 +136,7 @@ func (w *Writer) writeLog(id int64) error {
 		return err
 	}
 	h := logInfo{
+		version:    w.logVersion(),
 		status:     logStatusWritten,
 		timeID:     id,
 		entryCount: w.entryCount,
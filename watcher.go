@@ -0,0 +1,181 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// watcher receives entries put to the topic it watches.
+	watcher struct {
+		id        uint64
+		topicHash uint64
+		once      bool                        // once watcher is cancelled after it receives an entry.
+		match     func(topicHash uint64) bool // match matches topics of the pattern watcher.
+		matched   map[uint64]bool             // matched caches results of match by topic hash.
+		sent      uint64                      // sent is number of entries sent to the watcher.
+		dropped   uint64                      // dropped is number of entries dropped as the watcher was not ready to receive.
+		ch        chan *Entry
+		ws        *watchers
+	}
+
+	// watchedEntry is an entry put to a watched topic, it is fanned out to the watchers once it is committed.
+	watchedEntry struct {
+		topicHash uint64
+		e         *Entry
+	}
+
+	// watchers holds watchers of topics, entries put to a topic are fanned out to its watchers.
+	watchers struct {
+		sync.Mutex
+		nextID   uint64
+		m        map[uint64]map[uint64]*watcher // map[topicHash]map[watcherID]
+		patterns map[uint64]*watcher            // map[watcherID]
+	}
+)
+
+func newWatchers() *watchers {
+	return &watchers{m: make(map[uint64]map[uint64]*watcher), patterns: make(map[uint64]*watcher)}
+}
+
+// add adds a watcher for the topic hash.
+func (ws *watchers) add(topicHash uint64, once bool) *watcher {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.nextID++
+	w := &watcher{id: ws.nextID, topicHash: topicHash, once: once, ch: make(chan *Entry, 1), ws: ws}
+	if _, ok := ws.m[topicHash]; !ok {
+		ws.m[topicHash] = make(map[uint64]*watcher)
+	}
+	ws.m[topicHash][w.id] = w
+	return w
+}
+
+// addPattern adds a watcher for the topics matched by the match func, the watcher channel buffers size entries.
+func (ws *watchers) addPattern(match func(topicHash uint64) bool, size int) *watcher {
+	ws.Lock()
+	defer ws.Unlock()
+	ws.nextID++
+	w := &watcher{id: ws.nextID, match: match, matched: make(map[uint64]bool), ch: make(chan *Entry, size), ws: ws}
+	ws.patterns[w.id] = w
+	return w
+}
+
+// matches reports whether the topic is matched by the pattern watcher. The caller must hold the watchers lock.
+func (w *watcher) matches(topicHash uint64) bool {
+	ok, cached := w.matched[topicHash]
+	if !cached {
+		ok = w.match(topicHash)
+		w.matched[topicHash] = ok
+	}
+	return ok
+}
+
+// cancel removes the watcher and closes its channel.
+func (w *watcher) cancel() {
+	w.ws.Lock()
+	defer w.ws.Unlock()
+	w.remove()
+}
+
+// remove removes the watcher and closes its channel. The caller must hold the watchers lock.
+func (w *watcher) remove() {
+	if w.match != nil {
+		if _, ok := w.ws.patterns[w.id]; ok {
+			delete(w.ws.patterns, w.id)
+			close(w.ch)
+		}
+		return
+	}
+	tw, ok := w.ws.m[w.topicHash]
+	if !ok {
+		return
+	}
+	if _, ok := tw[w.id]; !ok {
+		return
+	}
+	delete(tw, w.id)
+	if len(tw) == 0 {
+		delete(w.ws.m, w.topicHash)
+	}
+	close(w.ch)
+}
+
+// watched reports whether the topic has watchers.
+func (ws *watchers) watched(topicHash uint64) bool {
+	ws.Lock()
+	defer ws.Unlock()
+	if len(ws.m[topicHash]) != 0 {
+		return true
+	}
+	for _, w := range ws.patterns {
+		if w.matches(topicHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// fanout sends the entry to watchers of the topic, a watcher that is not ready to receive misses the entry.
+// The entry is created only if the topic has watchers.
+func (ws *watchers) fanout(topicHash uint64, newEntry func() *Entry) {
+	ws.Lock()
+	defer ws.Unlock()
+	tw := ws.m[topicHash]
+	if len(tw) == 0 && len(ws.patterns) == 0 {
+		return
+	}
+	var e *Entry
+	send := func(w *watcher) {
+		if e == nil {
+			e = newEntry()
+		}
+		select {
+		case w.ch <- e:
+			atomic.AddUint64(&w.sent, 1)
+			if w.once {
+				w.remove()
+			}
+		default:
+			atomic.AddUint64(&w.dropped, 1)
+		}
+	}
+	for _, w := range tw {
+		send(w)
+	}
+	for _, w := range ws.patterns {
+		if w.matches(topicHash) {
+			send(w)
+		}
+	}
+}
+
+// close removes all watchers and closes their channels.
+func (ws *watchers) close() {
+	ws.Lock()
+	defer ws.Unlock()
+	for _, tw := range ws.m {
+		for _, w := range tw {
+			w.remove()
+		}
+	}
+	for _, w := range ws.patterns {
+		w.remove()
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 Saffat Technologies, Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package unitdb
+
+type (
+	putRequest struct {
+		id         []byte
+		topic      []byte
+		payload    []byte
+		expiresAt  uint32
+		contract   uint32
+		encryption bool
+	}
+
+	// WriteBatch accumulates entries and writes them to the DB on Flush.
+	// A WriteBatch is not safe for concurrent use.
+	WriteBatch struct {
+		db       *DB
+		requests []putRequest
+	}
+)
+
+// WriteBatch returns a new write batch.
+func (db *DB) WriteBatch() *WriteBatch {
+	return &WriteBatch{db: db}
+}
+
+// Put adds entry to the write batch for given topic->payload.
+// It is safe to modify the contents of the argument after Put returns.
+func (wb *WriteBatch) Put(topic, payload []byte) {
+	wb.PutEntry(NewEntry(topic, payload))
+}
+
+// PutEntry adds entry to the write batch.
+// It is safe to modify the contents of the argument after PutEntry returns.
+func (wb *WriteBatch) PutEntry(e *Entry) {
+	wb.requests = append(wb.requests, putRequest{
+		id:         append([]byte(nil), e.ID...),
+		topic:      append([]byte(nil), e.Topic...),
+		payload:    append([]byte(nil), e.Payload...),
+		expiresAt:  e.ExpiresAt,
+		contract:   e.Contract,
+		encryption: e.Encryption,
+	})
+}
+
+// Flush writes pending entries to the DB in a single batch. Pending entries
+// are cleared if the batch is committed, otherwise they are kept so Flush can be retried.
+func (wb *WriteBatch) Flush() error {
+	if len(wb.requests) == 0 {
+		return nil
+	}
+	if err := wb.db.Batch(func(b *Batch, completed <-chan struct{}) error {
+		for _, r := range wb.requests {
+			e := &Entry{
+				ID:         r.id,
+				Topic:      r.topic,
+				Payload:    r.payload,
+				ExpiresAt:  r.expiresAt,
+				Contract:   r.contract,
+				Encryption: r.encryption,
+			}
+			if err := b.PutEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	wb.Reset()
+	return nil
+}
+
+// Reset clears pending entries without writing them to the DB.
+func (wb *WriteBatch) Reset() {
+	wb.requests = wb.requests[:0]
+}
+
+// Len returns number of pending entries in the write batch.
+func (wb *WriteBatch) Len() int {
+	return len(wb.requests)
+}